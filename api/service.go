@@ -1,3 +1,8 @@
+// Package api implements the API gRPC service defined in pb/api.proto,
+// which exposes a DB manager to clients that don't embed the library.
+// Calls are authorized with a thread.Token obtained from GetToken, and
+// Listen streams collection changes. A Go client lives in api/client,
+// and generated clients for other languages live under pb.
 package api
 
 import (
@@ -2,10 +2,12 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	format "github.com/ipfs/go-ipld-format"
 	logging "github.com/ipfs/go-log"
 	peer "github.com/libp2p/go-libp2p-core/peer"
@@ -32,32 +34,172 @@ type App interface {
 	HandleNetRecord(rec net.ThreadRecord, key thread.Key, lid peer.ID, timeout time.Duration) error
 }
 
-// LocalEventsBus wraps a broadcaster for local events.
+// LosslessApp is implemented by apps whose local events may be dropped for
+// their listeners, see LocalEventsDropOldest, so the connector listens to
+// them without losing any.
+type LosslessApp interface {
+	// LosslessLocalEventListen returns a listener of local events exempt
+	// from the bus policy, which sends to it as LocalEventsBlock does.
+	LosslessLocalEventListen() *LocalEventListener
+}
+
+// ErrLocalEventsBusFull indicates a local event couldn't be sent to a
+// listener whose buffer is full, see LocalEventsError.
+var ErrLocalEventsBusFull = errors.New("local events listener is full")
+
+// LocalEventsPolicy tells what sending a local event to a listener whose
+// buffer is full does.
+type LocalEventsPolicy int
+
+const (
+	// LocalEventsBlock waits for the listener to receive the event, for up
+	// to 10 seconds, before failing.
+	LocalEventsBlock LocalEventsPolicy = iota
+	// LocalEventsDropOldest drops the oldest buffered event of the listener
+	// to make room for the new one, or the new one if it has no buffer.
+	LocalEventsDropOldest
+	// LocalEventsError fails right away with ErrLocalEventsBusFull.
+	LocalEventsError
+)
+
+// LocalEventsBusOption configures a LocalEventsBus.
+type LocalEventsBusOption func(*LocalEventsBus)
+
+// WithLocalEventsBuffer buffers up to n events per listener.
+func WithLocalEventsBuffer(n int) LocalEventsBusOption {
+	return func(leb *LocalEventsBus) {
+		leb.capacity = n
+	}
+}
+
+// WithLocalEventsPolicy sets what happens when a listener buffer is full.
+func WithLocalEventsPolicy(p LocalEventsPolicy) LocalEventsBusOption {
+	return func(leb *LocalEventsBus) {
+		leb.policy = p
+	}
+}
+
+// WithLocalEventsDropped sets a function called with the number of
+// listeners an event wasn't delivered to, either because the oldest
+// buffered event was dropped for it, or because sending it failed.
+func WithLocalEventsDropped(f func(n int)) LocalEventsBusOption {
+	return func(leb *LocalEventsBus) {
+		leb.dropped = f
+	}
+}
+
+// LocalEventsBus broadcasts local events to listeners, each with its own
+// buffer. By default, listeners have no buffer and sending blocks, see
+// LocalEventsBlock.
 type LocalEventsBus struct {
-	bus *broadcast.Broadcaster
+	capacity int
+	policy   LocalEventsPolicy
+	dropped  func(n int)
+
+	lock      sync.Mutex
+	listeners map[uint]chan *LocalEvent
+	lossless  map[uint]struct{}
+	nextID    uint
+	closed    bool
 }
 
 // NewLocalEventsBus returns a new bus for local event.
-func NewLocalEventsBus() *LocalEventsBus {
-	return &LocalEventsBus{bus: broadcast.NewBroadcaster(0)}
+func NewLocalEventsBus(opts ...LocalEventsBusOption) *LocalEventsBus {
+	leb := &LocalEventsBus{
+		listeners: make(map[uint]chan *LocalEvent),
+		lossless:  make(map[uint]struct{}),
+	}
+	for _, opt := range opts {
+		opt(leb)
+	}
+	return leb
 }
 
 // Send an IPLD node and thread auth into the bus.
 // These are received by the app connector and written to the underlying thread.
+// The bus policy only applies to listeners returned by Listen: sends to
+// lossless listeners, such as the connector one, block as with
+// LocalEventsBlock. Events not sent to the connector listener aren't
+// written to the thread.
 func (leb *LocalEventsBus) Send(event *LocalEvent) error {
-	return leb.bus.SendWithTimeout(event, busTimeout)
+	leb.lock.Lock()
+	defer leb.lock.Unlock()
+	if leb.closed {
+		return broadcast.ErrClosedChannel
+	}
+	var result *multierror.Error
+	dropped := 0
+	for id, l := range leb.listeners {
+		select {
+		case l <- event:
+			continue
+		default:
+		}
+		policy := leb.policy
+		if _, ok := leb.lossless[id]; ok {
+			policy = LocalEventsBlock
+		}
+		switch policy {
+		case LocalEventsDropOldest:
+			// Only sends hold the lock, so once an event is dropped the new
+			// one fits. Unbuffered listeners drop the new one instead.
+			if cap(l) > 0 {
+				select {
+				case <-l:
+				default:
+				}
+				select {
+				case l <- event:
+				default:
+				}
+			}
+			dropped++
+		case LocalEventsError:
+			result = multierror.Append(result, fmt.Errorf("listener '%d': %w", id, ErrLocalEventsBusFull))
+			dropped++
+		default:
+			select {
+			case l <- event:
+			case <-time.After(busTimeout):
+				result = multierror.Append(result, fmt.Errorf("unable to send to listener '%d'", id))
+				dropped++
+			}
+		}
+	}
+	if dropped > 0 && leb.dropped != nil {
+		leb.dropped(dropped)
+	}
+	return result.ErrorOrNil()
 }
 
 // Listen returns a local event listener.
 func (leb *LocalEventsBus) Listen() *LocalEventListener {
-	l := &LocalEventListener{
-		listener: leb.bus.Listen(),
-		c:        make(chan *LocalEvent),
+	return leb.listen(false)
+}
+
+// ListenLossless returns a local event listener exempt from the bus
+// policy, see LosslessApp.
+func (leb *LocalEventsBus) ListenLossless() *LocalEventListener {
+	return leb.listen(true)
+}
+
+func (leb *LocalEventsBus) listen(lossless bool) *LocalEventListener {
+	leb.lock.Lock()
+	defer leb.lock.Unlock()
+	ch := make(chan *LocalEvent, leb.capacity)
+	if leb.closed {
+		close(ch)
+	} else {
+		leb.listeners[leb.nextID] = ch
+		if lossless {
+			leb.lossless[leb.nextID] = struct{}{}
+		}
 	}
+	l := &LocalEventListener{bus: leb, id: leb.nextID, c: make(chan *LocalEvent)}
+	leb.nextID++
 	go func() {
-		for v := range l.listener.Channel() {
-			events := v.(*LocalEvent)
-			l.c <- events
+		for event := range ch {
+			l.c <- event
 		}
 		close(l.c)
 	}()
@@ -66,7 +208,15 @@ func (leb *LocalEventsBus) Listen() *LocalEventListener {
 
 // Discard the bus, closing all listeners.
 func (leb *LocalEventsBus) Discard() {
-	leb.bus.Discard()
+	leb.lock.Lock()
+	defer leb.lock.Unlock()
+	if leb.closed {
+		return
+	}
+	leb.closed = true
+	for _, l := range leb.listeners {
+		close(l)
+	}
 }
 
 // LocalEvent wraps an IPLD node and auth for delivery to a thread.
@@ -77,8 +227,9 @@ type LocalEvent struct {
 
 // LocalEventListener notifies about new locally generated events.
 type LocalEventListener struct {
-	listener *broadcast.Listener
-	c        chan *LocalEvent
+	bus *LocalEventsBus
+	id  uint
+	c   chan *LocalEvent
 }
 
 // Channel returns an unbuffered channel to receive local events.
@@ -89,7 +240,10 @@ func (l *LocalEventListener) Channel() <-chan *LocalEvent {
 // Discard indicates that no further events will be received
 // and ready for being garbage collected.
 func (l *LocalEventListener) Discard() {
-	l.listener.Discard()
+	l.bus.lock.Lock()
+	defer l.bus.lock.Unlock()
+	delete(l.bus.listeners, l.id)
+	delete(l.bus.lossless, l.id)
 }
 
 // Net adds the ability to connect an app to a thread.
@@ -137,10 +291,10 @@ func NewConnector(app App, net Net, tinfo thread.Info, conn Connection) (*Connec
 	}
 	var wg sync.WaitGroup
 	wg.Add(2)
+	a.goRoutines.Add(2)
 	go a.threadToApp(conn, &wg)
 	go a.appToThread(&wg)
 	wg.Wait()
-	a.goRoutines.Add(2)
 	return a, nil
 }
 
@@ -190,7 +344,12 @@ func (c *Connector) threadToApp(con Connection, wg *sync.WaitGroup) {
 
 func (c *Connector) appToThread(wg *sync.WaitGroup) {
 	defer c.goRoutines.Done()
-	l := c.app.LocalEventListen()
+	var l *LocalEventListener
+	if la, ok := c.app.(LosslessApp); ok {
+		l = la.LosslessLocalEventListen()
+	} else {
+		l = c.app.LocalEventListen()
+	}
 	defer l.Discard()
 	wg.Done()
 
@@ -40,6 +40,30 @@ type Event interface {
 	Collection() string
 }
 
+// VersionedEvent is an Event carrying the schema version its collection
+// had when the event was created. Events that aren't versioned are
+// considered to be of version 0.
+type VersionedEvent interface {
+	Event
+	SchemaVersion() int
+}
+
+// ClockedEvent is an Event carrying the Lamport clock of the DB that
+// created it, which orders concurrent events of an instance. Clocked
+// creates and saves carry the whole instance, replacing the stored one.
+// Events that aren't clocked have clock 0.
+type ClockedEvent interface {
+	Event
+	Clock() uint64
+}
+
+// TypedEvent is an Event telling the type of the action it was created
+// from, so stored events can be listed without knowing their codec.
+type TypedEvent interface {
+	Event
+	ActionType() ActionType
+}
+
 // ActionType is the type used by actions done in a txn.
 type ActionType int
 
@@ -64,6 +88,13 @@ type Action struct {
 	Previous []byte
 	// Current is the instance after the action was done.
 	Current []byte
+	// SchemaVersion is the schema version of the collection, which codecs
+	// supporting VersionedEvent include in the event.
+	SchemaVersion int
+	// Clock is the Lamport clock of the action, or 0 if the DB doesn't
+	// order events, which codecs supporting ClockedEvent include in the
+	// event.
+	Clock uint64
 }
 
 type ReduceAction struct {
@@ -77,17 +108,33 @@ type ReduceAction struct {
 
 // EventCodec transforms actions generated in collections to
 // events dispatched to thread logs, and viceversa.
+// Custom implementations can be provided to a DB, see the jsonpatcher
+// and protocodec packages for reference implementations.
 type EventCodec interface {
-	// Reduce applies generated events into state.
+	// Reduce applies generated events into state. Instances must be stored
+	// as JSON under baseKey/<collection>/<instance-id>, within a single
+	// transaction of datastore that is also passed to indexFunc along with
+	// the instance data before and after each event.
 	Reduce(
 		events []Event,
 		datastore ds.TxnDatastore,
 		baseKey ds.Key,
 		indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
 	) ([]ReduceAction, error)
-	// Create corresponding events to be dispatched.
+	// Create corresponding events to be dispatched, and the node added as a
+	// thread record body. The node must be a CBOR node, since record bodies
+	// are decoded as CBOR before reaching EventsFromBytes.
+	// Returned events are persisted by the dispatcher with encoding/gob.
 	Create(ops []Action) ([]Event, format.Node, error)
 	// EventsFromBytes deserializes a format.Node bytes payload into
-	// Events.
+	// Events. It must return events that Reduce accepts.
 	EventsFromBytes(data []byte) ([]Event, error)
 }
+
+// StoredEventDecoder is an EventCodec that can decode the events persisted
+// by the dispatcher, which gob encodes them, so they can be reduced again.
+type StoredEventDecoder interface {
+	EventCodec
+	// EventFromStore decodes a gob encoded event of the codec.
+	EventFromStore(data []byte) (Event, error)
+}
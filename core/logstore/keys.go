@@ -0,0 +1,124 @@
+package logstore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/textileio/go-threads/core/thread"
+	sym "github.com/textileio/go-threads/crypto/symmetric"
+)
+
+// ThreadKeys holds the keys of a thread, as serialized by KeyBook.ExportKeys.
+type ThreadKeys struct {
+	ReadKey    []byte    `json:"readKey,omitempty"`
+	ServiceKey []byte    `json:"serviceKey,omitempty"`
+	Logs       []LogKeys `json:"logs,omitempty"`
+}
+
+// LogKeys holds the keys of a log.
+type LogKeys struct {
+	ID      []byte `json:"id"`
+	PubKey  []byte `json:"pubKey,omitempty"`
+	PrivKey []byte `json:"privKey,omitempty"`
+}
+
+// ExportThreadKeys serializes all keys of a thread in kb. It's meant to
+// be used by KeyBook implementations, so that keys exported from one can
+// be imported into any other.
+func ExportThreadKeys(kb KeyBook, t thread.ID) ([]byte, error) {
+	var keys ThreadKeys
+	rk, err := kb.ReadKey(t)
+	if err != nil {
+		return nil, err
+	}
+	if rk != nil {
+		keys.ReadKey = rk.Bytes()
+	}
+	sk, err := kb.ServiceKey(t)
+	if err != nil {
+		return nil, err
+	}
+	if sk != nil {
+		keys.ServiceKey = sk.Bytes()
+	}
+	logs, err := kb.LogsWithKeys(t)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range logs {
+		lk := LogKeys{ID: []byte(id)}
+		pk, err := kb.PubKey(t, id)
+		if err != nil {
+			return nil, err
+		}
+		if pk != nil {
+			if lk.PubKey, err = crypto.MarshalPublicKey(pk); err != nil {
+				return nil, err
+			}
+		}
+		pvk, err := kb.PrivKey(t, id)
+		if err != nil {
+			return nil, err
+		}
+		if pvk != nil {
+			if lk.PrivKey, err = crypto.MarshalPrivateKey(pvk); err != nil {
+				return nil, err
+			}
+		}
+		keys.Logs = append(keys.Logs, lk)
+	}
+	return json.Marshal(keys)
+}
+
+// ImportThreadKeys adds keys serialized by ExportThreadKeys to kb.
+func ImportThreadKeys(kb KeyBook, t thread.ID, data []byte) error {
+	var keys ThreadKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return fmt.Errorf("error unmarshaling keys: %w", err)
+	}
+	if keys.ReadKey != nil {
+		rk, err := sym.FromBytes(keys.ReadKey)
+		if err != nil {
+			return err
+		}
+		if err := kb.AddReadKey(t, rk); err != nil {
+			return err
+		}
+	}
+	if keys.ServiceKey != nil {
+		sk, err := sym.FromBytes(keys.ServiceKey)
+		if err != nil {
+			return err
+		}
+		if err := kb.AddServiceKey(t, sk); err != nil {
+			return err
+		}
+	}
+	for _, lk := range keys.Logs {
+		id, err := peer.IDFromBytes(lk.ID)
+		if err != nil {
+			return err
+		}
+		if lk.PubKey != nil {
+			pk, err := crypto.UnmarshalPublicKey(lk.PubKey)
+			if err != nil {
+				return err
+			}
+			if err := kb.AddPubKey(t, id, pk); err != nil {
+				return err
+			}
+		}
+		if lk.PrivKey != nil {
+			pvk, err := crypto.UnmarshalPrivateKey(lk.PrivKey)
+			if err != nil {
+				return err
+			}
+			if err := kb.AddPrivKey(t, id, pvk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
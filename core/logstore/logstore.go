@@ -51,6 +51,11 @@ type Logstore interface {
 
 	// DeleteLog deletes a log.
 	DeleteLog(thread.ID, peer.ID) error
+
+	// RemoveLog deletes a compromised log: its keys, addresses and heads,
+	// and the read and service keys of its thread. The thread metadata is
+	// deleted too once the thread has no logs left.
+	RemoveLog(thread.ID, peer.ID) error
 }
 
 // ThreadMetadata stores local thread metadata like name.
@@ -72,6 +77,9 @@ type ThreadMetadata interface {
 
 	// PutBytes stores a byte value under key.
 	PutBytes(t thread.ID, key string, val []byte) error
+
+	// ClearMetadata deletes all values under a thread.
+	ClearMetadata(t thread.ID) error
 }
 
 // KeyBook stores log keys.
@@ -106,11 +114,31 @@ type KeyBook interface {
 	// ClearLogKeys deletes all keys under a log.
 	ClearLogKeys(thread.ID, peer.ID) error
 
+	// RemoveLog deletes the keys of a compromised log, along with the read
+	// and service keys of its thread, which it may have leaked.
+	RemoveLog(thread.ID, peer.ID) error
+
 	// LogsWithKeys returns a list of log IDs for a service.
 	LogsWithKeys(thread.ID) (peer.IDSlice, error)
 
+	// ForEachLog calls fn with each log ID with keys under a thread, until fn
+	// returns false. fn must not modify the book.
+	ForEachLog(thread.ID, func(peer.ID) bool) error
+
 	// ThreadsFromKeys returns a list of threads referenced in the book.
 	ThreadsFromKeys() (thread.IDSlice, error)
+
+	// NumLogsWithKeys returns the number of logs with keys under a thread.
+	NumLogsWithKeys(thread.ID) (int, error)
+
+	// NumThreadsFromKeys returns the number of threads referenced in the book.
+	NumThreadsFromKeys() (int, error)
+
+	// ExportKeys returns all keys under a thread, serialized.
+	ExportKeys(thread.ID) ([]byte, error)
+
+	// ImportKeys adds keys serialized by ExportKeys under a thread.
+	ImportKeys(thread.ID, []byte) error
 }
 
 // AddrBook stores log addresses.
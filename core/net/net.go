@@ -10,6 +10,7 @@ import (
 	"github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/textileio/go-threads/core/thread"
+	sym "github.com/textileio/go-threads/crypto/symmetric"
 )
 
 // Net wraps API with a DAGService and libp2p host.
@@ -23,6 +24,15 @@ type Net interface {
 	Host() host.Host
 }
 
+// ReadKeySetter is implemented by networks that can replace the read key of
+// a thread. Callers assert it on a Net.
+type ReadKeySetter interface {
+	// SetReadKey replaces the read key of a thread, which is used to encrypt
+	// the bodies of new records. Records created with the previous key can
+	// only be decrypted with it, so callers should keep it around.
+	SetReadKey(ctx context.Context, id thread.ID, key *sym.Key, opts ...ThreadOption) error
+}
+
 // API is the network interface for thread orchestration.
 type API interface {
 	io.Closer
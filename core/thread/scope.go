@@ -0,0 +1,91 @@
+package thread
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	jwted25519 "github.com/textileio/go-threads/jwt"
+)
+
+// Scope is a set of capabilities a token grants over a collection.
+type Scope int
+
+const (
+	// ScopeRead allows reading the instances of a collection.
+	ScopeRead Scope = 1 << iota
+	// ScopeWrite allows creating, saving and deleting the instances of a
+	// collection. Write transactions read instances too, so they need
+	// ScopeReadWrite.
+	ScopeWrite
+
+	// ScopeReadWrite allows reading and writing the instances of a collection.
+	ScopeReadWrite = ScopeRead | ScopeWrite
+)
+
+// Scopes maps collection names to the capabilities a token grants over
+// them. Collections missing from it can't be accessed.
+type Scopes map[string]Scope
+
+// Allows returns true if s grants every capability of scope over the
+// collection.
+func (s Scopes) Allows(collection string, scope Scope) bool {
+	return s[collection]&scope == scope
+}
+
+// scopedClaims are the claims of tokens limited to scopes. Tokens of
+// NewToken don't have the scopes claim, which leaves them unlimited.
+type scopedClaims struct {
+	jwt.StandardClaims
+	Scopes Scopes `json:"scopes"`
+}
+
+// NewScopedToken issues a new JWT token from issuer for the given public
+// key, which only grants scopes. It's a valid token for every use of the
+// tokens of NewToken, with the scopes checked on top of it.
+func NewScopedToken(issuer crypto.PrivKey, key PubKey, scopes Scopes) (Token, error) {
+	if _, ok := issuer.(*crypto.Ed25519PrivateKey); !ok {
+		return "", fmt.Errorf("issuer must be an Ed25519PrivateKey")
+	}
+	if scopes == nil {
+		scopes = Scopes{}
+	}
+	claims := scopedClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:  key.String(),
+			Issuer:   NewLibp2pIdentity(issuer).GetPublic().String(),
+			IssuedAt: time.Now().Unix(),
+		},
+		Scopes: scopes,
+	}
+	str, err := jwt.NewWithClaims(jwted25519.SigningMethodEd25519i, claims).SignedString(issuer)
+	if err != nil {
+		return "", err
+	}
+	return Token(str), nil
+}
+
+// Scopes returns the scopes granted by token if it was issued by issuer
+// with NewScopedToken. If token is not present or isn't limited to scopes,
+// both the returned scopes and error will be nil.
+func (t Token) Scopes(issuer crypto.PrivKey) (Scopes, error) {
+	if _, ok := issuer.(*crypto.Ed25519PrivateKey); !ok {
+		return nil, fmt.Errorf("issuer must be an Ed25519PrivateKey")
+	}
+	if t == "" {
+		return nil, nil
+	}
+	keyfunc := func(*jwt.Token) (interface{}, error) {
+		return issuer.GetPublic(), nil
+	}
+	var claims scopedClaims
+	tok, err := jwt.ParseWithClaims(string(t), &claims, keyfunc)
+	if err != nil {
+		if tok == nil {
+			return nil, ErrTokenNotFound
+		}
+		return nil, ErrInvalidToken
+	}
+	return claims.Scopes, nil
+}
@@ -0,0 +1,209 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// AggOp models an aggregation operator applied over a numeric field.
+type AggOp int
+
+const (
+	// AggCount counts matching instances.
+	AggCount AggOp = iota
+	// AggSum sums the field values.
+	AggSum
+	// AggAvg averages the field values.
+	AggAvg
+	// AggMin returns the minimum field value.
+	AggMin
+	// AggMax returns the maximum field value.
+	AggMax
+)
+
+// GroupBy partitions the instances matching q by the value of groupField
+// and computes op over valueField for each bucket. Instances are streamed
+// from the datastore, so only one accumulator per bucket is held in memory.
+// Instances that don't have groupField are skipped, as are instances that
+// don't have valueField (AggCount ignores valueField altogether).
+// Group values must be strings, numbers or booleans, and are keyed by
+// their string representation. Numbers decoded as json.Number, see
+// CollectionConfig.UseNumber, are keyed like the float64 of the same value. Results are cached like those of Find.
+func (c *Collection) GroupBy(q *Query, groupField, valueField string, op AggOp, opts ...TxnOption) (buckets map[string]float64, err error) {
+	err = c.ReadTxn(func(txn *Txn) error {
+		buckets, err = c.cachedGroupBy(txn, q, groupField, valueField, op)
+		return err
+	}, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return buckets, nil
+}
+
+// GroupBy partitions the instances matching q by the value of groupField
+// and computes op over valueField for each bucket in the current txn scope.
+func (t *Txn) GroupBy(q *Query, groupField, valueField string, op AggOp) (map[string]float64, error) {
+	if op < AggCount || op > AggMax {
+		return nil, fmt.Errorf("unknown aggregation operator %d", op)
+	}
+	accs := make(map[string]*accumulator)
+	err := t.forEach(q, func(v map[string]interface{}) error {
+		group, err := traverseFieldPathMap(v, groupField)
+		if err != nil {
+			return nil
+		}
+		key, err := groupKey(group.Interface())
+		if err != nil {
+			return err
+		}
+		acc, ok := accs[key]
+		if !ok {
+			acc = newAccumulator(op)
+			accs[key] = acc
+		}
+		if op == AggCount {
+			acc.add(0)
+			return nil
+		}
+		field, err := traverseFieldPathMap(v, valueField)
+		if err != nil {
+			return nil
+		}
+		f, ok := aggValue(field.Interface())
+		if !ok {
+			return fmt.Errorf("field %s isn't numeric: %v", valueField, field.Interface())
+		}
+		acc.add(f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	buckets := make(map[string]float64, len(accs))
+	for k, acc := range accs {
+		if acc.n == 0 && op != AggCount {
+			continue
+		}
+		buckets[k] = acc.result()
+	}
+	return buckets, nil
+}
+
+// forEach streams the decoded instances matching q to f, stopping
+// at the first error.
+func (t *Txn) forEach(q *Query, f func(map[string]interface{}) error) error {
+	if q == nil {
+		q = &Query{}
+	}
+	if err := q.Validate(); err != nil {
+		return fmt.Errorf("invalid query: %s", err)
+	}
+	txn, err := t.collection.db.datastore.NewTransaction(true)
+	if err != nil {
+		return fmt.Errorf("error building internal query: %v", err)
+	}
+	defer txn.Discard()
+	iter, err := t.newQueryIterator(txn, q)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	for {
+		res, ok := iter.NextSync()
+		if !ok {
+			return res.Error
+		}
+		if !q.IncludeDeleted && t.collection.isTombstone(res.Value) {
+			continue
+		}
+		v := res.MarshaledValue
+		if v == nil {
+			v = make(map[string]interface{})
+			if err := json.Unmarshal(res.Value, &v); err != nil {
+				return err
+			}
+		}
+		if err := f(v); err != nil {
+			return err
+		}
+	}
+}
+
+func groupKey(v interface{}) (string, error) {
+	switch g := v.(type) {
+	case string:
+		return g, nil
+	case float64:
+		return strconv.FormatFloat(g, 'f', -1, 64), nil
+	case json.Number:
+		r, ok := numberRat(g)
+		if !ok {
+			return "", fmt.Errorf("can't group by value %v (%T)", v, v)
+		}
+		if r.IsInt() {
+			return r.Num().String(), nil
+		}
+		f, _ := r.Float64()
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(g), nil
+	default:
+		return "", fmt.Errorf("can't group by value %v (%T)", v, v)
+	}
+}
+
+// aggValue returns the value of a numeric field as a float64, which
+// aggregations are computed with.
+func aggValue(v interface{}) (float64, bool) {
+	if f, ok := v.(float64); ok {
+		return f, true
+	}
+	r, ok := numberRat(v)
+	if !ok {
+		return 0, false
+	}
+	f, _ := r.Float64()
+	return f, true
+}
+
+type accumulator struct {
+	op  AggOp
+	n   int
+	val float64
+}
+
+func newAccumulator(op AggOp) *accumulator {
+	acc := &accumulator{op: op}
+	switch op {
+	case AggMin:
+		acc.val = math.Inf(1)
+	case AggMax:
+		acc.val = math.Inf(-1)
+	}
+	return acc
+}
+
+func (a *accumulator) add(f float64) {
+	a.n++
+	switch a.op {
+	case AggSum, AggAvg:
+		a.val += f
+	case AggMin:
+		a.val = math.Min(a.val, f)
+	case AggMax:
+		a.val = math.Max(a.val, f)
+	}
+}
+
+func (a *accumulator) result() float64 {
+	switch a.op {
+	case AggCount:
+		return float64(a.n)
+	case AggAvg:
+		return a.val / float64(a.n)
+	default:
+		return a.val
+	}
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/textileio/go-threads/util"
+)
+
+func TestGroupBy(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+
+	tests := []struct {
+		name     string
+		query    *Query
+		op       AggOp
+		expected map[string]float64
+	}{
+		{name: "Count", op: AggCount, expected: map[string]float64{"Author1": 3, "Author2": 1, "Author3": 1}},
+		{name: "Sum", op: AggSum, expected: map[string]float64{"Author1": 60, "Author2": 114, "Author3": 500}},
+		{name: "Avg", op: AggAvg, expected: map[string]float64{"Author1": 20, "Author2": 114, "Author3": 500}},
+		{name: "Min", op: AggMin, expected: map[string]float64{"Author1": 10, "Author2": 114, "Author3": 500}},
+		{name: "Max", op: AggMax, expected: map[string]float64{"Author1": 30, "Author2": 114, "Author3": 500}},
+		{name: "WithQuery", query: Where("Meta.TotalReads").Gt(float64(15)), op: AggSum, expected: map[string]float64{"Author1": 50, "Author2": 114, "Author3": 500}},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+			res, err := c.GroupBy(tc.query, "Author", "Meta.TotalReads", tc.op)
+			checkErr(t, err)
+			if !reflect.DeepEqual(res, tc.expected) {
+				t.Fatalf("wrong buckets, expected: %v, got: %v", tc.expected, res)
+			}
+		})
+	}
+	t.Run("MissingGroupField", func(t *testing.T) {
+		t.Parallel()
+		res, err := c.GroupBy(nil, "Missing", "Meta.TotalReads", AggSum)
+		checkErr(t, err)
+		if len(res) != 0 {
+			t.Fatalf("instances without the group field should be skipped, got: %v", res)
+		}
+	})
+	t.Run("NonNumericValueField", func(t *testing.T) {
+		t.Parallel()
+		if _, err := c.GroupBy(nil, "Author", "Title", AggSum); err == nil {
+			t.Fatal("aggregating a non-numeric field should fail")
+		}
+	})
+	t.Run("CanceledContext", func(t *testing.T) {
+		t.Parallel()
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := c.GroupBy(nil, "Author", "Meta.TotalReads", AggSum, WithTxnContext(ctx)); !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the txn error, got %v", err)
+		}
+	})
+}
+
+func TestGroupByUseNumber(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:      "Counter",
+		Schema:    util.SchemaFromSchemaString(counterSchema),
+		UseNumber: true,
+	})
+	checkErr(t, err)
+	for _, count := range []string{"1", "3", "3"} {
+		_, err = c.Create([]byte(`{"_id": "", "Count": ` + count + `}`))
+		checkErr(t, err)
+	}
+
+	res, err := c.GroupBy(nil, "Count", "Count", AggSum)
+	checkErr(t, err)
+	if expected := map[string]float64{"1": 1, "3": 6}; !reflect.DeepEqual(res, expected) {
+		t.Fatalf("wrong buckets, expected: %v, got: %v", expected, res)
+	}
+	res, err = c.GroupBy(Where("Count").Gt(float64(1)), "Count", "Count", AggAvg)
+	checkErr(t, err)
+	if expected := map[string]float64{"3": 3}; !reflect.DeepEqual(res, expected) {
+		t.Fatalf("wrong buckets, expected: %v, got: %v", expected, res)
+	}
+}
@@ -0,0 +1,183 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+// writeBatch accumulates the actions of committed write transactions
+// when write batching is enabled. Actions are added with the DB lock held.
+// Flushes hold the DB lock, or its read lock along with flushLock, so reads
+// can flush pending writes without excluding each other.
+type writeBatch struct {
+	size     int
+	interval time.Duration
+
+	flushLock sync.Mutex
+
+	lock  sync.Mutex
+	timer *time.Timer
+	token thread.Token
+	// actions are kept until they're committed, so a failed flush is
+	// retried by the next one.
+	actions []core.Action
+	// values holds the latest pending value of each instance key,
+	// nil if the instance is pending deletion.
+	values map[ds.Key][]byte
+}
+
+func newWriteBatch(size int, interval time.Duration) *writeBatch {
+	return &writeBatch{
+		size:     size,
+		interval: interval,
+		values:   make(map[ds.Key][]byte),
+	}
+}
+
+// get returns the pending value for key, and whether there's one.
+func (b *writeBatch) get(key ds.Key) ([]byte, bool) {
+	if b == nil {
+		return nil, false
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	v, ok := b.values[key]
+	return v, ok
+}
+
+// pendingValues returns the pending values of the instances under prefix.
+func (b *writeBatch) pendingValues(prefix ds.Key) map[ds.Key][]byte {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	res := make(map[ds.Key][]byte)
+	for key, v := range b.values {
+		if prefix.IsAncestorOf(key) {
+			res[key] = v
+		}
+	}
+	return res
+}
+
+func (b *writeBatch) empty() bool {
+	if b == nil {
+		return true
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.actions) == 0
+}
+
+// truncate drops the actions after the first n, restoring the pending
+// values of the remaining ones.
+func (b *writeBatch) truncate(n int) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.actions = b.actions[:n]
+	b.values = make(map[ds.Key][]byte, len(b.actions))
+	for _, a := range b.actions {
+		b.values[KeyForInstance(a.CollectionName, a.InstanceID)] = a.Current
+	}
+}
+
+// Flush applies any pending batched writes. It's a no-op unless
+// write batching is enabled.
+func (d *DB) Flush() error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.flushBatch()
+}
+
+// addToBatch adds actions to the pending batch, flushing it first if it
+// was created with a different token, and afterwards if it's full. If the
+// flush fails, actions are dropped from the batch, so they aren't applied.
+// It must be called with the DB lock held.
+func (d *DB) addToBatch(actions []core.Action, token thread.Token) error {
+	if len(actions) == 0 {
+		return nil
+	}
+	b := d.batch
+	if !b.empty() && b.token != token {
+		if err := d.flushBatch(); err != nil {
+			return err
+		}
+	}
+	b.lock.Lock()
+	if len(b.actions) == 0 {
+		b.token = token
+		if b.interval > 0 {
+			b.timer = time.AfterFunc(b.interval, d.flushBatchOnTimer)
+		}
+	}
+	for _, a := range actions {
+		key := KeyForInstance(a.CollectionName, a.InstanceID)
+		b.values[key] = a.Current
+	}
+	n := len(b.actions)
+	b.actions = append(b.actions, actions...)
+	full := len(b.actions) >= b.size
+	b.lock.Unlock()
+	if !full {
+		return nil
+	}
+	if err := d.flushBatch(); err != nil {
+		b.truncate(n)
+		return err
+	}
+	return nil
+}
+
+// flushBatch commits pending batched actions as a single event. Actions
+// are only removed from the batch once committed, so every flush returns
+// the error until one succeeds.
+// It must be called with the DB lock or read lock held.
+func (d *DB) flushBatch() error {
+	b := d.batch
+	if b == nil {
+		return nil
+	}
+	b.flushLock.Lock()
+	defer b.flushLock.Unlock()
+	b.lock.Lock()
+	actions, token := b.actions, b.token
+	b.lock.Unlock()
+	if len(actions) == 0 {
+		return nil
+	}
+	committed := make([]core.Action, len(actions))
+	copy(committed, actions)
+	if err := d.commitActions(context.Background(), committed, token); err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.actions = nil
+	b.token = ""
+	b.values = make(map[ds.Key][]byte)
+	return nil
+}
+
+func (d *DB) flushBatchOnTimer() {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		return
+	}
+	if err := d.flushBatch(); err != nil && d.batch.interval > 0 {
+		d.log.Errorf("error flushing write batch: %v", err)
+		d.batch.lock.Lock()
+		d.batch.timer = time.AfterFunc(d.batch.interval, d.flushBatchOnTimer)
+		d.batch.lock.Unlock()
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// CanonicalJSON returns the canonical form of the JSON document data, so
+// the same logical document always serializes to the same bytes: object
+// keys are sorted, insignificant whitespace is dropped, strings aren't
+// HTML escaped, and numbers are normalized, e.g. 1.0 and 1e0 become 1.
+// Integers are kept exactly, however large. Instances are stored in this
+// form, so their bytes can be hashed or compared directly.
+func CanonicalJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("error decoding json: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("error decoding json: unexpected data after document")
+	}
+	v, err := canonicalValue(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// canonicalValue normalizes the numbers of a decoded JSON value.
+func canonicalValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			ce, err := canonicalValue(e)
+			if err != nil {
+				return nil, err
+			}
+			v[k] = ce
+		}
+		return v, nil
+	case []interface{}:
+		for i, e := range v {
+			ce, err := canonicalValue(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = ce
+		}
+		return v, nil
+	case json.Number:
+		return canonicalNumber(v)
+	default:
+		return v, nil
+	}
+}
+
+// canonicalNumber formats integers in decimal, and any other number as
+// the shortest float64 representation encoding/json produces.
+func canonicalNumber(n json.Number) (json.Number, error) {
+	if i, ok := new(big.Int).SetString(n.String(), 10); ok {
+		return json.Number(i.String()), nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return "", fmt.Errorf("invalid number %s: %v", n, err)
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+	return json.Number(b), nil
+}
+
+// canonicalIndexFunc stores reduced instances in canonical form, whatever
+// the event codec produced, and indexes that form.
+func canonicalIndexFunc(
+	d *DB,
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+	return func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+		if newData == nil {
+			return indexFunc(collection, key, oldData, newData, txn)
+		}
+		canonical, err := CanonicalJSON(newData)
+		if err != nil {
+			d.log.Warnf("can't canonicalize instance %s in collection %s: %v", key.BaseNamespace(), collection, err)
+			return indexFunc(collection, key, oldData, newData, txn)
+		}
+		if !bytes.Equal(canonical, newData) {
+			if err := txn.Put(key, canonical); err != nil {
+				return err
+			}
+		}
+		return indexFunc(collection, key, oldData, canonical, txn)
+	}
+}
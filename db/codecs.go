@@ -0,0 +1,107 @@
+package db
+
+import (
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/multiformats/go-multihash"
+	core "github.com/textileio/go-threads/core/db"
+)
+
+var (
+	dsDBEventCodecs = dsDBPrefix.ChildString("codec")
+)
+
+// codecEnvelope wraps events created by a named event codec, so peers
+// decode them with the same codec. Events of the default codec aren't
+// wrapped.
+type codecEnvelope struct {
+	Codec string
+	Body  []byte
+}
+
+func init() {
+	cbornode.RegisterCborType(codecEnvelope{})
+}
+
+// eventCodec returns the name and codec of the events of collection.
+// The name is empty for the DB default codec, which is used by
+// collections that don't select a named one.
+func (d *DB) eventCodec(collection string) (string, core.EventCodec) {
+	if c := d.getCollection(collection); c != nil && c.eventCodec != "" {
+		return c.eventCodec, d.eventCodecs[c.eventCodec]
+	}
+	return "", d.eventcodec
+}
+
+// reduceEvents reduces events into store with the codecs of their
+// collections. Consecutive events sharing a codec are reduced together.
+func (d *DB) reduceEvents(store ds.TxnDatastore, events []core.Event, indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error) ([]core.ReduceAction, error) {
+	var actions []core.ReduceAction
+	for i := 0; i < len(events); {
+		name, codec := d.eventCodec(events[i].Collection())
+		j := i + 1
+		for ; j < len(events); j++ {
+			if n, _ := d.eventCodec(events[j].Collection()); n != name {
+				break
+			}
+		}
+		as, err := codec.Reduce(events[i:j], store, baseKey, indexFunc)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, as...)
+		i = j
+	}
+	return actions, nil
+}
+
+// createEvents creates events and a node from actions with the codecs of
+// their collections. Consecutive actions sharing a codec produce a single
+// node, so actions of collections with different codecs produce one node
+// per run.
+func (d *DB) createEvents(actions []core.Action, fn func(events []core.Event, node format.Node) error) error {
+	for i := 0; i < len(actions); {
+		name, codec := d.eventCodec(actions[i].CollectionName)
+		j := i + 1
+		for ; j < len(actions); j++ {
+			if n, _ := d.eventCodec(actions[j].CollectionName); n != name {
+				break
+			}
+		}
+		events, node, err := codec.Create(actions[i:j])
+		if err != nil {
+			return err
+		}
+		if node != nil && name != "" {
+			node, err = cbornode.WrapObject(codecEnvelope{
+				Codec: name,
+				Body:  node.RawData(),
+			}, multihash.SHA2_256, -1)
+			if err != nil {
+				return err
+			}
+		}
+		if err := fn(events, node); err != nil {
+			return err
+		}
+		i = j
+	}
+	return nil
+}
+
+// decodeEvents decodes events with the codec named in their envelope,
+// or with the DB default codec if they aren't wrapped.
+func (d *DB) decodeEvents(data []byte) ([]core.Event, error) {
+	var env codecEnvelope
+	if err := cbornode.DecodeInto(data, &env); err == nil && env.Codec != "" {
+		codec, ok := d.eventCodecs[env.Codec]
+		if !ok {
+			return nil, fmt.Errorf("event codec %s isn't registered", env.Codec)
+		}
+		return codec.EventsFromBytes(env.Body)
+	}
+	return d.eventcodec.EventsFromBytes(data)
+}
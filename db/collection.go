@@ -1,15 +1,19 @@
 package db
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/jsonschema"
 	jsonpatch "github.com/evanphx/json-patch"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	core "github.com/textileio/go-threads/core/db"
 	"github.com/textileio/go-threads/core/thread"
 	"github.com/tidwall/gjson"
@@ -31,21 +35,61 @@ var (
 	errAlreadyDiscardedCommitedTxn = errors.New("can't commit discarded/commited txn")
 	errCantCreateExistingInstance  = errors.New("can't create already existing instance")
 	errCantSaveNonExistentInstance = errors.New("can't save unkown instance")
+	errCantDropIDIndex             = errors.New("can't drop the _id index")
+	errCantChangeInstanceID        = errors.New("can't change the _id of an instance")
 
 	baseKey = dsDBPrefix.ChildString("collection")
 )
 
+// validateBatchSize is the max number of instances ValidateAll checks
+// while holding the DB lock.
+const validateBatchSize = 1000
+
 // Collection contains instances of a schema, and provides operations
 // for creating, updating, deleting, and quering them.
 type Collection struct {
-	name         string
-	schemaLoader gojsonschema.JSONLoader
-	valueType    reflect.Type
-	db           *DB
-	indexes      map[string]Index
+	name        string
+	schema      *jsonschema.Schema
+	validator   *gojsonschema.Schema
+	valueType   reflect.Type
+	db          *DB
+	indexes     map[string]Index
+	idGenerator IDGenerator
+	eventCodec  string
+	softDelete  bool
+	// maxInstanceBytes is the maximum size of instances, or 0 if unbounded.
+	maxInstanceBytes int
+	// properties are the top-level properties of the schema.
+	properties            map[string]*jsonschema.Type
+	useNumber             bool
+	disallowUnknownFields bool
+	timestamps            bool
+	// primaryKey lists the fields the _id of instances is synthesized
+	// from, or is empty if instances have a plain _id.
+	primaryKey []string
+	// schemaVersion and schemaCompatibility check the schema version of
+	// events from other peers.
+	schemaVersion       int
+	schemaCompatibility SchemaCompatibility
+	// queryCache caches query results, or is nil if disabled.
+	queryCache *queryCache
+	// defaults are applied to missing fields of created instances.
+	defaults []fieldDefault
+	// idField names the field holding the ID of instances.
+	idField string
+	// building holds the paths of unfinished indexes of AddIndexContext,
+	// which are true while their build runs.
+	building map[string]bool
 }
 
-func newCollection(name string, schema *jsonschema.Schema, d *DB) (*Collection, error) {
+func newCollection(config CollectionConfig, d *DB) (*Collection, error) {
+	if err := validateIDField(config); err != nil {
+		return nil, err
+	}
+	if config.IDField == "" {
+		config.IDField = idFieldName
+	}
+	schema := config.Schema
 	// by default, use top level properties to validate ID string property exists
 	properties := schema.Properties
 	if schema.Ref != "" {
@@ -61,21 +105,61 @@ func newCollection(name string, schema *jsonschema.Schema, d *DB) (*Collection,
 		}
 		properties = refDefinition.Properties
 	}
-	if !hasIDProperty(properties) {
+	if !hasIDProperty(properties, config.IDField) {
 		return nil, ErrInvalidCollectionSchema
 	}
 
-	schemaBytes, err := json.Marshal(schema)
+	validator, err := compileSchema(schema, d.definitions)
+	if err != nil {
+		return nil, err
+	}
+	if config.EventCodec != "" {
+		if _, ok := d.eventCodecs[config.EventCodec]; !ok {
+			return nil, fmt.Errorf("event codec %s isn't registered", config.EventCodec)
+		}
+	}
+	if config.MaxInstanceBytes < 0 {
+		return nil, fmt.Errorf("max instance bytes can't be negative")
+	}
+	if err := validatePrimaryKey(config); err != nil {
+		return nil, err
+	}
+	if err := validateSchemaVersion(config); err != nil {
+		return nil, err
+	}
+	defaults, err := schemaDefaults(schema, properties)
 	if err != nil {
 		return nil, err
 	}
-	schemaLoader := gojsonschema.NewBytesLoader(schemaBytes)
+	idGenerator := config.IDGenerator
+	if idGenerator == nil {
+		idGenerator = newRandomInstanceID
+	}
 	c := &Collection{
-		name:         name,
-		schemaLoader: schemaLoader,
-		valueType:    nil,
-		db:           d,
-		indexes:      make(map[string]Index),
+		name:                  config.Name,
+		schema:                schema,
+		validator:             validator,
+		valueType:             nil,
+		db:                    d,
+		indexes:               make(map[string]Index),
+		idGenerator:           idGenerator,
+		eventCodec:            config.EventCodec,
+		softDelete:            config.SoftDelete,
+		maxInstanceBytes:      config.MaxInstanceBytes,
+		properties:            properties,
+		defaults:              defaults,
+		useNumber:             config.UseNumber,
+		disallowUnknownFields: config.DisallowUnknownFields,
+		timestamps:            config.Timestamps,
+		primaryKey:            config.PrimaryKey,
+		schemaVersion:         config.SchemaVersion,
+		schemaCompatibility:   config.SchemaCompatibility,
+		idField:               config.IDField,
+	}
+	if d.queryCacheSize > 0 {
+		if c.queryCache, err = newQueryCache(d.queryCacheSize, d.queryCacheTTL); err != nil {
+			return nil, err
+		}
 	}
 	return c, nil
 }
@@ -89,73 +173,514 @@ func (c *Collection) Indexes() map[string]Index {
 	return c.indexes
 }
 
+// isMultikey returns whether the index on path is a multikey index.
+func (c *Collection) isMultikey(path string) bool {
+	index, ok := c.indexes[path]
+	return ok && index.MultiIndexFunc != nil
+}
+
 // AddIndex creates a new index based on the given path string.
 // Set unique to true if you want a unique constraint on the given path.
 // See https://github.com/tidwall/gjson for documentation on the supported path structure.
 // Adding an index will override any overlapping index values if they already exist.
-// @note: This does NOT currently build the index. If items have been added prior to adding
-// a new index, they will NOT be indexed a posteriori.
+// Existing instances are indexed a posteriori, and the index isn't added if they
+// violate its unique constraint. They're indexed in a single transaction with
+// the DB locked, see AddIndexContext for large collections.
+// Since transactions hold the DB lock, calling it from a transaction, e.g.
+// within WriteTxn, deadlocks.
 func (c *Collection) AddIndex(config IndexConfig) error {
-	indexKey := dsDBIndexes.ChildString(c.name)
-	exists, err := c.db.datastore.Has(indexKey)
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	if c.db.closed {
+		return ErrDBClosed
+	}
+	return c.addIndex(config)
+}
+
+// DropIndex removes the index on the given path string, along with all its entries.
+func (c *Collection) DropIndex(path string) error {
+	if path == c.idField {
+		return errCantDropIDIndex
+	}
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	if c.db.closed {
+		return ErrDBClosed
+	}
+
+	txn, err := c.db.datastore.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	indexes, err := c.getIndexConfigs(txn)
 	if err != nil {
 		return err
 	}
+	_, exists := indexes[path]
+	if !exists && !c.isBuilding(path) {
+		return ErrNoIndexFound
+	}
+	delete(indexes, path)
+	if err := c.putIndexConfigs(txn, indexes); err != nil {
+		return err
+	}
+	if err := c.clearIndex(txn, path); err != nil {
+		return err
+	}
+	if err := txn.Delete(indexBuildKey(c.name, path)); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	delete(c.indexes, path)
+	delete(c.building, path)
+	return nil
+}
 
-	indexes := map[string]IndexConfig{}
+// addIndex persists and registers an index. Entries are (re)built for
+// existing instances unless the same index config was already persisted,
+// e.g., when collections are re-created on start.
+// The DB lock must be held by the caller.
+func (c *Collection) addIndex(config IndexConfig) error {
+	txn, err := c.db.datastore.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	indexes, err := c.getIndexConfigs(txn)
+	if err != nil {
+		return err
+	}
 
-	if exists {
-		indexesBytes, err := c.db.datastore.Get(indexKey)
-		if err != nil {
+	existing, exists := indexes[config.Path]
+	if config.Path == c.idField && exists {
+		// The index on ID can't be redefined
+		config = existing
+	}
+	index, err := newIndex(config)
+	if err != nil {
+		return err
+	}
+	building := c.isBuilding(config.Path)
+	if !exists || existing != config || building {
+		indexes[config.Path] = config
+		if err := c.putIndexConfigs(txn, indexes); err != nil {
+			return err
+		}
+		if exists || building {
+			if err := c.clearIndex(txn, config.Path); err != nil {
+				return err
+			}
+		}
+		if err := txn.Delete(indexBuildKey(c.name, config.Path)); err != nil {
+			return err
+		}
+		if err := c.buildIndex(txn, config.Path, index); err != nil {
 			return err
 		}
-		if err = json.Unmarshal(indexesBytes, &indexes); err != nil {
+		if err := txn.Commit(); err != nil {
 			return err
 		}
 	}
+	delete(c.building, config.Path)
+	c.indexes[config.Path] = index
+	return nil
+}
 
-	// if the index being added is for path ID
-	if config.Path == idFieldName {
-		// and there already is and index on ID
-		if _, exists := indexes[idFieldName]; exists {
-			// just return gracefully
-			return nil
+// newIndex returns the index of config.
+func newIndex(config IndexConfig) (Index, error) {
+	index := Index{Unique: config.Unique, Sorted: config.Sorted}
+	if config.Sorted && config.Multikey {
+		return Index{}, fmt.Errorf("sorted index %s can't be multikey", config.Path)
+	}
+	if fields := compoundPaths(config.Path); fields != nil {
+		if config.Multikey {
+			return Index{}, fmt.Errorf("compound index %s can't be multikey", config.Path)
+		}
+		if config.Sorted {
+			return Index{}, fmt.Errorf("compound index %s can't be sorted", config.Path)
+		}
+		for _, field := range fields {
+			if field == "" {
+				return Index{}, fmt.Errorf("invalid compound index path %s", config.Path)
+			}
+		}
+		index.IndexFunc = compoundIndexFunc
+	} else if config.Multikey {
+		index.MultiIndexFunc = func(field string, value []byte) ([]ds.Key, error) {
+			result := gjson.GetBytes(value, field)
+			if !result.IsArray() {
+				return nil, ErrNotIndexable
+			}
+			var keys []ds.Key
+			seen := make(map[string]struct{})
+			for _, elem := range result.Array() {
+				if _, ok := seen[elem.String()]; ok {
+					continue
+				}
+				seen[elem.String()] = struct{}{}
+				keys = append(keys, ds.NewKey(elem.String()))
+			}
+			return keys, nil
+		}
+	} else if config.Sorted {
+		index.IndexFunc = sortedIndexFunc
+	} else {
+		index.IndexFunc = func(field string, value []byte) (ds.Key, error) {
+			result := gjson.GetBytes(value, field)
+			if !result.Exists() {
+				return ds.Key{}, ErrNotIndexable
+			}
+			return ds.NewKey(result.String()), nil
 		}
 	}
+	return index, nil
+}
 
-	indexes[config.Path] = config
+func (c *Collection) getIndexConfigs(txn ds.Txn) (map[string]IndexConfig, error) {
+	indexes := map[string]IndexConfig{}
+	indexesBytes, err := txn.Get(dsDBIndexes.ChildString(c.name))
+	if err == ds.ErrNotFound {
+		return indexes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(indexesBytes, &indexes); err != nil {
+		return nil, err
+	}
+	return indexes, nil
+}
 
+func (c *Collection) putIndexConfigs(txn ds.Txn, indexes map[string]IndexConfig) error {
 	indexBytes, err := json.Marshal(indexes)
 	if err != nil {
 		return err
 	}
+	return txn.Put(dsDBIndexes.ChildString(c.name), indexBytes)
+}
 
-	if err := c.db.datastore.Put(indexKey, indexBytes); err != nil {
+// buildIndex adds entries of a new index for all existing instances.
+func (c *Collection) buildIndex(txn ds.Txn, path string, index Index) error {
+	res, err := txn.Query(query.Query{Prefix: c.BaseKey().String()})
+	if err != nil {
 		return err
 	}
+	// Instances are fetched before updating the index, since txn can't
+	// be read while it's being iterated.
+	instances, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, r := range instances {
+		key := ds.NewKey(r.Key)
+		if !key.IsDescendantOf(c.BaseKey()) {
+			continue
+		}
+		if err := indexUpdate(c.BaseKey(), path, index, txn, key, r.Value, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	c.indexes[config.Path] = Index{
-		IndexFunc: func(field string, value []byte) (ds.Key, error) {
-			result := gjson.GetBytes(value, field)
-			if !result.Exists() {
-				return ds.Key{}, ErrNotIndexable
+// clearIndex deletes all entries of an index.
+func (c *Collection) clearIndex(txn ds.Txn, path string) error {
+	prefix := indexPrefix.Child(c.BaseKey()).ChildString(path)
+	res, err := txn.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		key := ds.NewKey(e.Key)
+		if !key.IsDescendantOf(prefix) {
+			continue
+		}
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearData deletes all instances, index entries, instance origins, stamps
+// and local changes of the collection.
+func (c *Collection) clearData(txn ds.Txn) error {
+	for _, prefix := range []ds.Key{c.BaseKey(), indexPrefix.Child(c.BaseKey()), dsDBOrigins.ChildString(c.name), dsDBStamps.ChildString(c.name), dsDBLocalChanges.ChildString(c.name)} {
+		res, err := txn.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+		if err != nil {
+			return err
+		}
+		entries, err := res.Rest()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			key := ds.NewKey(e.Key)
+			if !key.IsDescendantOf(prefix) {
+				continue // Collection names sharing a prefix, e.g. "dog" and "dogs"
 			}
-			return ds.NewKey(result.String()), nil
-		},
-		Unique: config.Unique,
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// IndexInconsistency is an index entry that doesn't match instance data.
+type IndexInconsistency struct {
+	// Path is the path of the index.
+	Path string
+	// Value is the indexed value of the entry.
+	Value string
+	// InstanceID is the instance the entry points to, or should point to.
+	InstanceID core.InstanceID
+	// Missing is true if the instance should be in the entry but isn't,
+	// and false if the entry points to an instance that shouldn't be there.
+	Missing bool
+}
+
+// VerifyIndexes recomputes the index entries of all instances and compares
+// them against stored entries, returning the inconsistencies found, sorted
+// by path, value and instance ID. Use RebuildIndexes to repair them.
+func (c *Collection) VerifyIndexes() ([]IndexInconsistency, error) {
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	if c.db.closed {
+		return nil, ErrDBClosed
+	}
+	if err := c.db.flushBatch(); err != nil {
+		return nil, err
+	}
+	txn, err := c.db.datastore.NewTransaction(true)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard()
+
+	// Expected instance keys by index entry key
+	expected := make(map[ds.Key]map[ds.Key]struct{})
+	res, err := txn.Query(query.Query{Prefix: c.BaseKey().String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		key := ds.NewKey(r.Key)
+		if !key.IsDescendantOf(c.BaseKey()) {
+			continue
+		}
+		for path, index := range c.indexes {
+			valueKeys, err := index.keys(path, r.Value)
+			if err != nil && !errors.Is(err, ErrNotIndexable) {
+				return nil, err
+			}
+			for _, valueKey := range valueKeys {
+				if valueKey.String() == "" {
+					continue
+				}
+				indexKey := indexPrefix.Child(c.BaseKey()).ChildString(path).ChildString(valueKey.String()[1:])
+				if expected[indexKey] == nil {
+					expected[indexKey] = make(map[ds.Key]struct{})
+				}
+				expected[indexKey][key] = struct{}{}
+			}
+		}
+	}
+
+	var found []IndexInconsistency
+	for path := range c.indexes {
+		prefix := indexPrefix.Child(c.BaseKey()).ChildString(path)
+		entries, err := txn.Query(query.Query{Prefix: prefix.String()})
+		if err != nil {
+			return nil, err
+		}
+		stored := make(map[ds.Key]struct{})
+		for e := range entries.Next() {
+			if e.Error != nil {
+				entries.Close()
+				return nil, e.Error
+			}
+			indexKey := ds.NewKey(e.Key)
+			if !indexKey.IsDescendantOf(prefix) {
+				continue
+			}
+			stored[indexKey] = struct{}{}
+			var keys keyList
+			if err := DefaultDecode(e.Value, &keys); err != nil {
+				entries.Close()
+				return nil, err
+			}
+			for _, k := range keys {
+				key := ds.RawKey(string(k))
+				if _, ok := expected[indexKey][key]; !ok {
+					found = append(found, newIndexInconsistency(prefix, indexKey, path, key, false))
+				}
+			}
+			for key := range expected[indexKey] {
+				if !keys.in(key) {
+					found = append(found, newIndexInconsistency(prefix, indexKey, path, key, true))
+				}
+			}
+		}
+		entries.Close()
+		for indexKey, keys := range expected {
+			if _, ok := stored[indexKey]; ok || !indexKey.IsDescendantOf(prefix) {
+				continue
+			}
+			for key := range keys {
+				found = append(found, newIndexInconsistency(prefix, indexKey, path, key, true))
+			}
+		}
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].Path != found[j].Path {
+			return found[i].Path < found[j].Path
+		}
+		if found[i].Value != found[j].Value {
+			return found[i].Value < found[j].Value
+		}
+		return found[i].InstanceID < found[j].InstanceID
+	})
+	return found, nil
+}
+
+func newIndexInconsistency(prefix, indexKey ds.Key, path string, key ds.Key, missing bool) IndexInconsistency {
+	return IndexInconsistency{
+		Path:       path,
+		Value:      strings.TrimPrefix(indexKey.String(), prefix.String()+"/"),
+		InstanceID: core.InstanceID(key.Name()),
+		Missing:    missing,
+	}
+}
+
+// RebuildIndexes drops all index entries of the collection and regenerates
+// them from instance data in a single transaction. It fails, leaving the
+// indexes untouched, if instances violate a unique constraint.
+func (c *Collection) RebuildIndexes() error {
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	if c.db.closed {
+		return ErrDBClosed
+	}
+	if err := c.db.flushBatch(); err != nil {
+		return err
+	}
+	txn, err := c.db.datastore.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	for path, index := range c.indexes {
+		if err := c.clearIndex(txn, path); err != nil {
+			return err
+		}
+		if err := c.buildIndex(txn, path, index); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// CollectionStats reports the size of a collection.
+type CollectionStats struct {
+	// Instances is the number of instances.
+	Instances int
+	// InstanceBytes is the total size of stored instance values, which are
+	// encrypted if the DB uses an encryption key.
+	InstanceBytes int64
+	// IndexEntries is the number of index entries of all indexes.
+	IndexEntries int
+	// IndexEntriesByPath is the number of index entries by index path.
+	IndexEntriesByPath map[string]int
+}
+
+// Stats scans the stored instances and index entries of the collection and
+// returns their counts and sizes. Index entries are counted by key, so an
+// entry shared by several instances with the same value counts once.
+func (c *Collection) Stats() (CollectionStats, error) {
+	stats := CollectionStats{IndexEntriesByPath: make(map[string]int)}
+	c.db.lock.RLock()
+	defer c.db.lock.RUnlock()
+	if c.db.closed {
+		return stats, ErrDBClosed
+	}
+	// Pending batched writes must be counted.
+	if err := c.db.flushBatch(); err != nil {
+		return stats, err
+	}
+	txn, err := c.db.datastore.NewTransaction(true)
+	if err != nil {
+		return stats, err
+	}
+	defer txn.Discard()
+
+	res, err := txn.Query(query.Query{Prefix: c.BaseKey().String(), KeysOnly: true, ReturnsSizes: true})
+	if err != nil {
+		return stats, err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return stats, r.Error
+		}
+		if !ds.NewKey(r.Key).IsDescendantOf(c.BaseKey()) {
+			continue
+		}
+		stats.Instances++
+		if r.Size > 0 {
+			stats.InstanceBytes += int64(r.Size)
+		}
+	}
+
+	for path := range c.indexes {
+		prefix := indexPrefix.Child(c.BaseKey()).ChildString(path)
+		entries, err := txn.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+		if err != nil {
+			return stats, err
+		}
+		n := 0
+		for e := range entries.Next() {
+			if e.Error != nil {
+				entries.Close()
+				return stats, e.Error
+			}
+			if ds.NewKey(e.Key).IsDescendantOf(prefix) {
+				n++
+			}
+		}
+		entries.Close()
+		stats.IndexEntriesByPath[path] = n
+		stats.IndexEntries += n
+	}
+	return stats, nil
+}
+
 // ReadTxn creates an explicit readonly transaction. Any operation
 // that tries to mutate an instance of the collection will ErrReadonlyTx.
-// Provides serializable isolation gurantees.
+// Provides serializable isolation gurantees: read transactions run
+// concurrently with each other but never with a write transaction or with
+// the dispatch of remote events, so all reads in f see the same committed
+// state and never a partially applied write.
 func (c *Collection) ReadTxn(f func(txn *Txn) error, opts ...TxnOption) error {
 	return c.db.readTxn(c, f, opts...)
 }
 
 // WriteTxn creates an explicit write transaction. Provides
-// serializable isolation gurantees.
+// serializable isolation gurantees. Changes are buffered until f returns
+// and then reduced in a single datastore transaction, so they become
+// visible to other transactions all at once. Reads inside f see the
+// committed state, not the transaction's own pending changes.
 func (c *Collection) WriteTxn(f func(txn *Txn) error, opts ...TxnOption) error {
 	return c.db.writeTxn(c, f, opts...)
 }
@@ -163,16 +688,26 @@ func (c *Collection) WriteTxn(f func(txn *Txn) error, opts ...TxnOption) error {
 // FindByID finds an instance by its ID.
 // If doesn't exists returns ErrNotFound.
 func (c *Collection) FindByID(id core.InstanceID, opts ...TxnOption) (instance []byte, err error) {
-	_ = c.ReadTxn(func(txn *Txn) error {
+	err = c.ReadTxn(func(txn *Txn) error {
 		instance, err = txn.FindByID(id)
 		return err
 	}, opts...)
 	return
 }
 
+// FindByIDs finds instances by their IDs in a single transaction.
+// Results are in the same order as ids, with nil entries for missing instances.
+func (c *Collection) FindByIDs(ids []core.InstanceID, opts ...TxnOption) (instances [][]byte, err error) {
+	err = c.ReadTxn(func(txn *Txn) error {
+		instances, err = txn.FindByIDs(ids)
+		return err
+	}, opts...)
+	return
+}
+
 // Create creates an instance in the collection.
 func (c *Collection) Create(v []byte, opts ...TxnOption) (id core.InstanceID, err error) {
-	_ = c.WriteTxn(func(txn *Txn) error {
+	err = c.WriteTxn(func(txn *Txn) error {
 		var ids []core.InstanceID
 		ids, err = txn.Create(v)
 		if err != nil {
@@ -188,7 +723,7 @@ func (c *Collection) Create(v []byte, opts ...TxnOption) (id core.InstanceID, er
 
 // CreateMany creates multiple instances in the collection.
 func (c *Collection) CreateMany(vs [][]byte, opts ...TxnOption) (ids []core.InstanceID, err error) {
-	_ = c.WriteTxn(func(txn *Txn) error {
+	err = c.WriteTxn(func(txn *Txn) error {
 		ids, err = txn.Create(vs...)
 		return err
 	}, opts...)
@@ -211,6 +746,32 @@ func (c *Collection) DeleteMany(ids []core.InstanceID, opts ...TxnOption) error
 	}, opts...)
 }
 
+// DeleteMatching deletes all instances matching the query in a single
+// transaction, and returns the number of deleted instances.
+func (c *Collection) DeleteMatching(q *Query, opts ...TxnOption) (count int, err error) {
+	err = c.WriteTxn(func(txn *Txn) error {
+		instances, err := txn.Find(q)
+		if err != nil {
+			return err
+		}
+		ids := make([]core.InstanceID, len(instances))
+		for i := range instances {
+			if ids[i], err = c.getInstanceID(instances[i]); err != nil {
+				return err
+			}
+		}
+		if err := txn.Delete(ids...); err != nil {
+			return err
+		}
+		count = len(ids)
+		return nil
+	}, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
 // Save saves changes of an instance in the collection.
 func (c *Collection) Save(v []byte, opts ...TxnOption) error {
 	return c.WriteTxn(func(txn *Txn) error {
@@ -225,10 +786,180 @@ func (c *Collection) SaveMany(vs [][]byte, opts ...TxnOption) error {
 	}, opts...)
 }
 
+// Validate checks an instance the way Create and Save do before writing
+// it, against the collection schema and instance size limit, without
+// opening a transaction. The schema defaults of its missing fields are
+// applied first, as Create does. It returns ErrInvalidSchemaInstance if
+// the instance doesn't match the schema.
+func (c *Collection) Validate(instance []byte) error {
+	c.db.lock.RLock()
+	defer c.db.lock.RUnlock()
+	if c.db.closed {
+		return ErrDBClosed
+	}
+	if len(c.defaults) > 0 {
+		var err error
+		if instance, err = applyDefaults(instance, c.defaults); err != nil {
+			return err
+		}
+	}
+	if err := c.checkInstanceSize(instance); err != nil {
+		return err
+	}
+	valid, err := c.validInstance(instance)
+	if err != nil {
+		return err
+	}
+	if !valid {
+		return ErrInvalidSchemaInstance
+	}
+	return nil
+}
+
+// InvalidInstance is a stored instance which fails validation, see
+// Collection.ValidateAll.
+type InvalidInstance struct {
+	ID core.InstanceID
+	// Errors tell why the instance is invalid.
+	Errors []string
+}
+
+// ValidateAll checks every stored instance the way Validate does, against
+// the current schema and instance size limit, and returns the invalid ones
+// sorted by ID, such as those stored under a prior looser schema. Data isn't
+// modified. Tombstones of soft deleted instances aren't checked. It stops
+// with the error of ctx once it's done.
+// Instances are read from a snapshot without holding the DB lock, which is
+// only held to check batches of them, so writes aren't blocked by the scan.
+func (c *Collection) ValidateAll(ctx context.Context) ([]InvalidInstance, error) {
+	txn, done, err := c.db.scanTxn()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	res, err := txn.Query(query.Query{Prefix: c.BaseKey().String()})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+	var (
+		invalid []InvalidInstance
+		batch   []query.Entry
+	)
+	check := func() error {
+		c.db.lock.RLock()
+		defer c.db.lock.RUnlock()
+		if c.db.closed {
+			return ErrDBClosed
+		}
+		for _, r := range batch {
+			if c.isTombstone(r.Value) {
+				continue
+			}
+			var errs []string
+			if err := c.checkInstanceSize(r.Value); err != nil {
+				errs = append(errs, err.Error())
+			}
+			// Stored instances may not even be JSON, which is reported as
+			// their error.
+			schemaErrs, err := c.instanceErrors(r.Value)
+			if err != nil {
+				schemaErrs = []string{err.Error()}
+			}
+			if errs = append(errs, schemaErrs...); len(errs) > 0 {
+				invalid = append(invalid, InvalidInstance{ID: core.InstanceID(ds.NewKey(r.Key).Name()), Errors: errs})
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	for r := range res.Next() {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if c.db.handlersCtx.Err() != nil {
+			return nil, ErrDBClosed
+		}
+		if r.Error != nil {
+			return nil, r.Error
+		}
+		if !ds.NewKey(r.Key).IsDescendantOf(c.BaseKey()) {
+			continue
+		}
+		if batch = append(batch, r.Entry); len(batch) == validateBatchSize {
+			if err := check(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := check(); err != nil {
+		return nil, err
+	}
+	sort.Slice(invalid, func(i, j int) bool { return invalid[i].ID < invalid[j].ID })
+	return invalid, nil
+}
+
+// Patch applies an RFC 6902 JSON Patch to the instance with id, and saves
+// the result. The instance is read and saved in the same transaction, so
+// the patch isn't affected by concurrent writers.
+func (c *Collection) Patch(id core.InstanceID, patch []byte, opts ...TxnOption) error {
+	return c.WriteTxn(func(txn *Txn) error {
+		return txn.Patch(id, patch)
+	}, opts...)
+}
+
+// MergePatch applies an RFC 7386 JSON Merge Patch to the instance with id,
+// and saves the result, see Txn.MergePatch. Like Patch, the instance is
+// read and saved in the same transaction.
+func (c *Collection) MergePatch(id core.InstanceID, merge []byte, opts ...TxnOption) error {
+	return c.WriteTxn(func(txn *Txn) error {
+		return txn.MergePatch(id, merge)
+	}, opts...)
+}
+
+// Upsert creates the instance if its ID doesn't exist in the collection,
+// or saves it otherwise. Instances without an ID are always created,
+// unless the collection has a primary key the ID is synthesized from.
+// It returns the instance ID, and whether or not it was created.
+func (c *Collection) Upsert(v []byte, opts ...TxnOption) (id core.InstanceID, created bool, err error) {
+	err = c.WriteTxn(func(txn *Txn) error {
+		id, err = c.getInstanceID(v)
+		if err != nil && !errors.Is(err, errMissingInstanceID) {
+			return err
+		}
+		if id == core.EmptyInstanceID && len(c.primaryKey) > 0 {
+			if id, err = c.instanceKeyID(v); err != nil {
+				return err
+			}
+			v = c.setInstanceID(v, id)
+		}
+		if id != core.EmptyInstanceID {
+			exists, err := txn.Has(id)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return txn.Save(v)
+			}
+		}
+		ids, err := txn.Create(v)
+		if err != nil {
+			return err
+		}
+		id, created = ids[0], true
+		return nil
+	}, opts...)
+	if err != nil {
+		return core.EmptyInstanceID, false, err
+	}
+	return id, created, nil
+}
+
 // Has returns true if ID exists in the collection, false
 // otherwise.
 func (c *Collection) Has(id core.InstanceID, opts ...TxnOption) (exists bool, err error) {
-	_ = c.ReadTxn(func(txn *Txn) error {
+	err = c.ReadTxn(func(txn *Txn) error {
 		exists, err = txn.Has(id)
 		return err
 	}, opts...)
@@ -238,31 +969,78 @@ func (c *Collection) Has(id core.InstanceID, opts ...TxnOption) (exists bool, er
 // HasMany returns true if all IDs exist in the collection, false
 // otherwise.
 func (c *Collection) HasMany(ids []core.InstanceID, opts ...TxnOption) (exists bool, err error) {
-	_ = c.ReadTxn(func(txn *Txn) error {
+	err = c.ReadTxn(func(txn *Txn) error {
 		exists, err = txn.Has(ids...)
 		return err
 	}, opts...)
 	return
 }
 
-// Find executes a Query and returns the result.
+// Find executes a Query and returns the result. Results are cached if
+// the DB has a query cache, see WithNewDBQueryCache and WithTxnNoCache.
 func (c *Collection) Find(q *Query, opts ...TxnOption) (instances [][]byte, err error) {
-	_ = c.ReadTxn(func(txn *Txn) error {
-		instances, err = txn.Find(q)
+	err = c.ReadTxn(func(txn *Txn) error {
+		instances, err = c.cachedFind(txn, q)
 		return err
 	}, opts...)
 	return
 }
 
+// compileSchema compiles schema for validation, resolving $ref
+// against the given schema definitions.
+func compileSchema(schema *jsonschema.Schema, definitions map[string]*jsonschema.Schema) (*gojsonschema.Schema, error) {
+	loader := gojsonschema.NewSchemaLoader()
+	for id, def := range definitions {
+		defBytes, err := json.Marshal(def)
+		if err != nil {
+			return nil, err
+		}
+		if err := loader.AddSchema(id, gojsonschema.NewBytesLoader(defBytes)); err != nil {
+			return nil, fmt.Errorf("error adding schema definition %s: %v", id, err)
+		}
+	}
+	schemaBytes, err := json.Marshal(schema)
+	if err != nil {
+		return nil, err
+	}
+	return loader.Compile(gojsonschema.NewBytesLoader(schemaBytes))
+}
+
 // validInstance validates the json object against the collection schema
 func (c *Collection) validInstance(v []byte) (bool, error) {
+	errs, err := c.instanceErrors(v)
+	if err != nil {
+		return false, err
+	}
+	return len(errs) == 0, nil
+}
+
+// instanceErrors returns why v doesn't match the collection schema, or
+// nothing if it does.
+func (c *Collection) instanceErrors(v []byte) ([]string, error) {
+	if c.disallowUnknownFields && c.hasUnknownFields(v) {
+		return []string{"instance has fields missing from the schema"}, nil
+	}
+	if c.timestamps {
+		var err error
+		if v, err = withoutTimestamps(v); err != nil {
+			return nil, err
+		}
+	}
 	var vLoader gojsonschema.JSONLoader
 	vLoader = gojsonschema.NewBytesLoader(v)
-	r, err := gojsonschema.Validate(c.schemaLoader, vLoader)
+	r, err := c.validator.Validate(vLoader)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	if r.Valid() {
+		return nil, nil
 	}
-	return r.Valid(), nil
+	errs := make([]string, len(r.Errors()))
+	for i, e := range r.Errors() {
+		errs[i] = e.String()
+	}
+	return errs, nil
 }
 
 // Sanity check
@@ -273,16 +1051,51 @@ var _ Indexer = (*Collection)(nil)
 type Txn struct {
 	collection *Collection
 	token      thread.Token
+	ctx        context.Context
 	discarded  bool
 	commited   bool
 	readonly   bool
+	noCache    bool
+	// includeDeleted makes FindByID and Has return tombstones, see
+	// WithTxnIncludeDeleted.
+	includeDeleted bool
 
 	actions []core.Action
+	// unique maps the unique index entries claimed by the txn to the
+	// instance keys claiming them.
+	unique map[ds.Key]ds.Key
+	// atomic commits the txn on its own, bypassing write and dispatcher
+	// batching, see ImportInstances.
+	atomic bool
+
+	// queryTimeout bounds the execution time of each query, if not 0.
+	queryTimeout time.Duration
+}
+
+// get returns the value at key, including pending batched writes.
+func (t *Txn) get(key ds.Key) ([]byte, error) {
+	if v, ok := t.collection.db.batch.get(key); ok {
+		if v == nil {
+			return nil, ds.ErrNotFound
+		}
+		return v, nil
+	}
+	return t.collection.db.datastore.Get(key)
+}
+
+// has returns whether key exists, including pending batched writes.
+func (t *Txn) has(key ds.Key) (bool, error) {
+	if v, ok := t.collection.db.batch.get(key); ok {
+		return v != nil, nil
+	}
+	return t.collection.db.datastore.Has(key)
 }
 
 // Create creates new instances in the collection
 // If the ID value on the instance is nil or otherwise a null value (e.g., ""),
 // and ID is generated and used to store the instance.
+// Creating a tombstoned instance replaces its tombstone, which is reported
+// as a save.
 func (t *Txn) Create(new ...[]byte) ([]core.InstanceID, error) {
 	results := make([]core.InstanceID, len(new))
 	for i := range new {
@@ -293,6 +1106,15 @@ func (t *Txn) Create(new ...[]byte) ([]core.InstanceID, error) {
 		updated := make([]byte, len(new[i]))
 		copy(updated, new[i])
 
+		if len(t.collection.defaults) > 0 {
+			var err error
+			if updated, err = applyDefaults(updated, t.collection.defaults); err != nil {
+				return nil, err
+			}
+		}
+		if err := t.collection.checkInstanceSize(updated); err != nil {
+			return nil, err
+		}
 		valid, err := t.collection.validInstance(updated)
 		if err != nil {
 			return nil, err
@@ -301,22 +1123,56 @@ func (t *Txn) Create(new ...[]byte) ([]core.InstanceID, error) {
 			return nil, ErrInvalidSchemaInstance
 		}
 
-		id, err := getInstanceID(updated)
+		id, err := t.collection.getInstanceID(updated)
 		if err != nil && !errors.Is(err, errMissingInstanceID) {
 			return nil, err
 		}
+		if len(t.collection.primaryKey) > 0 {
+			keyID, err := t.collection.instanceKeyID(updated)
+			if err != nil {
+				return nil, err
+			}
+			if id != core.EmptyInstanceID && id != keyID {
+				return nil, ErrPrimaryKeyMismatch
+			}
+			if t.hasCreate(keyID) {
+				return nil, errCantCreateExistingInstance
+			}
+			if id == core.EmptyInstanceID {
+				id = keyID
+				updated = t.collection.setInstanceID(updated, id)
+			}
+		}
 		if id == core.EmptyInstanceID {
-			id, updated = setNewInstanceID(updated)
+			id, err = t.collection.idGenerator(updated)
+			if err != nil {
+				return nil, fmt.Errorf("error generating instance id: %v", err)
+			}
+			if id == core.EmptyInstanceID {
+				return nil, fmt.Errorf("error generating instance id: empty id")
+			}
+			updated = t.collection.setInstanceID(updated, id)
 		}
 		results[i] = id
-		key := baseKey.ChildString(t.collection.name).ChildString(id.String())
-		exists, err := t.collection.db.datastore.Has(key)
-		if err != nil {
+		key := KeyForInstance(t.collection.name, id)
+		previous, err := t.get(key)
+		if err != nil && !errors.Is(err, ds.ErrNotFound) {
 			return nil, err
 		}
-		if exists {
+		if previous != nil && !t.collection.isTombstone(previous) {
 			return nil, errCantCreateExistingInstance
 		}
+		if t.collection.timestamps {
+			if updated, err = stampInstance(updated, nil, time.Now()); err != nil {
+				return nil, err
+			}
+		}
+		if updated, err = CanonicalJSON(updated); err != nil {
+			return nil, err
+		}
+		if err := t.checkUnique(key, updated); err != nil {
+			return nil, err
+		}
 
 		a := core.Action{
 			Type:           core.Create,
@@ -325,6 +1181,11 @@ func (t *Txn) Create(new ...[]byte) ([]core.InstanceID, error) {
 			Previous:       nil,
 			Current:        updated,
 		}
+		if previous != nil {
+			// Creating a tombstoned instance replaces its tombstone.
+			a.Type = core.Save
+			a.Previous = previous
+		}
 		t.actions = append(t.actions, a)
 	}
 	return results, nil
@@ -341,6 +1202,9 @@ func (t *Txn) Save(updated ...[]byte) error {
 		item := make([]byte, len(updated[i]))
 		copy(item, updated[i])
 
+		if err := t.collection.checkInstanceSize(item); err != nil {
+			return err
+		}
 		valid, err := t.collection.validInstance(item)
 		if err != nil {
 			return err
@@ -349,18 +1213,38 @@ func (t *Txn) Save(updated ...[]byte) error {
 			return ErrInvalidSchemaInstance
 		}
 
-		id, err := getInstanceID(item)
+		id, err := t.collection.getInstanceID(item)
 		if err != nil {
 			return err
 		}
-		key := baseKey.ChildString(t.collection.name).ChildString(id.String())
-		beforeBytes, err := t.collection.db.datastore.Get(key)
-		if err == ds.ErrNotFound {
+		if len(t.collection.primaryKey) > 0 {
+			keyID, err := t.collection.instanceKeyID(item)
+			if err != nil {
+				return err
+			}
+			if keyID != id {
+				return ErrPrimaryKeyMismatch
+			}
+		}
+		key := KeyForInstance(t.collection.name, id)
+		beforeBytes, err := t.get(key)
+		if err == ds.ErrNotFound || t.collection.isTombstone(beforeBytes) {
 			return errCantSaveNonExistentInstance
 		}
 		if err != nil {
 			return err
 		}
+		if t.collection.timestamps {
+			if item, err = stampInstance(item, beforeBytes, time.Now()); err != nil {
+				return err
+			}
+		}
+		if item, err = CanonicalJSON(item); err != nil {
+			return err
+		}
+		if err := t.checkUnique(key, item); err != nil {
+			return err
+		}
 
 		t.actions = append(t.actions, core.Action{
 			Type:           core.Save,
@@ -373,15 +1257,84 @@ func (t *Txn) Save(updated ...[]byte) error {
 	return nil
 }
 
+// Patch applies an RFC 6902 JSON Patch to an instance, which is saved
+// when the current transaction commits. The patched instance must be valid
+// against the collection schema, and keep its _id.
+func (t *Txn) Patch(id core.InstanceID, patch []byte) error {
+	if t.readonly {
+		return ErrReadonlyTx
+	}
+	p, err := jsonpatch.DecodePatch(patch)
+	if err != nil {
+		return fmt.Errorf("error decoding json patch: %v", err)
+	}
+	current, err := t.FindByID(id)
+	if err == ErrNotFound {
+		return errCantSaveNonExistentInstance
+	}
+	if err != nil {
+		return err
+	}
+	patched, err := p.Apply(current)
+	if err != nil {
+		return fmt.Errorf("error applying json patch: %v", err)
+	}
+	patchedID, err := t.collection.getInstanceID(patched)
+	if err != nil && err != errMissingInstanceID {
+		return err
+	}
+	if patchedID != id {
+		return errCantChangeInstanceID
+	}
+	return t.Save(patched)
+}
+
+// MergePatch applies an RFC 7386 JSON Merge Patch to an instance, which is
+// saved when the current transaction commits. Fields of merge replace
+// those of the instance, objects are merged recursively, and null fields
+// delete them. The merged instance must be valid against the collection
+// schema, and keep its _id.
+func (t *Txn) MergePatch(id core.InstanceID, merge []byte) error {
+	if t.readonly {
+		return ErrReadonlyTx
+	}
+	current, err := t.FindByID(id)
+	if err == ErrNotFound {
+		return errCantSaveNonExistentInstance
+	}
+	if err != nil {
+		return err
+	}
+	merged, err := jsonpatch.MergePatch(current, merge)
+	if err != nil {
+		return fmt.Errorf("error applying json merge patch: %v", err)
+	}
+	mergedID, err := t.collection.getInstanceID(merged)
+	if err != nil && err != errMissingInstanceID {
+		return err
+	}
+	if mergedID != id {
+		return errCantChangeInstanceID
+	}
+	return t.Save(merged)
+}
+
 // Delete deletes instances by ID when the current
-// transaction commits.
+// transaction commits. Instances of collections with soft deletes are
+// tombstoned instead, see CollectionConfig.SoftDelete.
 func (t *Txn) Delete(ids ...core.InstanceID) error {
 	for i := range ids {
 		if t.readonly {
 			return ErrReadonlyTx
 		}
-		key := baseKey.ChildString(t.collection.name).ChildString(ids[i].String())
-		exists, err := t.collection.db.datastore.Has(key)
+		key := KeyForInstance(t.collection.name, ids[i])
+		if t.collection.softDelete {
+			if err := t.softDelete(ids[i], key); err != nil {
+				return err
+			}
+			continue
+		}
+		exists, err := t.has(key)
 		if err != nil {
 			return err
 		}
@@ -396,16 +1349,18 @@ func (t *Txn) Delete(ids ...core.InstanceID) error {
 			Current:        nil,
 		}
 		t.actions = append(t.actions, a)
+		t.release(key)
 	}
 	return nil
 }
 
 // Has returns true if all IDs exists in the collection, false
-// otherwise.
+// otherwise. Tombstoned instances don't exist unless the txn includes
+// them, see WithTxnIncludeDeleted.
 func (t *Txn) Has(ids ...core.InstanceID) (bool, error) {
 	for i := range ids {
-		key := baseKey.ChildString(t.collection.name).ChildString(ids[i].String())
-		exists, err := t.collection.db.datastore.Has(key)
+		key := KeyForInstance(t.collection.name, ids[i])
+		exists, err := t.exists(key)
 		if err != nil {
 			return false, err
 		}
@@ -416,10 +1371,38 @@ func (t *Txn) Has(ids ...core.InstanceID) (bool, error) {
 	return true, nil
 }
 
-// FindByID gets an instance by ID in the current txn scope.
+// exists returns whether key exists like has, but reports tombstones as
+// missing unless the txn includes them.
+func (t *Txn) exists(key ds.Key) (bool, error) {
+	if !t.collection.softDelete || t.includeDeleted {
+		return t.has(key)
+	}
+	_, err := t.getLive(key)
+	if errors.Is(err, ds.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// getLive returns the value at key like get, but reports tombstones as not
+// found unless the txn includes them.
+func (t *Txn) getLive(key ds.Key) ([]byte, error) {
+	v, err := t.get(key)
+	if err != nil {
+		return nil, err
+	}
+	if !t.includeDeleted && t.collection.isTombstone(v) {
+		return nil, ds.ErrNotFound
+	}
+	return v, nil
+}
+
+// FindByID gets an instance by ID in the current txn scope. Tombstoned
+// instances aren't found unless the txn includes them, see
+// WithTxnIncludeDeleted.
 func (t *Txn) FindByID(id core.InstanceID) ([]byte, error) {
-	key := baseKey.ChildString(t.collection.name).ChildString(id.String())
-	bytes, err := t.collection.db.datastore.Get(key)
+	key := KeyForInstance(t.collection.name, id)
+	bytes, err := t.getLive(key)
 	if errors.Is(err, ds.ErrNotFound) {
 		return nil, ErrNotFound
 	}
@@ -429,6 +1412,135 @@ func (t *Txn) FindByID(id core.InstanceID) ([]byte, error) {
 	return bytes, nil
 }
 
+// checkUnique returns ErrUniqueConstraintViolation if instance, stored at
+// key, has the value of a unique index taken by another instance, either
+// stored, pending in the write batch, or written earlier in the txn, so the
+// violation is reported before the txn commits. Stored index entries of
+// instances the txn or the batch changes or deletes are released, since
+// they aren't reindexed until then.
+func (t *Txn) checkUnique(key ds.Key, instance []byte) error {
+	c := t.collection
+	released := func(owner, indexKey ds.Key) bool {
+		v, ok := t.pending(owner)
+		if !ok {
+			return false
+		}
+		return v == nil || !t.claims(v, indexKey)
+	}
+	claims, err := indexCheckUnique(c, c.idField, c.db.datastore, key, instance, released)
+	if err != nil {
+		return err
+	}
+	for path, indexKeys := range claims {
+		for _, indexKey := range indexKeys {
+			if owner, ok := t.unique[indexKey]; ok && owner != key {
+				return fmt.Errorf("%w: index %s", ErrUniqueConstraintViolation, path)
+			}
+		}
+	}
+	for owner, v := range c.db.batch.pendingValues(c.BaseKey()) {
+		if owner == key || v == nil {
+			continue
+		}
+		if _, ok := t.pendingInTxn(owner); ok {
+			continue
+		}
+		for path, indexKeys := range claims {
+			for _, indexKey := range indexKeys {
+				if t.claims(v, indexKey) {
+					return fmt.Errorf("%w: index %s", ErrUniqueConstraintViolation, path)
+				}
+			}
+		}
+	}
+	if t.unique == nil {
+		t.unique = make(map[ds.Key]ds.Key)
+	}
+	for _, indexKeys := range claims {
+		for _, indexKey := range indexKeys {
+			t.unique[indexKey] = key
+		}
+	}
+	return nil
+}
+
+// claims returns whether instance has the unique index entry indexKey.
+func (t *Txn) claims(instance []byte, indexKey ds.Key) bool {
+	if t.collection.isTombstone(instance) {
+		return false
+	}
+	keys, err := uniqueIndexKeys(t.collection, t.collection.idField, instance)
+	if err != nil {
+		return false
+	}
+	for _, indexKeys := range keys {
+		for _, k := range indexKeys {
+			if k == indexKey {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// pending returns the value the txn, or else the write batch, last wrote
+// for the instance at key, nil if it's deleted, and whether there's one.
+func (t *Txn) pending(key ds.Key) ([]byte, bool) {
+	if v, ok := t.pendingInTxn(key); ok {
+		return v, true
+	}
+	return t.collection.db.batch.get(key)
+}
+
+// pendingInTxn returns the value the txn last wrote for the instance at
+// key, nil if it's deleted, and whether there's one.
+func (t *Txn) pendingInTxn(key ds.Key) ([]byte, bool) {
+	for i := len(t.actions) - 1; i >= 0; i-- {
+		a := t.actions[i]
+		if KeyForInstance(a.CollectionName, a.InstanceID) == key {
+			return a.Current, true
+		}
+	}
+	return nil, false
+}
+
+// release drops the unique index entries of the instance at key, which
+// the txn deletes.
+func (t *Txn) release(key ds.Key) {
+	for indexKey, owner := range t.unique {
+		if owner == key {
+			delete(t.unique, indexKey)
+		}
+	}
+}
+
+// hasCreate returns whether the current txn creates the instance with id.
+func (t *Txn) hasCreate(id core.InstanceID) bool {
+	for _, a := range t.actions {
+		if a.Type == core.Create && a.InstanceID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// FindByIDs gets instances by ID in the current txn scope, in the same
+// order as ids. Entries of missing instances are nil.
+func (t *Txn) FindByIDs(ids []core.InstanceID) ([][]byte, error) {
+	res := make([][]byte, len(ids))
+	for i, id := range ids {
+		instance, err := t.FindByID(id)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res[i] = instance
+	}
+	return res, nil
+}
+
 // Commit applies all changes done in the current transaction
 // to the collection. This is a syncrhonous call so changes can
 // be assumed to be applied on function return.
@@ -436,20 +1548,20 @@ func (t *Txn) Commit() error {
 	if t.discarded || t.commited {
 		return errAlreadyDiscardedCommitedTxn
 	}
-	events, node, err := t.collection.db.eventcodec.Create(t.actions)
-	if err != nil {
-		return err
-	}
-	if len(events) == 0 && node == nil {
-		return nil
+	for i := range t.actions {
+		t.actions[i].SchemaVersion = t.collection.schemaVersion
 	}
-	if len(events) == 0 || node == nil {
-		return fmt.Errorf("created events and node must both be nil or not-nil")
+	d := t.collection.db
+	if t.atomic {
+		if err := d.flushBatch(); err != nil {
+			return err
+		}
+		return d.commitActions(withAtomicDispatch(context.Background()), t.actions, t.token)
 	}
-	if err := t.collection.db.dispatcher.Dispatch(events); err != nil {
-		return err
+	if d.batch != nil {
+		return d.addToBatch(t.actions, t.token)
 	}
-	return t.collection.db.notifyTxnEvents(node, t.token)
+	return d.commitActions(context.Background(), t.actions, t.token)
 }
 
 // Discard discards all changes done in the current
@@ -458,30 +1570,43 @@ func (t *Txn) Discard() {
 	t.discarded = true
 }
 
-func getInstanceID(t []byte) (core.InstanceID, error) {
-	partial := &struct {
-		ID *string `json:"_id"`
-	}{}
-	if err := json.Unmarshal(t, partial); err != nil {
+// getInstanceID returns the ID of instance t, held by the ID field of the
+// collection.
+func (c *Collection) getInstanceID(t []byte) (core.InstanceID, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(t, &fields); err != nil {
 		return core.EmptyInstanceID, fmt.Errorf("error unmarshaling json instance: %v", err)
 	}
-	if partial.ID == nil {
+	var id *string
+	if raw, ok := fields[c.idField]; ok {
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return core.EmptyInstanceID, fmt.Errorf("error unmarshaling json instance: %v", err)
+		}
+	}
+	if id == nil {
 		return core.EmptyInstanceID, errMissingInstanceID
 	}
-	return core.InstanceID(*partial.ID), nil
+	return core.InstanceID(*id), nil
+}
+
+func newRandomInstanceID([]byte) (core.InstanceID, error) {
+	return core.NewInstanceID(), nil
 }
 
-func setNewInstanceID(t []byte) (core.InstanceID, []byte) {
-	newID := core.NewInstanceID()
-	patchedValue, err := jsonpatch.MergePatch(t, []byte(fmt.Sprintf(`{"%s": %q}`, idFieldName, newID.String())))
+func (c *Collection) setInstanceID(t []byte, id core.InstanceID) []byte {
+	patch, err := json.Marshal(map[string]string{c.idField: id.String()})
+	if err != nil {
+		log.Fatalf("error encoding autogenerated _id: %v", err)
+	}
+	patchedValue, err := jsonpatch.MergePatch(t, patch)
 	if err != nil {
 		log.Fatalf("error while automatically patching autogenerated _id: %v", err)
 	}
-	return newID, patchedValue
+	return patchedValue
 }
 
-func hasIDProperty(properties map[string]*jsonschema.Type) bool {
-	idProperty := properties[idFieldName]
+func hasIDProperty(properties map[string]*jsonschema.Type, idField string) bool {
+	idProperty := properties[idField]
 	if idProperty == nil || idProperty.Type != "string" {
 		return false
 	}
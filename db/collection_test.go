@@ -1,14 +1,23 @@
 package db
 
 import (
+	"context"
 	"errors"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	logging "github.com/ipfs/go-log"
 	core "github.com/textileio/go-threads/core/db"
 	"github.com/textileio/go-threads/util"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 const (
@@ -30,6 +39,13 @@ type Comment struct {
 	Body string
 }
 
+type Contact struct {
+	ID     core.InstanceID `json:"_id"`
+	Email  string          `jsonschema:"format=email"`
+	Site   string          `jsonschema:"format=uri"`
+	Joined time.Time
+}
+
 func TestMain(m *testing.M) {
 	_ = logging.SetLogLevel("*", "error")
 	os.Exit(m.Run())
@@ -126,6 +142,278 @@ func TestAddIndex(t *testing.T) {
 			checkErr(t, err)
 		})
 	})
+	t.Run("BuildOnExistingInstances", func(t *testing.T) {
+		t.Parallel()
+		db, clean := createTestDB(t)
+		defer clean()
+		collection, err := db.NewCollection(CollectionConfig{
+			Name:   "Person",
+			Schema: util.SchemaFromInstance(&Person{}, false),
+		})
+		checkErr(t, err)
+		for _, p := range []*Person{{Name: "Alice", Age: 30}, {Name: "Bob", Age: 30}, {Name: "Charlie", Age: 42}} {
+			_, err := collection.Create(util.JSONFromInstance(p))
+			checkErr(t, err)
+		}
+
+		checkErr(t, collection.AddIndex(IndexConfig{Path: "Age"}))
+		res, err := collection.Find(Where("Age").Eq(float64(30)).UseIndex("Age"))
+		checkErr(t, err)
+		if len(res) != 2 {
+			t.Fatalf("expected 2 indexed results, got %d", len(res))
+		}
+		if err := collection.AddIndex(IndexConfig{Path: "Age", Unique: true}); err != ErrUniqueExists {
+			t.Fatalf("expected unique constraint violation, got %v", err)
+		}
+		res, err = collection.Find(Where("Age").Eq(float64(30)).UseIndex("Age"))
+		checkErr(t, err)
+		if len(res) != 2 {
+			t.Fatalf("failed unique index shouldn't alter the existing one, got %d results", len(res))
+		}
+	})
+}
+
+func TestDropIndex(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:    "Person",
+		Schema:  util.SchemaFromInstance(&Person{}, false),
+		Indexes: []IndexConfig{{Path: "Name"}, {Path: "Age"}},
+	})
+	checkErr(t, err)
+	_, err = collection.Create(util.JSONFromInstance(&Person{Name: "Alice", Age: 30}))
+	checkErr(t, err)
+
+	checkErr(t, collection.DropIndex("Name"))
+	if _, ok := collection.Indexes()["Name"]; ok {
+		t.Fatalf("dropped index shouldn't be registered")
+	}
+	if _, ok := collection.Indexes()["Age"]; !ok {
+		t.Fatalf("other indexes should be kept")
+	}
+	if err := collection.DropIndex("Name"); err != ErrNoIndexFound {
+		t.Fatalf("expected no index found error, got %v", err)
+	}
+	if err := collection.DropIndex(idFieldName); err != errCantDropIDIndex {
+		t.Fatalf("expected error when dropping the _id index, got %v", err)
+	}
+	res, err := db.datastore.Query(query.Query{Prefix: indexPrefix.Child(collection.BaseKey()).ChildString("Name").String()})
+	checkErr(t, err)
+	entries, err := res.Rest()
+	checkErr(t, err)
+	if len(entries) != 0 {
+		t.Fatalf("entries of the dropped index should be deleted")
+	}
+
+	// Re-adding the index rebuilds its entries
+	checkErr(t, collection.AddIndex(IndexConfig{Path: "Name"}))
+	found, err := collection.Find(Where("Name").Eq("Alice").UseIndex("Name"))
+	checkErr(t, err)
+	if len(found) != 1 {
+		t.Fatalf("expected 1 indexed result, got %d", len(found))
+	}
+}
+
+func TestAddIndexContext(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+	n := 2*indexBuildBatchSize + 500
+	instances := make([][]byte, n)
+	for i := range instances {
+		name := "Alice"
+		if i%2 == 1 {
+			name = "Bob"
+		}
+		instances[i] = util.JSONFromInstance(&Person{Name: name, Age: i})
+	}
+	_, err = collection.CreateMany(instances)
+	checkErr(t, err)
+
+	// The build is canceled after its first batch, and is resumed.
+	ctx, cancel := context.WithCancel(context.Background())
+	var reports []IndexProgress
+	err = collection.AddIndexContext(ctx, IndexConfig{Path: "Name"}, func(p IndexProgress) {
+		reports = append(reports, p)
+		cancel()
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the build to stop with its context, got %v", err)
+	}
+	if !reflect.DeepEqual(reports, []IndexProgress{{Processed: indexBuildBatchSize, Total: n}}) {
+		t.Fatalf("unexpected progress of the canceled build: %v", reports)
+	}
+	plan, err := collection.Explain(Where("Name").Eq("Bob").UseIndex("Name"))
+	checkErr(t, err)
+	if !plan.FullScan {
+		t.Fatalf("queries shouldn't use unfinished indexes, got %+v", plan)
+	}
+	for _, info := range db.ListCollections() {
+		for _, index := range info.Indexes {
+			if index.Path == "Name" {
+				t.Fatalf("unfinished indexes shouldn't be listed")
+			}
+		}
+	}
+	// Unfinished indexes are registered again when the DB restarts.
+	db.lock.Lock()
+	collection.building = nil
+	delete(collection.indexes, "Name")
+	err = collection.loadIndexBuilds()
+	db.lock.Unlock()
+	checkErr(t, err)
+	if _, ok := collection.Indexes()["Name"]; !ok || !collection.isBuilding("Name") {
+		t.Fatalf("persisted builds should be registered as unfinished indexes")
+	}
+	// Writes maintain unfinished indexes.
+	_, err = collection.Create(util.JSONFromInstance(&Person{Name: "Bob", Age: n}))
+	checkErr(t, err)
+
+	reports = nil
+	checkErr(t, collection.AddIndexContext(context.Background(), IndexConfig{Path: "Name"}, func(p IndexProgress) {
+		reports = append(reports, p)
+	}))
+	expected := []IndexProgress{
+		{Processed: 2 * indexBuildBatchSize, Total: n + 1},
+		{Processed: n + 1, Total: n + 1},
+	}
+	if !reflect.DeepEqual(reports, expected) {
+		t.Fatalf("expected resumed progress %v, got %v", expected, reports)
+	}
+	plan, err = collection.Explain(Where("Name").Eq("Bob").UseIndex("Name"))
+	checkErr(t, err)
+	if !reflect.DeepEqual(plan.Indexes, []string{"Name"}) {
+		t.Fatalf("queries should use built indexes, got %+v", plan)
+	}
+	found, err := collection.Find(Where("Name").Eq("Bob").UseIndex("Name"))
+	checkErr(t, err)
+	if len(found) != n/2+1 {
+		t.Fatalf("expected %d indexed results, got %d", n/2+1, len(found))
+	}
+	checkErr(t, collection.AddIndexContext(context.Background(), IndexConfig{Path: "Name"}, func(IndexProgress) {
+		t.Fatalf("built indexes shouldn't be built again")
+	}))
+
+	// Builds violating a unique constraint are discarded.
+	if err := collection.AddIndexContext(context.Background(), IndexConfig{Path: "Age", Unique: true}, nil); err != nil {
+		t.Fatalf("expected unique ages to be indexed, got %v", err)
+	}
+	err = collection.AddIndexContext(context.Background(), IndexConfig{Path: "Name", Unique: true}, nil)
+	if !errors.Is(err, ErrUniqueExists) {
+		t.Fatalf("expected unique constraint violation, got %v", err)
+	}
+	if _, ok := collection.Indexes()["Name"]; ok || collection.isBuilding("Name") {
+		t.Fatalf("violating builds should be discarded")
+	}
+}
+
+func TestVerifyIndexes(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:    "Person",
+		Schema:  util.SchemaFromInstance(&Person{}, false),
+		Indexes: []IndexConfig{{Path: "Name"}, {Path: "Age"}},
+	})
+	checkErr(t, err)
+	alice, err := collection.Create(util.JSONFromInstance(&Person{Name: "Alice", Age: 30}))
+	checkErr(t, err)
+	bob, err := collection.Create(util.JSONFromInstance(&Person{Name: "Bob", Age: 30}))
+	checkErr(t, err)
+
+	found, err := collection.VerifyIndexes()
+	checkErr(t, err)
+	if len(found) != 0 {
+		t.Fatalf("expected consistent indexes, got %+v", found)
+	}
+
+	// Drop Alice's entry and point Bob's to Alice
+	indexKey := func(path, value string) ds.Key {
+		return indexPrefix.Child(collection.BaseKey()).ChildString(path).ChildString(value)
+	}
+	checkErr(t, db.datastore.Delete(indexKey("Name", "Alice")))
+	stale, err := DefaultEncode(keyList{collection.BaseKey().ChildString(alice.String()).Bytes()})
+	checkErr(t, err)
+	checkErr(t, db.datastore.Put(indexKey("Name", "Bob"), stale))
+
+	found, err = collection.VerifyIndexes()
+	checkErr(t, err)
+	expected := []IndexInconsistency{
+		{Path: "Name", Value: "Alice", InstanceID: alice, Missing: true},
+		{Path: "Name", Value: "Bob", InstanceID: alice, Missing: false},
+		{Path: "Name", Value: "Bob", InstanceID: bob, Missing: true},
+	}
+	sort.Slice(expected, func(i, j int) bool {
+		if expected[i].Value != expected[j].Value {
+			return expected[i].Value < expected[j].Value
+		}
+		return expected[i].InstanceID < expected[j].InstanceID
+	})
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("expected inconsistencies %+v, got %+v", expected, found)
+	}
+
+	checkErr(t, collection.RebuildIndexes())
+	found, err = collection.VerifyIndexes()
+	checkErr(t, err)
+	if len(found) != 0 {
+		t.Fatalf("expected consistent indexes after rebuild, got %+v", found)
+	}
+	res, err := collection.Find(Where("Name").Eq("Bob").UseIndex("Name"))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected 1 indexed result, got %d", len(res))
+	}
+}
+
+func TestCollectionStats(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:    "Person",
+		Schema:  util.SchemaFromInstance(&Person{}, false),
+		Indexes: []IndexConfig{{Path: "Age"}},
+	})
+	checkErr(t, err)
+	other, err := db.NewCollection(CollectionConfig{
+		Name:   "PersonOther",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+	var size int64
+	for _, p := range []*Person{{Name: "Alice", Age: 30}, {Name: "Bob", Age: 30}, {Name: "Carol", Age: 40}} {
+		id, err := collection.Create(util.JSONFromInstance(p))
+		checkErr(t, err)
+		instance, err := collection.FindByID(id)
+		checkErr(t, err)
+		size += int64(len(instance))
+	}
+	_, err = other.Create(util.JSONFromInstance(&Person{Name: "Dave"}))
+	checkErr(t, err)
+
+	stats, err := collection.Stats()
+	checkErr(t, err)
+	if stats.Instances != 3 {
+		t.Fatalf("expected 3 instances, got %d", stats.Instances)
+	}
+	if stats.InstanceBytes != size {
+		t.Fatalf("expected %d instance bytes, got %d", size, stats.InstanceBytes)
+	}
+	if stats.IndexEntriesByPath[idFieldName] != 3 || stats.IndexEntriesByPath["Age"] != 2 {
+		t.Fatalf("unexpected index entries by path: %v", stats.IndexEntriesByPath)
+	}
+	if stats.IndexEntries != 5 {
+		t.Fatalf("expected 5 index entries, got %d", stats.IndexEntries)
+	}
 }
 
 func TestCreateInstance(t *testing.T) {
@@ -230,6 +518,34 @@ func TestCreateInstance(t *testing.T) {
 			t.Fatal("shouldn't create already existing instance")
 		}
 	})
+
+	t.Run("WithIDGenerator", func(t *testing.T) {
+		t.Parallel()
+		db, clean := createTestDB(t)
+		defer clean()
+		m, err := db.NewCollection(CollectionConfig{
+			Name:   "Person",
+			Schema: util.SchemaFromInstance(&Person{}, false),
+			IDGenerator: func(instance []byte) (core.InstanceID, error) {
+				p := &Person{}
+				util.InstanceFromJSON(instance, p)
+				return core.InstanceID(strings.ToLower(p.Name)), nil
+			},
+		})
+		checkErr(t, err)
+
+		res, err := m.Create(util.JSONFromInstance(Person{Name: "Foo", Age: 42}))
+		checkErr(t, err)
+		if res != "foo" {
+			t.Fatalf("expected generated id foo, got %s", res)
+		}
+		assertPersonInCollection(t, m, util.JSONFromInstance(Person{ID: res, Name: "Foo", Age: 42}))
+
+		_, err = m.Create(util.JSONFromInstance(Person{Name: "Foo", Age: 43}))
+		if !errors.Is(err, errCantCreateExistingInstance) {
+			t.Fatal("generated ids should still be unique")
+		}
+	})
 }
 
 func TestReadTxnValidation(t *testing.T) {
@@ -463,71 +779,1225 @@ func TestSaveInstance(t *testing.T) {
 	})
 }
 
-func TestDeleteInstance(t *testing.T) {
+func TestValidateAll(t *testing.T) {
 	t.Parallel()
-
 	db, clean := createTestDB(t)
 	defer clean()
 	collection, err := db.NewCollection(CollectionConfig{
-		Name:   "Person",
-		Schema: util.SchemaFromInstance(&Person{}, false),
+		Name:       "Person",
+		Schema:     util.SchemaFromInstance(&Person{}, false),
+		SoftDelete: true,
 	})
 	checkErr(t, err)
-
-	newPerson := util.JSONFromInstance(Person{Name: "Alice", Age: 42})
-	var res []core.InstanceID
-	err = collection.WriteTxn(func(txn *Txn) (err error) {
-		res, err = txn.Create(newPerson)
-		return
+	ids, err := collection.CreateMany([][]byte{
+		util.JSONFromInstance(&Person{Name: "Alice", Age: 30}),
+		util.JSONFromInstance(&Person{Name: "Bob", Age: 40}),
 	})
 	checkErr(t, err)
-
-	err = collection.Delete(res[0])
+	checkErr(t, collection.Delete(ids[1]))
+	invalid, err := collection.ValidateAll(context.Background())
 	checkErr(t, err)
+	if len(invalid) != 0 {
+		t.Fatalf("expected valid instances, got %v", invalid)
+	}
 
-	_, err = collection.FindByID(res[0])
-	if err != ErrNotFound {
-		t.Fatalf("FindByID: instance shouldn't exist")
+	// Instances stored under a looser schema, or not even JSON.
+	wrongType := core.NewInstanceID()
+	checkErr(t, db.datastore.Put(KeyForInstance("Person", wrongType), []byte(`{"_id":"`+wrongType.String()+`","Name":42,"Age":1}`)))
+	broken := core.NewInstanceID()
+	checkErr(t, db.datastore.Put(KeyForInstance("Person", broken), []byte(`{"_id":`)))
+	invalid, err = collection.ValidateAll(context.Background())
+	checkErr(t, err)
+	if len(invalid) != 2 {
+		t.Fatalf("expected 2 invalid instances, got %v", invalid)
 	}
-	if exist, err := collection.Has(res[0]); exist || err != nil {
-		t.Fatalf("Has: instance shouldn't exist")
+	byID := map[core.InstanceID][]string{invalid[0].ID: invalid[0].Errors, invalid[1].ID: invalid[1].Errors}
+	if errs := byID[wrongType]; len(errs) != 1 || !strings.Contains(errs[0], "Name") {
+		t.Fatalf("expected a Name type error, got %v", errs)
+	}
+	if errs := byID[broken]; len(errs) != 1 {
+		t.Fatalf("expected broken JSON to be reported, got %v", errs)
+	}
+	if _, err := collection.FindByID(ids[0]); err != nil {
+		t.Fatalf("validation shouldn't modify data, got %v", err)
 	}
 
-	// Try to delete again
-	if err = collection.Delete(res[0]); err != ErrNotFound {
-		t.Fatalf("cant't delete non-existent instance")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := collection.ValidateAll(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected validation to stop with its context, got %v", err)
 	}
 }
 
-type PersonFake struct {
-	ID   core.InstanceID
-	Name string
+func TestPatchInstance(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:    "Person",
+		Schema:  util.SchemaFromInstance(&Person{}, false),
+		Indexes: []IndexConfig{{Path: "Age"}},
+	})
+	checkErr(t, err)
+	id, err := collection.Create(util.JSONFromInstance(&Person{Name: "Alice", Age: 30}))
+	checkErr(t, err)
+
+	checkErr(t, collection.Patch(id, []byte(`[{"op": "replace", "path": "/Age", "value": 31}]`)))
+	instance, err := collection.FindByID(id)
+	checkErr(t, err)
+	p := &Person{}
+	util.InstanceFromJSON(instance, p)
+	if p.Name != "Alice" || p.Age != 31 {
+		t.Fatalf("unexpected patched instance %+v", p)
+	}
+	found, err := collection.Find(Where("Age").Eq(float64(31)).UseIndex("Age"))
+	checkErr(t, err)
+	if len(found) != 1 {
+		t.Fatalf("patched instance should be indexed, got %d results", len(found))
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := map[string]string{
+			"BadPatch":    `{"op": "replace"}`,
+			"FailedTest":  `[{"op": "test", "path": "/Age", "value": 30}]`,
+			"InvalidType": `[{"op": "replace", "path": "/Age", "value": "old"}]`,
+			"ChangedID":   `[{"op": "replace", "path": "/_id", "value": "other"}]`,
+			"RemovedID":   `[{"op": "remove", "path": "/_id"}]`,
+		}
+		for name, patch := range tests {
+			if err := collection.Patch(id, []byte(patch)); err == nil {
+				t.Fatalf("%s: patch should fail", name)
+			}
+		}
+		if err := collection.Patch(core.NewInstanceID(), []byte(`[]`)); err != errCantSaveNonExistentInstance {
+			t.Fatalf("expected non existent instance error, got %v", err)
+		}
+		instance, err := collection.FindByID(id)
+		checkErr(t, err)
+		util.InstanceFromJSON(instance, p)
+		if p.Age != 31 {
+			t.Fatalf("failed patches shouldn't change the instance")
+		}
+	})
 }
 
-func TestInvalidActions(t *testing.T) {
+func TestMergePatchInstance(t *testing.T) {
 	t.Parallel()
-
 	db, clean := createTestDB(t)
 	defer clean()
 	collection, err := db.NewCollection(CollectionConfig{
-		Name:   "Person",
-		Schema: util.SchemaFromInstance(&Person{}, false),
+		Name:    "Profile",
+		Schema:  util.SchemaFromInstance(&Profile{}, false),
+		Indexes: []IndexConfig{{Path: "Age"}},
 	})
 	checkErr(t, err)
-	t.Run("Create", func(t *testing.T) {
-		f := util.JSONFromInstance(PersonFake{Name: "fake"})
-		if _, err := collection.Create(f); !errors.Is(err, ErrInvalidSchemaInstance) {
-			t.Fatalf("instance should be invalid compared to schema, got: %v", err)
+	id, err := collection.Create(util.JSONFromInstance(&Profile{
+		Name: "Alice",
+		Age:  30,
+		Home: &Address{City: "Berlin", Street: "Main"},
+	}))
+	checkErr(t, err)
+
+	tests := []struct {
+		name     string
+		merge    string
+		expected Profile
+	}{
+		{"SetField", `{"Age": 31}`, Profile{Name: "Alice", Age: 31, Home: &Address{City: "Berlin", Street: "Main"}}},
+		{"NestedMerge", `{"Home": {"City": "Lisbon"}}`, Profile{Name: "Alice", Age: 31, Home: &Address{City: "Lisbon", Street: "Main"}}},
+		{"NestedNull", `{"Home": {"Street": null}}`, Profile{Name: "Alice", Age: 31, Home: &Address{City: "Lisbon"}}},
+		{"Null", `{"Age": null, "Home": null}`, Profile{Name: "Alice"}},
+	}
+	for _, tc := range tests {
+		checkErr(t, collection.MergePatch(id, []byte(tc.merge)))
+		instance, err := collection.FindByID(id)
+		checkErr(t, err)
+		got := Profile{}
+		util.InstanceFromJSON(instance, &got)
+		tc.expected.ID = id
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Fatalf("%s: expected %+v, got %s", tc.name, tc.expected, instance)
+		}
+	}
+	found, err := collection.Find(Where("Age").Eq(float64(31)).UseIndex("Age"))
+	checkErr(t, err)
+	if len(found) != 0 {
+		t.Fatalf("deleted fields should be unindexed, got %d results", len(found))
+	}
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := map[string]string{
+			"BadJSON":     `{"Age": `,
+			"InvalidType": `{"Age": "old"}`,
+			"ChangedID":   `{"_id": "other"}`,
+			"RemovedID":   `{"_id": null}`,
+		}
+		for name, merge := range tests {
+			if err := collection.MergePatch(id, []byte(merge)); err == nil {
+				t.Fatalf("%s: merge patch should fail", name)
+			}
+		}
+		if err := collection.MergePatch(core.NewInstanceID(), []byte(`{}`)); err != errCantSaveNonExistentInstance {
+			t.Fatalf("expected non existent instance error, got %v", err)
+		}
+		instance, err := collection.FindByID(id)
+		checkErr(t, err)
+		if string(instance) != `{"Name":"Alice","_id":"`+id.String()+`"}` {
+			t.Fatalf("failed merge patches shouldn't change the instance, got %s", instance)
 		}
 	})
-	t.Run("Save", func(t *testing.T) {
-		r := util.JSONFromInstance(Person{Name: "real"})
-		_, err := collection.Create(r)
+}
+
+func TestMaxInstanceBytes(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:             "Person",
+		Schema:           util.SchemaFromInstance(&Person{}, false),
+		MaxInstanceBytes: 100,
+	})
+	checkErr(t, err)
+	large := strings.Repeat("a", 100)
+
+	if _, err := collection.Create(util.JSONFromInstance(Person{Name: large})); !errors.Is(err, ErrInstanceTooLarge) {
+		t.Fatalf("expected create of large instance to fail, got %v", err)
+	}
+	id, err := collection.Create(util.JSONFromInstance(Person{Name: "Alice", Age: 30}))
+	checkErr(t, err)
+	if err := collection.Save(util.JSONFromInstance(Person{ID: id, Name: large})); !errors.Is(err, ErrInstanceTooLarge) {
+		t.Fatalf("expected save of large instance to fail, got %v", err)
+	}
+	patch := []byte(`[{"op": "replace", "path": "/Name", "value": "` + large + `"}]`)
+	if err := collection.Patch(id, patch); !errors.Is(err, ErrInstanceTooLarge) {
+		t.Fatalf("expected patch to a large instance to fail, got %v", err)
+	}
+	if info := db.ListCollections(); info[0].MaxInstanceBytes != 100 {
+		t.Fatalf("expected max instance bytes to be reported, got %d", info[0].MaxInstanceBytes)
+	}
+
+	t.Run("Remote", func(t *testing.T) {
+		current, err := collection.FindByID(id)
 		checkErr(t, err)
-		f := util.JSONFromInstance(PersonFake{Name: "fake"})
-		if err := collection.Save(f); !errors.Is(err, ErrInvalidSchemaInstance) {
-			t.Fatalf("instance should be invalid compared to schema, got: %v", err)
+		newID := core.NewInstanceID()
+		events, _, err := db.eventcodec.Create([]core.Action{{
+			Type:           core.Save,
+			InstanceID:     id,
+			CollectionName: "Person",
+			Previous:       current,
+			Current:        util.JSONFromInstance(Person{ID: id, Name: large}),
+		}, {
+			Type:           core.Create,
+			InstanceID:     newID,
+			CollectionName: "Person",
+			Current:        util.JSONFromInstance(Person{ID: newID, Name: large}),
+		}})
+		checkErr(t, err)
+		l, err := db.Listen(ListenOption{Collection: "Person"})
+		checkErr(t, err)
+		defer l.Close()
+		checkErr(t, db.dispatch(context.Background(), events))
+		select {
+		case a := <-l.Channel():
+			t.Fatalf("dropped remote changes shouldn't be notified, got %+v", a)
+		case <-time.After(100 * time.Millisecond):
 		}
+
+		instance, err := collection.FindByID(id)
+		checkErr(t, err)
+		p := &Person{}
+		util.InstanceFromJSON(instance, p)
+		if p.Name != "Alice" {
+			t.Fatalf("large remote save shouldn't be applied")
+		}
+		if _, err := collection.FindByID(newID); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("large remote create shouldn't be applied, got %v", err)
+		}
+
+		// Sizes are checked once instances are canonical.
+		padded := core.NewInstanceID()
+		events, _, err = db.eventcodec.Create([]core.Action{{
+			Type:           core.Create,
+			InstanceID:     padded,
+			CollectionName: "Person",
+			Current:        []byte(`{"_id": "` + padded.String() + `", "Name": "Bob",` + strings.Repeat(" ", 100) + `"Age": 40}`),
+		}})
+		checkErr(t, err)
+		checkErr(t, db.dispatch(context.Background(), events))
+		if _, err := collection.FindByID(padded); err != nil {
+			t.Fatalf("remote create fitting once canonical should be applied, got %v", err)
+		}
+	})
+}
+
+func TestTimestamps(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:       "Person",
+		Schema:     util.SchemaFromInstance(&Person{}, false),
+		Timestamps: true,
+	})
+	checkErr(t, err)
+	start := time.Now().UnixNano()
+
+	alice, err := collection.Create(util.JSONFromInstance(Person{Name: "Alice"}))
+	checkErr(t, err)
+	bob, err := collection.Create(util.JSONFromInstance(Person{Name: "Bob"}))
+	checkErr(t, err)
+	instance, err := collection.FindByID(alice)
+	checkErr(t, err)
+	created := gjson.GetBytes(instance, "_created").Int()
+	if created < start || gjson.GetBytes(instance, "_mod").Int() != created {
+		t.Fatalf("unexpected timestamps of created instance: %s", instance)
+	}
+
+	saved := time.Now().UnixNano()
+	updated, err := sjson.SetBytes(instance, "Age", 42)
+	checkErr(t, err)
+	checkErr(t, collection.Save(updated))
+	instance, err = collection.FindByID(alice)
+	checkErr(t, err)
+	if gjson.GetBytes(instance, "_created").Int() != created || gjson.GetBytes(instance, "_mod").Int() < saved {
+		t.Fatalf("unexpected timestamps of saved instance: %s", instance)
+	}
+
+	res, err := collection.Find(Where("_mod").Ge(float64(saved)))
+	checkErr(t, err)
+	if len(res) != 1 || gjson.GetBytes(res[0], "_id").String() != alice.String() {
+		t.Fatalf("expected the modified instance")
+	}
+	res, err = collection.Find(OrderBy("_mod"))
+	checkErr(t, err)
+	if len(res) != 2 || gjson.GetBytes(res[0], "_id").String() != bob.String() {
+		t.Fatalf("expected instances sorted by modification time")
+	}
+
+	t.Run("Remote", func(t *testing.T) {
+		id := core.NewInstanceID()
+		current := []byte(`{"_id": "` + id.String() + `", "Name": "Carol", "Age": 0, "_created": 1, "_mod": 2}`)
+		events, _, err := db.eventcodec.Create([]core.Action{{
+			Type:           core.Create,
+			InstanceID:     id,
+			CollectionName: "Person",
+			Current:        current,
+		}})
+		checkErr(t, err)
+		checkErr(t, db.dispatch(context.Background(), events))
+		instance, err := collection.FindByID(id)
+		checkErr(t, err)
+		if gjson.GetBytes(instance, "_created").Int() != 1 || gjson.GetBytes(instance, "_mod").Int() != 2 {
+			t.Fatalf("remote instances should keep the times of their events: %s", instance)
+		}
+	})
+}
+
+type Membership struct {
+	ID     core.InstanceID `json:"_id"`
+	Tenant string
+	User   int
+	Role   string
+}
+
+func TestPrimaryKey(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	if _, err := db.NewCollection(CollectionConfig{
+		Name:        "Membership",
+		Schema:      util.SchemaFromInstance(&Membership{}, false),
+		PrimaryKey:  []string{"Tenant", "User"},
+		IDGenerator: func([]byte) (core.InstanceID, error) { return core.NewInstanceID(), nil },
+	}); err == nil {
+		t.Fatalf("primary keys shouldn't be combined with id generators")
+	}
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:       "Membership",
+		Schema:     util.SchemaFromInstance(&Membership{}, false),
+		PrimaryKey: []string{"Tenant", "User"},
+	})
+	checkErr(t, err)
+
+	id, err := collection.Create(util.JSONFromInstance(Membership{Tenant: "acme:east", User: 7, Role: "admin"}))
+	checkErr(t, err)
+	keyID, err := collection.KeyID("acme:east", 7)
+	checkErr(t, err)
+	if id != keyID {
+		t.Fatalf("expected _id %s synthesized from the primary key, got %s", keyID, id)
+	}
+	other, err := collection.Create(util.JSONFromInstance(Membership{Tenant: "acme", User: 7}))
+	checkErr(t, err)
+	if other == id {
+		t.Fatalf("instances with different primary keys should have different IDs")
+	}
+	if _, err := collection.Create(util.JSONFromInstance(Membership{Tenant: "acme:east", User: 7})); !errors.Is(err, errCantCreateExistingInstance) {
+		t.Fatalf("instances with the same primary key shouldn't be created twice, got %v", err)
+	}
+	if _, err := collection.CreateMany([][]byte{
+		util.JSONFromInstance(Membership{Tenant: "globex", User: 1}),
+		util.JSONFromInstance(Membership{Tenant: "globex", User: 1}),
+	}); !errors.Is(err, errCantCreateExistingInstance) {
+		t.Fatalf("a txn shouldn't create the same primary key twice, got %v", err)
+	}
+	if _, err := collection.Create(util.JSONFromInstance(Membership{ID: core.NewInstanceID(), Tenant: "globex", User: 2})); !errors.Is(err, ErrPrimaryKeyMismatch) {
+		t.Fatalf("expected an _id mismatch, got %v", err)
+	}
+
+	instance, err := collection.FindByKey([]interface{}{"acme:east", 7})
+	checkErr(t, err)
+	m := &Membership{}
+	util.InstanceFromJSON(instance, m)
+	if m.ID != id || m.Role != "admin" {
+		t.Fatalf("unexpected instance found by key: %s", instance)
+	}
+	if _, err := collection.FindByKey([]interface{}{"acme:east", 8}); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected instance to be missing, got %v", err)
+	}
+	if _, err := collection.FindByKey([]interface{}{"acme:east"}); err == nil {
+		t.Fatalf("incomplete primary keys should be rejected")
+	}
+
+	m.Role = "owner"
+	checkErr(t, collection.Save(util.JSONFromInstance(m)))
+	m.User = 8
+	if err := collection.Save(util.JSONFromInstance(m)); !errors.Is(err, ErrPrimaryKeyMismatch) {
+		t.Fatalf("primary key fields shouldn't change, got %v", err)
+	}
+
+	upserted, created, err := collection.Upsert(util.JSONFromInstance(Membership{Tenant: "acme:east", User: 7, Role: "guest"}))
+	checkErr(t, err)
+	if created || upserted != id {
+		t.Fatalf("upserting an existing primary key should save its instance")
+	}
+	instance, err = collection.FindByKey([]interface{}{"acme:east", 7})
+	checkErr(t, err)
+	if gjson.GetBytes(instance, "Role").String() != "guest" {
+		t.Fatalf("expected upserted instance, got %s", instance)
+	}
+}
+
+func TestCanonicalJSON(t *testing.T) {
+	t.Parallel()
+	for in, want := range map[string]string{
+		`{"b": 1.0, "a": [2e0, "<x>"]}`:   `{"a":[2,"<x>"],"b":1}`,
+		`{"n": 12345678901234567890123}`:  `{"n":12345678901234567890123}`,
+		` {"z": {"y": 0.50, "x": null}} `: `{"z":{"x":null,"y":0.5}}`,
+	} {
+		got, err := CanonicalJSON([]byte(in))
+		checkErr(t, err)
+		if string(got) != want {
+			t.Fatalf("expected canonical form %s, got %s", want, got)
+		}
+	}
+	if _, err := CanonicalJSON([]byte(`{"a": 1} {}`)); err == nil {
+		t.Fatalf("trailing data should be rejected")
+	}
+
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+	id, err := collection.Create([]byte(`{"Name": "Alice", "Age": 30.0, "_id": ""}`))
+	checkErr(t, err)
+	instance, err := collection.FindByID(id)
+	checkErr(t, err)
+	if want := `{"Age":30,"Name":"Alice","_id":"` + id.String() + `"}`; string(instance) != want {
+		t.Fatalf("expected stored instance %s, got %s", want, instance)
+	}
+	checkErr(t, collection.Save([]byte(`{"_id": "`+id.String()+`", "Name": "Alice & Bob", "Age": 3.1e1}`)))
+	instance, err = collection.FindByID(id)
+	checkErr(t, err)
+	if want := `{"Age":31,"Name":"Alice & Bob","_id":"` + id.String() + `"}`; string(instance) != want {
+		t.Fatalf("expected saved instance %s, got %s", want, instance)
+	}
+	res, err := collection.Find(Where("Age").Eq(float64(31)))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected the saved instance to be found")
+	}
+
+	t.Run("Remote", func(t *testing.T) {
+		id := core.NewInstanceID()
+		events, _, err := db.eventcodec.Create([]core.Action{{
+			Type:           core.Create,
+			InstanceID:     id,
+			CollectionName: "Person",
+			Current:        []byte(`{"_id": "` + id.String() + `", "Name": "Carol", "Age": 4.0}`),
+		}})
+		checkErr(t, err)
+		checkErr(t, db.dispatch(context.Background(), events))
+		instance, err := collection.FindByID(id)
+		checkErr(t, err)
+		if want := `{"Age":4,"Name":"Carol","_id":"` + id.String() + `"}`; string(instance) != want {
+			t.Fatalf("expected remote instance %s, got %s", want, instance)
+		}
+	})
+}
+
+type Account struct {
+	ID       core.InstanceID `json:"_id"`
+	Email    string
+	Org      string
+	Username string
+}
+
+func TestUniqueConstraints(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Account",
+		Schema: util.SchemaFromInstance(&Account{}, false),
+		Indexes: []IndexConfig{
+			{Path: "Email", Unique: true},
+			{Path: "Org,Username", Unique: true},
+		},
+	})
+	checkErr(t, err)
+	if err := collection.AddIndex(IndexConfig{Path: "Org,Email", Multikey: true}); err == nil {
+		t.Fatalf("compound indexes shouldn't be multikey")
+	}
+	id, err := collection.Create(util.JSONFromInstance(Account{Email: "alice@textile.io", Org: "textile", Username: "alice"}))
+	checkErr(t, err)
+	_, err = collection.Create(util.JSONFromInstance(Account{Email: "bob@textile.io", Org: "textile", Username: "bob"}))
+	checkErr(t, err)
+	_, err = collection.Create(util.JSONFromInstance(Account{Email: "alice@acme.io", Org: "acme", Username: "alice"}))
+	checkErr(t, err)
+
+	t.Run("Single", func(t *testing.T) {
+		_, err := collection.Create(util.JSONFromInstance(Account{Email: "alice@textile.io", Org: "other", Username: "other"}))
+		if !errors.Is(err, ErrUniqueConstraintViolation) {
+			t.Fatalf("expected unique constraint violation, got %v", err)
+		}
+		err = collection.Save(util.JSONFromInstance(Account{ID: id, Email: "bob@textile.io", Org: "textile", Username: "alice"}))
+		if !errors.Is(err, ErrUniqueConstraintViolation) {
+			t.Fatalf("expected unique constraint violation on save, got %v", err)
+		}
+		checkErr(t, collection.Save(util.JSONFromInstance(Account{ID: id, Email: "alice@textile.io", Org: "textile", Username: "alice"})))
+	})
+	t.Run("Compound", func(t *testing.T) {
+		_, err := collection.Create(util.JSONFromInstance(Account{Email: "other@textile.io", Org: "textile", Username: "bob"}))
+		if !errors.Is(err, ErrUniqueConstraintViolation) {
+			t.Fatalf("expected compound unique constraint violation, got %v", err)
+		}
+		if _, err := collection.Find(Where("Org").Eq("textile").UseIndex("Org,Username")); err == nil {
+			t.Fatalf("compound indexes shouldn't be used by queries")
+		}
+	})
+	t.Run("SameTxn", func(t *testing.T) {
+		err := collection.WriteTxn(func(txn *Txn) error {
+			_, err := txn.Create(
+				util.JSONFromInstance(Account{Email: "carol@textile.io", Org: "textile", Username: "carol"}),
+				util.JSONFromInstance(Account{Email: "carol@textile.io", Org: "textile", Username: "carol2"}),
+			)
+			return err
+		})
+		if !errors.Is(err, ErrUniqueConstraintViolation) {
+			t.Fatalf("expected unique constraint violation within the txn, got %v", err)
+		}
+		exists, err := collection.Find(Where("Email").Eq("carol@textile.io"))
+		checkErr(t, err)
+		if len(exists) != 0 {
+			t.Fatalf("the violating txn shouldn't be applied")
+		}
+		// Values of instances deleted in the txn can be taken.
+		checkErr(t, collection.WriteTxn(func(txn *Txn) error {
+			if err := txn.Delete(id); err != nil {
+				return err
+			}
+			_, err := txn.Create(util.JSONFromInstance(Account{Email: "alice@textile.io", Org: "textile", Username: "alice"}))
+			return err
+		}))
+		// So can values of instances changed earlier in the txn.
+		dave, err := collection.Create(util.JSONFromInstance(Account{Email: "dave@textile.io", Org: "textile", Username: "dave"}))
+		checkErr(t, err)
+		checkErr(t, collection.WriteTxn(func(txn *Txn) error {
+			if err := txn.Save(util.JSONFromInstance(Account{ID: dave, Email: "dave@acme.io", Org: "acme", Username: "dave"})); err != nil {
+				return err
+			}
+			_, err := txn.Create(util.JSONFromInstance(Account{Email: "dave@textile.io", Org: "textile", Username: "dave"}))
+			return err
+		}))
+	})
+	t.Run("Batched", func(t *testing.T) {
+		db, clean := createTestDB(t, WithNewDBWriteBatching(100, 0))
+		defer clean()
+		collection, err := db.NewCollection(CollectionConfig{
+			Name:    "Account",
+			Schema:  util.SchemaFromInstance(&Account{}, false),
+			Indexes: []IndexConfig{{Path: "Email", Unique: true}},
+		})
+		checkErr(t, err)
+		id, err := collection.Create(util.JSONFromInstance(Account{Email: "alice@textile.io"}))
+		checkErr(t, err)
+		_, err = collection.Create(util.JSONFromInstance(Account{Email: "alice@textile.io"}))
+		if !errors.Is(err, ErrUniqueConstraintViolation) {
+			t.Fatalf("expected unique constraint violation of a batched write, got %v", err)
+		}
+		checkErr(t, db.Flush())
+		checkErr(t, collection.Save(util.JSONFromInstance(Account{ID: id, Email: "alice@acme.io"})))
+		_, err = collection.Create(util.JSONFromInstance(Account{Email: "alice@textile.io"}))
+		checkErr(t, err)
+		_, err = collection.Create(util.JSONFromInstance(Account{Email: "alice@acme.io"}))
+		if !errors.Is(err, ErrUniqueConstraintViolation) {
+			t.Fatalf("expected unique constraint violation of a batched save, got %v", err)
+		}
+		checkErr(t, db.Flush())
+	})
+}
+
+func TestUpsertInstance(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+
+	t.Run("CreateWithoutID", func(t *testing.T) {
+		p := util.JSONFromInstance(Person{Name: "Alice", Age: 42})
+		id, created, err := collection.Upsert(p)
+		checkErr(t, err)
+		if !created {
+			t.Fatal("instance without id should be created")
+		}
+		assertPersonInCollection(t, collection, util.SetJSONID(id, p))
+	})
+	t.Run("CreateWithID", func(t *testing.T) {
+		p := util.JSONFromInstance(Person{ID: core.NewInstanceID(), Name: "Bob", Age: 43})
+		_, created, err := collection.Upsert(p)
+		checkErr(t, err)
+		if !created {
+			t.Fatal("instance with unknown id should be created")
+		}
+		assertPersonInCollection(t, collection, p)
+	})
+	t.Run("Save", func(t *testing.T) {
+		id, err := collection.Create(util.JSONFromInstance(Person{Name: "Charlie", Age: 44}))
+		checkErr(t, err)
+		p := util.JSONFromInstance(Person{ID: id, Name: "Charlie", Age: 45})
+		upsertedID, created, err := collection.Upsert(p)
+		checkErr(t, err)
+		if created || upsertedID != id {
+			t.Fatal("existing instance should be saved")
+		}
+		assertPersonInCollection(t, collection, p)
+	})
+}
+
+func TestNewCollectionFromType(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollectionFromType("Person", &Person{}, []IndexConfig{{Path: "Age"}})
+	checkErr(t, err)
+	_, err = c.Create(util.JSONFromInstance(Person{Name: "Alice", Age: 42}))
+	checkErr(t, err)
+	res, err := c.Find(Where("Age").Eq(float64(42)).UseIndex("Age"))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected 1 instance, got %d", len(res))
+	}
+	if _, err := c.Create([]byte(`{"_id": "other", "Age": "old"}`)); !errors.Is(err, ErrInvalidSchemaInstance) {
+		t.Fatalf("instances should be validated against the reflected schema, got %v", err)
+	}
+
+	type Employee struct {
+		Person
+		Role string
+	}
+	_, err = db.NewCollectionFromType("Employee", Employee{}, nil)
+	checkErr(t, err)
+
+	type NoID struct {
+		ID   core.InstanceID
+		Name string
+	}
+	if _, err := db.NewCollectionFromType("NoID", NoID{}, nil); !errors.Is(err, ErrInvalidCollectionSchema) {
+		t.Fatalf("expected ErrInvalidCollectionSchema, got %v", err)
+	}
+	type IntID struct {
+		ID int `json:"_id"`
+	}
+	if _, err := db.NewCollectionFromType("IntID", IntID{}, nil); !errors.Is(err, ErrInvalidCollectionSchema) {
+		t.Fatalf("expected ErrInvalidCollectionSchema, got %v", err)
+	}
+	if _, err := db.NewCollectionFromType("Invalid", "string", nil); err == nil {
+		t.Fatalf("non-struct types should be rejected")
+	}
+}
+
+func TestTypedCollection(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	tc, err := db.NewTypedCollection(CollectionConfig{
+		Name:    "Person",
+		Indexes: []IndexConfig{{Path: "Age"}},
+	}, Person{})
+	checkErr(t, err)
+
+	alice := &Person{Name: "Alice", Age: 42}
+	id, err := tc.Create(alice)
+	checkErr(t, err)
+	if alice.ID != id {
+		t.Fatalf("created id should be set in the instance")
+	}
+	_, err = tc.Create(&Person{Name: "Bob", Age: 43})
+	checkErr(t, err)
+
+	alice.Age = 44
+	checkErr(t, tc.Save(alice))
+	found := &Person{}
+	checkErr(t, tc.FindByID(id, found))
+	if !reflect.DeepEqual(found, alice) {
+		t.Fatalf("expected %+v, got %+v", alice, found)
+	}
+
+	var people []Person
+	checkErr(t, tc.Find(Where("Age").Gt(float64(42)).UseIndex("Age"), &people))
+	if len(people) != 2 {
+		t.Fatalf("expected 2 instances, got %d", len(people))
+	}
+	var ptrs []*Person
+	checkErr(t, tc.Find(Where("Name").Eq("Alice"), &ptrs))
+	if len(ptrs) != 1 || !reflect.DeepEqual(ptrs[0], alice) {
+		t.Fatalf("expected %+v, got %v", alice, ptrs)
+	}
+
+	if _, err := tc.Create(Person{Name: "Charlie"}); err == nil {
+		t.Fatalf("instances must be passed by pointer")
+	}
+	if err := tc.FindByID(id, &Dog{}); err == nil {
+		t.Fatalf("instances of other types should be rejected")
+	}
+	if err := tc.Find(&Query{}, &[]Dog{}); err == nil {
+		t.Fatalf("slices of other types should be rejected")
+	}
+
+	typed, err := db.GetCollection("Person").Typed(&Person{})
+	checkErr(t, err)
+	checkErr(t, typed.Delete(id))
+	if err := tc.FindByID(id, found); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestDeleteInstance(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+
+	newPerson := util.JSONFromInstance(Person{Name: "Alice", Age: 42})
+	var res []core.InstanceID
+	err = collection.WriteTxn(func(txn *Txn) (err error) {
+		res, err = txn.Create(newPerson)
+		return
+	})
+	checkErr(t, err)
+
+	err = collection.Delete(res[0])
+	checkErr(t, err)
+
+	_, err = collection.FindByID(res[0])
+	if err != ErrNotFound {
+		t.Fatalf("FindByID: instance shouldn't exist")
+	}
+	if exist, err := collection.Has(res[0]); exist || err != nil {
+		t.Fatalf("Has: instance shouldn't exist")
+	}
+
+	// Try to delete again
+	if err = collection.Delete(res[0]); err != ErrNotFound {
+		t.Fatalf("cant't delete non-existent instance")
+	}
+}
+
+type PersonFake struct {
+	ID   core.InstanceID
+	Name string
+}
+
+func TestSoftDelete(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:       "Person",
+		Schema:     util.SchemaFromInstance(&Person{}, false),
+		SoftDelete: true,
+	})
+	checkErr(t, err)
+	alice, err := collection.Create(util.JSONFromInstance(&Person{Name: "Alice", Age: 30}))
+	checkErr(t, err)
+	_, err = collection.Create(util.JSONFromInstance(&Person{Name: "Bob", Age: 40}))
+	checkErr(t, err)
+
+	l, err := db.Listen(ListenOption{Collection: "Person", Type: ListenDelete})
+	checkErr(t, err)
+	defer l.Close()
+	checkErr(t, collection.Delete(alice))
+	select {
+	case a := <-l.Channel():
+		if a.Type != ActionDelete || a.ID != alice {
+			t.Fatalf("expected a delete action, got %+v", a)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("soft deletes should be reported to delete listeners")
+	}
+
+	if _, err := collection.FindByID(alice); err != ErrNotFound {
+		t.Fatalf("expected not found error finding a tombstoned instance, got %v", err)
+	}
+	instance, err := collection.FindByID(alice, WithTxnIncludeDeleted())
+	checkErr(t, err)
+	if !isTombstone(instance) {
+		t.Fatalf("deleted instance should be tombstoned, got %s", instance)
+	}
+	instances, err := collection.FindByIDs([]core.InstanceID{alice})
+	checkErr(t, err)
+	if instances[0] != nil {
+		t.Fatalf("tombstoned instance shouldn't be found by ids, got %s", instances[0])
+	}
+	if exists, err := collection.Has(alice); err != nil || exists {
+		t.Fatalf("tombstoned instance shouldn't exist, got %v, %v", exists, err)
+	}
+	if exists, err := collection.Has(alice, WithTxnIncludeDeleted()); err != nil || !exists {
+		t.Fatalf("tombstoned instance should exist with deleted ones, got %v, %v", exists, err)
+	}
+	found, err := collection.Find(&Query{})
+	checkErr(t, err)
+	if len(found) != 1 {
+		t.Fatalf("expected 1 instance without tombstones, got %d", len(found))
+	}
+	found, err = collection.Find((&Query{}).WithDeleted())
+	checkErr(t, err)
+	if len(found) != 2 {
+		t.Fatalf("expected 2 instances with tombstones, got %d", len(found))
+	}
+	if err := collection.Save(util.JSONFromInstance(&Person{ID: alice, Name: "Alice"})); err != errCantSaveNonExistentInstance {
+		t.Fatalf("expected error saving a tombstoned instance, got %v", err)
+	}
+	if err := collection.Delete(alice); err != ErrNotFound {
+		t.Fatalf("expected not found error deleting a tombstoned instance, got %v", err)
+	}
+
+	count, err := collection.Purge(time.Now().Add(-time.Hour))
+	checkErr(t, err)
+	if count != 0 {
+		t.Fatalf("recent tombstones shouldn't be purged, got %d", count)
+	}
+	count, err = collection.Purge(time.Now().Add(time.Second))
+	checkErr(t, err)
+	if count != 1 {
+		t.Fatalf("expected 1 purged tombstone, got %d", count)
+	}
+	if _, err := collection.FindByID(alice); err != ErrNotFound {
+		t.Fatalf("purged instance shouldn't exist, got %v", err)
+	}
+	found, err = collection.Find((&Query{}).WithDeleted())
+	checkErr(t, err)
+	if len(found) != 1 {
+		t.Fatalf("expected 1 instance after purge, got %d", len(found))
+	}
+
+	// Creating a tombstoned instance replaces its tombstone.
+	bob, err := collection.Create(util.JSONFromInstance(&Person{Name: "Bob", Age: 20}))
+	checkErr(t, err)
+	checkErr(t, collection.Delete(bob))
+	_, err = collection.Create(util.JSONFromInstance(&Person{ID: bob, Name: "Bob", Age: 21}))
+	checkErr(t, err)
+	instance, err = collection.FindByID(bob)
+	checkErr(t, err)
+	if isTombstone(instance) || !strings.Contains(string(instance), `"Age":21`) {
+		t.Fatalf("created instance should replace the tombstone, got %s", instance)
+	}
+	checkErr(t, collection.Delete(bob))
+	id, created, err := collection.Upsert(util.JSONFromInstance(&Person{ID: bob, Name: "Bob", Age: 22}))
+	checkErr(t, err)
+	if id != bob || !created {
+		t.Fatalf("upserting a tombstoned instance should create it, got %s, %v", id, created)
+	}
+}
+
+func TestFindByIDs(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+	ids, err := c.CreateMany([][]byte{
+		util.JSONFromInstance(Person{Name: "Foo1"}),
+		util.JSONFromInstance(Person{Name: "Foo2"}),
+	})
+	checkErr(t, err)
+
+	missing := core.NewInstanceID()
+	res, err := c.FindByIDs([]core.InstanceID{ids[1], missing, ids[0]})
+	checkErr(t, err)
+	if len(res) != 3 || res[1] != nil {
+		t.Fatalf("expected 3 results with a nil entry for the missing id, got %v", res)
+	}
+	for i, name := range map[int]string{0: "Foo2", 2: "Foo1"} {
+		p := &Person{}
+		util.InstanceFromJSON(res[i], p)
+		if p.Name != name {
+			t.Fatalf("expected %s at position %d, got %s", name, i, p.Name)
+		}
+	}
+}
+
+func TestTxnContext(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := c.Create(util.JSONFromInstance(Person{Name: "Foo"}), WithTxnContext(ctx)); err != context.Canceled {
+			t.Fatalf("expected canceled error, got %v", err)
+		}
+		if _, err := c.Find(&Query{}, WithTxnContext(ctx)); err != context.Canceled {
+			t.Fatalf("expected canceled error, got %v", err)
+		}
+	})
+	t.Run("LockTimeout", func(t *testing.T) {
+		db.lock.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+		defer cancel()
+		_, err := c.Create(util.JSONFromInstance(Person{Name: "Foo"}), WithTxnContext(ctx))
+		db.lock.Unlock()
+		if err != context.DeadlineExceeded {
+			t.Fatalf("expected deadline exceeded error, got %v", err)
+		}
+		res, err := c.Find(&Query{})
+		checkErr(t, err)
+		if len(res) != 0 {
+			t.Fatalf("aborted transaction shouldn't create instances")
+		}
+	})
+	t.Run("Done", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		id, err := c.Create(util.JSONFromInstance(Person{Name: "Foo"}), WithTxnContext(ctx))
+		checkErr(t, err)
+		_, err = c.FindByID(id, WithTxnContext(ctx))
+		checkErr(t, err)
+	})
+}
+
+func TestTxnIsolation(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+	ids, err := c.CreateMany([][]byte{
+		util.JSONFromInstance(Person{Name: "Foo1"}),
+		util.JSONFromInstance(Person{Name: "Foo2"}),
+	})
+	checkErr(t, err)
+
+	// The writer always saves both instances with the same age in a single
+	// transaction, so readers must never see them differ.
+	const writes = 50
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 1; i <= writes; i++ {
+			err := c.WriteTxn(func(txn *Txn) error {
+				vs := make([][]byte, len(ids))
+				for j, id := range ids {
+					vs[j] = util.JSONFromInstance(Person{ID: id, Name: "Foo", Age: i})
+				}
+				return txn.Save(vs...)
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var ages []int
+				err := c.ReadTxn(func(txn *Txn) error {
+					res, err := txn.FindByIDs(ids)
+					if err != nil {
+						return err
+					}
+					for _, r := range res {
+						p := &Person{}
+						util.InstanceFromJSON(r, p)
+						ages = append(ages, p.Age)
+					}
+					res, err = txn.Find(&Query{})
+					if err != nil {
+						return err
+					}
+					for _, r := range res {
+						p := &Person{}
+						util.InstanceFromJSON(r, p)
+						ages = append(ages, p.Age)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, a := range ages {
+					if a != ages[0] {
+						t.Errorf("read txn saw a partial write: %v", ages)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestDeleteMatching(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:    "Person",
+		Schema:  util.SchemaFromInstance(&Person{}, false),
+		Indexes: []IndexConfig{{Path: "Age"}},
+	})
+	checkErr(t, err)
+
+	var ids []core.InstanceID
+	for i := 0; i < 5; i++ {
+		id, err := collection.Create(util.JSONFromInstance(Person{Name: "Alice", Age: 40 + i}))
+		checkErr(t, err)
+		ids = append(ids, id)
+	}
+
+	count, err := collection.DeleteMatching(Where("Age").Ge(float64(42)))
+	checkErr(t, err)
+	if count != 3 {
+		t.Fatalf("expected 3 deleted instances, got %d", count)
+	}
+	for i, id := range ids {
+		exists, err := collection.Has(id)
+		checkErr(t, err)
+		if exists != (i < 2) {
+			t.Fatalf("instance %s has wrong existence after delete: %v", id, exists)
+		}
+	}
+	res, err := collection.Find(Where("Age").Ge(float64(0)).UseIndex("Age"))
+	checkErr(t, err)
+	if len(res) != 2 {
+		t.Fatalf("index entries of deleted instances should be removed, got %d results", len(res))
+	}
+
+	count, err = collection.DeleteMatching(Where("Age").Ge(float64(42)))
+	checkErr(t, err)
+	if count != 0 {
+		t.Fatalf("expected no deleted instances, got %d", count)
+	}
+}
+
+func TestInvalidActions(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&Person{}, false),
+	})
+	checkErr(t, err)
+	t.Run("Create", func(t *testing.T) {
+		f := util.JSONFromInstance(PersonFake{Name: "fake"})
+		if _, err := collection.Create(f); !errors.Is(err, ErrInvalidSchemaInstance) {
+			t.Fatalf("instance should be invalid compared to schema, got: %v", err)
+		}
+	})
+	t.Run("Save", func(t *testing.T) {
+		r := util.JSONFromInstance(Person{Name: "real"})
+		_, err := collection.Create(r)
+		checkErr(t, err)
+		f := util.JSONFromInstance(PersonFake{Name: "fake"})
+		if err := collection.Save(f); !errors.Is(err, ErrInvalidSchemaInstance) {
+			t.Fatalf("instance should be invalid compared to schema, got: %v", err)
+		}
+	})
+	t.Run("Validate", func(t *testing.T) {
+		f := util.JSONFromInstance(PersonFake{Name: "fake"})
+		if err := collection.Validate(f); !errors.Is(err, ErrInvalidSchemaInstance) {
+			t.Fatalf("instance should be invalid compared to schema, got: %v", err)
+		}
+		r := util.JSONFromInstance(Person{Name: "valid"})
+		checkErr(t, collection.Validate(r))
+		res, err := collection.Find(Where("Name").Eq("valid"))
+		checkErr(t, err)
+		if len(res) != 0 {
+			t.Fatalf("validated instances shouldn't be written")
+		}
+	})
+}
+
+func TestFormatValidation(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Contact",
+		Schema: util.SchemaFromInstance(&Contact{}, false),
+	})
+	checkErr(t, err)
+
+	valid := map[string]interface{}{
+		"_id":    "",
+		"Email":  "alice@textile.io",
+		"Site":   "https://textile.io",
+		"Joined": "2020-06-01T12:00:00Z",
+	}
+	id, err := collection.Create(util.JSONFromInstance(valid))
+	checkErr(t, err)
+
+	tests := map[string]string{
+		"Email":  "alice.textile.io",
+		"Site":   "textile.io",
+		"Joined": "June 1st",
+	}
+	for field, value := range tests {
+		instance := map[string]interface{}{}
+		for k, v := range valid {
+			instance[k] = v
+		}
+		instance[field] = value
+		t.Run(field, func(t *testing.T) {
+			if err := collection.Validate(util.JSONFromInstance(instance)); !errors.Is(err, ErrInvalidSchemaInstance) {
+				t.Fatalf("instance with invalid %s should be invalid, got: %v", field, err)
+			}
+			if _, err := collection.Create(util.JSONFromInstance(instance)); !errors.Is(err, ErrInvalidSchemaInstance) {
+				t.Fatalf("instance with invalid %s should be rejected, got: %v", field, err)
+			}
+			instance["_id"] = id.String()
+			if err := collection.Save(util.JSONFromInstance(instance)); !errors.Is(err, ErrInvalidSchemaInstance) {
+				t.Fatalf("instance with invalid %s should be rejected, got: %v", field, err)
+			}
+		})
+	}
+}
+
+type Profile struct {
+	ID   core.InstanceID `json:"_id"`
+	Name string          `json:",omitempty" jsonschema:"default=anonymous"`
+	Age  int             `json:",omitempty" jsonschema:"default=18"`
+	Home *Address        `json:",omitempty"`
+}
+
+type Address struct {
+	City   string `json:",omitempty" jsonschema:"default=Berlin"`
+	Street string `json:",omitempty"`
+}
+
+func TestSchemaDefaults(t *testing.T) {
+	t.Parallel()
+
+	db, clean := createTestDB(t)
+	defer clean()
+	collection, err := db.NewCollection(CollectionConfig{
+		Name:   "Profile",
+		Schema: util.SchemaFromInstance(&Profile{}, false),
+	})
+	checkErr(t, err)
+
+	tests := map[string]struct {
+		instance string
+		expected Profile
+	}{
+		"Missing":  {`{"_id": ""}`, Profile{Name: "anonymous", Age: 18}},
+		"Provided": {`{"_id": "", "Name": "Alice", "Age": 30}`, Profile{Name: "Alice", Age: 30}},
+		"Nested":   {`{"_id": "", "Home": {"Street": "Main"}}`, Profile{Name: "anonymous", Age: 18, Home: &Address{City: "Berlin", Street: "Main"}}},
+		"NestedProvided": {
+			`{"_id": "", "Age": 0, "Home": {"City": "Lisbon"}}`,
+			Profile{Name: "anonymous", Home: &Address{City: "Lisbon"}},
+		},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			id, err := collection.Create([]byte(tc.instance))
+			checkErr(t, err)
+			res, err := collection.FindByID(id)
+			checkErr(t, err)
+			got := Profile{}
+			util.InstanceFromJSON(res, &got)
+			tc.expected.ID = id
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("expected %+v, got %s", tc.expected, res)
+			}
+
+			// Defaults only apply to creates.
+			checkErr(t, collection.Save([]byte(`{"_id": "`+id.String()+`"}`)))
+			res, err = collection.FindByID(id)
+			checkErr(t, err)
+			if string(res) != `{"_id":"`+id.String()+`"}` {
+				t.Fatalf("saves shouldn't apply defaults, got %s", res)
+			}
+		})
+	}
+
+	t.Run("Validate", func(t *testing.T) {
+		type Required struct {
+			ID   core.InstanceID `json:"_id"`
+			Name string          `jsonschema:"default=anonymous"`
+		}
+		collection, err := db.NewCollection(CollectionConfig{
+			Name:   "Required",
+			Schema: util.SchemaFromInstance(&Required{}, false),
+		})
+		checkErr(t, err)
+		instance := []byte(`{"_id": ""}`)
+		checkErr(t, collection.Validate(instance))
+		_, err = collection.Create(instance)
+		checkErr(t, err)
 	})
 }
 
@@ -7,6 +7,7 @@ import (
 
 	datastore "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
+	dssync "github.com/ipfs/go-datastore/sync"
 	core "github.com/textileio/go-threads/core/db"
 )
 
@@ -27,13 +28,29 @@ func (d *TxMapDatastore) NewTransaction(_ bool) (datastore.Txn, error) {
 	return NewSimpleTx(d), nil
 }
 
+// memTxnDatastore is a thread-safe in-memory TxnDatastore.
+// Transactions buffer writes until commit, without isolation from other
+// transactions, which is enough since the DB serializes its writes.
+type memTxnDatastore struct {
+	*dssync.MutexDatastore
+}
+
+func newInMemoryDatastore() datastore.TxnDatastore {
+	return &memTxnDatastore{MutexDatastore: dssync.MutexWrap(datastore.NewMapDatastore())}
+}
+
+func (d *memTxnDatastore) NewTransaction(_ bool) (datastore.Txn, error) {
+	return NewSimpleTx(d), nil
+}
+
 type op struct {
 	delete bool
 	value  []byte
 }
 
 // SimpleTx implements the transaction interface for datastores who do
-// not have any sort of underlying transactional support
+// not have any sort of underlying transactional support. Gets see the
+// writes of the transaction, but queries only see committed data.
 type SimpleTx struct {
 	ops    map[datastore.Key]op
 	lock   sync.RWMutex
@@ -56,18 +73,33 @@ func (bt *SimpleTx) Query(q query.Query) (query.Results, error) {
 func (bt *SimpleTx) Get(k datastore.Key) ([]byte, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
+	if op, ok := bt.ops[k]; ok {
+		if op.delete {
+			return nil, datastore.ErrNotFound
+		}
+		return op.value, nil
+	}
 	return bt.target.Get(k)
 }
 
 func (bt *SimpleTx) Has(k datastore.Key) (bool, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
+	if op, ok := bt.ops[k]; ok {
+		return !op.delete, nil
+	}
 	return bt.target.Has(k)
 }
 
 func (bt *SimpleTx) GetSize(k datastore.Key) (int, error) {
 	bt.lock.RLock()
 	defer bt.lock.RUnlock()
+	if op, ok := bt.ops[k]; ok {
+		if op.delete {
+			return -1, datastore.ErrNotFound
+		}
+		return len(op.value), nil
+	}
 	return bt.target.GetSize(k)
 }
 
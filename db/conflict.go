@@ -0,0 +1,135 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+// ConflictResolver decides the state of an instance when an event from
+// another peer overwrites a local change the peer may not have seen. current
+// is the local state and incoming is the state the event would produce; the
+// returned bytes become the new state of the instance.
+// Resolutions are local: they aren't dispatched as events, so other peers
+// keep the incoming state, and peers with different resolvers, or none,
+// don't converge.
+type ConflictResolver func(collection string, id core.InstanceID, current, incoming []byte) ([]byte, error)
+
+var dsDBLocalChanges = dsDBPrefix.ChildString("localchanges")
+
+type ctxKey string
+
+// withRemoteEvents marks ctx as dispatching events received from the network.
+func withRemoteEvents(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKey("remote"), true)
+}
+
+func remoteEvents(ctx context.Context) bool {
+	remote, _ := ctx.Value(ctxKey("remote")).(bool)
+	return remote
+}
+
+func localChangeKey(collection string, id core.InstanceID) ds.Key {
+	return dsDBLocalChanges.ChildString(collection).ChildString(id.String())
+}
+
+// localChangesIndexFunc wraps indexFunc to track instances whose state comes
+// from local events, which remote saves conflict with. It's only used by DBs
+// with a conflict resolver.
+func localChangesIndexFunc(
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+	return func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+		if err := indexFunc(collection, key, oldData, newData, txn); err != nil {
+			return err
+		}
+		lkey := localChangeKey(collection, core.InstanceID(key.BaseNamespace()))
+		if newData == nil {
+			return txn.Delete(lkey)
+		}
+		return txn.Put(lkey, nil)
+	}
+}
+
+// resolveConflictsIndexFunc wraps indexFunc so that remote saves of an
+// instance with a local change, or in DBs with federated threads, last
+// written from another thread than origin, are passed through resolve
+// before being indexed. Resolved states are written in the reducer's txn,
+// replacing the incoming state. The local change is kept unless the
+// incoming state wins.
+func resolveConflictsIndexFunc(
+	d *DB,
+	resolve ConflictResolver,
+	origin thread.ID,
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+	return func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+		id := core.InstanceID(key.BaseNamespace())
+		lkey := localChangeKey(collection, id)
+		if oldData == nil || newData == nil {
+			if err := indexFunc(collection, key, oldData, newData, txn); err != nil {
+				return err
+			}
+			return txn.Delete(lkey)
+		}
+		c := d.getCollection(collection)
+		if c == nil {
+			return ErrCollectionNotFound
+		}
+		conflict, err := txn.Has(lkey)
+		if err != nil {
+			return err
+		}
+		if !conflict && d.feedThreads != nil {
+			if conflict, err = d.otherOrigin(txn, collection, id, origin); err != nil {
+				return err
+			}
+		}
+		if !conflict {
+			return indexFunc(collection, key, oldData, newData, txn)
+		}
+		resolved, err := resolve(collection, id, oldData, newData)
+		if err != nil {
+			return fmt.Errorf("error resolving conflict: %v", err)
+		}
+		if bytes.Equal(resolved, newData) {
+			if err := indexFunc(collection, key, oldData, newData, txn); err != nil {
+				return err
+			}
+			return txn.Delete(lkey)
+		}
+		valid, err := c.validInstance(resolved)
+		if err != nil {
+			return err
+		}
+		if !valid {
+			return ErrInvalidSchemaInstance
+		}
+		if err := txn.Put(key, resolved); err != nil {
+			return err
+		}
+		return indexFunc(collection, key, oldData, resolved, txn)
+	}
+}
+
+// otherOrigin returns whether the instance was last written from another
+// thread than origin.
+func (d *DB) otherOrigin(txn ds.Txn, collection string, id core.InstanceID, origin thread.ID) (bool, error) {
+	b, err := txn.Get(originKey(collection, id))
+	if errors.Is(err, ds.ErrNotFound) {
+		return origin != d.connector.ThreadID(), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	last, err := thread.Cast(b)
+	if err != nil {
+		return false, err
+	}
+	return last != origin, nil
+}
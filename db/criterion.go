@@ -25,6 +25,7 @@ package db
 // Code has multiple changes compared to original, but still merits proper mentioning.
 
 import (
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"time"
@@ -40,6 +41,11 @@ const (
 	ge           // >=
 	le           // <=
 	fn           // func
+	eqFold       // case-insensitive ==
+	hasPrefix    // string prefix
+	regex        // regular expression
+	contains     // array element ==
+	present      // field presence
 )
 
 type errTypeMismatch struct {
@@ -279,6 +285,16 @@ func compare(value, other interface{}) (int, error) {
 			return -1, nil
 		}
 		return 1, nil
+	case json.Number:
+		v, ok := numberRat(t)
+		if !ok {
+			return 0, &errTypeMismatch{t, other}
+		}
+		o, ok := numberRat(other)
+		if !ok {
+			return 0, &errTypeMismatch{t, other}
+		}
+		return v.Cmp(o), nil
 	case string:
 		tother, ok := other.(string)
 		if !ok {
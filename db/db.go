@@ -7,10 +7,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/alecthomas/jsonschema"
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
 	kt "github.com/ipfs/go-datastore/keytransform"
 	"github.com/ipfs/go-datastore/query"
@@ -24,24 +27,42 @@ import (
 	lstore "github.com/textileio/go-threads/core/logstore"
 	"github.com/textileio/go-threads/core/net"
 	"github.com/textileio/go-threads/core/thread"
+	sym "github.com/textileio/go-threads/crypto/symmetric"
 	"github.com/textileio/go-threads/util"
+	"github.com/xeipuuv/gojsonschema"
 )
 
 const (
-	idFieldName            = "_id"
+	idFieldName = "_id"
+	// getBlockRetries and getBlockInitialTimeout drive the fallback fetch
+	// of record blocks, which waits 0.5s, 1s and 2s between attempts. Both
+	// the attempts and the waits are bounded by the record timeout, so a
+	// slow link needs a timeout that fits the attempts it should make.
 	getBlockRetries        = 3
 	getBlockInitialTimeout = time.Millisecond * 500
+	defaultCloseTimeout    = time.Second * 10
 )
 
 var (
 	log = logging.Logger("db")
 
 	// ErrInvalidCollectionSchema indicates the provided schema isn't valid for a Collection.
-	ErrInvalidCollectionSchema = errors.New("the collection schema should specify an _id string property")
+	ErrInvalidCollectionSchema = errors.New("the collection schema should specify an _id string property, or one named by CollectionConfig.IDField")
+	// ErrCollectionNotFound indicates the collection isn't registered in the DB.
+	ErrCollectionNotFound = errors.New("collection not found")
+	// ErrDBClosed indicates the DB was closed.
+	ErrDBClosed = errors.New("db is closed")
+	// ErrReadOnly indicates the DB is read-only and rejects local writes.
+	ErrReadOnly = errors.New("db is read-only")
+	// ErrUnauthorized indicates the token doesn't grant the scope an operation
+	// needs over a collection, see thread.NewScopedToken.
+	ErrUnauthorized = errors.New("token isn't authorized")
 
 	dsDBPrefix  = ds.NewKey("/db")
 	dsDBSchemas = dsDBPrefix.ChildString("schema")
 	dsDBIndexes = dsDBPrefix.ChildString("index")
+
+	dsDBSchemaDefinitions = dsDBPrefix.ChildString("definitions")
 )
 
 // DB is the aggregate-root of events and state. External/remote events
@@ -56,13 +77,67 @@ type DB struct {
 	datastore  ds.TxnDatastore
 	dispatcher *dispatcher
 	eventcodec core.EventCodec
+	// eventCodecs are the named codecs collections can select.
+	eventCodecs map[string]core.EventCodec
+	metrics     Metrics
+	log         Logger
+	tracer      Tracer
+
+	conflictResolver   ConflictResolver
+	collectionResolver CollectionResolver
+	// token is used by operations that aren't given a token.
+	token thread.Token
+
+	// handlers tracks in-flight HandleNetRecord calls, background pulls
+	// and scans, which Close waits for up to closeTimeout before canceling
+	// handlersCtx.
+	handlers       sync.WaitGroup
+	handlersCtx    context.Context
+	cancelHandlers context.CancelFunc
+	closeTimeout   time.Duration
+	// recordTimeout overrides the timeout given by the connector to
+	// HandleNetRecord, if positive.
+	recordTimeout time.Duration
+	// recordLimiter throttles HandleNetRecord, if set.
+	recordLimiter *rateLimiter
+	// readOnly rejects write transactions.
+	readOnly bool
+	// queryCacheSize and queryCacheTTL configure collection query caches.
+	queryCacheSize int
+	queryCacheTTL  time.Duration
+	// incompatibleEvents handles remote events of incompatible schemas.
+	incompatibleEvents IncompatibleEventPolicy
+	// readTxns and writeTxns count and bound concurrent transactions.
+	readTxns  *txnLimiter
+	writeTxns *txnLimiter
+	// feeds connect the federated threads, listed in feedThreads.
+	feeds       []*threadFeed
+	feedThreads map[thread.ID]struct{}
+	// clock orders events of instances, if set.
+	clock *lamportClock
+	// durability is whether commits of local writes sync the datastore.
+	durability Durability
+	// queryTimeout is the default execution time bound of queries.
+	queryTimeout time.Duration
+	// lastRecords holds when records of other logs were last received.
+	lastRecords recordTimes
+	// webhooks sends changes of instances to webhooks, if configured.
+	webhooks *webhooks
+	// snapshotSigners are the peers whose snapshots are accepted, besides
+	// the host.
+	snapshotSigners map[peer.ID]struct{}
 
 	lock            sync.RWMutex
 	collectionNames map[string]*Collection
+	definitions     map[string]*jsonschema.Schema
+	readKeys        []*sym.Key
 	closed          bool
+	batch           *writeBatch
 
 	localEventsBus      *app.LocalEventsBus
 	stateChangedNotifee *stateChangedNotifee
+	hooks               dispatchHooks
+	pause               dispatchPause
 }
 
 // NewDB creates a new DB, which will *own* ds and dispatcher for internal use.
@@ -86,6 +161,7 @@ func NewDB(ctx context.Context, network app.Net, id thread.ID, opts ...NewDBOpti
 // NewDBFromAddr creates a new DB from a thread hosted by another peer at address,
 // which will *own* ds and dispatcher for internal use.
 // Saying it differently, ds and dispatcher shouldn't be used externally.
+// The thread is pulled in the background unless WithNewDBBlockOnPull is used.
 func NewDBFromAddr(ctx context.Context, network app.Net, addr ma.Multiaddr, key thread.Key, opts ...NewDBOption) (*DB, error) {
 	options := &NewDBOptions{}
 	for _, opt := range opts {
@@ -98,16 +174,22 @@ func NewDBFromAddr(ctx context.Context, network app.Net, addr ma.Multiaddr, key
 	if err != nil {
 		return nil, err
 	}
+	options.SnapshotSigners = appendAddrPeer(options.SnapshotSigners, addr)
 	d, err := newDB(network, ti.ID, options)
 	if err != nil {
 		return nil, err
 	}
 
-	go func() {
+	if options.BlockOnPull {
 		if err := network.PullThread(ctx, ti.ID, net.WithThreadToken(options.Token)); err != nil {
-			log.Errorf("error pulling thread %s", ti.ID)
+			if err := d.Close(); err != nil {
+				d.log.Errorf("error closing db %s: %v", ti.ID, err)
+			}
+			return nil, fmt.Errorf("error pulling thread %s: %v", ti.ID, err)
 		}
-	}()
+		return d, nil
+	}
+	d.pullThread(options.Token)
 	return d, nil
 }
 
@@ -115,7 +197,7 @@ func NewDBFromAddr(ctx context.Context, network app.Net, addr ma.Multiaddr, key
 // with the same config.
 func newDB(n app.Net, id thread.ID, options *NewDBOptions) (*DB, error) {
 	if options.Datastore == nil {
-		datastore, err := newDefaultDatastore(options.RepoPath, options.LowMem)
+		datastore, err := newDefaultDatastore(options.RepoPath, options.LowMem, options.Durability)
 		if err != nil {
 			return nil, err
 		}
@@ -124,6 +206,18 @@ func newDB(n app.Net, id thread.ID, options *NewDBOptions) (*DB, error) {
 	if options.EventCodec == nil {
 		options.EventCodec = newDefaultEventCodec()
 	}
+	if options.Metrics == nil {
+		options.Metrics = nopMetrics{}
+	}
+	if options.Tracer == nil {
+		options.Tracer = nopTracer{}
+	}
+	if options.Logger == nil {
+		options.Logger = log
+	}
+	if options.CloseTimeout == 0 {
+		options.CloseTimeout = defaultCloseTimeout
+	}
 	if !managedDatastore(options.Datastore) {
 		if options.Debug {
 			if err := util.SetLogLevels(map[string]logging.LogLevel{
@@ -134,17 +228,87 @@ func newDB(n app.Net, id thread.ID, options *NewDBOptions) (*DB, error) {
 		}
 	}
 
+	store := options.Datastore
+	if options.Shards > 0 {
+		var err error
+		if store, err = newShardedDatastore(store, options.Shards, options.ShardFactory); err != nil {
+			return nil, err
+		}
+	}
+	if options.EncryptionKey != nil {
+		var err error
+		if store, err = newEncryptedDatastore(store, options.EncryptionKey); err != nil {
+			return nil, err
+		}
+	}
+
+	dispatcher := newDispatcher(store)
+	dispatcher.batchSize = options.DispatcherBatchSize
+	dispatcher.sync = options.DispatcherSync
+	localEventsBus := app.NewLocalEventsBus(
+		app.WithLocalEventsBuffer(options.LocalEventsBuffer),
+		app.WithLocalEventsPolicy(options.LocalEventsPolicy),
+		app.WithLocalEventsDropped(options.Metrics.LocalEventsDropped),
+	)
 	d := &DB{
-		datastore:           options.Datastore,
-		dispatcher:          newDispatcher(options.Datastore),
+		datastore:           store,
+		dispatcher:          dispatcher,
 		eventcodec:          options.EventCodec,
+		eventCodecs:         options.EventCodecs,
+		metrics:             options.Metrics,
+		tracer:              options.Tracer,
+		conflictResolver:    options.ConflictResolver,
+		collectionResolver:  options.CollectionResolver,
+		token:               options.Token,
+		closeTimeout:        options.CloseTimeout,
+		recordTimeout:       options.RecordTimeout,
+		readOnly:            options.ReadOnly,
+		queryCacheSize:      options.QueryCacheSize,
+		queryCacheTTL:       options.QueryCacheTTL,
+		incompatibleEvents:  options.IncompatibleEvents,
+		readTxns:            newTxnLimiter(options.MaxReadTxns, options.TxnLimitPolicy),
+		writeTxns:           newTxnLimiter(options.MaxWriteTxns, options.TxnLimitPolicy),
+		feedThreads:         newFeedThreads(options.FederatedThreads),
 		collectionNames:     make(map[string]*Collection),
-		localEventsBus:      app.NewLocalEventsBus(),
-		stateChangedNotifee: &stateChangedNotifee{},
+		localEventsBus:      localEventsBus,
+		stateChangedNotifee: &stateChangedNotifee{log: options.Logger, window: options.CoalesceWindow},
+		log:                 options.Logger,
+	}
+	d.handlersCtx, d.cancelHandlers = context.WithCancel(context.Background())
+	d.pause.size = options.PausedQueueSize
+	if d.pause.size == 0 {
+		d.pause.size = defaultPausedQueueSize
+	}
+	if options.RecordRate > 0 {
+		d.recordLimiter = newRateLimiter(options.RecordRate, options.RecordBurst)
+	}
+	if options.BatchSize > 0 {
+		d.batch = newWriteBatch(options.BatchSize, options.BatchInterval)
+	}
+	d.durability = options.Durability
+	d.queryTimeout = options.QueryTimeout
+	if len(options.Webhooks.URLs) > 0 {
+		d.webhooks = newWebhooks(options.Webhooks, id, d.log)
+	}
+	d.snapshotSigners = make(map[peer.ID]struct{}, len(options.SnapshotSigners))
+	for _, s := range options.SnapshotSigners {
+		d.snapshotSigners[s] = struct{}{}
+	}
+	if options.LamportOrdering {
+		clock, err := newLamportClock(store)
+		if err != nil {
+			return nil, err
+		}
+		d.clock = clock
 	}
 	if err := d.reCreateCollections(); err != nil {
 		return nil, err
 	}
+	readKeys, err := d.getReadKeys()
+	if err != nil {
+		return nil, err
+	}
+	d.readKeys = readKeys
 	d.dispatcher.Register(d)
 
 	for _, cc := range options.Collections {
@@ -158,12 +322,26 @@ func newDB(n app.Net, id thread.ID, options *NewDBOptions) (*DB, error) {
 		log.Fatalf("unable to connect app: %s", err)
 	}
 	d.connector = connector
+	if err := d.connectFeeds(n, options.FederatedThreads); err != nil {
+		_ = d.Close()
+		return nil, err
+	}
+	if err := d.initAppliedHeads(context.Background()); err != nil {
+		d.log.Errorf("error initializing applied heads: %v", err)
+	}
 
 	return d, nil
 }
 
-// reCreateCollections loads and registers schemas from the datastore.
+// reCreateCollections loads and registers schema definitions
+// and schemas from the datastore.
 func (d *DB) reCreateCollections() error {
+	definitions, err := d.getSchemaDefinitions()
+	if err != nil {
+		return err
+	}
+	d.definitions = definitions
+
 	results, err := d.datastore.Query(query.Query{
 		Prefix: dsDBSchemas.String(),
 	})
@@ -186,15 +364,61 @@ func (d *DB) reCreateCollections() error {
 			_ = json.Unmarshal(index, &indexes)
 		}
 
-		indexValues := make([]IndexConfig, len(indexes))
+		indexValues := make([]IndexConfig, 0, len(indexes))
 		for _, value := range indexes {
 			indexValues = append(indexValues, value)
 		}
 
+		var eventCodec string
+		codec, err := d.datastore.Get(dsDBEventCodecs.ChildString(name))
+		if err == nil {
+			eventCodec = string(codec)
+		} else if !errors.Is(err, ds.ErrNotFound) {
+			return err
+		}
+		softDelete, err := d.datastore.Has(dsDBSoftDeletes.ChildString(name))
+		if err != nil {
+			return err
+		}
+		maxInstanceBytes, err := d.getMaxInstanceBytes(name)
+		if err != nil {
+			return err
+		}
+		decoding, err := d.getDecodingConfig(name)
+		if err != nil {
+			return err
+		}
+		timestamps, err := d.datastore.Has(dsDBTimestamps.ChildString(name))
+		if err != nil {
+			return err
+		}
+		primaryKey, err := d.getPrimaryKey(name)
+		if err != nil {
+			return err
+		}
+		schemaVersion, err := d.getSchemaVersion(name)
+		if err != nil {
+			return err
+		}
+		idField, err := d.getIDField(name)
+		if err != nil {
+			return err
+		}
+
 		if _, err := d.NewCollection(CollectionConfig{
-			Name:    name,
-			Schema:  schema,
-			Indexes: indexValues,
+			Name:                  name,
+			Schema:                schema,
+			Indexes:               indexValues,
+			EventCodec:            eventCodec,
+			SoftDelete:            softDelete,
+			MaxInstanceBytes:      maxInstanceBytes,
+			UseNumber:             decoding.UseNumber,
+			DisallowUnknownFields: decoding.DisallowUnknownFields,
+			Timestamps:            timestamps,
+			PrimaryKey:            primaryKey,
+			SchemaVersion:         schemaVersion.Version,
+			SchemaCompatibility:   schemaVersion.Compatibility,
+			IDField:               idField,
 		}); err != nil {
 			return err
 		}
@@ -204,21 +428,107 @@ func (d *DB) reCreateCollections() error {
 
 // CollectionConfig describes a new Collection.
 type CollectionConfig struct {
-	Name    string
+	Name string
+	// Schema validates the instances of the collection. String formats,
+	// such as date-time, email or uri, are checked as well, so instances
+	// with malformed values are rejected like any other invalid instance.
+	// Fields missing from created instances take the value of their
+	// default keyword, if any, before validation. Since create events carry
+	// the defaulted instance, peers don't apply defaults themselves.
 	Schema  *jsonschema.Schema
 	Indexes []IndexConfig
+	// IDGenerator produces the _id of instances created without one.
+	// Random ULID based IDs are used if nil. Since it's a function, it isn't
+	// persisted, and should be supplied again when the DB is reopened.
+	IDGenerator IDGenerator
+	// EventCodec is the name of a codec registered with
+	// WithNewDBNamedEventCodec, used for the collection events instead of
+	// the DB default. It's persisted with the collection.
+	EventCodec string
+	// SoftDelete makes deletes tombstone instances, setting their _deleted
+	// field to the deletion time, instead of removing them. Tombstones are
+	// saved like any other change, so peers converge on them, and are
+	// reported to listeners as deletes. Find and GroupBy skip them unless
+	// the query includes deleted instances, and Purge removes them for good.
+	// Saving a tombstoned instance fails as if it didn't exist.
+	// It's persisted with the collection.
+	SoftDelete bool
+	// MaxInstanceBytes bounds the size of the serialized instances of the
+	// collection; writes of larger instances fail with ErrInstanceTooLarge.
+	// Changes from other peers that produce larger instances are ignored,
+	// leaving the local instance as it was. Zero means no limit.
+	// It's persisted with the collection.
+	MaxInstanceBytes int
+	// UseNumber decodes the numbers of instances as json.Number instead of
+	// float64 when matching queries, including the values of index entries,
+	// so large integers don't lose precision. Criteria on numbers are
+	// compared exactly; use a json.Number value for numbers that don't fit
+	// a float64. It's persisted with the collection.
+	UseNumber bool
+	// DisallowUnknownFields rejects instances with top-level fields that
+	// aren't properties of the schema with ErrInvalidSchemaInstance, even
+	// if the schema allows additional properties.
+	// It's persisted with the collection.
+	DisallowUnknownFields bool
+	// Timestamps makes the DB maintain the creation and last modification
+	// times of instances, in Unix nanoseconds, in their _created and _mod
+	// fields, which can be used in queries like any other field. They're
+	// set by Create, Save and deletes of the writing peer and travel in its
+	// events, so other peers see the same times instead of the time they
+	// reduced the events. Values given for them are overwritten, and they
+	// aren't validated against the schema.
+	// It's persisted with the collection.
+	Timestamps bool
+	// PrimaryKey lists fields whose values together identify instances,
+	// such as a tenant and an entity ID. The _id of instances is then
+	// synthesized from them on Create, so instances with the same values
+	// can't be created twice, and Save fails with ErrPrimaryKeyMismatch if
+	// they change. Values must be strings, numbers or booleans. See
+	// Collection.FindByKey. It can't be combined with IDGenerator.
+	// It's persisted with the collection.
+	PrimaryKey []string
+	// SchemaVersion is the version of Schema, which is included in the
+	// events of the collection by codecs supporting it, such as the
+	// default one. Zero means unversioned.
+	// It's persisted with the collection.
+	SchemaVersion int
+	// SchemaCompatibility tells which schema versions of events from
+	// other peers are compatible with SchemaVersion. Incompatible events
+	// are logged, or skipped if the DB rejects them, see
+	// WithNewDBIncompatibleEvents. Events of codecs without versions are
+	// of version 0. It's persisted with the collection.
+	SchemaCompatibility SchemaCompatibility
+	// IDField names the string field holding the ID of instances, which
+	// must be in Schema. It's "_id" by default, and can be changed for
+	// apps that use "_id" for their own semantics, or that interoperate
+	// with systems using another name, such as "id". It can't have index
+	// path syntax, like dots. It's persisted with the collection.
+	IDField string
 }
 
+// IDGenerator returns the InstanceID for a new instance,
+// given the instance being created.
+type IDGenerator func(instance []byte) (core.InstanceID, error)
+
 // NewCollection creates a new collection in the db with a JSON schema.
 func (d *DB) NewCollection(config CollectionConfig) (*Collection, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	if d.closed {
+		return nil, ErrDBClosed
+	}
+	return d.addCollection(config)
+}
+
+// addCollection creates and registers a new collection.
+// The DB lock must be held by the caller.
+func (d *DB) addCollection(config CollectionConfig) (*Collection, error) {
 	if _, ok := d.collectionNames[config.Name]; ok {
 		return nil, fmt.Errorf("already registered collection")
 	}
 
-	c, err := newCollection(config.Name, config.Schema, d)
+	c, err := newCollection(config, d)
 	if err != nil {
 		return nil, err
 	}
@@ -235,39 +545,353 @@ func (d *DB) NewCollection(config CollectionConfig) (*Collection, error) {
 		if err := d.datastore.Put(key, schemaBytes); err != nil {
 			return nil, err
 		}
+		if config.EventCodec != "" {
+			if err := d.datastore.Put(dsDBEventCodecs.ChildString(config.Name), []byte(config.EventCodec)); err != nil {
+				return nil, err
+			}
+		}
+		if config.SoftDelete {
+			if err := d.datastore.Put(dsDBSoftDeletes.ChildString(config.Name), []byte("true")); err != nil {
+				return nil, err
+			}
+		}
+		if config.MaxInstanceBytes > 0 {
+			if err := d.putMaxInstanceBytes(config.Name, config.MaxInstanceBytes); err != nil {
+				return nil, err
+			}
+		}
+		if config.Timestamps {
+			if err := d.datastore.Put(dsDBTimestamps.ChildString(config.Name), []byte("true")); err != nil {
+				return nil, err
+			}
+		}
+		if config.SchemaVersion != 0 || config.SchemaCompatibility != SchemaCompatAny {
+			if err := d.putSchemaVersion(config.Name, schemaVersionConfig{
+				Version:       config.SchemaVersion,
+				Compatibility: config.SchemaCompatibility,
+			}); err != nil {
+				return nil, err
+			}
+		}
+		if len(config.PrimaryKey) > 0 {
+			if err := d.putPrimaryKey(config.Name, config.PrimaryKey); err != nil {
+				return nil, err
+			}
+		}
+		if c.idField != idFieldName {
+			if err := d.putIDField(config.Name, c.idField); err != nil {
+				return nil, err
+			}
+		}
+		if config.UseNumber || config.DisallowUnknownFields {
+			if err := d.putDecodingConfig(config.Name, decodingConfig{
+				UseNumber:             config.UseNumber,
+				DisallowUnknownFields: config.DisallowUnknownFields,
+			}); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	if err := c.AddIndex(IndexConfig{Path: idFieldName, Unique: true}); err != nil {
+	if err := c.addIndex(IndexConfig{Path: c.idField, Unique: true}); err != nil {
 		return nil, err
 	}
 
 	for _, cfg := range config.Indexes {
 		// @todo: Should check to make sure this is a valid field path for this schema
-		if err := c.AddIndex(cfg); err != nil {
+		if err := c.addIndex(cfg); err != nil {
 			return nil, err
 		}
 	}
+	if err := c.loadIndexBuilds(); err != nil {
+		return nil, err
+	}
 
 	d.collectionNames[config.Name] = c
 	return c, nil
 }
 
-// GetCollection returns a collection by name.
+// RegisterSchemaDefinition registers a shared schema document under id,
+// which must be an absolute URI, for collection schemas to reference with
+// $ref (e.g., "<id>#/definitions/Address"). Registering an existing id
+// replaces its definition. Definitions are persisted, and should be
+// registered before the collections that reference them.
+func (d *DB) RegisterSchemaDefinition(id string, schema *jsonschema.Schema) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return ErrDBClosed
+	}
+	if u, err := url.Parse(id); err != nil || !u.IsAbs() {
+		return fmt.Errorf("schema definition id must be an absolute URI")
+	}
+	definitions := make(map[string]*jsonschema.Schema, len(d.definitions)+1)
+	for k, v := range d.definitions {
+		definitions[k] = v
+	}
+	definitions[id] = schema
+
+	// Make sure existing collections still compile with the new definition
+	validators := make(map[string]*gojsonschema.Schema, len(d.collectionNames))
+	for name, c := range d.collectionNames {
+		validator, err := compileSchema(c.schema, definitions)
+		if err != nil {
+			return fmt.Errorf("error compiling schema of collection %s: %v", name, err)
+		}
+		validators[name] = validator
+	}
+	definitionsBytes, err := json.Marshal(definitions)
+	if err != nil {
+		return err
+	}
+	if err := d.datastore.Put(dsDBSchemaDefinitions, definitionsBytes); err != nil {
+		return err
+	}
+	d.definitions = definitions
+	for name, validator := range validators {
+		d.collectionNames[name].validator = validator
+	}
+	return nil
+}
+
+// getSchemaDefinitions returns the persisted schema definitions.
+func (d *DB) getSchemaDefinitions() (map[string]*jsonschema.Schema, error) {
+	definitions := make(map[string]*jsonschema.Schema)
+	definitionsBytes, err := d.datastore.Get(dsDBSchemaDefinitions)
+	if errors.Is(err, ds.ErrNotFound) {
+		return definitions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(definitionsBytes, &definitions); err != nil {
+		return nil, err
+	}
+	return definitions, nil
+}
+
+// GetCollection returns a collection by name. Once the DB is closed, the
+// collection's operations return ErrDBClosed.
 func (d *DB) GetCollection(name string) *Collection {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.getCollection(name)
+}
+
+// getCollection returns a collection by name.
+// The DB lock must be held by the caller.
+func (d *DB) getCollection(name string) *Collection {
 	return d.collectionNames[name]
 }
 
+// CollectionInfo describes a registered collection.
+type CollectionInfo struct {
+	Name    string
+	Schema  *jsonschema.Schema
+	Indexes []IndexConfig
+	// EventCodec is the name of the collection event codec, or empty
+	// for the DB default.
+	EventCodec string
+	// SoftDelete tells whether deletes tombstone instances.
+	SoftDelete bool
+	// MaxInstanceBytes is the maximum instance size, or 0 if unbounded.
+	MaxInstanceBytes int
+	// UseNumber tells whether numbers are decoded as json.Number.
+	UseNumber bool
+	// DisallowUnknownFields tells whether fields missing from the schema
+	// are rejected.
+	DisallowUnknownFields bool
+	// Timestamps tells whether instance times are maintained.
+	Timestamps bool
+	// PrimaryKey lists the fields instance IDs are synthesized from.
+	PrimaryKey []string
+	// SchemaVersion and SchemaCompatibility tell which events from other
+	// peers are compatible with the schema.
+	SchemaVersion       int
+	SchemaCompatibility SchemaCompatibility
+	// IDField names the field holding the ID of instances.
+	IDField string
+}
+
+// ListCollections returns info about all registered collections, sorted by name.
+func (d *DB) ListCollections() []CollectionInfo {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	infos := make([]CollectionInfo, 0, len(d.collectionNames))
+	for name, c := range d.collectionNames {
+		indexes := make([]IndexConfig, 0, len(c.indexes))
+		for path, index := range c.indexes {
+			if c.isBuilding(path) {
+				continue
+			}
+			indexes = append(indexes, IndexConfig{
+				Path:     path,
+				Unique:   index.Unique,
+				Multikey: index.MultiIndexFunc != nil,
+				Sorted:   index.Sorted,
+			})
+		}
+		sort.Slice(indexes, func(i, j int) bool {
+			return indexes[i].Path < indexes[j].Path
+		})
+		infos = append(infos, CollectionInfo{
+			Name:                  name,
+			Schema:                c.schema,
+			Indexes:               indexes,
+			EventCodec:            c.eventCodec,
+			SoftDelete:            c.softDelete,
+			MaxInstanceBytes:      c.maxInstanceBytes,
+			UseNumber:             c.useNumber,
+			DisallowUnknownFields: c.disallowUnknownFields,
+			Timestamps:            c.timestamps,
+			PrimaryKey:            c.primaryKey,
+			SchemaVersion:         c.schemaVersion,
+			SchemaCompatibility:   c.schemaCompatibility,
+			IDField:               c.idField,
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
+// DeleteCollection deletes a collection by name, along with its schema,
+// index configuration, instances and index entries, in a single transaction.
+// Dispatched events of the collection are kept until the next Compact.
+// This only affects the local DB: events of the collection received from
+// other peers will fail to be reduced afterwards.
+func (d *DB) DeleteCollection(name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return ErrDBClosed
+	}
+	c, ok := d.collectionNames[name]
+	if !ok {
+		return ErrCollectionNotFound
+	}
+	if err := d.flushBatch(); err != nil {
+		return err
+	}
+	txn, err := d.datastore.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+
+	if err := c.clearData(txn); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBSchemas.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBIndexes.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBEventCodecs.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBSoftDeletes.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBMaxInstanceBytes.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBDecodings.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBTimestamps.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBPrimaryKeys.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBSchemaVersions.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBIDFields.ChildString(name)); err != nil {
+		return err
+	}
+	if err := txn.Delete(dsDBSnapshotCollections.ChildString(name)); err != nil {
+		return err
+	}
+	if err := c.clearIndexBuilds(txn); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	delete(d.collectionNames, name)
+	return nil
+}
+
 // Reduce processes txn events into the collections.
 func (d *DB) Reduce(events []core.Event) error {
-	codecActions, err := d.eventcodec.Reduce(
-		events,
-		d.datastore,
-		baseKey,
-		defaultIndexFunc(d),
-	)
+	return d.reduceContext(context.Background(), events)
+}
+
+func (d *DB) reduceContext(ctx context.Context, events []core.Event) (err error) {
+	_, span := d.tracer.Start(ctx, "db.Reduce")
+	span.SetAttribute("events", len(events))
+	defer func() { span.End(err) }()
+
+	// Remote changes producing oversized instances are dropped, along with
+	// their actions. Sizes are checked innermost, on the final bytes.
+	dropped := make(map[ds.Key]bool)
+	indexFunc := defaultIndexFunc(d)
+	if remoteEvents(ctx) {
+		indexFunc = limitInstanceSizeIndexFunc(d, dropped, indexFunc)
+	}
+	indexFunc = canonicalIndexFunc(d, indexFunc)
+	if d.feedThreads != nil {
+		indexFunc = originIndexFunc(d, originThread(ctx), indexFunc)
+	}
+	if d.conflictResolver != nil {
+		if remoteEvents(ctx) {
+			indexFunc = resolveConflictsIndexFunc(d, d.conflictResolver, originThread(ctx), indexFunc)
+		} else {
+			indexFunc = localChangesIndexFunc(indexFunc)
+		}
+	}
+	// Saves tombstoning instances of collections with soft deletes are
+	// reduced to deletes, so listeners get delete actions for them.
+	tombstoned := make(map[ds.Key]struct{})
+	// Events reduced in a dispatch txn are only visible, and notified,
+	// once it's committed.
+	var store ds.TxnDatastore = d.datastore
+	done := func(f func()) { f() }
+	if txn := dispatchTxnFrom(ctx); txn != nil {
+		store, done = txnDatastore{Txn: txn}, txn.onCommit
+	}
+	defer done(func() { d.invalidateQueryCaches(events) })
+	reduceIndexFunc := func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+		if c := d.getCollection(collection); c != nil && c.isTombstone(newData) && oldData != nil && !c.isTombstone(oldData) {
+			tombstoned[key] = struct{}{}
+		}
+		return indexFunc(collection, key, oldData, newData, txn)
+	}
+	start := time.Now()
+	codecActions, err := d.reduceEvents(store, events, reduceIndexFunc)
+	d.metrics.Reduce(len(events), time.Since(start), err)
 	if err != nil {
 		return err
 	}
+	kept := codecActions[:0]
+	for _, ca := range codecActions {
+		key := KeyForInstance(ca.Collection, ca.InstanceID)
+		if dropped[key] {
+			continue
+		}
+		if _, ok := tombstoned[key]; ok && ca.Type == core.Save {
+			ca.Type = core.Delete
+		}
+		kept = append(kept, ca)
+	}
+	codecActions = kept
 	actions := make([]Action, len(codecActions))
 	for i, ca := range codecActions {
 		var actionType ActionType
@@ -283,17 +907,20 @@ func (d *DB) Reduce(events []core.Event) error {
 		}
 		actions[i] = Action{Collection: ca.Collection, Type: actionType, ID: ca.InstanceID}
 	}
-	d.notifyStateChanged(actions)
+	done(func() { d.notifyStateChanged(actions) })
 
 	return nil
 }
 
 // GetDBInfo returns the addresses and key that can be used to join the DB thread
 func (d *DB) GetDBInfo(opts ...InviteInfoOption) ([]ma.Multiaddr, thread.Key, error) {
-	options := &InviteInfoOptions{}
+	options := &InviteInfoOptions{Token: d.token}
 	for _, opt := range opts {
 		opt(options)
 	}
+	if d.IsClosed() {
+		return nil, thread.Key{}, ErrDBClosed
+	}
 
 	tinfo, err := d.connector.Net.GetThread(context.Background(), d.connector.ThreadID(), net.WithThreadToken(options.Token))
 	if err != nil {
@@ -302,21 +929,215 @@ func (d *DB) GetDBInfo(opts ...InviteInfoOption) ([]ma.Multiaddr, thread.Key, er
 	return tinfo.Addrs, tinfo.Key, nil
 }
 
-// Close closes the db.
-func (d *DB) Close() error {
+// ThreadID returns the ID of the DB thread.
+func (d *DB) ThreadID() thread.ID {
+	return d.connector.ThreadID()
+}
+
+// ThreadInfo returns the info of the DB thread, including its logs with
+// their heads and addresses.
+func (d *DB) ThreadInfo(ctx context.Context, opts ...ThreadInfoOption) (thread.Info, error) {
+	args := &ThreadInfoOptions{Token: d.token}
+	for _, opt := range opts {
+		opt(args)
+	}
+	if d.IsClosed() {
+		return thread.Info{}, ErrDBClosed
+	}
+	return d.connector.Net.GetThread(ctx, d.connector.ThreadID(), net.WithThreadToken(args.Token))
+}
+
+// Health returns an error if the DB isn't functional: it's closed, its
+// datastore doesn't respond to a query, or its thread can't be read from
+// the network. It's safe to call concurrently.
+// Errors in background thread processing currently terminate the process,
+// so there's no recorded background error to report.
+func (d *DB) Health(ctx context.Context) error {
+	if err := d.datastoreHealth(ctx); err != nil {
+		return err
+	}
+	// The network is queried without the DB lock, so a slow network doesn't
+	// hold back writes.
+	if d.connector == nil {
+		return errors.New("db isn't connected to a thread")
+	}
+	if _, err := d.connector.Net.GetThread(ctx, d.connector.ThreadID()); err != nil {
+		return fmt.Errorf("getting db thread failed: %v", err)
+	}
+	return nil
+}
+
+// datastoreHealth returns an error if the DB is closed or its datastore
+// doesn't respond to a query.
+func (d *DB) datastoreHealth(ctx context.Context) error {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	res, err := d.datastore.Query(query.Query{
+		Prefix:   dsDBSchemas.String(),
+		KeysOnly: true,
+		Limit:    1,
+	})
+	if err != nil {
+		return fmt.Errorf("datastore query failed: %v", err)
+	}
+	if _, err := res.Rest(); err != nil {
+		return fmt.Errorf("datastore query failed: %v", err)
+	}
+	return nil
+}
+
+// Compact removes dispatched events which aren't needed anymore: all but
+// the latest event of each instance, and every event of deleted instances.
+// Collection state is materialized in the datastore, so compaction doesn't
+// alter it. Thread records aren't touched either, so peers still catching up
+// keep being served from the thread log.
+// Compaction holds the DB lock while removing events, so no transactions or
+// incoming records are processed until it returns. Any feature that relies on
+// the full dispatched event history won't see events before the compaction
+// point. The markers of applied records are pruned too, see Replay.
+func (d *DB) Compact(ctx context.Context) error {
+	if d.IsClosed() {
+		return ErrDBClosed
+	}
+	if err := d.pruneApplied(ctx); err != nil {
+		return fmt.Errorf("error pruning applied records: %v", err)
+	}
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+	return d.dispatcher.Compact(ctx, func(collection string, id core.InstanceID) (bool, error) {
+		return d.datastore.Has(KeyForInstance(collection, id))
+	})
+}
 
+// DumpEvents returns the events applied by the dispatcher, sorted by time,
+// for diagnostics. If collection isn't empty, only its events are returned.
+// Events removed by Compact aren't included. Their types are decoded with
+// the event codecs of their collections, see EventRecord.Type.
+func (d *DB) DumpEvents(collection string) ([]EventRecord, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
 	if d.closed {
+		return nil, ErrDBClosed
+	}
+	records, err := d.dispatcher.Events(collection)
+	if err != nil {
+		return nil, err
+	}
+	for i, r := range records {
+		records[i].Type = d.storedEventType(r)
+	}
+	return records, nil
+}
+
+// storedEventType returns the type of the stored event r, or 0 if its
+// codec can't tell it.
+// The DB lock must be held by the caller.
+func (d *DB) storedEventType(r EventRecord) ActionType {
+	_, codec := d.eventCodec(r.Collection)
+	decoder, ok := codec.(core.StoredEventDecoder)
+	if !ok {
+		return 0
+	}
+	e, err := decoder.EventFromStore(r.Data)
+	if err != nil {
+		return 0
+	}
+	te, ok := e.(core.TypedEvent)
+	if !ok {
+		return 0
+	}
+	switch te.ActionType() {
+	case core.Create:
+		return ActionCreate
+	case core.Save:
+		return ActionSave
+	case core.Delete:
+		return ActionDelete
+	default:
+		return 0
+	}
+}
+
+// RawQuery runs q against the DB datastore, e.g. for prefix scans or
+// custom filters the Collection API doesn't have. See the key layout in
+// keys.go; values are decrypted if the DB uses an encryption key.
+// It's an escape hatch: results aren't checked against schemas, indexes
+// aren't used, and tokens aren't checked, so it's meant for trusted
+// tooling. Results are streamed from a read-only transaction opened after
+// pending batched writes are flushed, so they're a consistent snapshot that
+// can be iterated while writing to the DB. They must be closed, since
+// closing the DB waits for them.
+func (d *DB) RawQuery(q query.Query) (query.Results, error) {
+	txn, done, err := d.scanTxn()
+	if err != nil {
+		return nil, err
+	}
+	res, err := txn.Query(q)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	var once sync.Once
+	return query.ResultsFromIterator(q, query.Iterator{
+		Next: res.NextSync,
+		Close: func() (err error) {
+			once.Do(func() {
+				err = res.Close()
+				done()
+			})
+			return err
+		},
+	}), nil
+}
+
+// IsClosed returns whether the db was closed. Operations on a closed db
+// return ErrDBClosed.
+func (d *DB) IsClosed() bool {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.closed
+}
+
+// Close closes the db. It waits for records from other peers which are
+// being handled, for up to the close timeout (see WithNewDBCloseTimeout).
+// Past it, their handling is canceled, and Close returns as soon as they
+// return, so it may block a bit longer than the timeout.
+func (d *DB) Close() error {
+	d.lock.Lock()
+	if d.closed {
+		d.lock.Unlock()
 		return nil
 	}
+	if err := d.flushBatch(); err != nil {
+		d.lock.Unlock()
+		return fmt.Errorf("error flushing write batch: %v", err)
+	}
 	d.closed = true
+	d.lock.Unlock()
 
+	// In-flight records need the lock to be dispatched, and so does the
+	// connector to stop handling them, so they're waited for without it.
+	d.waitForHandlers()
+	if err := d.closeFeeds(); err != nil {
+		return err
+	}
 	if d.connector != nil {
 		if err := d.connector.Close(); err != nil {
 			return err
 		}
 	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
 	d.localEventsBus.Discard()
 	if !managedDatastore(d.datastore) {
 		if err := d.datastore.Close(); err != nil {
@@ -324,36 +1145,173 @@ func (d *DB) Close() error {
 		}
 	}
 	d.stateChangedNotifee.close()
+	if d.webhooks != nil {
+		d.webhooks.close()
+	}
 	return nil
 }
 
+// HandleNetRecord applies a record from another peer. timeout bounds
+// fetching the record block and body, and is replaced by the record
+// timeout set with WithNewDBRecordTimeout, if any.
 func (d *DB) HandleNetRecord(rec net.ThreadRecord, key thread.Key, lid peer.ID, timeout time.Duration) error {
+	d.tapRecord(rec)
+	if d.recordTimeout > 0 {
+		timeout = d.recordTimeout
+	}
 	if rec.LogID() == lid {
 		return nil // Ignore our own events since DB already dispatches to DB reducers
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	d.lastRecords.seen(rec.LogID())
+	d.lock.RLock()
+	if d.closed {
+		d.lock.RUnlock()
+		d.log.Debugf("ignoring record %s received after closing", rec.Value().Cid())
+		return nil
+	}
+	d.handlers.Add(1)
+	d.lock.RUnlock()
+	defer d.handlers.Done()
+
+	queued, err := d.pause.enqueue(d.handlersCtx, queuedRecord{rec: rec, key: key, lid: lid, timeout: timeout})
+	if err != nil {
+		d.log.Debugf("handling of record %s canceled by closing: %v", rec.Value().Cid(), err)
+		return nil
+	}
+	if queued {
+		d.log.Debugf("queued record %s while dispatching is paused", rec.Value().Cid())
+		return nil
+	}
+	return d.processNetRecord(rec, key, timeout)
+}
+
+// pullThread pulls the DB thread in the background. Close waits for the
+// pull, canceling it if it doesn't return within the close timeout.
+func (d *DB) pullThread(token thread.Token) {
+	d.handlers.Add(1)
+	go func() {
+		defer d.handlers.Done()
+		tid := d.connector.ThreadID()
+		if err := d.connector.Net.PullThread(d.handlersCtx, tid, net.WithThreadToken(token)); err != nil && d.handlersCtx.Err() == nil {
+			d.log.Errorf("error pulling thread %s", tid)
+		}
+	}()
+}
+
+// scanTxn returns a read-only txn to scan the datastore without holding
+// the DB lock, once pending batched writes are flushed. Like handlers,
+// scans are waited for by Close, and canceled with handlersCtx. done must
+// be called once the scan ends.
+func (d *DB) scanTxn() (txn ds.Txn, done func(), err error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		return nil, nil, ErrDBClosed
+	}
+	if err := d.flushBatch(); err != nil {
+		return nil, nil, err
+	}
+	if txn, err = d.datastore.NewTransaction(true); err != nil {
+		return nil, nil, err
+	}
+	d.handlers.Add(1)
+	return txn, func() {
+		txn.Discard()
+		d.handlers.Done()
+	}, nil
+}
+
+// processNetRecord applies a record from another peer. The caller
+// must be tracked by d.handlers.
+func (d *DB) processNetRecord(rec net.ThreadRecord, key thread.Key, timeout time.Duration) error {
+	if d.recordLimiter != nil {
+		if err := d.recordLimiter.wait(d.handlersCtx); err != nil {
+			d.log.Debugf("handling of record %s canceled by closing: %v", rec.Value().Cid(), err)
+			return nil
+		}
+	}
+
+	ctx, span := d.tracer.Start(d.handlersCtx, "db.HandleNetRecord")
+	span.SetAttribute("record.cid", rec.Value().Cid().String())
+	span.SetAttribute("thread.id", rec.ThreadID().String())
+	span.SetAttribute("log.id", rec.LogID().String())
+	start := time.Now()
+	err := d.handleNetRecord(ctx, rec, key, timeout)
+	d.metrics.HandleNetRecord(time.Since(start), err)
+	span.End(err)
+	if err != nil && d.handlersCtx.Err() != nil {
+		d.log.Debugf("handling of record %s canceled by closing: %v", rec.Value().Cid(), err)
+		return nil
+	}
+	return err
+}
+
+// waitForHandlers waits for in-flight HandleNetRecord calls, canceling
+// them if they don't return within the close timeout.
+func (d *DB) waitForHandlers() {
+	defer d.cancelHandlers()
+	done := make(chan struct{})
+	go func() {
+		d.handlers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(d.closeTimeout):
+		d.log.Warnf("canceling records still being handled after %s", d.closeTimeout)
+		d.cancelHandlers()
+		<-done
+	}
+}
+
+func (d *DB) handleNetRecord(ctx context.Context, rec net.ThreadRecord, key thread.Key, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(withOriginThread(ctx, rec.ThreadID()), timeout)
 	defer cancel()
-	event, err := threadcbor.EventFromRecord(ctx, d.connector.Net, rec.Value())
+	return d.applyRecord(ctx, rec.LogID(), rec.Value(), key)
+}
+
+// applyRecord dispatches the events of a log record, unless they were
+// already applied, and tracks the record as the applied head of the log.
+func (d *DB) applyRecord(ctx context.Context, lid peer.ID, rec net.Record, key thread.Key) error {
+	node, dbEvents, err := d.recordEvents(ctx, lid, rec, key)
 	if err != nil {
-		block, err := d.getBlockWithRetry(ctx, rec.Value())
+		return err
+	}
+	d.log.Debugf("dispatching new record: %s/%s", d.connector.ThreadID(), lid)
+	return d.dispatchRecord(ctx, lid, rec.Cid(), node.Cid(), dbEvents)
+}
+
+// recordEvents returns the body of a log record and its decoded events.
+func (d *DB) recordEvents(ctx context.Context, lid peer.ID, rec net.Record, key thread.Key) (format.Node, []core.Event, error) {
+	node, err := d.recordBody(ctx, lid, rec, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	dbEvents, err := d.eventsFromBytes(ctx, node.RawData())
+	if err != nil {
+		return nil, nil, fmt.Errorf("error when unmarshaling event from bytes: %v", err)
+	}
+	return node, dbEvents, nil
+}
+
+// recordBody returns the decrypted body of a log record.
+func (d *DB) recordBody(ctx context.Context, lid peer.ID, rec net.Record, key thread.Key) (format.Node, error) {
+	event, err := threadcbor.EventFromRecord(ctx, d.connector.Net, rec)
+	if err != nil {
+		block, err := d.getBlockWithRetry(ctx, rec)
 		if err != nil {
-			return fmt.Errorf("error when getting block from record: %v", err)
+			return nil, fmt.Errorf("error when getting block from record: %v", err)
 		}
 		event, err = threadcbor.EventFromNode(block)
 		if err != nil {
-			return fmt.Errorf("error when decoding block to event: %v", err)
+			return nil, fmt.Errorf("error when decoding block to event: %v", err)
 		}
 	}
-	node, err := event.GetBody(ctx, d.connector.Net, key.Read())
+	node, err := d.getEventBody(ctx, event, key.Read())
 	if err != nil {
-		return fmt.Errorf("error when getting body of event on thread %s/%s: %v", d.connector.ThreadID(), rec.LogID(), err)
+		return nil, fmt.Errorf("error when getting body of event on thread %s/%s: %v", d.connector.ThreadID(), lid, err)
 	}
-	dbEvents, err := d.eventsFromBytes(node.RawData())
-	if err != nil {
-		return fmt.Errorf("error when unmarshaling event from bytes: %v", err)
-	}
-	log.Debugf("dispatching new record: %s/%s", rec.ThreadID(), rec.LogID())
-	return d.dispatch(dbEvents)
+	return node, nil
 }
 
 // getBlockWithRetry gets a record block with exponential backoff.
@@ -361,12 +1319,18 @@ func (d *DB) getBlockWithRetry(ctx context.Context, rec net.Record) (format.Node
 	backoff := getBlockInitialTimeout
 	var err error
 	for i := 1; i <= getBlockRetries; i++ {
-		n, err := rec.GetBlock(ctx, d.connector.Net)
+		var n format.Node
+		n, err = rec.GetBlock(ctx, d.connector.Net)
+		d.metrics.GetBlockAttempt(i, err)
 		if err == nil {
 			return n, nil
 		}
-		log.Warnf("error when fetching block %s in retry %d", rec.Cid(), i)
-		time.Sleep(backoff)
+		d.log.Warnf("error when fetching block %s in retry %d", rec.Cid(), i)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(backoff):
+		}
 		backoff *= 2
 	}
 	return nil, err
@@ -374,60 +1338,284 @@ func (d *DB) getBlockWithRetry(ctx context.Context, rec net.Record) (format.Node
 
 // dispatch applies external events to the db. This function guarantee
 // no interference with registered collection states, and viceversa.
-func (d *DB) dispatch(events []core.Event) error {
+func (d *DB) dispatch(ctx context.Context, events []core.Event) error {
+	return d.dispatchRecord(ctx, "", cid.Undef, cid.Undef, events)
+}
+
+// dispatchRecord is like dispatch, but skips the events of the record
+// body if it was already applied, and marks it as applied otherwise. If
+// rec is defined, it's tracked as the applied head of the log lid, in the
+// same txn.
+func (d *DB) dispatchRecord(ctx context.Context, lid peer.ID, rec, body cid.Cid, events []core.Event) error {
+	return d.dispatchRecords(ctx, []streamedRecord{{lid: lid, rec: rec, body: body, events: events}})
+}
+
+// streamedRecord holds the events of a log record dispatched along with
+// other records, see dispatchRecords. Events of ReduceStream have no record.
+type streamedRecord struct {
+	lid    peer.ID
+	rec    cid.Cid
+	body   cid.Cid
+	events []core.Event
+}
+
+// dispatchRecords is like dispatchRecord, but dispatches the events of
+// several records in a single txn.
+func (d *DB) dispatchRecords(ctx context.Context, records []streamedRecord) (err error) {
+	ctx, span := d.tracer.Start(withRemoteEvents(ctx), "db.dispatch")
+	defer func() { span.End(err) }()
+
 	d.lock.Lock()
 	defer d.lock.Unlock()
-	return d.dispatcher.Dispatch(events)
+	if d.closed {
+		return ErrDBClosed
+	}
+	txn, err := d.newDispatchTxn()
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	var events []core.Event
+	dispatched := false
+	applied := make(map[cid.Cid]struct{})
+	for _, r := range records {
+		if r.body.Defined() {
+			_, skip := applied[r.body]
+			if !skip {
+				if skip, err = d.isApplied(r.body); err != nil {
+					return err
+				}
+			}
+			if skip {
+				d.log.Debugf("skipping already applied record body %s", r.body)
+				if r.rec.Defined() {
+					if err = setAppliedHead(txn, r.lid, r.rec); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			applied[r.body] = struct{}{}
+		}
+		if !dispatched {
+			if err = d.flushBatch(); err != nil {
+				return err
+			}
+			dispatched = true
+		}
+		d.resolveCollections(r.events)
+		revents := d.checkSchemaVersions(r.events)
+		// Stamps are put right away, so later records of the batch are
+		// ordered after them.
+		if d.clock != nil {
+			if revents, err = d.orderEvents(txn, revents, r.body); err != nil {
+				return err
+			}
+			if err = d.putStamps(txn, revents, r.body); err != nil {
+				return err
+			}
+		}
+		if r.body.Defined() {
+			if err = markApplied(txn, r.body); err != nil {
+				return err
+			}
+		}
+		if r.rec.Defined() {
+			if err = setAppliedHead(txn, r.lid, r.rec); err != nil {
+				return err
+			}
+		}
+		events = append(events, revents...)
+	}
+	span.SetAttribute("events", len(events))
+	if !dispatched {
+		return txn.Commit()
+	}
+	if err = d.preDispatch(events, true); err != nil {
+		return err
+	}
+	err = d.dispatcher.DispatchContext(withDispatchTxn(ctx, txn), events)
+	d.metrics.Dispatch(len(events), err)
+	if err != nil {
+		return err
+	}
+	if err = d.commitDispatch(txn); err != nil {
+		return err
+	}
+	d.postDispatch(events, true)
+	return nil
 }
 
 // eventFromBytes generates an Event from its binary representation using
-// the underlying EventCodec configured in the DB.
-func (d *DB) eventsFromBytes(data []byte) ([]core.Event, error) {
-	return d.eventcodec.EventsFromBytes(data)
+// the EventCodec that created it.
+func (d *DB) eventsFromBytes(ctx context.Context, data []byte) (events []core.Event, err error) {
+	_, span := d.tracer.Start(ctx, "db.eventsFromBytes")
+	defer func() { span.End(err) }()
+	return d.decodeEvents(data)
 }
 
 // managedDatastore returns whether or not the datastore is
 // being wrapped by an external datastore.
 func managedDatastore(ds ds.Datastore) bool {
+	if e, ok := ds.(*encryptedDatastore); ok {
+		ds = e.TxnDatastore
+	}
+	if s, ok := ds.(*shardedDatastore); ok {
+		ds = s.TxnDatastore
+	}
 	_, ok := ds.(kt.KeyTransform)
 	return ok
 }
 
 func (d *DB) readTxn(c *Collection, f func(txn *Txn) error, opts ...TxnOption) error {
-	d.lock.RLock()
-	defer d.lock.RUnlock()
-
-	args := &TxnOptions{}
+	args := &TxnOptions{Token: d.token, Context: context.Background(), QueryTimeout: d.queryTimeout}
 	for _, opt := range opts {
 		opt(args)
 	}
-	txn := &Txn{collection: c, token: args.Token, readonly: true}
+	if err := d.authorize(c, args.Token, thread.ScopeRead); err != nil {
+		return err
+	}
+	if err := d.readTxns.acquire(args.Context); err != nil {
+		return err
+	}
+	defer d.readTxns.release()
+	if err := lockContext(args.Context, d.lock.RLock, d.lock.RUnlock); err != nil {
+		return err
+	}
+	defer d.lock.RUnlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+	// Pending batched writes must be visible to reads.
+	if err := d.flushBatch(); err != nil {
+		return err
+	}
+
+	txn := &Txn{collection: c, token: args.Token, ctx: args.Context, readonly: true, noCache: args.NoCache, includeDeleted: args.IncludeDeleted, queryTimeout: args.QueryTimeout}
 	defer txn.Discard()
 	if err := f(txn); err != nil {
 		return err
 	}
-	return nil
+	return args.Context.Err()
 }
 
 func (d *DB) writeTxn(c *Collection, f func(txn *Txn) error, opts ...TxnOption) error {
-	d.lock.Lock()
-	defer d.lock.Unlock()
-
-	args := &TxnOptions{}
+	args := &TxnOptions{Token: d.token, Context: context.Background(), QueryTimeout: d.queryTimeout}
 	for _, opt := range opts {
 		opt(args)
 	}
-	txn := &Txn{collection: c, token: args.Token}
+	if err := d.authorize(c, args.Token, thread.ScopeReadWrite); err != nil {
+		return err
+	}
+	if err := d.writeTxns.acquire(args.Context); err != nil {
+		return err
+	}
+	defer d.writeTxns.release()
+	if err := lockContext(args.Context, d.lock.Lock, d.lock.Unlock); err != nil {
+		return err
+	}
+	defer d.lock.Unlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	txn := &Txn{collection: c, token: args.Token, ctx: args.Context, includeDeleted: args.IncludeDeleted, queryTimeout: args.QueryTimeout}
 	defer txn.Discard()
 	if err := f(txn); err != nil {
 		return err
 	}
-	return txn.Commit()
+	if err := args.Context.Err(); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := txn.Commit()
+	d.metrics.TxnCommit(time.Since(start), err)
+	return err
+}
+
+// commitActions reduces actions as a single event per event codec and
+// notifies the connector. It must be called with the DB lock held, or
+// the read lock along with the flush lock of the write batch.
+func (d *DB) commitActions(ctx context.Context, actions []core.Action, token thread.Token) error {
+	if d.clock != nil && len(actions) > 0 {
+		clock := d.clock.tick()
+		for i := range actions {
+			actions[i].Clock = clock
+		}
+	}
+	return d.createEvents(actions, func(events []core.Event, node format.Node) error {
+		if len(events) == 0 && node == nil {
+			return nil
+		}
+		if len(events) == 0 || node == nil {
+			return fmt.Errorf("created events and node must both be nil or not-nil")
+		}
+		if err := d.preDispatch(events, false); err != nil {
+			return err
+		}
+		txn, err := d.newDispatchTxn()
+		if err != nil {
+			return err
+		}
+		defer txn.Discard()
+		if err := d.dispatcher.DispatchContext(withDispatchTxn(ctx, txn), events); err != nil {
+			return err
+		}
+		if d.clock != nil {
+			if err := d.putStamps(txn, events, node.Cid()); err != nil {
+				return err
+			}
+		}
+		if err := markApplied(txn, node.Cid()); err != nil {
+			return err
+		}
+		if err := d.commitDispatch(txn); err != nil {
+			return err
+		}
+		d.postDispatch(events, false)
+		if err := d.syncWrites(); err != nil {
+			return err
+		}
+		return d.notifyTxnEvents(node, token)
+	})
+}
+
+// lockContext acquires a lock unless ctx is done first. If the lock is
+// acquired after giving up, it's released right away.
+func lockContext(ctx context.Context, lock, unlock func()) error {
+	if ctx.Done() == nil {
+		lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	acquired := make(chan struct{})
+	go func() {
+		lock()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-acquired
+			unlock()
+		}()
+		return ctx.Err()
+	}
 }
 
 func defaultIndexFunc(s *DB) func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
 	return func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
-		indexer := s.GetCollection(collection)
+		indexer := s.getCollection(collection)
+		if indexer == nil {
+			return ErrCollectionNotFound
+		}
 		if err := indexDelete(indexer, txn, key, oldData); err != nil {
 			return err
 		}
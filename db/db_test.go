@@ -1,21 +1,40 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/alecthomas/jsonschema"
+	"github.com/ipfs/go-cid"
 	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
 	format "github.com/ipfs/go-ipld-format"
+	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/textileio/go-threads/common"
+	"github.com/textileio/go-threads/core/app"
 	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/net"
 	"github.com/textileio/go-threads/core/thread"
+	sym "github.com/textileio/go-threads/crypto/symmetric"
+	netpkg "github.com/textileio/go-threads/net"
+	"github.com/textileio/go-threads/protocodec"
 	"github.com/textileio/go-threads/util"
+	"github.com/tidwall/gjson"
 )
 
 func TestE2EWithThreads(t *testing.T) {
@@ -91,253 +110,3311 @@ func TestE2EWithThreads(t *testing.T) {
 	}
 }
 
+func TestRotateReadKey(t *testing.T) {
+	t.Parallel()
+
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	id1 := thread.NewIDV1(thread.Raw, 32)
+	d1, err := NewDB(context.Background(), n1, id1, WithNewDBRepoPath(tmpDir1))
+	checkErr(t, err)
+	defer d1.Close()
+	cc := CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}
+	c1, err := d1.NewCollection(cc)
+	checkErr(t, err)
+	idBefore, err := c1.Create(util.JSONFromInstance(dummy{Name: "Before"}))
+	checkErr(t, err)
+
+	peer1ID, err := multiaddr.NewComponent("p2p", n1.Host().ID().String())
+	checkErr(t, err)
+	threadComp, err := multiaddr.NewComponent("thread", id1.String())
+	checkErr(t, err)
+	addr := n1.Host().Addrs()[0].Encapsulate(peer1ID).Encapsulate(threadComp)
+
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+
+	ti, err := n1.GetThread(context.Background(), id1)
+	checkErr(t, err)
+	d2, err := NewDBFromAddr(context.Background(), n2, addr, ti.Key, WithNewDBRepoPath(tmpDir2), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d2.Close()
+	time.Sleep(time.Second * 3) // Wait a bit for sync
+
+	newKey := thread.NewKey(ti.Key.Service(), sym.New())
+	if err := d1.RotateReadKey(context.Background(), thread.NewServiceKey(ti.Key.Service())); err == nil {
+		t.Fatalf("rotating to a key without read key should fail")
+	}
+	checkErr(t, d1.RotateReadKey(context.Background(), newKey))
+	checkErr(t, d2.RotateReadKey(context.Background(), newKey))
+	ti, err = n1.GetThread(context.Background(), id1)
+	checkErr(t, err)
+	if ti.Key.Read().String() != newKey.Read().String() {
+		t.Fatalf("thread read key should be rotated")
+	}
+
+	idAfter, err := c1.Create(util.JSONFromInstance(dummy{Name: "After"}))
+	checkErr(t, err)
+	time.Sleep(time.Second * 3) // Wait a bit for sync
+
+	c2 := d2.GetCollection("dummy")
+	for _, id := range []core.InstanceID{idBefore, idAfter} {
+		_, err := c2.FindByID(id)
+		checkErr(t, err)
+	}
+}
+
+// failingKeyNet fails to set read keys.
+type failingKeyNet struct {
+	app.Net
+}
+
+func (n *failingKeyNet) SetReadKey(context.Context, thread.ID, *sym.Key, ...net.ThreadOption) error {
+	return errors.New("set read key failed")
+}
+
+// failingPutDatastore fails to put key.
+type failingPutDatastore struct {
+	ds.TxnDatastore
+	key ds.Key
+}
+
+func (f *failingPutDatastore) Put(key ds.Key, value []byte) error {
+	if key.Equal(f.key) {
+		return errors.New("put failed")
+	}
+	return f.TxnDatastore.Put(key, value)
+}
+
+func TestRotateReadKeyFailures(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	n := d.connector.Net
+	id := d.connector.ThreadID()
+	info, err := n.GetThread(context.Background(), id)
+	checkErr(t, err)
+	oldKey := info.Key.Read()
+	newKey := thread.NewKey(info.Key.Service(), sym.New())
+
+	// The thread key isn't replaced if the keys can't be persisted.
+	store := d.datastore
+	d.datastore = &failingPutDatastore{TxnDatastore: store, key: dsDBReadKeys}
+	if err := d.RotateReadKey(context.Background(), newKey); err == nil {
+		t.Fatal("rotating should fail if read keys can't be persisted")
+	}
+	d.datastore = store
+	info, err = n.GetThread(context.Background(), id)
+	checkErr(t, err)
+	if info.Key.Read().String() != oldKey.String() {
+		t.Fatal("thread read key shouldn't be rotated")
+	}
+
+	// The previous key is kept if the thread key can't be replaced.
+	d.connector.Net = &failingKeyNet{Net: n}
+	err = d.RotateReadKey(context.Background(), newKey)
+	d.connector.Net = n
+	if err == nil {
+		t.Fatal("rotating should fail if the read key can't be set")
+	}
+	keys, err := d.getReadKeys()
+	checkErr(t, err)
+	if !containsKey(keys, oldKey) {
+		t.Fatal("previous read key should be persisted")
+	}
+}
+
+// blockingTracer blocks dispatches of remote events until release is
+// closed or their context is canceled.
+type blockingTracer struct {
+	nopTracer
+	started  chan struct{}
+	release  chan struct{}
+	canceled chan struct{}
+	once     sync.Once
+}
+
+func (bt *blockingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	if name == "db.dispatch" {
+		bt.once.Do(func() { close(bt.started) })
+		select {
+		case <-bt.release:
+		case <-ctx.Done():
+			close(bt.canceled)
+		}
+	}
+	return ctx, nopSpan{}
+}
+
+func TestCloseWaitsForHandlers(t *testing.T) {
+	t.Parallel()
+
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	id1 := thread.NewIDV1(thread.Raw, 32)
+	d1, err := NewDB(context.Background(), n1, id1, WithNewDBRepoPath(tmpDir1))
+	checkErr(t, err)
+	defer d1.Close()
+	cc := CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}
+	c1, err := d1.NewCollection(cc)
+	checkErr(t, err)
+
+	peer1ID, err := multiaddr.NewComponent("p2p", n1.Host().ID().String())
+	checkErr(t, err)
+	threadComp, err := multiaddr.NewComponent("thread", id1.String())
+	checkErr(t, err)
+	addr := n1.Host().Addrs()[0].Encapsulate(peer1ID).Encapsulate(threadComp)
+
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+
+	ti, err := n1.GetThread(context.Background(), id1)
+	checkErr(t, err)
+	tracer := &blockingTracer{
+		started:  make(chan struct{}),
+		release:  make(chan struct{}),
+		canceled: make(chan struct{}),
+	}
+	timeout := time.Second
+	d2, err := NewDBFromAddr(context.Background(), n2, addr, ti.Key, WithNewDBRepoPath(tmpDir2),
+		WithNewDBCollections(cc), WithNewDBTracer(tracer), WithNewDBCloseTimeout(timeout))
+	checkErr(t, err)
+	time.Sleep(time.Second) // Wait a bit for the thread to be pulled
+
+	_, err = c1.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	select {
+	case <-tracer.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("record wasn't dispatched")
+	}
+
+	start := time.Now()
+	closed := make(chan error)
+	go func() {
+		closed <- d2.Close()
+	}()
+	select {
+	case <-closed:
+		t.Fatal("close shouldn't return while a record is being handled")
+	case <-time.After(timeout / 2):
+	}
+	select {
+	case err := <-closed:
+		checkErr(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("close should return after the timeout")
+	}
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("close returned after %s, before the timeout", elapsed)
+	}
+	select {
+	case <-tracer.canceled:
+	default:
+		t.Fatal("handling of the record should have been canceled")
+	}
+}
+
+// slowNet delays getting nodes from the network.
+type slowNet struct {
+	app.Net
+	delay time.Duration
+}
+
+func (n *slowNet) Get(ctx context.Context, c cid.Cid) (format.Node, error) {
+	select {
+	case <-time.After(n.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return n.Net.Get(ctx, c)
+}
+
+func TestRecordTimeout(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t, WithNewDBRecordTimeout(time.Millisecond*200))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	time.Sleep(time.Second) // Wait for the record to be added to the log
+
+	n := d.connector.Net
+	info, err := n.GetThread(context.Background(), d.connector.ThreadID())
+	checkErr(t, err)
+	own := info.GetOwnLog()
+	getRecord := func() net.ThreadRecord {
+		rec, err := n.GetRecord(context.Background(), info.ID, own.Head)
+		checkErr(t, err)
+		return netpkg.NewRecord(rec, info.ID, own.ID)
+	}
+	d.connector.Net = &slowNet{Net: n, delay: time.Millisecond * 500}
+	defer func() { d.connector.Net = n }()
+
+	// The record timeout replaces the connector timeout
+	if err := d.HandleNetRecord(getRecord(), info.Key, "", time.Minute); err == nil {
+		t.Fatalf("handling the record should time out")
+	}
+	d.recordTimeout = time.Second * 5
+	checkErr(t, d.HandleNetRecord(getRecord(), info.Key, "", time.Millisecond))
+}
+
+func TestImportInstances(t *testing.T) {
+	t.Parallel()
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+	cc := CollectionConfig{Name: "dummy", Schema: util.SchemaFromInstance(&dummy{}, false)}
+	d1, err := NewDB(context.Background(), n1, thread.NewIDV1(thread.Raw, 32), WithNewDBRepoPath(tmpDir1), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d1.Close()
+
+	addrs, key, err := d1.GetDBInfo()
+	checkErr(t, err)
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+	d2, err := NewDBFromAddr(context.Background(), n2, addrs[0], key, WithNewDBRepoPath(tmpDir2), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d2.Close()
+	time.Sleep(time.Second)
+
+	if err := d1.ImportInstances("missing", nil); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected collection not found, got %v", err)
+	}
+	id := core.NewInstanceID()
+	instances := [][]byte{
+		util.JSONFromInstance(dummy{ID: id, Name: "Alice"}),
+		util.JSONFromInstance(dummy{Name: "Bob"}),
+	}
+	checkErr(t, d1.ImportInstances("dummy", instances))
+	if err := d1.ImportInstances("dummy", [][]byte{
+		util.JSONFromInstance(dummy{Name: "Charlie"}),
+		util.JSONFromInstance(dummy{ID: id, Name: "Alice"}),
+	}); !errors.Is(err, errCantCreateExistingInstance) {
+		t.Fatalf("expected existing instances to fail the import, got %v", err)
+	}
+	c1 := d1.GetCollection("dummy")
+	checkQueryCount(t, c1, &Query{}, 2)
+	if _, err := c1.FindByID(id); err != nil {
+		t.Fatalf("imported instances should keep their IDs, got %v", err)
+	}
+
+	// Imported instances reach other peers as thread records.
+	time.Sleep(time.Second * 2)
+	checkQueryCount(t, d2.GetCollection("dummy"), &Query{}, 2)
+}
+
+func TestImportInstancesBatched(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t, WithNewDBDispatcherBatchSize(1), WithNewDBWriteBatching(100, 0))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{Name: "dummy", Schema: util.SchemaFromInstance(&dummy{}, false)})
+	checkErr(t, err)
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Pending"}))
+	checkErr(t, err)
+
+	instances := [][]byte{
+		util.JSONFromInstance(dummy{Name: "Alice"}),
+		util.JSONFromInstance(dummy{Name: "Bob"}),
+		util.JSONFromInstance(dummy{Name: "Charlie"}),
+	}
+	checkErr(t, d.ImportInstances("dummy", instances))
+	// The import isn't batched, and is committed after the pending write.
+	checkQueryCount(t, c, &Query{}, 4)
+	if n := ownLogRecords(t, d, 2); n != 2 {
+		t.Fatalf("expected the pending write and the import in 2 records, got %d", n)
+	}
+	events, err := d.dispatcher.Events("dummy")
+	checkErr(t, err)
+	if len(events) != 4 {
+		t.Fatalf("expected 4 stored events, got %d", len(events))
+	}
+}
+
+func TestPeers(t *testing.T) {
+	t.Parallel()
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	cc := CollectionConfig{Name: "dummy", Schema: util.SchemaFromInstance(&dummy{}, false)}
+	d1, err := NewDB(context.Background(), n1, thread.NewIDV1(thread.Raw, 32), WithNewDBRepoPath(tmpDir1), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d1.Close()
+	c1 := d1.GetCollection("dummy")
+	_, err = c1.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	peers, err := d1.Peers(context.Background())
+	checkErr(t, err)
+	if len(peers) != 1 || !peers[0].Own || peers[0].Connected {
+		t.Fatalf("db with only its own log must have a single unconnected own log, got %+v", peers)
+	}
+	logID := peers[0].LogID
+
+	addrs, key, err := d1.GetDBInfo()
+	checkErr(t, err)
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+	d2, err := NewDBFromAddr(context.Background(), n2, addrs[0], key, WithNewDBRepoPath(tmpDir2), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d2.Close()
+	time.Sleep(time.Second)
+	_, err = c1.Create(util.JSONFromInstance(dummy{Name: "Textile2"}))
+	checkErr(t, err)
+	time.Sleep(time.Second * 2)
+
+	peers, err = d2.Peers(context.Background())
+	checkErr(t, err)
+	var status *PeerStatus
+	for i := range peers {
+		if peers[i].LogID == logID {
+			status = &peers[i]
+		}
+	}
+	if status == nil {
+		t.Fatalf("log of peer 1 is missing from %+v", peers)
+	}
+	if status.Own || !status.Connected || !status.Head.Defined() || status.LastRecord.IsZero() {
+		t.Fatalf("log of peer 1 should be connected with a received record, got %+v", status)
+	}
+	if len(status.Hosts) != 1 || status.Hosts[0] != n1.Host().ID() {
+		t.Fatalf("log of peer 1 should be hosted by it, got %v", status.Hosts)
+	}
+}
+
+func TestSyncStatus(t *testing.T) {
+	t.Parallel()
+
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	id1 := thread.NewIDV1(thread.Raw, 32)
+	d1, err := NewDB(context.Background(), n1, id1, WithNewDBRepoPath(tmpDir1))
+	checkErr(t, err)
+	defer d1.Close()
+	cc := CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}
+	c1, err := d1.NewCollection(cc)
+	checkErr(t, err)
+	_, err = c1.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	_, err = c1.Create(util.JSONFromInstance(dummy{Name: "Textile2"}))
+	checkErr(t, err)
+
+	status, err := d1.SyncStatus(context.Background())
+	checkErr(t, err)
+	if !status.Synced() || len(status.Logs) != 1 {
+		t.Fatalf("db with only its own log must be synced")
+	}
+
+	peer1Addr := n1.Host().Addrs()[0]
+	peer1ID, err := multiaddr.NewComponent("p2p", n1.Host().ID().String())
+	checkErr(t, err)
+	threadComp, err := multiaddr.NewComponent("thread", id1.String())
+	checkErr(t, err)
+	addr := peer1Addr.Encapsulate(peer1ID).Encapsulate(threadComp)
+
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+
+	ti, err := n1.GetThread(context.Background(), id1)
+	checkErr(t, err)
+	d2, err := NewDBFromAddr(context.Background(), n2, addr, ti.Key, WithNewDBRepoPath(tmpDir2), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d2.Close()
+
+	time.Sleep(time.Second * 3) // Wait a bit for peer1 heads to be known
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	checkErr(t, d2.WaitForSync(ctx))
+
+	status, err = d1.SyncStatus(context.Background())
+	checkErr(t, err)
+	peer1Log := status.Logs[0]
+	status, err = d2.SyncStatus(context.Background())
+	checkErr(t, err)
+	var found bool
+	for _, l := range status.Logs {
+		if l.ID == peer1Log.ID {
+			found = true
+			if !l.LocalHead.Defined() || !l.LocalHead.Equals(peer1Log.RemoteHead) || l.Pending != 0 {
+				t.Fatalf("log of peer1 must be fully applied")
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("status must include the log of peer1")
+	}
+	n, err := d2.GetCollection("dummy").Find(&Query{})
+	checkErr(t, err)
+	if len(n) != 2 {
+		t.Fatalf("expected 2 instances after sync, got %d", len(n))
+	}
+
+	// DBs which applied records before tracking heads get them initialized
+	checkErr(t, d2.datastore.Delete(dsDBHeads.ChildString(peer1Log.ID.String())))
+	checkErr(t, d2.datastore.Delete(dsDBHeadsInitialized))
+	checkErr(t, d2.initAppliedHeads(context.Background()))
+	head, err := d2.getAppliedHead(peer1Log.ID)
+	checkErr(t, err)
+	if !head.Equals(peer1Log.RemoteHead) {
+		t.Fatalf("applied head of peer1 log must be initialized to its head")
+	}
+}
+
+func TestNewDBFromAddrBlockOnPull(t *testing.T) {
+	t.Parallel()
+
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	id1 := thread.NewIDV1(thread.Raw, 32)
+	d1, err := NewDB(context.Background(), n1, id1, WithNewDBRepoPath(tmpDir1))
+	checkErr(t, err)
+	defer d1.Close()
+	cc := CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}
+	c1, err := d1.NewCollection(cc)
+	checkErr(t, err)
+	res, err := c1.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+
+	time.Sleep(time.Second) // Wait a bit for the record to be created
+
+	peer1Addr := n1.Host().Addrs()[0]
+	peer1ID, err := multiaddr.NewComponent("p2p", n1.Host().ID().String())
+	checkErr(t, err)
+	threadComp, err := multiaddr.NewComponent("thread", id1.String())
+	checkErr(t, err)
+	addr := peer1Addr.Encapsulate(peer1ID).Encapsulate(threadComp)
+
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+
+	ti, err := n1.GetThread(context.Background(), id1)
+	checkErr(t, err)
+	d2, err := NewDBFromAddr(context.Background(), n2, addr, ti.Key, WithNewDBRepoPath(tmpDir2), WithNewDBCollections(cc), WithNewDBBlockOnPull(true))
+	checkErr(t, err)
+	defer d2.Close()
+
+	// Records are known once the pull returns, so waiting doesn't depend on timing
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	checkErr(t, d2.WaitForSync(ctx))
+	if _, err := d2.GetCollection("dummy").FindByID(res); err != nil {
+		t.Fatalf("instance should be available after a blocking pull: %v", err)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+
+	checkErr(t, d.Health(context.Background()))
+	checkErr(t, d.Close())
+	if err := d.Health(context.Background()); err != ErrDBClosed {
+		t.Fatalf("expected closed db error, got %v", err)
+	}
+}
+
+func TestDeleteCollection(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+
+	newCollection := func(name string) *Collection {
+		c, err := d.NewCollection(CollectionConfig{
+			Name:    name,
+			Schema:  util.SchemaFromInstance(&dummy{}, false),
+			Indexes: []IndexConfig{{Path: "Name"}},
+		})
+		checkErr(t, err)
+		_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+		checkErr(t, err)
+		return c
+	}
+	newCollection("dog")
+	dogs := newCollection("dogs")
+
+	checkErr(t, d.DeleteCollection("dog"))
+	if d.GetCollection("dog") != nil {
+		t.Fatalf("deleted collection shouldn't be registered")
+	}
+	if err := d.DeleteCollection("dog"); err != ErrCollectionNotFound {
+		t.Fatalf("expected collection not found error, got %v", err)
+	}
+	for _, prefix := range []ds.Key{dsDBSchemas.ChildString("dog"), dsDBIndexes.ChildString("dog"), baseKey.ChildString("dog"), indexPrefix.Child(baseKey.ChildString("dog"))} {
+		res, err := d.datastore.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+		checkErr(t, err)
+		entries, err := res.Rest()
+		checkErr(t, err)
+		for _, e := range entries {
+			if ds.NewKey(e.Key).Equal(prefix) || ds.NewKey(e.Key).IsDescendantOf(prefix) {
+				t.Fatalf("key %s should have been deleted", e.Key)
+			}
+		}
+	}
+
+	// Collections sharing a name prefix must be untouched
+	res, err := dogs.Find(Where("Name").Eq("Textile").UseIndex("Name"))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected 1 instance in remaining collection, got %d", len(res))
+	}
+
+	// The collection can be created again from scratch
+	dog, err := d.NewCollection(CollectionConfig{
+		Name:   "dog",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	res, err = dog.Find(&Query{})
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("recreated collection should be empty, got %d instances", len(res))
+	}
+}
+
+func TestListCollections(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+
+	if len(d.ListCollections()) != 0 {
+		t.Fatalf("new db shouldn't have collections")
+	}
+	schema := util.SchemaFromInstance(&dummy{}, false)
+	_, err := d.NewCollection(CollectionConfig{
+		Name:    "b",
+		Schema:  schema,
+		Indexes: []IndexConfig{{Path: "Name", Unique: true}},
+	})
+	checkErr(t, err)
+	_, err = d.NewCollection(CollectionConfig{Name: "a", Schema: schema})
+	checkErr(t, err)
+
+	infos := d.ListCollections()
+	if len(infos) != 2 || infos[0].Name != "a" || infos[1].Name != "b" {
+		t.Fatalf("unexpected collections %v", infos)
+	}
+	if infos[1].Schema != schema {
+		t.Fatalf("collection info should have the collection schema")
+	}
+	expected := []IndexConfig{{Path: "Name", Unique: true}, {Path: idFieldName, Unique: true}}
+	if !reflect.DeepEqual(infos[1].Indexes, expected) {
+		t.Fatalf("expected indexes %v, got %v", expected, infos[1].Indexes)
+	}
+}
+
 func TestOptions(t *testing.T) {
 	t.Parallel()
-	tmpDir, err := ioutil.TempDir("", "")
+	tmpDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	n, err := common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+
+	ec := &mockEventCodec{}
+	id := thread.NewIDV1(thread.Raw, 32)
+	d, err := NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir), WithNewDBEventCodec(ec))
+	checkErr(t, err)
+
+	m, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	_, err = m.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+
+	if !ec.called {
+		t.Fatalf("custom event codec wasn't called")
+	}
+
+	// Re-do again to re-use key. If something wasn't closed correctly, would fail
+	checkErr(t, n.Close())
+	checkErr(t, d.Close())
+
+	time.Sleep(time.Second * 3)
+	n, err = common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+	d, err = NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir), WithNewDBEventCodec(ec))
+	checkErr(t, err)
+	checkErr(t, d.Close())
+}
+
+func TestReCreateCollectionsIndexes(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	n, err := common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	id := thread.NewIDV1(thread.Raw, 32)
+	d, err := NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir))
+	checkErr(t, err)
+	_, err = d.NewCollection(CollectionConfig{
+		Name:    "dummy",
+		Schema:  util.SchemaFromInstance(&dummy{}, false),
+		Indexes: []IndexConfig{{Path: "Name"}, {Path: "Counter"}},
+	})
+	checkErr(t, err)
+	checkErr(t, n.Close())
+	checkErr(t, d.Close())
+
+	time.Sleep(time.Second * 3)
+	n, err = common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+	d, err = NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir))
+	checkErr(t, err)
+	defer d.Close()
+
+	c := d.GetCollection("dummy")
+	if c == nil {
+		t.Fatalf("collection should be re-created")
+	}
+	indexes := c.Indexes()
+	if len(indexes) != 3 {
+		t.Fatalf("expected 3 indexes, got %d", len(indexes))
+	}
+	for _, path := range []string{idFieldName, "Name", "Counter"} {
+		if _, ok := indexes[path]; !ok {
+			t.Fatalf("index on %s should be re-created", path)
+		}
+	}
+	b, err := d.datastore.Get(dsDBIndexes.ChildString("dummy"))
+	checkErr(t, err)
+	configs := map[string]IndexConfig{}
+	checkErr(t, json.Unmarshal(b, &configs))
+	if _, ok := configs[""]; ok || len(configs) != 3 {
+		t.Fatalf("persisted index configs shouldn't contain phantom indexes: %v", configs)
+	}
+}
+
+func TestCollectionEventCodecs(t *testing.T) {
+	t.Parallel()
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	ccs := []CollectionConfig{
+		{Name: "dummy", Schema: util.SchemaFromInstance(&dummy{}, false)},
+		{Name: "log", Schema: util.SchemaFromInstance(&dummy{}, false), EventCodec: "proto"},
+	}
+	id1 := thread.NewIDV1(thread.Raw, 32)
+	d1, err := NewDB(context.Background(), n1, id1, WithNewDBRepoPath(tmpDir1),
+		WithNewDBNamedEventCodec("proto", protocodec.New()), WithNewDBCollections(ccs...))
+	checkErr(t, err)
+	defer d1.Close()
+
+	infos := d1.ListCollections()
+	if infos[0].EventCodec != "" || infos[1].EventCodec != "proto" {
+		t.Fatalf("unexpected collection event codecs: %+v", infos)
+	}
+	dummyID, err := d1.GetCollection("dummy").Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	logID, err := d1.GetCollection("log").Create(util.JSONFromInstance(dummy{Name: "Entry", Counter: 1}))
+	checkErr(t, err)
+
+	peer1Addr := n1.Host().Addrs()[0]
+	peer1ID, err := multiaddr.NewComponent("p2p", n1.Host().ID().String())
+	checkErr(t, err)
+	threadComp, err := multiaddr.NewComponent("thread", id1.String())
+	checkErr(t, err)
+	addr := peer1Addr.Encapsulate(peer1ID).Encapsulate(threadComp)
+
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+
+	ti, err := n1.GetThread(context.Background(), id1)
+	checkErr(t, err)
+	d2, err := NewDBFromAddr(context.Background(), n2, addr, ti.Key, WithNewDBRepoPath(tmpDir2),
+		WithNewDBNamedEventCodec("proto", protocodec.New()), WithNewDBCollections(ccs...))
+	checkErr(t, err)
+	defer d2.Close()
+
+	time.Sleep(time.Second * 3) // Wait a bit for sync
+
+	for name, id := range map[string]core.InstanceID{"dummy": dummyID, "log": logID} {
+		if _, err := d2.GetCollection(name).FindByID(id); err != nil {
+			t.Fatalf("instance of %s should be synced: %v", name, err)
+		}
+	}
+
+	_, err = d1.NewCollection(CollectionConfig{
+		Name:       "unknown",
+		Schema:     util.SchemaFromInstance(&dummy{}, false),
+		EventCodec: "unknown",
+	})
+	if err == nil {
+		t.Fatalf("collections with unregistered event codecs shouldn't be created")
+	}
+}
+
+func TestReCreateCollectionsEventCodec(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	n, err := common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	id := thread.NewIDV1(thread.Raw, 32)
+	d, err := NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir), WithNewDBNamedEventCodec("proto", protocodec.New()))
+	checkErr(t, err)
+	c, err := d.NewCollection(CollectionConfig{
+		Name:             "log",
+		Schema:           util.SchemaFromInstance(&dummy{}, false),
+		EventCodec:       "proto",
+		SoftDelete:       true,
+		MaxInstanceBytes: 1024,
+		UseNumber:        true,
+		Timestamps:       true,
+		PrimaryKey:       []string{"Name"},
+		SchemaVersion:    3,
+	})
+	checkErr(t, err)
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Entry"}))
+	checkErr(t, err)
+	time.Sleep(time.Second)
+	checkErr(t, n.Close())
+	checkErr(t, d.Close())
+
+	time.Sleep(time.Second * 3)
+	n, err = common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+	d, err = NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir), WithNewDBNamedEventCodec("proto", protocodec.New()))
+	checkErr(t, err)
+	defer d.Close()
+
+	c = d.GetCollection("log")
+	if c == nil {
+		t.Fatalf("collection should be re-created")
+	}
+	if c.eventCodec != "proto" {
+		t.Fatalf("collection event codec should be re-created, got %q", c.eventCodec)
+	}
+	if !c.softDelete {
+		t.Fatalf("collection soft deletes should be re-created")
+	}
+	if c.maxInstanceBytes != 1024 {
+		t.Fatalf("collection max instance bytes should be re-created, got %d", c.maxInstanceBytes)
+	}
+	if !c.useNumber {
+		t.Fatalf("collection decoding should be re-created")
+	}
+	if !c.timestamps {
+		t.Fatalf("collection timestamps should be re-created")
+	}
+	if !reflect.DeepEqual(c.primaryKey, []string{"Name"}) {
+		t.Fatalf("collection primary key should be re-created, got %v", c.primaryKey)
+	}
+	if c.schemaVersion != 3 {
+		t.Fatalf("collection schema version should be re-created, got %d", c.schemaVersion)
+	}
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Another"}))
+	checkErr(t, err)
+}
+
+func TestSchemaDefinitions(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	n, err := common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	id := thread.NewIDV1(thread.Raw, 32)
+	d, err := NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir))
+	checkErr(t, err)
+
+	const defsID = "https://textile.io/schemas/address.json"
+	if err := d.RegisterSchemaDefinition("address", &jsonschema.Schema{}); err == nil {
+		t.Fatalf("relative definition ids should be rejected")
+	}
+	checkErr(t, d.RegisterSchemaDefinition(defsID, &jsonschema.Schema{
+		Definitions: jsonschema.Definitions{
+			"Address": {
+				Type:       "object",
+				Properties: map[string]*jsonschema.Type{"City": {Type: "string"}},
+				Required:   []string{"City"},
+			},
+		},
+	}))
+	schema := &jsonschema.Schema{Type: &jsonschema.Type{
+		Type: "object",
+		Properties: map[string]*jsonschema.Type{
+			"_id":  {Type: "string"},
+			"Home": {Ref: defsID + "#/definitions/Address"},
+		},
+	}}
+	_, err = d.NewCollection(CollectionConfig{Name: "person", Schema: schema})
+	checkErr(t, err)
+	checkErr(t, n.Close())
+	checkErr(t, d.Close())
+
+	time.Sleep(time.Second * 3)
+	n, err = common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+	d, err = NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir))
+	checkErr(t, err)
+	defer d.Close()
+
+	c := d.GetCollection("person")
+	if c == nil {
+		t.Fatalf("collection should be re-created")
+	}
+	_, err = c.Create([]byte(`{"Home":{"City":"Berlin"}}`))
+	checkErr(t, err)
+	if _, err = c.Create([]byte(`{"Home":{"City":42}}`)); err != ErrInvalidSchemaInstance {
+		t.Fatalf("expected invalid schema instance error, got %v", err)
+	}
+}
+
+func TestIDField(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	type account struct {
+		ID   string `json:"id"`
+		Ref  string `json:"_id"`
+		Name string
+	}
+	n, err := common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	id := thread.NewIDV1(thread.Raw, 32)
+	d, err := NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir))
+	checkErr(t, err)
+	if _, err := d.NewCollection(CollectionConfig{
+		Name:    "account",
+		Schema:  util.SchemaFromInstance(&dummy{}, false),
+		IDField: "id",
+	}); err != ErrInvalidCollectionSchema {
+		t.Fatalf("expected schemas without the id field to be rejected, got %v", err)
+	}
+	if _, err := d.NewCollection(CollectionConfig{
+		Name:    "account",
+		Schema:  util.SchemaFromInstance(&account{}, false),
+		IDField: "meta.id",
+	}); err == nil {
+		t.Fatalf("id fields with path syntax should be rejected")
+	}
+	c, err := d.NewCollection(CollectionConfig{
+		Name:    "account",
+		Schema:  util.SchemaFromInstance(&account{}, false),
+		IDField: "id",
+	})
+	checkErr(t, err)
+	first, err := c.Create(util.JSONFromInstance(account{Ref: "external", Name: "Alice"}))
+	checkErr(t, err)
+	instance, err := c.FindByID(first)
+	checkErr(t, err)
+	a := &account{}
+	util.InstanceFromJSON(instance, a)
+	if a.ID != first.String() || a.Ref != "external" {
+		t.Fatalf("expected the id in the id field only, got %s", instance)
+	}
+	if _, err := c.Create(util.JSONFromInstance(account{ID: first.String(), Name: "Bob"})); !errors.Is(err, errCantCreateExistingInstance) {
+		t.Fatalf("expected ids of the id field to be unique, got %v", err)
+	}
+	res, err := c.Find(&Query{Fields: []string{"Name"}})
+	checkErr(t, err)
+	if len(res) != 1 || gjson.GetBytes(res[0], "id").String() != first.String() || gjson.GetBytes(res[0], "_id").Exists() {
+		t.Fatalf("expected projections to keep the id field, got %s", res)
+	}
+	time.Sleep(time.Second) // Give threads a chance to finish work
+	checkErr(t, n.Close())
+	checkErr(t, d.Close())
+
+	time.Sleep(time.Second * 3)
+	n, err = common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+	d, err = NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir))
+	checkErr(t, err)
+	defer d.Close()
+
+	c = d.GetCollection("account")
+	if c == nil || c.idField != "id" {
+		t.Fatalf("collection id field should be re-created")
+	}
+	second, err := c.Create(util.JSONFromInstance(account{Name: "Bob"}))
+	checkErr(t, err)
+	checkErr(t, c.Save(util.JSONFromInstance(account{ID: second.String(), Name: "Charlie"})))
+	instance, err = c.FindByID(second)
+	checkErr(t, err)
+	if gjson.GetBytes(instance, "Name").String() != "Charlie" {
+		t.Fatalf("expected saved instance, got %s", instance)
+	}
+}
+
+func TestInMemoryDatastore(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir)
+	n, err := common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+
+	repoDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(repoDir)
+	d, err := NewDB(context.Background(), n, thread.NewIDV1(thread.Raw, 32), WithNewDBRepoPath(repoDir), WithNewDBInMemoryDatastore())
+	checkErr(t, err)
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	id, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	checkErr(t, c.Save(util.JSONFromInstance(dummy{ID: id, Name: "Textile", Counter: 1})))
+	res, err := c.FindByID(id)
+	checkErr(t, err)
+	saved := &dummy{}
+	util.InstanceFromJSON(res, saved)
+	if saved.Counter != 1 {
+		t.Fatalf("expected saved counter 1, got %d", saved.Counter)
+	}
+	checkErr(t, d.Close())
+	files, err := ioutil.ReadDir(repoDir)
+	checkErr(t, err)
+	if len(files) != 0 {
+		t.Fatalf("in-memory db shouldn't write to its repo path, found %d files", len(files))
+	}
+}
+
+func TestClosedDB(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{Name: "Person", Schema: util.SchemaFromInstance(&Person{}, false)})
+	checkErr(t, err)
+	id, err := c.Create(util.JSONFromInstance(Person{Name: "Alice"}))
+	checkErr(t, err)
+	if d.IsClosed() {
+		t.Fatal("db shouldn't be closed")
+	}
+	checkErr(t, d.Close())
+	if !d.IsClosed() {
+		t.Fatal("db should be closed")
+	}
+
+	if _, err := d.NewCollection(CollectionConfig{Name: "Other", Schema: util.SchemaFromInstance(&Person{}, false)}); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("NewCollection: expected ErrDBClosed, got %v", err)
+	}
+	if d.GetCollection("Person") != c {
+		t.Fatal("GetCollection: expected the collection")
+	}
+	if _, err := c.FindByID(id); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("FindByID: expected ErrDBClosed, got %v", err)
+	}
+	if _, err := c.Find(&Query{}); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("Find: expected ErrDBClosed, got %v", err)
+	}
+	if _, err := c.Create(util.JSONFromInstance(Person{Name: "Bob"})); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("Create: expected ErrDBClosed, got %v", err)
+	}
+	if err := c.AddIndex(IndexConfig{Path: "Name"}); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("AddIndex: expected ErrDBClosed, got %v", err)
+	}
+	if err := c.DropIndex("Name"); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("DropIndex: expected ErrDBClosed, got %v", err)
+	}
+	if _, _, err := d.GetDBInfo(); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("GetDBInfo: expected ErrDBClosed, got %v", err)
+	}
+	if err := d.DeleteCollection("Person"); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("DeleteCollection: expected ErrDBClosed, got %v", err)
+	}
+	if _, err := d.Listen(); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("Listen: expected ErrDBClosed, got %v", err)
+	}
+}
+
+func TestScopedTokens(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	newCollection := func(name string) *Collection {
+		c, err := d.NewCollection(CollectionConfig{Name: name, Schema: util.SchemaFromInstance(&Person{}, false)})
+		checkErr(t, err)
+		return c
+	}
+	readOnly, readWrite, hidden := newCollection("ReadOnly"), newCollection("ReadWrite"), newCollection("Hidden")
+	id, err := readOnly.Create(util.JSONFromInstance(Person{Name: "Alice"}))
+	checkErr(t, err)
+
+	sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	checkErr(t, err)
+	identity := thread.NewLibp2pIdentity(sk)
+	token, err := d.NewScopedToken(identity.GetPublic(), thread.Scopes{
+		"ReadOnly":  thread.ScopeRead,
+		"ReadWrite": thread.ScopeReadWrite,
+	})
+	checkErr(t, err)
+	if _, err := readOnly.FindByID(id, WithTxnToken(token)); err != nil {
+		t.Fatalf("reading a collection in scope should succeed: %v", err)
+	}
+	if _, err := readOnly.Create(util.JSONFromInstance(Person{Name: "Bob"}), WithTxnToken(token)); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("writing a read-only collection: expected ErrUnauthorized, got %v", err)
+	}
+	if _, err := readWrite.Create(util.JSONFromInstance(Person{Name: "Bob"}), WithTxnToken(token)); err != nil {
+		t.Fatalf("writing a read-write collection should succeed: %v", err)
+	}
+	if _, err := hidden.Find(&Query{}, WithTxnToken(token)); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("reading a collection out of scope: expected ErrUnauthorized, got %v", err)
+	}
+
+	// Tokens that aren't limited to scopes keep every capability.
+	full, err := d.connector.Net.GetToken(context.Background(), identity)
+	checkErr(t, err)
+	if _, err := hidden.Create(util.JSONFromInstance(Person{Name: "Bob"}), WithTxnToken(full)); err != nil {
+		t.Fatalf("writing with an unscoped token should succeed: %v", err)
+	}
+	if _, err := hidden.Find(&Query{}, WithTxnToken(thread.Token("invalid"))); err == nil {
+		t.Fatalf("invalid tokens should be rejected")
+	}
+}
+
+func TestDefaultToken(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(dir)
+	n, err := common.DefaultNetwork(dir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+
+	identities := make([]thread.Identity, 2)
+	tokens := make([]thread.Token, 2)
+	for i := range identities {
+		sk, _, err := crypto.GenerateEd25519Key(rand.Reader)
+		checkErr(t, err)
+		identities[i] = thread.NewLibp2pIdentity(sk)
+		tokens[i], err = n.GetToken(ctx, identities[i])
+		checkErr(t, err)
+	}
+	id := thread.NewIDV1(thread.Raw, 32)
+	d, err := NewDB(ctx, n, id, WithNewDBRepoPath(dir), WithNewDBToken(tokens[0]))
+	checkErr(t, err)
+	defer d.Close()
+	c, err := d.NewCollection(CollectionConfig{Name: "Person", Schema: util.SchemaFromInstance(&Person{}, false)})
+	checkErr(t, err)
+
+	sub, err := n.Subscribe(ctx, net.WithSubFilter(id))
+	checkErr(t, err)
+	checkAuthor := func(identity thread.Identity) {
+		select {
+		case rec := <-sub:
+			pk, err := identity.GetPublic().MarshalBinary()
+			checkErr(t, err)
+			if !bytes.Equal(rec.Value().PubKey(), pk) {
+				t.Fatal("record wasn't authored by the expected identity")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for record")
+		}
+	}
+
+	_, err = c.Create(util.JSONFromInstance(Person{Name: "Alice"}))
+	checkErr(t, err)
+	checkAuthor(identities[0])
+	_, err = c.Create(util.JSONFromInstance(Person{Name: "Bob"}), WithTxnToken(tokens[1]))
+	checkErr(t, err)
+	checkAuthor(identities[1])
+	if _, _, err := d.GetDBInfo(); err != nil {
+		t.Fatalf("getting db info with the default token should succeed: %v", err)
+	}
+}
+
+func TestWriteBatching(t *testing.T) {
+	t.Parallel()
+	stored := func(d *DB, id core.InstanceID) bool {
+		exists, err := d.datastore.Has(baseKey.ChildString("dummy").ChildString(id.String()))
+		checkErr(t, err)
+		return exists
+	}
+	newCollection := func(t *testing.T, d *DB) *Collection {
+		c, err := d.NewCollection(CollectionConfig{
+			Name:   "dummy",
+			Schema: util.SchemaFromInstance(&dummy{}, false),
+		})
+		checkErr(t, err)
+		return c
+	}
+
+	t.Run("FlushOnSize", func(t *testing.T) {
+		t.Parallel()
+		d, clean := createTestDB(t, WithNewDBWriteBatching(3, 0))
+		defer clean()
+		c := newCollection(t, d)
+		id1, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+		checkErr(t, err)
+		// Pending writes are visible to later writes in the batch
+		checkErr(t, c.WriteTxn(func(txn *Txn) error {
+			return txn.Save(util.JSONFromInstance(dummy{ID: id1, Name: "foo", Counter: 1}))
+		}))
+		if stored(d, id1) {
+			t.Fatalf("instance shouldn't be stored before the batch is flushed")
+		}
+		id2, err := c.Create(util.JSONFromInstance(dummy{Name: "bar"}))
+		checkErr(t, err)
+		if !stored(d, id1) || !stored(d, id2) {
+			t.Fatalf("instances should be stored after the batch is full")
+		}
+		res, err := c.FindByID(id1)
+		checkErr(t, err)
+		got := &dummy{}
+		util.InstanceFromJSON(res, got)
+		if got.Counter != 1 {
+			t.Fatalf("expected batched save to be applied, got %+v", got)
+		}
+	})
+	t.Run("FlushOnInterval", func(t *testing.T) {
+		t.Parallel()
+		d, clean := createTestDB(t, WithNewDBWriteBatching(100, time.Millisecond*100))
+		defer clean()
+		c := newCollection(t, d)
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+		checkErr(t, err)
+		if stored(d, id) {
+			t.Fatalf("instance shouldn't be stored before the interval elapses")
+		}
+		time.Sleep(time.Millisecond * 500)
+		if !stored(d, id) {
+			t.Fatalf("instance should be stored after the interval elapses")
+		}
+	})
+	t.Run("ExplicitFlush", func(t *testing.T) {
+		t.Parallel()
+		d, clean := createTestDB(t, WithNewDBWriteBatching(100, 0))
+		defer clean()
+		c := newCollection(t, d)
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+		checkErr(t, err)
+		checkErr(t, d.Flush())
+		if !stored(d, id) {
+			t.Fatalf("instance should be stored after flush")
+		}
+	})
+	t.Run("FlushOnRead", func(t *testing.T) {
+		t.Parallel()
+		d, clean := createTestDB(t, WithNewDBWriteBatching(100, 0))
+		defer clean()
+		c := newCollection(t, d)
+		_, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+		checkErr(t, err)
+		res, err := c.Find(Where("Name").Eq("foo"))
+		checkErr(t, err)
+		if len(res) != 1 {
+			t.Fatalf("expected pending write to be visible to reads, got %d results", len(res))
+		}
+	})
+	t.Run("FlushOnClose", func(t *testing.T) {
+		t.Parallel()
+		store := NewTxMapDatastore()
+		d, clean := createTestDB(t, WithNewDBWriteBatching(100, 0), func(o *NewDBOptions) error {
+			o.Datastore = store
+			return nil
+		})
+		defer clean()
+		c := newCollection(t, d)
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+		checkErr(t, err)
+		checkErr(t, d.Close())
+		exists, err := store.Has(baseKey.ChildString("dummy").ChildString(id.String()))
+		checkErr(t, err)
+		if !exists {
+			t.Fatalf("instance should be stored after close")
+		}
+	})
+	t.Run("FailedFlush", func(t *testing.T) {
+		t.Parallel()
+		d, clean := createTestDB(t, WithNewDBWriteBatching(2, 0))
+		defer clean()
+		c := newCollection(t, d)
+		fail := errors.New("fail")
+		remove := d.OnPreDispatch(func([]core.Event, bool) error { return fail })
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+		checkErr(t, err)
+		// The write filling the batch fails with it, and isn't kept
+		if _, err := c.Create(util.JSONFromInstance(dummy{Name: "bar"})); !errors.Is(err, fail) {
+			t.Fatalf("expected flush error, got %v", err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := d.Flush(); !errors.Is(err, fail) {
+				t.Fatalf("expected flush error, got %v", err)
+			}
+		}
+		remove()
+		res, err := c.Find(&Query{})
+		checkErr(t, err)
+		if len(res) != 1 || !stored(d, id) {
+			t.Fatalf("pending write should be kept until flushed, got %d results", len(res))
+		}
+	})
+	t.Run("ConcurrentReads", func(t *testing.T) {
+		t.Parallel()
+		d, clean := createTestDB(t, WithNewDBWriteBatching(100, 0))
+		defer clean()
+		c := newCollection(t, d)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					_, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+					checkErr(t, err)
+					_, err = c.Find(&Query{})
+					checkErr(t, err)
+				}
+			}()
+		}
+		wg.Wait()
+		res, err := c.Find(&Query{})
+		checkErr(t, err)
+		if len(res) != 40 {
+			t.Fatalf("expected 40 instances, got %d", len(res))
+		}
+	})
+}
+
+func TestDurability(t *testing.T) {
+	t.Parallel()
+	for _, mode := range []Durability{DurabilitySync, DurabilityAsync} {
+		store := &countingDatastore{TxnDatastore: NewTxMapDatastore()}
+		d, clean := createTestDB(t, WithNewDBDurability(mode), func(o *NewDBOptions) error {
+			o.Datastore = store
+			return nil
+		})
+		if d.Durability() != mode {
+			t.Fatalf("expected durability %d, got %d", mode, d.Durability())
+		}
+		c, err := d.NewCollection(CollectionConfig{
+			Name:   "dummy",
+			Schema: util.SchemaFromInstance(&dummy{}, false),
+		})
+		checkErr(t, err)
+		syncs := store.syncs
+		_, err = c.Create(util.JSONFromInstance(dummy{Name: "foo"}))
+		checkErr(t, err)
+		if mode == DurabilitySync && store.syncs == syncs {
+			t.Fatalf("commits should sync the datastore in sync mode")
+		}
+		if mode == DurabilityAsync && store.syncs != syncs {
+			t.Fatalf("commits shouldn't sync the datastore in async mode")
+		}
+		clean()
+	}
+	if err := WithNewDBDurability(Durability(5))(&NewDBOptions{}); err == nil {
+		t.Fatalf("unknown durability modes should be rejected")
+	}
+}
+
+func TestConflictResolver(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	// Keep the highest counter seen
+	resolver := func(collection string, id core.InstanceID, current, incoming []byte) ([]byte, error) {
+		calls++
+		c, i := &dummy{}, &dummy{}
+		util.InstanceFromJSON(current, c)
+		util.InstanceFromJSON(incoming, i)
+		if c.Counter > i.Counter {
+			return current, nil
+		}
+		return incoming, nil
+	}
+	d, clean := createTestDB(t, WithNewDBConflictResolver(resolver))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	id, err := c.Create(util.JSONFromInstance(dummy{Name: "foo", Counter: 1}))
+	checkErr(t, err)
+	local := util.JSONFromInstance(dummy{ID: id, Name: "foo", Counter: 10})
+	checkErr(t, c.Save(local))
+	if calls != 0 {
+		t.Fatalf("resolver shouldn't be called for local writes")
+	}
+
+	dispatchRemote := func(counter int) {
+		current, err := c.FindByID(id)
+		checkErr(t, err)
+		events, _, err := d.eventcodec.Create([]core.Action{{
+			Type:           core.Save,
+			InstanceID:     id,
+			CollectionName: "dummy",
+			Previous:       current,
+			Current:        util.JSONFromInstance(dummy{ID: id, Name: "foo", Counter: counter}),
+		}})
+		checkErr(t, err)
+		checkErr(t, d.dispatch(context.Background(), events))
+	}
+	assertCounter := func(expected int) {
+		res, err := c.FindByID(id)
+		checkErr(t, err)
+		got := &dummy{}
+		util.InstanceFromJSON(res, got)
+		if got.Counter != expected {
+			t.Fatalf("expected counter %d, got %d", expected, got.Counter)
+		}
+	}
+
+	dispatchRemote(5)
+	if calls != 1 {
+		t.Fatalf("expected resolver to be called once, got %d", calls)
+	}
+	assertCounter(10)
+	dispatchRemote(20)
+	assertCounter(20)
+	res, err := c.Find(Where("Counter").Eq(float64(20)))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("queries should see the resolved state")
+	}
+	// The local change was overwritten, so there's no conflict left
+	dispatchRemote(15)
+	if calls != 2 {
+		t.Fatalf("resolver shouldn't be called without local changes, got %d calls", calls)
+	}
+	assertCounter(15)
+
+	// Rebuilding reduces the remote events as remote again
+	checkErr(t, d.RebuildCollection(context.Background(), "dummy"))
+	if calls != 4 {
+		t.Fatalf("resolver should be called again when rebuilding, got %d calls", calls)
+	}
+	assertCounter(15)
+}
+
+func TestLamportOrdering(t *testing.T) {
+	t.Parallel()
+	id := core.NewInstanceID()
+	instance := func(name string, counter int) []byte {
+		return util.JSONFromInstance(dummy{ID: id, Name: name, Counter: counter})
+	}
+	type record struct {
+		events []core.Event
+		body   cid.Cid
+	}
+	codec := newDefaultEventCodec()
+	newRecord := func(a core.Action) record {
+		a.InstanceID, a.CollectionName = id, "dummy"
+		events, node, err := codec.Create([]core.Action{a})
+		checkErr(t, err)
+		return record{events: events, body: node.Cid()}
+	}
+	create := newRecord(core.Action{Type: core.Create, Current: instance("foo", 0), Clock: 1})
+	older := newRecord(core.Action{Type: core.Save, Previous: instance("foo", 0), Current: instance("older", 1), Clock: 2})
+	// Concurrent saves of the same clock are ordered by record CID.
+	saveA := newRecord(core.Action{Type: core.Save, Previous: instance("foo", 0), Current: instance("a", 2), Clock: 3})
+	saveB := newRecord(core.Action{Type: core.Save, Previous: instance("older", 1), Current: instance("b", 3), Clock: 3})
+	winner := "a"
+	if bytes.Compare(saveB.body.Bytes(), saveA.body.Bytes()) > 0 {
+		winner = "b"
+	}
+	del := newRecord(core.Action{Type: core.Delete, Clock: 4})
+
+	tests := []struct {
+		name     string
+		records  []record
+		expected string
+	}{
+		{"InOrder", []record{create, older, saveA, saveB}, winner},
+		{"Reversed", []record{create, saveB, saveA, older}, winner},
+		{"SaveBeforeCreate", []record{saveA, create, older, saveB}, winner},
+		{"Delete", []record{create, saveA, del, saveB}, ""},
+		{"DeleteFirst", []record{create, del, older, saveB, saveA}, ""},
+	}
+	// Every order must reach the same bytes.
+	var state []byte
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d, clean := createTestDB(t, WithNewDBLamportOrdering(true))
+			defer clean()
+			c, err := d.NewCollection(CollectionConfig{
+				Name:   "dummy",
+				Schema: util.SchemaFromInstance(&dummy{}, false),
+			})
+			checkErr(t, err)
+			for _, r := range tc.records {
+				checkErr(t, d.dispatchRecord(context.Background(), "", cid.Undef, r.body, r.events))
+			}
+			res, err := c.FindByID(id)
+			if tc.expected == "" {
+				if !errors.Is(err, ErrNotFound) {
+					t.Fatalf("expected the instance to be deleted, got %s", res)
+				}
+				return
+			}
+			checkErr(t, err)
+			got := &dummy{}
+			util.InstanceFromJSON(res, got)
+			if got.Name != tc.expected {
+				t.Fatalf("expected the save of %s to win, got %s", tc.expected, res)
+			}
+			if state == nil {
+				state = res
+			} else if !bytes.Equal(res, state) {
+				t.Fatalf("expected state %s, got %s", state, res)
+			}
+
+			// Local writes are ordered after every event received.
+			checkErr(t, c.Save(instance("local", 4)))
+			if d.clock.time != 4 {
+				t.Fatalf("expected clock 4 after a local write, got %d", d.clock.time)
+			}
+			checkErr(t, d.dispatchRecord(context.Background(), "", cid.Undef, older.body, older.events))
+			res, err = c.FindByID(id)
+			checkErr(t, err)
+			util.InstanceFromJSON(res, got)
+			if got.Name != "local" {
+				t.Fatalf("older events shouldn't overwrite local writes, got %s", res)
+			}
+		})
+	}
+	t.Run("FailedDispatch", func(t *testing.T) {
+		d, clean := createTestDB(t, WithNewDBLamportOrdering(true))
+		defer clean()
+		events, node, err := codec.Create([]core.Action{{
+			Type:           core.Create,
+			InstanceID:     id,
+			CollectionName: "missing",
+			Current:        instance("foo", 0),
+			Clock:          9,
+		}})
+		checkErr(t, err)
+		if err := d.dispatchRecord(context.Background(), "", cid.Undef, node.Cid(), events); err == nil {
+			t.Fatalf("expected dispatching to a missing collection to fail")
+		}
+		// Stamps and the clock are only saved along with the events
+		if _, ok, err := getStamp(d.datastore, "missing", id); err != nil || ok {
+			t.Fatalf("stamp of a failed dispatch shouldn't be saved, got %v", err)
+		}
+		if _, err := d.datastore.Get(dsDBClock); !errors.Is(err, ds.ErrNotFound) {
+			t.Fatalf("clock of a failed dispatch shouldn't be saved, got %v", err)
+		}
+	})
+}
+
+func TestDispatchHooks(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+
+	var pre, post int
+	errAbort := errors.New("abort")
+	abort := false
+	removePre := d.OnPreDispatch(func(events []core.Event, remote bool) error {
+		if remote || len(events) != 1 || events[0].Collection() != "dummy" {
+			t.Fatalf("unexpected pre-dispatch events")
+		}
+		pre++
+		if abort {
+			return errAbort
+		}
+		return nil
+	})
+	removePost := d.OnPostDispatch(func(events []core.Event, remote bool) {
+		if remote || len(events) != 1 {
+			t.Fatalf("unexpected post-dispatch events")
+		}
+		post++
+	})
+
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	if pre != 1 || post != 1 {
+		t.Fatalf("expected hooks to be called once, got %d and %d calls", pre, post)
+	}
+
+	abort = true
+	id, err := c.Create(util.JSONFromInstance(dummy{Name: "Aborted"}))
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("expected the pre-dispatch hook error, got %v", err)
+	}
+	if pre != 2 || post != 1 {
+		t.Fatalf("aborted dispatches shouldn't call post-dispatch hooks")
+	}
+	if ok, err := c.Has(id); err != nil || ok {
+		t.Fatalf("aborted instance shouldn't exist")
+	}
+
+	removePre()
+	removePost()
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	if pre != 2 || post != 1 {
+		t.Fatalf("removed hooks shouldn't be called")
+	}
+}
+
+func TestCollectionResolver(t *testing.T) {
+	t.Parallel()
+	var resolved []string
+	d, clean := createTestDB(t, WithNewDBCollectionResolver(func(name string) (CollectionConfig, error) {
+		resolved = append(resolved, name)
+		if name != "dummy" {
+			return CollectionConfig{}, errors.New("unknown collection")
+		}
+		return CollectionConfig{
+			Name:    "dummy",
+			Schema:  util.SchemaFromInstance(&dummy{}, false),
+			Indexes: []IndexConfig{{Path: "Name"}},
+		}, nil
+	}))
+	defer clean()
+
+	id := core.NewInstanceID()
+	events, _, err := d.eventcodec.Create([]core.Action{{
+		Type:           core.Create,
+		InstanceID:     id,
+		CollectionName: "dummy",
+		Current:        util.JSONFromInstance(dummy{ID: id, Name: "foo"}),
+	}})
+	checkErr(t, err)
+	checkErr(t, d.dispatch(context.Background(), events))
+	c := d.GetCollection("dummy")
+	if c == nil {
+		t.Fatalf("collection should be created by the resolver")
+	}
+	res, err := c.Find(Where("Name").Eq("foo"))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("event should be applied to the resolved collection")
+	}
+
+	events, _, err = d.eventcodec.Create([]core.Action{{
+		Type:           core.Create,
+		InstanceID:     core.NewInstanceID(),
+		CollectionName: "other",
+		Current:        util.JSONFromInstance(dummy{Name: "bar"}),
+	}})
+	checkErr(t, err)
+	if err := d.dispatch(context.Background(), events); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected unresolved collections to fail, got %v", err)
+	}
+	if len(resolved) != 2 {
+		t.Fatalf("expected the resolver to be called twice, got %d calls", len(resolved))
+	}
+}
+
+func TestThreadInfo(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+
+	time.Sleep(time.Millisecond * 500) // Records are created in the background
+
+	if !d.ThreadID().Defined() {
+		t.Fatalf("thread ID should be defined")
+	}
+	info, err := d.ThreadInfo(context.Background())
+	checkErr(t, err)
+	if !info.ID.Equals(d.ThreadID()) {
+		t.Fatalf("expected thread %s, got %s", d.ThreadID(), info.ID)
+	}
+	if len(info.Logs) != 1 || !info.Logs[0].Head.Defined() {
+		t.Fatalf("expected one log with a head")
+	}
+	addrs, _, err := d.GetDBInfo()
+	checkErr(t, err)
+	if len(info.Addrs) != len(addrs) {
+		t.Fatalf("expected the same addresses as the DB info")
+	}
+}
+
+func TestRecordRateLimit(t *testing.T) {
+	t.Parallel()
+	if err := WithNewDBRecordRateLimit(0, 1)(&NewDBOptions{}); err == nil {
+		t.Fatalf("zero record rate should be rejected")
+	}
+	d, clean := createTestDB(t, WithNewDBRecordRateLimit(10, 2))
+	defer clean()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.recordLimiter.wait(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 50)
+	if n := d.QueuedRecords(); n != 2 {
+		t.Fatalf("expected 2 queued records, got %d", n)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+		t.Fatalf("records exceeding the burst should wait, took %s", elapsed)
+	}
+	if n := d.QueuedRecords(); n != 0 {
+		t.Fatalf("expected no queued records, got %d", n)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t, WithNewDBReadOnly(true))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+
+	if _, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"})); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected create to fail, got %v", err)
+	}
+	if err := c.WriteTxn(func(txn *Txn) error { return nil }); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected write txn to fail, got %v", err)
+	}
+
+	id := core.NewInstanceID()
+	events, _, err := d.eventcodec.Create([]core.Action{{
+		Type:           core.Create,
+		InstanceID:     id,
+		CollectionName: "dummy",
+		Current:        util.JSONFromInstance(dummy{ID: id, Name: "foo"}),
+	}})
+	checkErr(t, err)
+	checkErr(t, d.dispatch(context.Background(), events))
+	if _, err := c.FindByID(id); err != nil {
+		t.Fatalf("remote events should be applied, got %v", err)
+	}
+	if err := c.Delete(id); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("expected delete to fail, got %v", err)
+	}
+}
+
+func TestPauseDispatch(t *testing.T) {
+	t.Parallel()
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	cc := CollectionConfig{Name: "dummy", Schema: util.SchemaFromInstance(&dummy{}, false)}
+	id1 := thread.NewIDV1(thread.Raw, 32)
+	d1, err := NewDB(context.Background(), n1, id1, WithNewDBRepoPath(tmpDir1), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d1.Close()
+
+	addrs, key, err := d1.GetDBInfo()
+	checkErr(t, err)
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+	// A queue of one record makes the next ones wait for resuming
+	d2, err := NewDBFromAddr(context.Background(), n2, addrs[0], key, WithNewDBRepoPath(tmpDir2),
+		WithNewDBCollections(cc), WithNewDBPausedQueueSize(1))
+	checkErr(t, err)
+	defer d2.Close()
+	time.Sleep(time.Second)
+
+	d2.PauseDispatch()
+	c1 := d1.GetCollection("dummy")
+	var ids []core.InstanceID
+	for i := 0; i < 3; i++ {
+		id, err := c1.Create(util.JSONFromInstance(dummy{Name: "Textile", Counter: i}))
+		checkErr(t, err)
+		ids = append(ids, id)
+	}
+	time.Sleep(time.Second * 2)
+	c2 := d2.GetCollection("dummy")
+	for _, id := range ids {
+		if ok, err := c2.Has(id); err != nil || ok {
+			t.Fatalf("records shouldn't be applied while paused")
+		}
+	}
+
+	d2.ResumeDispatch()
+	time.Sleep(time.Second * 2)
+	if ok, err := c2.HasMany(ids); err != nil || !ok {
+		t.Fatalf("records should be applied after resuming")
+	}
+}
+
+func TestTapRecords(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+
+	var lock sync.Mutex
+	var tapped []net.ThreadRecord
+	remove := d.TapRecords(func(rec net.ThreadRecord) {
+		lock.Lock()
+		defer lock.Unlock()
+		tapped = append(tapped, rec)
+	})
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	time.Sleep(time.Second)
+
+	info, err := d.ThreadInfo(context.Background())
+	checkErr(t, err)
+	lock.Lock()
+	if len(tapped) != 1 || tapped[0].LogID() != info.GetOwnLog().ID {
+		t.Fatalf("expected the tap to see the record of the own log, got %d records", len(tapped))
+	}
+	lock.Unlock()
+
+	remove()
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	time.Sleep(time.Second)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(tapped) != 1 {
+		t.Fatalf("removed taps shouldn't be called")
+	}
+}
+
+func TestShards(t *testing.T) {
+	t.Parallel()
+	tmpDir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir)
+	var shards []ds.TxnDatastore
+	factory := func(i int) (ds.TxnDatastore, error) {
+		shard, err := newDefaultDatastore(filepath.Join(tmpDir, fmt.Sprintf("shard%d", i)), false, DurabilitySync)
+		if err == nil {
+			shards = append(shards, shard)
+		}
+		return shard, err
+	}
+	d, clean := createTestDB(t, WithNewDBShards(3, factory))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:    "dummy",
+		Schema:  util.SchemaFromInstance(&dummy{}, false),
+		Indexes: []IndexConfig{{Path: "Counter"}},
+	})
+	checkErr(t, err)
+
+	var ids []core.InstanceID
+	for i := 0; i < 30; i++ {
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile", Counter: i % 2}))
+		checkErr(t, err)
+		ids = append(ids, id)
+	}
+	for i, shard := range shards {
+		res, err := shard.Query(query.Query{Prefix: c.BaseKey().String(), KeysOnly: true})
+		checkErr(t, err)
+		entries, err := res.Rest()
+		checkErr(t, err)
+		if len(entries) == 0 {
+			t.Fatalf("shard %d should store instances", i)
+		}
+	}
+
+	res, err := c.Find(nil)
+	checkErr(t, err)
+	if len(res) != len(ids) {
+		t.Fatalf("expected %d instances, got %d", len(ids), len(res))
+	}
+	for i := 1; i < len(res); i++ {
+		prev, next := &dummy{}, &dummy{}
+		util.InstanceFromJSON(res[i-1], prev)
+		util.InstanceFromJSON(res[i], next)
+		if prev.ID >= next.ID {
+			t.Fatalf("merged instances should be sorted by ID")
+		}
+	}
+	res, err = c.Find(Where("Counter").Eq(float64(1)).UseIndex("Counter"))
+	checkErr(t, err)
+	if len(res) != len(ids)/2 {
+		t.Fatalf("expected %d indexed instances, got %d", len(ids)/2, len(res))
+	}
+
+	checkErr(t, c.Delete(ids[0]))
+	if _, err := c.FindByID(ids[0]); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted instance shouldn't be found, got %v", err)
+	}
+	checkErr(t, c.Save(util.JSONFromInstance(dummy{ID: ids[1], Name: "Saved"})))
+	instance, err := c.FindByID(ids[1])
+	checkErr(t, err)
+	got := &dummy{}
+	util.InstanceFromJSON(instance, got)
+	if got.Name != "Saved" {
+		t.Fatalf("saved instance should be updated")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:    "dummy",
+		Schema:  util.SchemaFromInstance(&dummy{}, false),
+		Indexes: []IndexConfig{{Path: "Name"}},
+	})
+	checkErr(t, err)
+	id, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+	checkErr(t, c.Save(util.SetJSONID(id, util.JSONFromInstance(dummy{Name: "Textile", Counter: 42}))))
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Other"}))
+	checkErr(t, err)
+	time.Sleep(time.Second) // Wait for records to be added to the log
+
+	assertState := func() {
+		instance, err := c.FindByID(id)
+		checkErr(t, err)
+		v := &dummy{}
+		util.InstanceFromJSON(instance, v)
+		if v.Counter != 42 {
+			t.Fatalf("expected replayed counter 42, got %d", v.Counter)
+		}
+		found, err := c.Find(&Query{})
+		checkErr(t, err)
+		if len(found) != 2 {
+			t.Fatalf("expected 2 instances, got %d", len(found))
+		}
+		inconsistencies, err := c.VerifyIndexes()
+		checkErr(t, err)
+		if len(inconsistencies) != 0 {
+			t.Fatalf("expected consistent indexes, got %+v", inconsistencies)
+		}
+	}
+
+	// Applied records are skipped
+	checkErr(t, d.Replay(context.Background(), nil))
+	assertState()
+
+	// Lose the collection state
+	for _, prefix := range []ds.Key{c.BaseKey(), indexPrefix.Child(c.BaseKey()), dsDBAppliedRecords} {
+		res, err := d.datastore.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+		checkErr(t, err)
+		entries, err := res.Rest()
+		checkErr(t, err)
+		for _, e := range entries {
+			checkErr(t, d.datastore.Delete(ds.NewKey(e.Key)))
+		}
+	}
+	if _, err := c.FindByID(id); err != ErrNotFound {
+		t.Fatalf("expected lost instance, got %v", err)
+	}
+	checkErr(t, d.Replay(context.Background(), nil))
+	assertState()
+
+	info, err := d.connector.Net.GetThread(context.Background(), d.connector.ThreadID())
+	checkErr(t, err)
+	head, err := d.connector.Net.GetRecord(context.Background(), info.ID, info.GetOwnLog().Head)
+	checkErr(t, err)
+	checkErr(t, d.Replay(context.Background(), head))
+	assertState()
+
+	// Compact prunes applied markers, and replaying stays a no-op
+	checkErr(t, d.Compact(context.Background()))
+	res, err := d.datastore.Query(query.Query{Prefix: dsDBAppliedRecords.String(), KeysOnly: true})
+	checkErr(t, err)
+	markers, err := res.Rest()
+	checkErr(t, err)
+	if len(markers) != 0 {
+		t.Fatalf("expected applied markers to be pruned, got %d", len(markers))
+	}
+	checkErr(t, d.Replay(context.Background(), nil))
+	checkErr(t, d.Replay(context.Background(), head))
+	assertState()
+}
+
+func TestListeners(t *testing.T) {
+	t.Parallel()
+
+	assertActions := func(actions, expected []Action) {
+		if len(actions) != len(expected) {
+			t.Fatalf("number of actions isn't correct, expected %d, got %d", len(expected), len(actions))
+		}
+		for i := range actions {
+			if !reflect.DeepEqual(actions[i], expected[i]) {
+				t.Fatalf("wrong action detect, expected %v, got %v", expected[i], actions[i])
+			}
+		}
+	}
+
+	t.Run("AllDBEvents", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t)
+		expected := []Action{
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
+			{Collection: "Collection2", Type: ActionCreate, ID: "id-j1"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
+			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
+			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		}
+		assertActions(actions, expected)
+	})
+	t.Run("AnyCollection1Events", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection1"})
+		expected := []Action{
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		}
+		assertActions(actions, expected)
+	})
+	t.Run("AnyCollection2Events", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection2"})
+		expected := []Action{
+			{Collection: "Collection2", Type: ActionCreate, ID: "id-j1"},
+			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
+			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
+		}
+		assertActions(actions, expected)
+	})
+	t.Run("AnyCreateEvent", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t, ListenOption{Type: ListenCreate})
+		expected := []Action{
+			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
+			{Collection: "Collection2", Type: ActionCreate, ID: "id-j1"},
+		}
+		assertActions(actions, expected)
+	})
+	t.Run("AnySaveEvent", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t, ListenOption{Type: ListenSave})
+		expected := []Action{
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
+			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
+		}
+		assertActions(actions, expected)
+	})
+	t.Run("AnyDeleteEvent", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t, ListenOption{Type: ListenDelete})
+		expected := []Action{
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
+			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		}
+		assertActions(actions, expected)
+	})
+	t.Run("AnyCollection1OrDeleteCollection2Events", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection1"}, ListenOption{Collection: "Collection2", Type: ListenDelete})
+		expected := []Action{
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
+			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		}
+		assertActions(actions, expected)
+	})
+	t.Run("EmptyFilterEvent", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection3"})
+		var expected []Action
+		assertActions(actions, expected)
+	})
+	t.Run("MixedComplexEvent", func(t *testing.T) {
+		t.Parallel()
+		actions := runListenersComplexUseCase(t,
+			ListenOption{Collection: "Collection2", Type: ListenSave},
+			ListenOption{Collection: "Collection1", Type: ListenSave, ID: "id-i2"},
+			ListenOption{Collection: "Collection1", Type: ListenDelete, ID: "id-i1"},
+			ListenOption{Collection: "Collection2", Type: ListenDelete},
+		)
+		expected := []Action{
+			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
+			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
+			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
+			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
+		}
+		assertActions(actions, expected)
+	})
+}
+
+// runListenersComplexUseCase runs a complex db use-case, and returns
+// Actions received with the ...ListenOption provided.
+func runListenersComplexUseCase(t *testing.T, los ...ListenOption) []Action {
+	t.Helper()
+	d, cls := createTestDB(t)
+	cc1 := CollectionConfig{
+		Name:   "Collection1",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}
+	c1, err := d.NewCollection(cc1)
+	checkErr(t, err)
+	cc2 := CollectionConfig{
+		Name:   "Collection2",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}
+	c2, err := d.NewCollection(cc2)
+	checkErr(t, err)
+
+	// Create some instance *before* any listener, just to test doesn't appear
+	// on listener Action stream.
+	i1 := util.JSONFromInstance(dummy{ID: "id-i1", Name: "Textile1"})
+	i1Ids, err := c1.Create(i1)
+	checkErr(t, err)
+
+	l, err := d.Listen(los...)
+	checkErr(t, err)
+	var actions []Action
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		for a := range l.Channel() {
+			actions = append(actions, a)
+		}
+		wg.Done()
+	}()
+
+	// Collection1 Save i1
+	i1 = util.SetJSONProperty("Name", "Textile0", i1)
+	checkErr(t, c1.Save(i1))
+
+	// Collection1 Create i2
+	i2 := util.JSONFromInstance(dummy{ID: "id-i2", Name: "Textile2"})
+	i2Ids, err := c1.Create(i2)
+	checkErr(t, err)
+
+	// Collection2 Create j1
+	j1 := util.JSONFromInstance(dummy{ID: "id-j1", Name: "Textile3"})
+	j1Ids, err := c2.Create(j1)
+	checkErr(t, err)
+
+	// Collection1 Save i1
+	// Collection1 Save i2
+	err = c1.WriteTxn(func(txn *Txn) error {
+		i1 = util.SetJSONProperty("Counter", 30, i1)
+		i2 = util.SetJSONProperty("Counter", 11, i2)
+		return txn.Save(i1, i2)
+	})
+	checkErr(t, err)
+
+	// Collection2 Save j1
+	j1 = util.SetJSONProperty("Counter", -1, j1)
+	j1 = util.SetJSONProperty("Name", "Textile33", j1)
+	checkErr(t, c2.Save(j1))
+
+	checkErr(t, c1.Delete(i1Ids))
+
+	// Collection2 Delete
+	checkErr(t, c2.Delete(j1Ids))
+
+	// Collection2 Delete i2
+	checkErr(t, c1.Delete(i2Ids))
+
+	l.Close()
+	cls()
+	wg.Wait()
+	// Expected generated actions:
+	// Collection1 Save i1
+	// Collection1 Create i2
+	// Collection2 Create j1
+	// Save i1
+	// Save i2
+	// Collection2 Save j1
+	// Delete i1
+	// Collection2 Delete j1
+	// Delete i2
+
+	return actions
+}
+
+func TestTxnLimits(t *testing.T) {
+	t.Parallel()
+	newCollection := func(t *testing.T, opts ...NewDBOption) (*Collection, *DB, func()) {
+		d, clean := createTestDB(t, opts...)
+		c, err := d.NewCollection(CollectionConfig{
+			Name:   "dummy",
+			Schema: util.SchemaFromInstance(&dummy{}, false),
+		})
+		checkErr(t, err)
+		return c, d, clean
+	}
+	// hold runs a transaction with run until release is closed.
+	hold := func(run func(func(*Txn) error, ...TxnOption) error) (release func(), done chan error) {
+		started := make(chan struct{})
+		stop := make(chan struct{})
+		done = make(chan error, 1)
+		go func() {
+			done <- run(func(*Txn) error {
+				close(started)
+				<-stop
+				return nil
+			})
+		}()
+		<-started
+		return func() { close(stop) }, done
+	}
+
+	t.Run("Fail", func(t *testing.T) {
+		t.Parallel()
+		c, d, clean := newCollection(t, WithNewDBTxnLimits(1, 1, FailOnTxnLimit))
+		defer clean()
+		release, done := hold(c.WriteTxn)
+		if _, writes := d.InFlightTxns(); writes != 1 {
+			t.Fatalf("expected 1 write txn in flight, got %d", writes)
+		}
+		if _, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile"})); !errors.Is(err, ErrTooManyTxns) {
+			t.Fatalf("expected ErrTooManyTxns, got %v", err)
+		}
+		release()
+		checkErr(t, <-done)
+		_, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+		checkErr(t, err)
+
+		release, done = hold(c.ReadTxn)
+		if reads, _ := d.InFlightTxns(); reads != 1 {
+			t.Fatalf("expected 1 read txn in flight, got %d", reads)
+		}
+		if _, err := c.Find(&Query{}); !errors.Is(err, ErrTooManyTxns) {
+			t.Fatalf("expected ErrTooManyTxns, got %v", err)
+		}
+		release()
+		checkErr(t, <-done)
+		if reads, writes := d.InFlightTxns(); reads != 0 || writes != 0 {
+			t.Fatalf("expected no txns in flight, got %d reads and %d writes", reads, writes)
+		}
+	})
+	t.Run("Block", func(t *testing.T) {
+		t.Parallel()
+		c, _, clean := newCollection(t, WithNewDBTxnLimits(0, 1, BlockOnTxnLimit))
+		defer clean()
+		release, done := hold(c.ReadTxn)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		if _, err := c.Find(&Query{}, WithTxnContext(ctx)); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", err)
+		}
+		errs := make(chan error, 1)
+		go func() {
+			_, err := c.Find(&Query{})
+			errs <- err
+		}()
+		time.Sleep(50 * time.Millisecond)
+		release()
+		checkErr(t, <-done)
+		checkErr(t, <-errs)
+	})
+}
+
+func TestCoalesceNotifications(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t, WithNewDBCoalesceNotifications(time.Second))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
 	checkErr(t, err)
-	defer os.RemoveAll(tmpDir)
+	l, err := d.Listen()
+	checkErr(t, err)
+	var lock sync.Mutex
+	var actions []Action
+	done := make(chan struct{})
+	go func() {
+		for a := range l.Channel() {
+			lock.Lock()
+			actions = append(actions, a)
+			lock.Unlock()
+		}
+		close(done)
+	}()
 
-	n, err := common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	a := util.JSONFromInstance(dummy{ID: "a", Name: "A"})
+	_, err = c.Create(a)
+	checkErr(t, err)
+	for i := 1; i <= 3; i++ {
+		checkErr(t, c.Save(util.SetJSONProperty("Counter", i, a)))
+	}
+	b := util.JSONFromInstance(dummy{ID: "b", Name: "B"})
+	_, err = c.Create(b)
 	checkErr(t, err)
+	checkErr(t, c.Save(util.SetJSONProperty("Counter", 1, b)))
+	checkErr(t, c.Delete("a"))
+	checkErr(t, c.Save(util.SetJSONProperty("Counter", 2, b)))
+	expected := []Action{
+		{Collection: "dummy", Type: ActionCreate, ID: "a"},
+		{Collection: "dummy", Type: ActionSave, ID: "a"},
+		{Collection: "dummy", Type: ActionCreate, ID: "b"},
+		{Collection: "dummy", Type: ActionSave, ID: "b"},
+		{Collection: "dummy", Type: ActionDelete, ID: "a"},
+	}
+	time.Sleep(2500 * time.Millisecond)
+	lock.Lock()
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected coalesced actions %v, got %v", expected, actions)
+	}
+	lock.Unlock()
 
-	ec := &mockEventCodec{}
-	id := thread.NewIDV1(thread.Raw, 32)
-	d, err := NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir), WithNewDBEventCodec(ec))
+	// Saves after a notification aren't coalesced into it.
+	checkErr(t, c.Save(util.SetJSONProperty("Counter", 3, b)))
+	time.Sleep(2500 * time.Millisecond)
+	l.Close()
+	<-done
+	expected = append(expected, Action{Collection: "dummy", Type: ActionSave, ID: "b"})
+	if !reflect.DeepEqual(actions, expected) {
+		t.Fatalf("expected actions %v, got %v", expected, actions)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	id, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile", Counter: 1}))
 	checkErr(t, err)
+	counterIs := func(n int) func([]byte) bool {
+		return func(instance []byte) bool {
+			if instance == nil {
+				return false
+			}
+			v := &dummy{}
+			util.InstanceFromJSON(instance, v)
+			return v.Counter == n
+		}
+	}
 
-	m, err := d.NewCollection(CollectionConfig{
+	// An already satisfied state resolves right away.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	checkErr(t, c.WaitFor(ctx, id, counterIs(1)))
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- c.WaitFor(ctx, id, counterIs(3))
+	}()
+	for i := 2; i <= 3; i++ {
+		time.Sleep(50 * time.Millisecond)
+		checkErr(t, c.Save(util.JSONFromInstance(dummy{ID: id, Name: "Textile", Counter: i})))
+	}
+	checkErr(t, <-errs)
+
+	go func() {
+		errs <- c.WaitFor(ctx, id, func(instance []byte) bool { return instance == nil })
+	}()
+	time.Sleep(50 * time.Millisecond)
+	checkErr(t, c.Delete(id))
+	checkErr(t, <-errs)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := c.WaitFor(ctx, id, counterIs(4)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestSchemaVersion(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t, WithNewDBIncompatibleEvents(RejectIncompatibleEvents))
+	defer clean()
+	if _, err := d.NewCollection(CollectionConfig{
+		Name:          "dummy",
+		Schema:        util.SchemaFromInstance(&dummy{}, false),
+		SchemaVersion: -1,
+	}); err == nil {
+		t.Fatalf("negative schema versions should be rejected")
+	}
+	c, err := d.NewCollection(CollectionConfig{
+		Name:                "dummy",
+		Schema:              util.SchemaFromInstance(&dummy{}, false),
+		SchemaVersion:       2,
+		SchemaCompatibility: SchemaCompatBackward,
+	})
+	checkErr(t, err)
+	version, err := d.SchemaVersion("dummy")
+	checkErr(t, err)
+	if version != 2 {
+		t.Fatalf("expected schema version 2, got %d", version)
+	}
+	if _, err := d.SchemaVersion("missing"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected collection not found, got %v", err)
+	}
+
+	dispatchVersion := func(version int) core.InstanceID {
+		id := core.NewInstanceID()
+		events, _, err := d.eventcodec.Create([]core.Action{{
+			Type:           core.Create,
+			InstanceID:     id,
+			CollectionName: "dummy",
+			Current:        util.JSONFromInstance(dummy{ID: id, Name: "Remote"}),
+			SchemaVersion:  version,
+		}})
+		checkErr(t, err)
+		checkErr(t, d.dispatch(context.Background(), events))
+		return id
+	}
+	for version, applied := range map[int]bool{0: true, 1: true, 2: true, 3: false} {
+		exists, err := c.Has(dispatchVersion(version))
+		checkErr(t, err)
+		if exists != applied {
+			t.Fatalf("event of schema version %d should be applied: %v", version, applied)
+		}
+	}
+}
+
+func TestDumpEvents(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
 		Name:   "dummy",
 		Schema: util.SchemaFromInstance(&dummy{}, false),
 	})
 	checkErr(t, err)
-	_, err = m.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	o, err := d.NewCollection(CollectionConfig{
+		Name:   "other",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
 	checkErr(t, err)
 
-	if !ec.called {
-		t.Fatalf("custom event codec wasn't called")
+	dummyJSON := util.JSONFromInstance(dummy{Name: "Textile"})
+	id, err := c.Create(dummyJSON)
+	checkErr(t, err)
+	checkErr(t, c.Save(util.SetJSONProperty("Counter", 1, util.SetJSONID(id, dummyJSON))))
+	checkErr(t, c.Delete(id))
+	_, err = o.Create(util.JSONFromInstance(dummy{Name: "Other"}))
+	checkErr(t, err)
+
+	all, err := d.DumpEvents("")
+	checkErr(t, err)
+	if len(all) != 4 {
+		t.Fatalf("expected 4 events, got %d", len(all))
 	}
+	events, err := d.DumpEvents("dummy")
+	checkErr(t, err)
+	expected := []ActionType{ActionCreate, ActionSave, ActionDelete}
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d", len(expected), len(events))
+	}
+	for i, e := range events {
+		if e.Collection != "dummy" || e.InstanceID != id {
+			t.Fatalf("unexpected event %+v", e)
+		}
+		if e.Type != expected[i] {
+			t.Fatalf("expected event %d to have type %d, got %d", i, expected[i], e.Type)
+		}
+		if i > 0 && e.Time.Before(events[i-1].Time) {
+			t.Fatalf("events should be sorted by time")
+		}
+	}
+}
 
-	// Re-do again to re-use key. If something wasn't closed correctly, would fail
-	checkErr(t, n.Close())
-	checkErr(t, d.Close())
+func TestSnapshot(t *testing.T) {
+	t.Parallel()
+	tmpDir1, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir1)
+	n1, err := common.DefaultNetwork(tmpDir1, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n1.Close()
+
+	cc := CollectionConfig{
+		Name:    "dummy",
+		Schema:  util.SchemaFromInstance(&dummy{}, false),
+		Indexes: []IndexConfig{{Path: "Name", Unique: true}},
+	}
+	d1, err := NewDB(context.Background(), n1, thread.NewIDV1(thread.Raw, 32), WithNewDBRepoPath(tmpDir1), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d1.Close()
+	c1 := d1.GetCollection("dummy")
+	for _, name := range []string{"Alice", "Bob"} {
+		_, err := c1.Create(util.JSONFromInstance(dummy{Name: name}))
+		checkErr(t, err)
+	}
+	var snapshot bytes.Buffer
+	checkErr(t, d1.Snapshot(context.Background(), &snapshot))
+
+	addrs, key, err := d1.GetDBInfo()
+	checkErr(t, err)
+	tmpDir2, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(tmpDir2)
+	n2, err := common.DefaultNetwork(tmpDir2, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n2.Close()
+	d2, err := NewDBFromAddr(context.Background(), n2, addrs[0], key, WithNewDBRepoPath(tmpDir2), WithNewDBCollections(cc))
+	checkErr(t, err)
+	defer d2.Close()
+
+	tampered := append([]byte{}, snapshot.Bytes()...)
+	tampered[len(tampered)/2] ^= 0xff
+	if err := d2.LoadSnapshot(context.Background(), bytes.NewReader(tampered)); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("loading a tampered snapshot: expected ErrInvalidSnapshot, got %v", err)
+	}
+	checkErr(t, d2.LoadSnapshot(context.Background(), bytes.NewReader(snapshot.Bytes())))
+	c2 := d2.GetCollection("dummy")
+	res, err := c2.Find(Where("Name").Eq("Alice").UseIndex("Name"))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("expected the snapshot instance to be indexed, got %d results", len(res))
+	}
 
+	// Records after the snapshot are synced incrementally.
+	id, err := c1.Create(util.JSONFromInstance(dummy{Name: "Charlie"}))
+	checkErr(t, err)
 	time.Sleep(time.Second * 3)
-	n, err = common.DefaultNetwork(tmpDir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	if ok, err := c2.Has(id); err != nil || !ok {
+		t.Fatalf("records missing from the snapshot should be applied")
+	}
+	all, err := c2.Find(&Query{})
 	checkErr(t, err)
-	defer n.Close()
-	d, err = NewDB(context.Background(), n, id, WithNewDBRepoPath(tmpDir), WithNewDBEventCodec(ec))
+	if len(all) != 3 {
+		t.Fatalf("expected 3 instances, got %d", len(all))
+	}
+	if err := d2.LoadSnapshot(context.Background(), bytes.NewReader(snapshot.Bytes())); err == nil {
+		t.Fatalf("snapshots missing applied records should be rejected")
+	}
+	if err := d2.RebuildCollection(context.Background(), "dummy"); !errors.Is(err, ErrLoadedFromSnapshot) {
+		t.Fatalf("rebuilding a collection loaded from a snapshot: expected ErrLoadedFromSnapshot, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	checkErr(t, d2.WaitForSync(ctx))
+
+	// Peers of the thread can only sign snapshots others accept if they're
+	// accepted signers.
+	var snapshot2 bytes.Buffer
+	checkErr(t, d2.Snapshot(context.Background(), &snapshot2))
+	if err := d1.LoadSnapshot(context.Background(), bytes.NewReader(snapshot2.Bytes())); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("loading a snapshot of a peer that isn't accepted: expected ErrInvalidSnapshot, got %v", err)
+	}
+
+	d3, clean := createTestDB(t, WithNewDBCollections(cc))
+	defer clean()
+	if err := d3.LoadSnapshot(context.Background(), bytes.NewReader(snapshot.Bytes())); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Fatalf("loading a snapshot of another thread: expected ErrInvalidSnapshot, got %v", err)
+	}
+}
+
+func TestRebuildCollection(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:    "dummy",
+		Schema:  util.SchemaFromInstance(&dummy{}, false),
+		Indexes: []IndexConfig{{Path: "Name"}},
+	})
+	checkErr(t, err)
+	other, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy2",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+
+	dummyJSON := util.JSONFromInstance(dummy{Name: "Textile1"})
+	id1, err := c.Create(dummyJSON)
+	checkErr(t, err)
+	checkErr(t, c.Save(util.SetJSONProperty("Counter", 2, util.SetJSONID(id1, dummyJSON))))
+	id2, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile2"}))
+	checkErr(t, err)
+	checkErr(t, c.Delete(id2))
+	otherID, err := other.Create(util.JSONFromInstance(dummy{Name: "Other"}))
+	checkErr(t, err)
+
+	// Corrupt the collection state.
+	key := baseKey.ChildString("dummy").ChildString(id1.String())
+	checkErr(t, d.datastore.Put(key, []byte("{")))
+	checkErr(t, d.datastore.Put(baseKey.ChildString("dummy").ChildString("stray"), []byte("{}")))
+
+	checkErr(t, d.RebuildCollection(context.Background(), "dummy"))
+
+	res, err := c.FindByID(id1)
+	checkErr(t, err)
+	instance := &dummy{}
+	util.InstanceFromJSON(res, instance)
+	if instance.Name != "Textile1" || instance.Counter != 2 {
+		t.Fatalf("instance should be rebuilt from its events, got %+v", instance)
+	}
+	if _, err := c.FindByID(id2); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("deleted instance should stay deleted")
+	}
+	if _, err := c.FindByID("stray"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("instances without events should be cleared")
+	}
+	found, err := c.Find(Where("Name").Eq("Textile1").UseIndex("Name"))
+	checkErr(t, err)
+	if len(found) != 1 {
+		t.Fatalf("index should be rebuilt, found %d instances", len(found))
+	}
+	if _, err := other.FindByID(otherID); err != nil {
+		t.Fatalf("other collections shouldn't be touched: %v", err)
+	}
+
+	if err := d.RebuildCollection(context.Background(), "missing"); !errors.Is(err, ErrCollectionNotFound) {
+		t.Fatalf("expected ErrCollectionNotFound, got %v", err)
+	}
+}
+
+func TestFindAsOf(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:    "dummy",
+		Schema:  util.SchemaFromInstance(&dummy{}, false),
+		Indexes: []IndexConfig{{Path: "Name"}},
+	})
+	checkErr(t, err)
+
+	// lastRecord waits for a record after head to be added to the own log.
+	ctx := context.Background()
+	head := cid.Undef
+	lastRecord := func() net.Record {
+		for i := 0; i < 50; i++ {
+			info, err := d.connector.Net.GetThread(ctx, d.connector.ThreadID())
+			checkErr(t, err)
+			if own := info.GetOwnLog(); own != nil && own.Head.Defined() && !own.Head.Equals(head) {
+				head = own.Head
+				rec, err := d.connector.Net.GetRecord(ctx, d.connector.ThreadID(), head)
+				checkErr(t, err)
+				return rec
+			}
+			time.Sleep(time.Millisecond * 100)
+		}
+		t.Fatal("record wasn't added to the log")
+		return nil
+	}
+	id1, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile1"}))
+	checkErr(t, err)
+	created := lastRecord()
+	checkErr(t, c.Save(util.JSONFromInstance(dummy{ID: id1, Name: "Textile1", Counter: 1})))
+	saved := lastRecord()
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile2"}))
+	checkErr(t, err)
+	createdOther := lastRecord()
+	checkErr(t, c.Delete(id1))
+	deleted := lastRecord()
+
+	tests := []struct {
+		name     string
+		record   net.Record
+		query    *Query
+		expected int
+	}{
+		{"Created", created, &Query{}, 1},
+		{"CreatedCounter", created, Where("Counter").Eq(float64(1)), 0},
+		{"Saved", saved, Where("Counter").Eq(float64(1)), 1},
+		{"CreatedOther", createdOther, &Query{}, 2},
+		{"CreatedOtherIndex", createdOther, Where("Name").Eq("Textile1").UseIndex("Name"), 1},
+		{"Deleted", deleted, Where("Name").Eq("Textile1").UseIndex("Name"), 0},
+	}
+	for _, tc := range tests {
+		res, err := c.FindAsOf(ctx, tc.record, tc.query)
+		checkErr(t, err)
+		if len(res) != tc.expected {
+			t.Fatalf("%s: expected %d instances, got %d", tc.name, tc.expected, len(res))
+		}
+	}
+	res, err := c.Find(&Query{})
 	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("the current state shouldn't change, got %d instances", len(res))
+	}
+
+	// Views are rebuilt from the records, so compacted events are included.
+	checkErr(t, d.Compact(ctx))
+	res, err = c.FindAsOf(ctx, saved, Where("Counter").Eq(float64(1)))
+	checkErr(t, err)
+	if len(res) != 1 {
+		t.Fatalf("after compacting: expected 1 instance, got %d", len(res))
+	}
+}
+
+func TestInstanceKeys(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	id, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
+
+	key := KeyForInstance("dummy", id)
+	if ok, err := d.datastore.Has(key); err != nil || !ok {
+		t.Fatalf("instance should be stored at %s", key)
+	}
+	collection, parsed, ok := ParseInstanceKey(key)
+	if !ok || collection != "dummy" || parsed != id {
+		t.Fatalf("expected dummy/%s, got %s/%s (%v)", id, collection, parsed, ok)
+	}
+	for _, k := range []ds.Key{
+		dsDBSchemas.ChildString("dummy"),
+		baseKey.ChildString("dummy"),
+		key.ChildString("extra"),
+	} {
+		if _, _, ok := ParseInstanceKey(k); ok {
+			t.Fatalf("%s isn't an instance key", k)
+		}
+	}
+}
+
+func TestRawQuery(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	ids := make(map[core.InstanceID]bool)
+	for _, name := range []string{"Textile", "Threads"} {
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: name}))
+		checkErr(t, err)
+		ids[id] = true
+	}
+
+	res, err := d.RawQuery(query.Query{Prefix: baseKey.ChildString("dummy").String()})
+	checkErr(t, err)
+	n := 0
+	for r := range res.Next() {
+		checkErr(t, r.Error)
+		collection, id, ok := ParseInstanceKey(ds.NewKey(r.Key))
+		if !ok || collection != "dummy" || !ids[id] {
+			t.Fatalf("unexpected key %s", r.Key)
+		}
+		// Results are read from a snapshot, so writing doesn't block.
+		_, err := c.Create(util.JSONFromInstance(dummy{Name: "Other"}))
+		checkErr(t, err)
+		n++
+	}
+	checkErr(t, res.Close())
+	if n != len(ids) {
+		t.Fatalf("expected %d results, got %d", len(ids), n)
+	}
+
 	checkErr(t, d.Close())
+	if _, err := d.RawQuery(query.Query{}); !errors.Is(err, ErrDBClosed) {
+		t.Fatalf("expected ErrDBClosed, got %v", err)
+	}
 }
 
-func TestListeners(t *testing.T) {
+func TestFederatedThreads(t *testing.T) {
 	t.Parallel()
+	dir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer func() { _ = os.RemoveAll(dir) }()
+	n, err := common.DefaultNetwork(dir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+	newDB := func(name string, id thread.ID, opts ...NewDBOption) (*DB, *Collection) {
+		opts = append(opts, WithNewDBRepoPath(filepath.Join(dir, name)))
+		d, err := NewDB(context.Background(), n, id, opts...)
+		checkErr(t, err)
+		c, err := d.NewCollection(CollectionConfig{
+			Name:   "dummy",
+			Schema: util.SchemaFromInstance(&dummy{}, false),
+		})
+		checkErr(t, err)
+		return d, c
+	}
 
-	assertActions := func(actions, expected []Action) {
-		if len(actions) != len(expected) {
-			t.Fatalf("number of actions isn't correct, expected %d, got %d", len(expected), len(actions))
+	// Each shard DB writes to its own thread.
+	shardA, shardB := thread.NewIDV1(thread.Raw, 32), thread.NewIDV1(thread.Raw, 32)
+	dA, cA := newDB("a", shardA)
+	defer dA.Close()
+	dB, cB := newDB("b", shardB)
+	defer dB.Close()
+
+	var lock sync.Mutex
+	resolved := 0
+	resolver := func(collection string, id core.InstanceID, current, incoming []byte) ([]byte, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		resolved++
+		// Greatest name wins
+		var cur, in dummy
+		util.InstanceFromJSON(current, &cur)
+		util.InstanceFromJSON(incoming, &in)
+		if cur.Name > in.Name {
+			return current, nil
 		}
-		for i := range actions {
-			if !reflect.DeepEqual(actions[i], expected[i]) {
-				t.Fatalf("wrong action detect, expected %v, got %v", expected[i], actions[i])
+		return incoming, nil
+	}
+	own := thread.NewIDV1(thread.Raw, 32)
+	d, c := newDB("federated", own, WithNewDBFederatedThreads(shardA, shardB), WithNewDBConflictResolver(resolver))
+	defer d.Close()
+	if ids := d.FederatedThreads(); len(ids) != 2 || ids[0] != shardA || ids[1] != shardB {
+		t.Fatalf("unexpected federated threads %v", ids)
+	}
+
+	waitForName := func(id core.InstanceID, name string) {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			if b, err := c.FindByID(id); err == nil {
+				var v dummy
+				util.InstanceFromJSON(b, &v)
+				if v.Name == name {
+					return
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		t.Fatalf("instance %s wasn't named %s", id, name)
+	}
+	checkOrigin := func(id core.InstanceID, expected thread.ID) {
+		t.Helper()
+		origin, err := c.Origin(id)
+		checkErr(t, err)
+		if origin != expected {
+			t.Fatalf("expected origin %s, got %s", expected, origin)
+		}
+	}
+
+	idA, err := cA.Create(util.JSONFromInstance(dummy{Name: "a"}))
+	checkErr(t, err)
+	idB, err := cB.Create(util.JSONFromInstance(dummy{Name: "b"}))
+	checkErr(t, err)
+	waitForName(idA, "a")
+	waitForName(idB, "b")
+	checkOrigin(idA, shardA)
+	checkOrigin(idB, shardB)
+	idLocal, err := c.Create(util.JSONFromInstance(dummy{Name: "local"}))
+	checkErr(t, err)
+	checkOrigin(idLocal, own)
+	if _, err := c.Origin(core.NewInstanceID()); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	// Local writes only go to the DB thread.
+	time.Sleep(time.Second)
+	if exists, err := cA.Has(idLocal); err != nil || exists {
+		t.Fatalf("local instance shouldn't be in shard threads")
+	}
+
+	// Both shards write the same instance.
+	shared := core.NewInstanceID()
+	_, err = cA.Create(util.JSONFromInstance(dummy{ID: shared, Name: "a1"}))
+	checkErr(t, err)
+	waitForName(shared, "a1")
+	// Creating an instance created from another thread is skipped.
+	_, err = cB.Create(util.JSONFromInstance(dummy{ID: shared, Name: "b0"}))
+	checkErr(t, err)
+	checkErr(t, cB.Save(util.JSONFromInstance(dummy{ID: shared, Name: "b1"})))
+	waitForName(shared, "b1")
+	checkOrigin(shared, shardB)
+	checkErr(t, cA.Save(util.JSONFromInstance(dummy{ID: shared, Name: "a2"})))
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		done := resolved == 2
+		lock.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	waitForName(shared, "b1")
+	checkOrigin(shared, shardA)
+	lock.Lock()
+	if resolved != 2 {
+		t.Fatalf("expected 2 resolved conflicts, got %d", resolved)
+	}
+	lock.Unlock()
+
+	checkErr(t, c.Save(util.JSONFromInstance(dummy{ID: shared, Name: "local"})))
+	checkOrigin(shared, own)
+}
+
+func TestLocalEventsBusPolicy(t *testing.T) {
+	t.Parallel()
+	create := func(c *Collection, n int) error {
+		for i := 0; i < n; i++ {
+			if _, err := c.Create(util.JSONFromInstance(dummy{Name: "foo"})); err != nil {
+				return err
 			}
 		}
+		return nil
 	}
-
-	t.Run("AllDBEvents", func(t *testing.T) {
+	t.Run("DropOldest", func(t *testing.T) {
 		t.Parallel()
-		actions := runListenersComplexUseCase(t)
-		expected := []Action{
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
-			{Collection: "Collection2", Type: ActionCreate, ID: "id-j1"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
-			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
-			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		m := &mockMetrics{}
+		d, clean := createTestDB(t, WithNewDBMetrics(m), WithNewDBLocalEventsBus(2, app.LocalEventsDropOldest))
+		defer clean()
+		c, err := d.NewCollection(CollectionConfig{
+			Name:   "dummy",
+			Schema: util.SchemaFromInstance(&dummy{}, false),
+		})
+		checkErr(t, err)
+		// A listener that never receives doesn't stall writes.
+		l := d.LocalEventListen()
+		defer l.Discard()
+		start := time.Now()
+		checkErr(t, create(c, 6))
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Fatalf("writes were stalled for %s", elapsed)
 		}
-		assertActions(actions, expected)
-	})
-	t.Run("AnyCollection1Events", func(t *testing.T) {
-		t.Parallel()
-		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection1"})
-		expected := []Action{
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		m.lock.Lock()
+		dropped := m.dropped
+		m.lock.Unlock()
+		// The listener holds 3 events, its buffer plus the one being received.
+		if dropped < 3 {
+			t.Fatalf("expected at least 3 dropped events, got %d", dropped)
 		}
-		assertActions(actions, expected)
-	})
-	t.Run("AnyCollection2Events", func(t *testing.T) {
-		t.Parallel()
-		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection2"})
-		expected := []Action{
-			{Collection: "Collection2", Type: ActionCreate, ID: "id-j1"},
-			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
-			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
+		select {
+		case <-l.Channel():
+		case <-time.After(time.Second):
+			t.Fatalf("expected buffered events")
 		}
-		assertActions(actions, expected)
-	})
-	t.Run("AnyCreateEvent", func(t *testing.T) {
-		t.Parallel()
-		actions := runListenersComplexUseCase(t, ListenOption{Type: ListenCreate})
-		expected := []Action{
-			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
-			{Collection: "Collection2", Type: ActionCreate, ID: "id-j1"},
+		// The connector doesn't drop events, so every write is in the thread.
+		if n := ownLogRecords(t, d, 6); n != 6 {
+			t.Fatalf("expected 6 records in the own log, got %d", n)
 		}
-		assertActions(actions, expected)
 	})
-	t.Run("AnySaveEvent", func(t *testing.T) {
+	t.Run("Error", func(t *testing.T) {
 		t.Parallel()
-		actions := runListenersComplexUseCase(t, ListenOption{Type: ListenSave})
-		expected := []Action{
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
-			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
+		d, clean := createTestDB(t, WithNewDBLocalEventsBus(0, app.LocalEventsError))
+		defer clean()
+		c, err := d.NewCollection(CollectionConfig{
+			Name:   "dummy",
+			Schema: util.SchemaFromInstance(&dummy{}, false),
+		})
+		checkErr(t, err)
+		l := d.LocalEventListen()
+		defer l.Discard()
+		if err := create(c, 3); !errors.Is(err, app.ErrLocalEventsBusFull) {
+			t.Fatalf("expected ErrLocalEventsBusFull, got %v", err)
 		}
-		assertActions(actions, expected)
 	})
-	t.Run("AnyDeleteEvent", func(t *testing.T) {
+	t.Run("InvalidOptions", func(t *testing.T) {
 		t.Parallel()
-		actions := runListenersComplexUseCase(t, ListenOption{Type: ListenDelete})
-		expected := []Action{
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
-			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		o := &NewDBOptions{}
+		if err := WithNewDBLocalEventsBus(-1, app.LocalEventsBlock)(o); err == nil {
+			t.Fatalf("negative buffer should be rejected")
 		}
-		assertActions(actions, expected)
-	})
-	t.Run("AnyCollection1OrDeleteCollection2Events", func(t *testing.T) {
-		t.Parallel()
-		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection1"}, ListenOption{Collection: "Collection2", Type: ListenDelete})
-		expected := []Action{
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionCreate, ID: "id-i2"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i1"},
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
-			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i2"},
+		if err := WithNewDBLocalEventsBus(1, app.LocalEventsPolicy(5))(o); err == nil {
+			t.Fatalf("unknown policy should be rejected")
 		}
-		assertActions(actions, expected)
-	})
-	t.Run("EmptyFilterEvent", func(t *testing.T) {
-		t.Parallel()
-		actions := runListenersComplexUseCase(t, ListenOption{Collection: "Collection3"})
-		var expected []Action
-		assertActions(actions, expected)
 	})
-	t.Run("MixedComplexEvent", func(t *testing.T) {
-		t.Parallel()
-		actions := runListenersComplexUseCase(t,
-			ListenOption{Collection: "Collection2", Type: ListenSave},
-			ListenOption{Collection: "Collection1", Type: ListenSave, ID: "id-i2"},
-			ListenOption{Collection: "Collection1", Type: ListenDelete, ID: "id-i1"},
-			ListenOption{Collection: "Collection2", Type: ListenDelete},
-		)
-		expected := []Action{
-			{Collection: "Collection1", Type: ActionSave, ID: "id-i2"},
-			{Collection: "Collection2", Type: ActionSave, ID: "id-j1"},
-			{Collection: "Collection1", Type: ActionDelete, ID: "id-i1"},
-			{Collection: "Collection2", Type: ActionDelete, ID: "id-j1"},
+}
+
+// ownLogRecords returns the number of records of the own log of d, waiting
+// for up to 5 seconds for it to have n.
+func ownLogRecords(t *testing.T, d *DB, n int) int {
+	ctx := context.Background()
+	count := 0
+	for i := 0; i < 50; i++ {
+		info, err := d.connector.Net.GetThread(ctx, d.connector.ThreadID())
+		checkErr(t, err)
+		count = 0
+		for c := info.GetOwnLog().Head; c.Defined(); count++ {
+			rec, err := d.connector.Net.GetRecord(ctx, info.ID, c)
+			checkErr(t, err)
+			c = rec.PrevID()
 		}
-		assertActions(actions, expected)
-	})
+		if count >= n {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return count
 }
 
-// runListenersComplexUseCase runs a complex db use-case, and returns
-// Actions received with the ...ListenOption provided.
-func runListenersComplexUseCase(t *testing.T, los ...ListenOption) []Action {
-	t.Helper()
-	d, cls := createTestDB(t)
-	cc1 := CollectionConfig{
-		Name:   "Collection1",
+func TestCompact(t *testing.T) {
+	t.Parallel()
+	d, clean := createTestDB(t)
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
 		Schema: util.SchemaFromInstance(&dummy{}, false),
-	}
-	c1, err := d.NewCollection(cc1)
+	})
 	checkErr(t, err)
-	cc2 := CollectionConfig{
-		Name:   "Collection2",
-		Schema: util.SchemaFromInstance(&dummy{}, false),
+
+	dummyJSON := util.JSONFromInstance(dummy{Name: "Textile1"})
+	id1, err := c.Create(dummyJSON)
+	checkErr(t, err)
+	dummyJSON = util.SetJSONID(id1, dummyJSON)
+	for i := 1; i <= 3; i++ {
+		checkErr(t, c.Save(util.SetJSONProperty("Counter", i, dummyJSON)))
 	}
-	c2, err := d.NewCollection(cc2)
+	id2, err := c.Create(util.JSONFromInstance(dummy{Name: "Textile2"}))
 	checkErr(t, err)
+	checkErr(t, c.Delete(id2))
 
-	// Create some instance *before* any listener, just to test doesn't appear
-	// on listener Action stream.
-	i1 := util.JSONFromInstance(dummy{ID: "id-i1", Name: "Textile1"})
-	i1Ids, err := c1.Create(i1)
+	events, err := d.dispatcher.Query(query.Query{Prefix: dsDispatcherPrefix.String()})
 	checkErr(t, err)
+	if len(events) != 6 {
+		t.Fatalf("expected 6 dispatched events, got %d", len(events))
+	}
 
-	l, err := d.Listen(los...)
+	checkErr(t, d.Compact(context.Background()))
+
+	events, err = d.dispatcher.Query(query.Query{Prefix: dsDispatcherPrefix.String()})
 	checkErr(t, err)
-	var actions []Action
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		for a := range l.Channel() {
-			actions = append(actions, a)
-		}
-		wg.Done()
-	}()
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event after compaction, got %d", len(events))
+	}
+	if _, id, _, err := parseKey(ds.RawKey(events[0].Key)); err != nil || id != id1 {
+		t.Fatalf("the latest event of the live instance should be kept")
+	}
+	res, err := c.FindByID(id1)
+	checkErr(t, err)
+	instance := &dummy{}
+	util.InstanceFromJSON(res, instance)
+	if instance.Counter != 3 {
+		t.Fatalf("compaction shouldn't alter collection state")
+	}
+}
 
-	// Collection1 Save i1
-	i1 = util.SetJSONProperty("Name", "Textile0", i1)
-	checkErr(t, c1.Save(i1))
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	m := &mockMetrics{}
+	d, clean := createTestDB(t, WithNewDBMetrics(m))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	_, err = c.Create(util.JSONFromInstance(dummy{Name: "Textile"}))
+	checkErr(t, err)
 
-	// Collection1 Create i2
-	i2 := util.JSONFromInstance(dummy{ID: "id-i2", Name: "Textile2"})
-	i2Ids, err := c1.Create(i2)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.commits != 1 {
+		t.Fatalf("expected 1 txn commit, got %d", m.commits)
+	}
+	if m.reduces != 1 {
+		t.Fatalf("expected 1 reduce, got %d", m.reduces)
+	}
+}
+
+func TestReduceStream(t *testing.T) {
+	t.Parallel()
+	m := &mockMetrics{}
+	d, clean := createTestDB(t, WithNewDBMetrics(m))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
 	checkErr(t, err)
 
-	// Collection2 Create j1
-	j1 := util.JSONFromInstance(dummy{ID: "id-j1", Name: "Textile3"})
-	j1Ids, err := c2.Create(j1)
+	n := 2*reduceStreamBatchSize + 500
+	events := make(chan core.Event, n)
+	for i := 0; i < n; i++ {
+		id := core.NewInstanceID()
+		es, _, err := d.eventcodec.Create([]core.Action{{
+			Type:           core.Create,
+			InstanceID:     id,
+			CollectionName: "dummy",
+			Current:        util.JSONFromInstance(dummy{ID: id, Name: "foo", Counter: i}),
+		}})
+		checkErr(t, err)
+		for _, e := range es {
+			events <- e
+		}
+	}
+	close(events)
+	checkErr(t, d.ReduceStream(context.Background(), events))
+	res, err := c.Find(&Query{})
+	checkErr(t, err)
+	if len(res) != n {
+		t.Fatalf("expected %d instances, got %d", n, len(res))
+	}
+	m.lock.Lock()
+	reduces := m.reduces
+	m.lock.Unlock()
+	if reduces != 3 {
+		t.Fatalf("expected events to be reduced in 3 batches, got %d", reduces)
+	}
+	stored, err := d.dispatcher.Events("dummy")
+	checkErr(t, err)
+	if len(stored) != n {
+		t.Fatalf("expected %d events in the event store, got %d", n, len(stored))
+	}
+	remote, _, err := d.dispatcher.eventOrigin(stored[0])
 	checkErr(t, err)
+	if !remote {
+		t.Fatalf("streamed events should be stored as remote events")
+	}
 
-	// Collection1 Save i1
-	// Collection1 Save i2
-	err = c1.WriteTxn(func(txn *Txn) error {
-		i1 = util.SetJSONProperty("Counter", 30, i1)
-		i2 = util.SetJSONProperty("Counter", 11, i2)
-		return txn.Save(i1, i2)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.ReduceStream(ctx, make(chan core.Event)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the stream to stop with its context, got %v", err)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Parallel()
+	secret := []byte("secret")
+	payloads := make(chan WebhookPayload, 10)
+	var failed bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		checkErr(t, err)
+		if !failed {
+			failed = true
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if sig := r.Header.Get(WebhookSignatureHeader); sig != "sha256="+SignWebhookPayload(secret, body) {
+			t.Errorf("invalid payload signature %s", sig)
+		}
+		var p WebhookPayload
+		checkErr(t, json.Unmarshal(body, &p))
+		payloads <- p
+	}))
+	defer srv.Close()
+	// A URL that never answers must not hold back writes, nor the others.
+	release := make(chan struct{})
+	blocked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer blocked.Close()
+	defer close(release)
+
+	d, clean := createTestDB(t, WithNewDBWebhooks(WebhookConfig{
+		URLs:         []string{srv.URL, blocked.URL},
+		Secret:       secret,
+		Collections:  []string{"dummy"},
+		IncludeValue: true,
+		QueueSize:    2,
+		Backoff:      10 * time.Millisecond,
+	}))
+	defer clean()
+	c, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+	other, err := d.NewCollection(CollectionConfig{
+		Name:   "other",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
 	})
 	checkErr(t, err)
 
-	// Collection2 Save j1
-	j1 = util.SetJSONProperty("Counter", -1, j1)
-	j1 = util.SetJSONProperty("Name", "Textile33", j1)
-	checkErr(t, c2.Save(j1))
+	_, err = other.Create(util.JSONFromInstance(dummy{Name: "Alice"}))
+	checkErr(t, err)
+	id, err := c.Create(util.JSONFromInstance(dummy{Name: "Alice"}))
+	checkErr(t, err)
+	checkErr(t, c.Save(util.JSONFromInstance(dummy{ID: id, Name: "Bob"})))
+	checkErr(t, c.Delete(id))
 
-	checkErr(t, c1.Delete(i1Ids))
+	for _, expected := range []struct {
+		action string
+		name   string
+	}{{"create", "Alice"}, {"save", "Bob"}, {"delete", ""}} {
+		var p WebhookPayload
+		select {
+		case p = <-payloads:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s payload", expected.action)
+		}
+		if p.Thread != d.ThreadID().String() || p.Collection != "dummy" || p.ID != id || p.Action != expected.action {
+			t.Fatalf("unexpected %s payload %+v", expected.action, p)
+		}
+		if expected.name == "" {
+			if p.Value != nil {
+				t.Fatalf("expected no value in %s payload", expected.action)
+			}
+			continue
+		}
+		var v dummy
+		checkErr(t, json.Unmarshal(p.Value, &v))
+		if v.Name != expected.name {
+			t.Fatalf("expected %s value %s, got %s", expected.action, expected.name, v.Name)
+		}
+	}
+	select {
+	case p := <-payloads:
+		t.Fatalf("unexpected payload %+v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
 
-	// Collection2 Delete
-	checkErr(t, c2.Delete(j1Ids))
+	if _, err := NewDB(context.Background(), nil, thread.NewIDV1(thread.Raw, 32),
+		WithNewDBWebhooks(WebhookConfig{URLs: []string{"ftp://example.com"}})); err == nil {
+		t.Fatal("expected an invalid webhook URL to be rejected")
+	}
+}
 
-	// Collection2 Delete i2
-	checkErr(t, c1.Delete(i2Ids))
+func TestLogger(t *testing.T) {
+	t.Parallel()
+	l := &mockLogger{}
+	d, clean := createTestDB(t, WithNewDBLogger(l))
+	defer clean()
+	_, err := d.NewCollection(CollectionConfig{
+		Name:                "dummy",
+		Schema:              util.SchemaFromInstance(&dummy{}, false),
+		SchemaVersion:       1,
+		SchemaCompatibility: SchemaCompatExact,
+	})
+	checkErr(t, err)
+	id := core.NewInstanceID()
+	events, _, err := d.eventcodec.Create([]core.Action{{
+		Type:           core.Create,
+		InstanceID:     id,
+		CollectionName: "dummy",
+		Current:        util.JSONFromInstance(dummy{ID: id, Name: "Remote"}),
+		SchemaVersion:  2,
+	}})
+	checkErr(t, err)
+	checkErr(t, d.dispatch(context.Background(), events))
 
-	l.Close()
-	cls()
-	wg.Wait()
-	// Expected generated actions:
-	// Collection1 Save i1
-	// Collection1 Create i2
-	// Collection2 Create j1
-	// Save i1
-	// Save i2
-	// Collection2 Save j1
-	// Delete i1
-	// Collection2 Delete j1
-	// Delete i2
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if len(l.warnings) != 1 || !strings.Contains(l.warnings[0], "incompatible schema version") {
+		t.Fatalf("expected a warning about the incompatible event, got %v", l.warnings)
+	}
+}
 
-	return actions
+func TestTracer(t *testing.T) {
+	t.Parallel()
+	tr := &mockTracer{}
+	d, clean := createTestDB(t, WithNewDBTracer(tr))
+	defer clean()
+	_, err := d.NewCollection(CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	})
+	checkErr(t, err)
+
+	id := core.NewInstanceID()
+	events, _, err := d.eventcodec.Create([]core.Action{{
+		Type:           core.Create,
+		InstanceID:     id,
+		CollectionName: "dummy",
+		Current:        util.JSONFromInstance(dummy{ID: id, Name: "Textile"}),
+	}})
+	checkErr(t, err)
+	checkErr(t, d.dispatch(context.Background(), events))
+
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+	expected := []string{"db.dispatch", "db.Reduce"}
+	if !reflect.DeepEqual(tr.spans, expected) {
+		t.Fatalf("expected spans %v, got %v", expected, tr.spans)
+	}
 }
 
 type dummy struct {
@@ -364,3 +3441,58 @@ func (dec *mockEventCodec) EventsFromBytes([]byte) ([]core.Event, error) {
 	dec.called = true
 	return nil, nil
 }
+
+type mockMetrics struct {
+	nopMetrics
+	lock    sync.Mutex
+	commits int
+	reduces int
+	dropped int
+}
+
+func (m *mockMetrics) LocalEventsDropped(n int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.dropped += n
+}
+
+func (m *mockMetrics) Reduce(int, time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.reduces++
+}
+
+func (m *mockMetrics) TxnCommit(time.Duration, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.commits++
+}
+
+type mockLogger struct {
+	lock     sync.Mutex
+	warnings []string
+}
+
+func (l *mockLogger) Debugf(string, ...interface{}) {}
+
+func (l *mockLogger) Infof(string, ...interface{}) {}
+
+func (l *mockLogger) Warnf(format string, args ...interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.warnings = append(l.warnings, fmt.Sprintf(format, args...))
+}
+
+func (l *mockLogger) Errorf(string, ...interface{}) {}
+
+type mockTracer struct {
+	lock  sync.Mutex
+	spans []string
+}
+
+func (m *mockTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.spans = append(m.spans, name)
+	return ctx, nopSpan{}
+}
@@ -0,0 +1,227 @@
+// Package dbtest provides helpers to test DBs of several networked peers
+// sharing a thread, such as waiting for their collections to converge.
+package dbtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/textileio/go-threads/common"
+	"github.com/textileio/go-threads/core/thread"
+	"github.com/textileio/go-threads/db"
+	"github.com/textileio/go-threads/util"
+)
+
+const (
+	convergenceInterval = time.Millisecond * 100
+)
+
+// Peers are DBs sharing a thread, each with its own network.
+type Peers struct {
+	// Thread is the thread the DBs share.
+	Thread thread.ID
+	// DBs holds the DB of each peer, the first one having created Thread.
+	DBs []*db.DB
+	// Nets holds the network of each peer.
+	Nets []common.NetBoostrapper
+
+	dirs []string
+}
+
+// NewPeers creates n DBs sharing a new thread, each with an in-memory
+// datastore and its own network listening on a local address. The first
+// DB creates the thread, and the others join it from its address. opts are
+// applied to every DB, e.g. db.WithNewDBCollections registering the
+// collections under test. Peers are closed when the test ends.
+func NewPeers(t *testing.T, n int, opts ...db.NewDBOption) *Peers {
+	t.Helper()
+	if n < 1 {
+		t.Fatalf("at least one peer is needed, got %d", n)
+	}
+	p := &Peers{Thread: thread.NewIDV1(thread.Raw, 32)}
+	t.Cleanup(func() {
+		if err := p.Close(); err != nil {
+			t.Errorf("error closing peers: %v", err)
+		}
+	})
+	ctx := context.Background()
+	var addr ma.Multiaddr
+	var key thread.Key
+	for i := 0; i < n; i++ {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.dirs = append(p.dirs, dir)
+		net, err := common.DefaultNetwork(dir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Nets = append(p.Nets, net)
+		dbOpts := append([]db.NewDBOption{db.WithNewDBRepoPath(dir), db.WithNewDBInMemoryDatastore()}, opts...)
+
+		var d *db.DB
+		if i == 0 {
+			if d, err = db.NewDB(ctx, net, p.Thread, dbOpts...); err != nil {
+				t.Fatal(err)
+			}
+			if addr, key, err = threadAddr(ctx, net, p.Thread); err != nil {
+				t.Fatal(err)
+			}
+		} else if d, err = db.NewDBFromAddr(ctx, net, addr, key, dbOpts...); err != nil {
+			t.Fatal(err)
+		}
+		p.DBs = append(p.DBs, d)
+	}
+	return p
+}
+
+// threadAddr returns the address of the thread on net, and its key.
+func threadAddr(ctx context.Context, net common.NetBoostrapper, id thread.ID) (ma.Multiaddr, thread.Key, error) {
+	info, err := net.GetThread(ctx, id)
+	if err != nil {
+		return nil, thread.Key{}, err
+	}
+	peerComp, err := ma.NewComponent("p2p", net.Host().ID().String())
+	if err != nil {
+		return nil, thread.Key{}, err
+	}
+	threadComp, err := ma.NewComponent("thread", id.String())
+	if err != nil {
+		return nil, thread.Key{}, err
+	}
+	return net.Host().Addrs()[0].Encapsulate(peerComp).Encapsulate(threadComp), info.Key, nil
+}
+
+// Collections returns the collection named name of every DB, or nil where
+// it isn't registered.
+func (p *Peers) Collections(name string) []*db.Collection {
+	res := make([]*db.Collection, len(p.DBs))
+	for i, d := range p.DBs {
+		res[i] = d.GetCollection(name)
+	}
+	return res
+}
+
+// State returns the instances of a collection of the DB i, decoded from
+// JSON and keyed by ID, as held by the ID field of the collection.
+func (p *Peers) State(i int, collection string) (map[string]interface{}, error) {
+	c := p.DBs[i].GetCollection(collection)
+	if c == nil {
+		return nil, fmt.Errorf("collection %s of peer %d: %w", collection, i, db.ErrCollectionNotFound)
+	}
+	idField := ""
+	for _, info := range p.DBs[i].ListCollections() {
+		if info.Name == collection {
+			idField = info.IDField
+		}
+	}
+	instances, err := c.Find(&db.Query{})
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]interface{}, len(instances))
+	for _, instance := range instances {
+		var v map[string]interface{}
+		if err := json.Unmarshal(instance, &v); err != nil {
+			return nil, err
+		}
+		id, _ := v[idField].(string)
+		res[id] = v
+	}
+	return res, nil
+}
+
+// Converged returns nil if every DB has the same instances in each of the
+// collections, or an error describing the first difference otherwise.
+func (p *Peers) Converged(collections ...string) error {
+	for _, name := range collections {
+		first, err := p.State(0, name)
+		if err != nil {
+			return err
+		}
+		for i := 1; i < len(p.DBs); i++ {
+			state, err := p.State(i, name)
+			if err != nil {
+				return err
+			}
+			if err := diff(first, state); err != nil {
+				return fmt.Errorf("collection %s of peers 0 and %d differ: %v", name, i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// diff describes a difference between the states a and b.
+func diff(a, b map[string]interface{}) error {
+	for id, va := range a {
+		vb, ok := b[id]
+		if !ok {
+			return fmt.Errorf("instance %s is missing in the second one", id)
+		}
+		if !reflect.DeepEqual(va, vb) {
+			return fmt.Errorf("instance %s is %v and %v", id, va, vb)
+		}
+	}
+	for id := range b {
+		if _, ok := a[id]; !ok {
+			return fmt.Errorf("instance %s is missing in the first one", id)
+		}
+	}
+	return nil
+}
+
+// WaitForConvergence polls the DBs until they converge in each of the
+// collections, see Converged, or ctx is done, in which case the last
+// difference is returned.
+func (p *Peers) WaitForConvergence(ctx context.Context, collections ...string) error {
+	for {
+		err := p.Converged(collections...)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%v: %v", ctx.Err(), err)
+		case <-time.After(convergenceInterval):
+		}
+	}
+}
+
+// AssertConverged fails the test if the DBs don't converge in each of the
+// collections within timeout.
+func (p *Peers) AssertConverged(t *testing.T, timeout time.Duration, collections ...string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := p.WaitForConvergence(ctx, collections...); err != nil {
+		t.Fatalf("peers didn't converge: %v", err)
+	}
+}
+
+// Close closes the DBs and their networks, and removes their files.
+func (p *Peers) Close() error {
+	for _, d := range p.DBs {
+		if err := d.Close(); err != nil {
+			return err
+		}
+	}
+	for _, n := range p.Nets {
+		if err := n.Close(); err != nil {
+			return err
+		}
+	}
+	for _, dir := range p.dirs {
+		_ = os.RemoveAll(dir)
+	}
+	p.DBs, p.Nets, p.dirs = nil, nil, nil
+	return nil
+}
@@ -0,0 +1,91 @@
+package dbtest
+
+import (
+	"testing"
+	"time"
+
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/db"
+	"github.com/textileio/go-threads/util"
+)
+
+type dummy struct {
+	ID      core.InstanceID `json:"_id"`
+	Name    string
+	Counter int
+}
+
+type keyed struct {
+	Key  string
+	Name string
+}
+
+func TestPeersConverge(t *testing.T) {
+	t.Parallel()
+	p := NewPeers(t, 3, db.WithNewDBCollections(db.CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}, db.CollectionConfig{
+		Name:    "keyed",
+		Schema:  util.SchemaFromInstance(&keyed{}, false),
+		IDField: "Key",
+	}))
+	if len(p.DBs) != 3 {
+		t.Fatalf("expected 3 DBs, got %d", len(p.DBs))
+	}
+	for i, d := range p.DBs {
+		if d.GetCollection("dummy") == nil {
+			t.Fatalf("collection isn't registered in peer %d", i)
+		}
+	}
+
+	// Every peer writes.
+	collections := p.Collections("dummy")
+	for i, c := range collections {
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: "foo", Counter: i}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Save(util.JSONFromInstance(dummy{ID: id, Name: "bar", Counter: i})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Instances of collections with an ID field are keyed by it.
+	for i, c := range p.Collections("keyed") {
+		if _, err := c.Create(util.JSONFromInstance(keyed{Name: "foo"})); err != nil {
+			t.Fatalf("peer %d: %v", i, err)
+		}
+	}
+	p.AssertConverged(t, time.Second*30, "dummy", "keyed")
+	for i := range p.DBs {
+		for _, name := range []string{"dummy", "keyed"} {
+			state, err := p.State(i, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(state) != len(collections) {
+				t.Fatalf("expected %d instances of %s in peer %d, got %d", len(collections), name, i, len(state))
+			}
+		}
+	}
+	if err := p.Converged("missing"); err == nil {
+		t.Fatalf("unregistered collections can't converge")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Parallel()
+	a := map[string]interface{}{"1": map[string]interface{}{"Name": "foo"}}
+	if err := diff(a, map[string]interface{}{"1": map[string]interface{}{"Name": "foo"}}); err != nil {
+		t.Fatalf("equal states shouldn't differ: %v", err)
+	}
+	for _, b := range []map[string]interface{}{
+		{},
+		{"1": map[string]interface{}{"Name": "bar"}},
+		{"1": map[string]interface{}{"Name": "foo"}, "2": map[string]interface{}{}},
+	} {
+		if err := diff(a, b); err == nil {
+			t.Fatalf("expected %v and %v to differ", a, b)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math/big"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	dsDBDecodings = dsDBPrefix.ChildString("decoding")
+)
+
+// decodingConfig holds the decoding options of a collection.
+type decodingConfig struct {
+	UseNumber             bool
+	DisallowUnknownFields bool
+}
+
+// getDecodingConfig returns the persisted decoding options of collection.
+func (d *DB) getDecodingConfig(collection string) (decodingConfig, error) {
+	var config decodingConfig
+	v, err := d.datastore.Get(dsDBDecodings.ChildString(collection))
+	if errors.Is(err, ds.ErrNotFound) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(v, &config)
+	return config, err
+}
+
+func (d *DB) putDecodingConfig(collection string, config decodingConfig) error {
+	v, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return d.datastore.Put(dsDBDecodings.ChildString(collection), v)
+}
+
+// decodeInstance decodes instance for matching queries, with numbers as
+// json.Number if useNumber is true, or float64 otherwise.
+func decodeInstance(instance []byte, useNumber bool) (map[string]interface{}, error) {
+	v := make(map[string]interface{})
+	if !useNumber {
+		err := json.Unmarshal(instance, &v)
+		return v, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(instance))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// decodeIndexValue decodes the value of an index entry the same way
+// decodeInstance decodes instance fields.
+func decodeIndexValue(name string, useNumber bool) interface{} {
+	res := gjson.Parse(name)
+	if useNumber && res.Type == gjson.Number {
+		return json.Number(res.Raw)
+	}
+	return res.Value()
+}
+
+// hasUnknownFields returns whether instance has top-level fields that
+// aren't properties of the collection schema.
+func (c *Collection) hasUnknownFields(instance []byte) bool {
+	unknown := false
+	gjson.ParseBytes(instance).ForEach(func(key, _ gjson.Result) bool {
+		name := key.String()
+		if _, ok := c.properties[name]; !ok && name != deletedFieldName && !(c.timestamps && isTimestampField(name)) {
+			unknown = true
+		}
+		return !unknown
+	})
+	return unknown
+}
+
+// numberRat returns the exact value of a float64 or json.Number.
+func numberRat(v interface{}) (*big.Rat, bool) {
+	switch n := v.(type) {
+	case float64:
+		r := new(big.Rat)
+		if r.SetFloat64(n) == nil {
+			return nil, false
+		}
+		return r, true
+	case json.Number:
+		return new(big.Rat).SetString(string(n))
+	default:
+		return nil, false
+	}
+}
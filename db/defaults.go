@@ -0,0 +1,93 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/jsonschema"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// fieldDefault is the default value of the field at a dot separated path,
+// e.g. "Home.City", declared with the default keyword of the schema.
+type fieldDefault struct {
+	path  string
+	value []byte
+}
+
+// schemaDefaults returns the field defaults of properties, the top-level
+// properties of schema, including those of nested objects. They're sorted
+// by path, so the default of an object comes before those of its fields.
+func schemaDefaults(schema *jsonschema.Schema, properties map[string]*jsonschema.Type) ([]fieldDefault, error) {
+	var res []fieldDefault
+	refs := map[string]bool{schema.Ref: true}
+	if err := collectDefaults("", properties, schema.Definitions, refs, &res); err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].path < res[j].path })
+	return res, nil
+}
+
+func collectDefaults(
+	prefix string,
+	properties map[string]*jsonschema.Type,
+	definitions jsonschema.Definitions,
+	refs map[string]bool,
+	res *[]fieldDefault,
+) error {
+	for name, t := range properties {
+		if t == nil {
+			continue
+		}
+		path := prefix + name
+		if t.Default != nil {
+			value, err := json.Marshal(t.Default)
+			if err != nil {
+				return fmt.Errorf("error encoding default of %s: %v", path, err)
+			}
+			*res = append(*res, fieldDefault{path: path, value: value})
+		}
+		if t.Ref == "" {
+			if err := collectDefaults(path+".", t.Properties, definitions, refs, res); err != nil {
+				return err
+			}
+			continue
+		}
+		// Recursive types stop at the first repeated reference.
+		parts := strings.Split(t.Ref, "/")
+		def := definitions[parts[len(parts)-1]]
+		if def == nil || refs[t.Ref] {
+			continue
+		}
+		refs[t.Ref] = true
+		err := collectDefaults(path+".", def.Properties, definitions, refs, res)
+		delete(refs, t.Ref)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyDefaults returns instance with the defaults of its missing fields.
+// Defaults of nested fields only apply if their object is present, after
+// its own default if any. Provided fields, including nulls, are kept.
+func applyDefaults(instance []byte, defaults []fieldDefault) ([]byte, error) {
+	res := instance
+	for _, d := range defaults {
+		if i := strings.LastIndex(d.path, "."); i >= 0 && !gjson.GetBytes(res, d.path[:i]).IsObject() {
+			continue
+		}
+		if gjson.GetBytes(res, d.path).Exists() {
+			continue
+		}
+		var err error
+		if res, err = sjson.SetRawBytes(res, d.path, d.value); err != nil {
+			return nil, fmt.Errorf("error applying default of %s: %v", d.path, err)
+		}
+	}
+	return res, nil
+}
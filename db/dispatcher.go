@@ -5,17 +5,42 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	datastore "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/thread"
 	"golang.org/x/sync/errgroup"
 )
 
+const (
+	// compactBatchSize is the max number of event deletions
+	// committed in a single transaction while compacting.
+	compactBatchSize = 1000
+	// indexBatchSize is the max number of collection index entries
+	// committed in a single transaction while indexing stored events.
+	indexBatchSize = 1000
+)
+
 var (
 	dsDispatcherPrefix = dsDBPrefix.ChildString("dispatcher")
+	// dsDispatcherIndexPrefix holds the keys of stored events by
+	// collection, as <collection>/<timestamp>/<instance-id>.
+	dsDispatcherIndexPrefix = dsDBPrefix.ChildString("dispatcherindex")
+	// dsDispatcherIndexed marks event stores whose collection index
+	// includes events stored before the index existed.
+	dsDispatcherIndexed = dsDBPrefix.ChildString("dispatcherindexed")
+	// dsDispatcherOrigins holds the origin of stored events received from
+	// other peers, at their key relative to dsDispatcherPrefix. Values are
+	// the thread the events came from, or empty if it's unknown. Local
+	// events have none.
+	dsDispatcherOrigins = dsDBPrefix.ChildString("dispatcherorigins")
 )
 
 // Reducer applies an event to an existing state.
@@ -23,6 +48,19 @@ type Reducer interface {
 	Reduce(events []core.Event) error
 }
 
+// StreamReducer is a Reducer that can also reduce a stream of events in
+// bounded batches, see DB.ReduceStream.
+type StreamReducer interface {
+	Reducer
+	ReduceStream(ctx context.Context, events <-chan core.Event) error
+}
+
+// contextReducer is a Reducer that can take part in the dispatch context,
+// e.g. to continue its trace.
+type contextReducer interface {
+	reduceContext(ctx context.Context, events []core.Event) error
+}
+
 // dispatcher is used to dispatch events to registered reducers.
 //
 // This is different from generic pub-sub systems because reducers are not subscribed to particular events.
@@ -33,6 +71,13 @@ type dispatcher struct {
 	reducers []Reducer
 	lock     sync.RWMutex
 	lastID   int
+
+	// batchSize is the max number of events persisted per transaction,
+	// or zero to persist every dispatched batch in one transaction. Batches
+	// are committed on their own, so they aren't atomic with the dispatch.
+	batchSize int
+	// sync makes the store flush persisted events before reducing them.
+	sync bool
 }
 
 // NewDispatcher creates a new EventDispatcher
@@ -60,14 +105,79 @@ func (d *dispatcher) Register(reducer Reducer) {
 // 1. Save all txn events with transaction guarantees.
 // 2. Notify all reducers about the known events.
 func (d *dispatcher) Dispatch(events []core.Event) error {
+	return d.DispatchContext(context.Background(), events)
+}
+
+// DispatchContext is like Dispatch, but passes ctx on to reducers
+// that support it. If ctx carries a dispatch txn, events are persisted in
+// it, so they're committed along with their reduction, unless batchSize
+// is set and ctx isn't tagged with withAtomicDispatch.
+func (d *dispatcher) DispatchContext(ctx context.Context, events []core.Event) error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 
+	var origin []byte
+	if remoteEvents(ctx) {
+		origin = originThread(ctx).Bytes()
+	}
+	if txn := dispatchTxnFrom(ctx); txn != nil && (d.batchSize == 0 || atomicDispatch(ctx)) {
+		if err := persistEvents(txn, events, origin); err != nil {
+			return err
+		}
+	} else {
+		// Batches are committed on their own, so a failure may leave
+		// some of the events persisted but not reduced.
+		for pending := events; len(pending) > 0; {
+			n := len(pending)
+			if d.batchSize > 0 && n > d.batchSize {
+				n = d.batchSize
+			}
+			if err := d.persist(pending[:n], origin); err != nil {
+				return err
+			}
+			pending = pending[n:]
+		}
+	}
+	if d.sync && dispatchTxnFrom(ctx) == nil {
+		if err := d.store.Sync(dsDispatcherPrefix); err != nil {
+			return err
+		}
+	}
+	// Safe to fire off reducers now that event is persisted
+	g, _ := errgroup.WithContext(context.Background())
+	for _, reducer := range d.reducers {
+		reducer := reducer
+		// Launch each reducer in a separate goroutine
+		g.Go(func() error {
+			if cr, ok := reducer.(contextReducer); ok {
+				return cr.reduceContext(ctx, events)
+			}
+			return reducer.Reduce(events)
+		})
+	}
+	// Wait for all reducers to complete or error out
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// persist saves events to the event store in a single transaction.
+func (d *dispatcher) persist(events []core.Event, origin []byte) error {
 	txn, err := d.store.NewTransaction(false)
 	if err != nil {
 		return err
 	}
 	defer txn.Discard()
+	if err := persistEvents(txn, events, origin); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// persistEvents writes events and their collection index keys in txn.
+// Unless origin is nil, it's written as the origin of the events.
+func persistEvents(txn datastore.Txn, events []core.Event, origin []byte) error {
 	for _, event := range events {
 		key, err := getKey(event)
 		if err != nil {
@@ -82,24 +192,41 @@ func (d *dispatcher) Dispatch(events []core.Event) error {
 		if err := txn.Put(key, b.Bytes()); err != nil {
 			return err
 		}
+		ikey, err := getIndexKey(key)
+		if err != nil {
+			return err
+		}
+		if err := txn.Put(ikey, []byte{}); err != nil {
+			return err
+		}
+		if origin != nil {
+			if err := txn.Put(getOriginKey(key), origin); err != nil {
+				return err
+			}
+		}
 	}
-	if err := txn.Commit(); err != nil {
-		return err
+	return nil
+}
+
+// eventOrigin returns whether the stored event r was received from other
+// peers, and if so, the thread it came from, which is undefined if it's
+// unknown.
+func (d *dispatcher) eventOrigin(r EventRecord) (remote bool, origin thread.ID, err error) {
+	key := dsDispatcherPrefix.ChildString(strconv.FormatInt(r.Time.UnixNano(), 10)).
+		ChildString(r.InstanceID.String()).
+		ChildString(r.Collection)
+	v, err := d.store.Get(getOriginKey(key))
+	if errors.Is(err, datastore.ErrNotFound) {
+		return false, thread.Undef, nil
 	}
-	// Safe to fire off reducers now that event is persisted
-	g, _ := errgroup.WithContext(context.Background())
-	for _, reducer := range d.reducers {
-		reducer := reducer
-		// Launch each reducer in a separate goroutine
-		g.Go(func() error {
-			return reducer.Reduce(events)
-		})
+	if err != nil {
+		return false, thread.Undef, err
 	}
-	// Wait for all reducers to complete or error out
-	if err := g.Wait(); err != nil {
-		return err
+	if len(v) == 0 {
+		return true, thread.Undef, nil
 	}
-	return nil
+	origin, err = thread.Cast(v)
+	return true, origin, err
 }
 
 // Query searches the internal event store and returns a query result.
@@ -112,6 +239,243 @@ func (d *dispatcher) Query(query query.Query) ([]query.Entry, error) {
 	return result.Rest()
 }
 
+// EventRecord is an event stored by the dispatcher.
+type EventRecord struct {
+	Time       time.Time
+	Collection string
+	InstanceID core.InstanceID
+	// Type is the kind of change carried by the event, which DB.DumpEvents
+	// decodes for codecs of events implementing core.TypedEvent, and is
+	// zero otherwise.
+	Type ActionType
+	// Data is the event as stored, which is gob encoded.
+	Data []byte
+}
+
+// Events returns stored events sorted by time. If collection isn't
+// empty, only its events are returned, which are looked up in the
+// collection index of the store.
+func (d *dispatcher) Events(collection string) ([]EventRecord, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	if collection != "" {
+		return d.collectionEvents(collection)
+	}
+	entries, err := d.Query(query.Query{Prefix: dsDispatcherPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]EventRecord, 0, len(entries))
+	for _, e := range entries {
+		r, err := newEventRecord(datastore.RawKey(e.Key), e.Value)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	sortEventRecords(records)
+	return records, nil
+}
+
+// collectionEvents returns the stored events of collection sorted by time.
+func (d *dispatcher) collectionEvents(collection string) ([]EventRecord, error) {
+	if err := d.buildIndex(); err != nil {
+		return nil, err
+	}
+	entries, err := d.Query(query.Query{
+		Prefix:   dsDispatcherIndexPrefix.ChildString(collection).String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	records := make([]EventRecord, 0, len(entries))
+	for _, e := range entries {
+		key, err := eventKeyFromIndex(datastore.RawKey(e.Key))
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.store.Get(key)
+		if err != nil {
+			return nil, fmt.Errorf("error getting indexed event %s: %v", key, err)
+		}
+		r, err := newEventRecord(key, v)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	sortEventRecords(records)
+	return records, nil
+}
+
+// buildIndex adds the events stored before the collection index existed
+// to it. It's a no-op once they're indexed.
+func (d *dispatcher) buildIndex() error {
+	indexed, err := d.store.Has(dsDispatcherIndexed)
+	if err != nil || indexed {
+		return err
+	}
+	entries, err := d.Query(query.Query{
+		Prefix:   dsDispatcherPrefix.String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	for len(entries) > 0 {
+		n := indexBatchSize
+		if n > len(entries) {
+			n = len(entries)
+		}
+		if err := d.putIndexKeys(entries[:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return d.store.Put(dsDispatcherIndexed, []byte{})
+}
+
+func (d *dispatcher) putIndexKeys(entries []query.Entry) error {
+	txn, err := d.store.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	for _, e := range entries {
+		ikey, err := getIndexKey(datastore.RawKey(e.Key))
+		if err != nil {
+			return err
+		}
+		if err := txn.Put(ikey, []byte{}); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+func newEventRecord(key datastore.Key, value []byte) (EventRecord, error) {
+	unix, id, c, err := parseKey(key)
+	if err != nil {
+		return EventRecord{}, err
+	}
+	return EventRecord{
+		Time:       time.Unix(0, unix),
+		Collection: c,
+		InstanceID: id,
+		Data:       value,
+	}, nil
+}
+
+func sortEventRecords(records []EventRecord) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+}
+
+// Compact removes stored events which aren't the latest event of an instance,
+// and every event of instances for which live returns false.
+// Deletions are committed in batches, so an interrupted compaction leaves
+// the store partially compacted, but running it again is safe.
+func (d *dispatcher) Compact(ctx context.Context, live func(collection string, id core.InstanceID) (bool, error)) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	type instance struct {
+		collection string
+		id         core.InstanceID
+	}
+	type latestEvent struct {
+		time int64
+		key  datastore.Key
+	}
+	results, err := d.store.Query(query.Query{
+		Prefix:   dsDispatcherPrefix.String(),
+		KeysOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	latest := make(map[instance]latestEvent)
+	var obsolete []datastore.Key
+	for res := range results.Next() {
+		if res.Error != nil {
+			results.Close()
+			return res.Error
+		}
+		key := datastore.RawKey(res.Key)
+		unix, id, collection, err := parseKey(key)
+		if err != nil {
+			results.Close()
+			return err
+		}
+		i := instance{collection: collection, id: id}
+		l, ok := latest[i]
+		if !ok {
+			latest[i] = latestEvent{time: unix, key: key}
+			continue
+		}
+		if unix > l.time {
+			obsolete = append(obsolete, l.key)
+			latest[i] = latestEvent{time: unix, key: key}
+		} else {
+			obsolete = append(obsolete, key)
+		}
+	}
+	results.Close()
+
+	for i, l := range latest {
+		ok, err := live(i.collection, i.id)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			obsolete = append(obsolete, l.key)
+		}
+	}
+
+	for len(obsolete) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n := compactBatchSize
+		if n > len(obsolete) {
+			n = len(obsolete)
+		}
+		txn, err := d.store.NewTransaction(false)
+		if err != nil {
+			return err
+		}
+		for _, key := range obsolete[:n] {
+			ikey, err := getIndexKey(key)
+			if err != nil {
+				txn.Discard()
+				return err
+			}
+			if err := txn.Delete(key); err != nil {
+				txn.Discard()
+				return err
+			}
+			if err := txn.Delete(ikey); err != nil {
+				txn.Discard()
+				return err
+			}
+			if err := txn.Delete(getOriginKey(key)); err != nil {
+				txn.Discard()
+				return err
+			}
+		}
+		if err := txn.Commit(); err != nil {
+			txn.Discard()
+			return err
+		}
+		txn.Discard()
+		obsolete = obsolete[n:]
+	}
+	return nil
+}
+
 // Key format: <timestamp>/<instance-id>/<type>
 // @todo: This is up for debate, its a 'fake' Event struct right now anyway
 func getKey(event core.Event) (key datastore.Key, err error) {
@@ -126,3 +490,47 @@ func getKey(event core.Event) (key datastore.Key, err error) {
 		ChildString(event.Collection())
 	return key, nil
 }
+
+// parseKey extracts the event time, instance id, and collection
+// from a key built by getKey.
+func parseKey(key datastore.Key) (unix int64, id core.InstanceID, collection string, err error) {
+	parts := key.Namespaces()
+	if len(parts) < 3 {
+		return 0, "", "", fmt.Errorf("malformed event key %s", key)
+	}
+	parts = parts[len(parts)-3:]
+	unix, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, "", "", fmt.Errorf("malformed event key %s: %v", key, err)
+	}
+	return unix, core.InstanceID(parts[1]), parts[2], nil
+}
+
+// getIndexKey returns the collection index key of the event stored at key.
+func getIndexKey(key datastore.Key) (datastore.Key, error) {
+	unix, id, collection, err := parseKey(key)
+	if err != nil {
+		return datastore.Key{}, err
+	}
+	return dsDispatcherIndexPrefix.ChildString(collection).
+		ChildString(strconv.FormatInt(unix, 10)).
+		ChildString(id.String()), nil
+}
+
+// getOriginKey returns the key of the origin of the event stored at key.
+func getOriginKey(key datastore.Key) datastore.Key {
+	return dsDispatcherOrigins.Child(datastore.NewKey(key.String()[len(dsDispatcherPrefix.String()):]))
+}
+
+// eventKeyFromIndex returns the key of the event a collection index key
+// built by getIndexKey points to.
+func eventKeyFromIndex(ikey datastore.Key) (datastore.Key, error) {
+	parts := ikey.Namespaces()
+	if len(parts) < 3 {
+		return datastore.Key{}, fmt.Errorf("malformed event index key %s", ikey)
+	}
+	parts = parts[len(parts)-3:]
+	return dsDispatcherPrefix.ChildString(parts[1]).
+		ChildString(parts[2]).
+		ChildString(parts[0]), nil
+}
@@ -64,7 +64,7 @@ func TestDispatch(t *testing.T) {
 	if err := dispatcher.Dispatch([]core.Event{event}); err != nil {
 		t.Error("unexpected error in dispatch call")
 	}
-	results, err := dispatcher.Query(query.Query{})
+	results, err := dispatcher.Query(query.Query{Prefix: dsDispatcherPrefix.String()})
 	if err != nil {
 		t.Fatalf("query failed: %v", err)
 	}
@@ -80,7 +80,7 @@ func TestDispatch(t *testing.T) {
 			t.Errorf("`%s` should be `error`", err)
 		}
 	}
-	results, err = dispatcher.Query(query.Query{})
+	results, err = dispatcher.Query(query.Query{Prefix: dsDispatcherPrefix.String()})
 	if err != nil {
 		t.Fatalf("query failed: %v", err)
 	}
@@ -89,6 +89,35 @@ func TestDispatch(t *testing.T) {
 	}
 }
 
+func TestDispatchBatchSizeAndSync(t *testing.T) {
+	t.Parallel()
+	eventstore := &countingDatastore{TxnDatastore: NewTxMapDatastore()}
+	dispatcher := newDispatcher(eventstore)
+	dispatcher.batchSize = 2
+	dispatcher.sync = true
+	now := time.Now()
+	events := make([]core.Event, 5)
+	for i := range events {
+		events[i] = newNullEvent(now.Add(time.Duration(i)))
+	}
+	if err := dispatcher.Dispatch(events); err != nil {
+		t.Fatal(err)
+	}
+	if eventstore.txns != 3 {
+		t.Fatalf("expected events to be persisted in 3 transactions, got %d", eventstore.txns)
+	}
+	if eventstore.syncs != 1 {
+		t.Fatalf("expected 1 sync, got %d", eventstore.syncs)
+	}
+	results, err := dispatcher.Query(query.Query{Prefix: dsDispatcherPrefix.String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(events) {
+		t.Fatalf("expected %d persisted events, got %d", len(events), len(results))
+	}
+}
+
 func TestValidStore(t *testing.T) {
 	t.Parallel()
 	eventstore := NewTxMapDatastore()
@@ -119,6 +148,7 @@ func TestDispatcherQuery(t *testing.T) {
 		}
 	}
 	results, err := dispatcher.Query(query.Query{
+		Prefix: dsDispatcherPrefix.String(),
 		Orders: []query.Order{query.OrderByKey{}},
 	})
 	if err != nil {
@@ -129,6 +159,45 @@ func TestDispatcherQuery(t *testing.T) {
 	}
 }
 
+func TestDispatcherCollectionEvents(t *testing.T) {
+	t.Parallel()
+	eventstore := NewTxMapDatastore()
+	dispatcher := newDispatcher(eventstore)
+	n := 10
+	for i := 0; i < n; i++ {
+		if err := dispatcher.Dispatch([]core.Event{newNullEvent(time.Now())}); err != nil {
+			t.Fatalf("unexpected error in dispatch call: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	records, err := dispatcher.Events("null")
+	checkErr(t, err)
+	if len(records) != n {
+		t.Fatalf("expected %d events, got %d", n, len(records))
+	}
+	if records, err = dispatcher.Events("other"); err != nil || len(records) != 0 {
+		t.Fatalf("expected no events of other collections, got %d (%v)", len(records), err)
+	}
+
+	// Events stored before the index existed are indexed on demand.
+	entries, err := dispatcher.Query(query.Query{Prefix: dsDispatcherIndexPrefix.String(), KeysOnly: true})
+	checkErr(t, err)
+	for _, e := range entries {
+		checkErr(t, eventstore.Delete(datastore.RawKey(e.Key)))
+	}
+	checkErr(t, eventstore.Delete(dsDispatcherIndexed))
+	records, err = dispatcher.Events("null")
+	checkErr(t, err)
+	if len(records) != n {
+		t.Fatalf("expected %d events after indexing, got %d", n, len(records))
+	}
+	for i := 1; i < len(records); i++ {
+		if records[i].Time.Before(records[i-1].Time) {
+			t.Fatalf("events should be sorted by time")
+		}
+	}
+}
+
 func newNullEvent(t time.Time) core.Event {
 	return &nullEvent{Timestamp: t}
 }
@@ -159,3 +228,19 @@ func (n *nullEvent) Node() (format.Node, error) {
 
 // Sanity check
 var _ core.Event = (*nullEvent)(nil)
+
+type countingDatastore struct {
+	datastore.TxnDatastore
+	txns  int
+	syncs int
+}
+
+func (c *countingDatastore) NewTransaction(readOnly bool) (datastore.Txn, error) {
+	c.txns++
+	return c.TxnDatastore.NewTransaction(readOnly)
+}
+
+func (c *countingDatastore) Sync(prefix datastore.Key) error {
+	c.syncs++
+	return c.TxnDatastore.Sync(prefix)
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+// dispatchTxn is the datastore transaction in which a dispatch persists and
+// reduces events, along with the DB state tracking them, such as applied
+// records, so they're committed atomically. Work that must only happen once
+// the changes are visible, such as notifying listeners, is deferred with
+// onCommit.
+type dispatchTxn struct {
+	ds.Txn
+	committed []func()
+}
+
+func (d *DB) newDispatchTxn() (*dispatchTxn, error) {
+	txn, err := d.datastore.NewTransaction(false)
+	if err != nil {
+		return nil, err
+	}
+	return &dispatchTxn{Txn: txn}, nil
+}
+
+// onCommit defers f until the transaction is committed.
+func (t *dispatchTxn) onCommit(f func()) {
+	t.committed = append(t.committed, f)
+}
+
+// Commit commits the transaction and runs the deferred functions.
+func (t *dispatchTxn) Commit() error {
+	if err := t.Txn.Commit(); err != nil {
+		return err
+	}
+	for _, f := range t.committed {
+		f()
+	}
+	t.committed = nil
+	return nil
+}
+
+// commitDispatch commits txn, and flushes the persisted events if the
+// dispatcher syncs them, see WithNewDBDispatcherSync.
+func (d *DB) commitDispatch(txn *dispatchTxn) error {
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	if d.dispatcher.sync {
+		return d.datastore.Sync(dsDispatcherPrefix)
+	}
+	return nil
+}
+
+// withDispatchTxn tags ctx as dispatching events in txn.
+func withDispatchTxn(ctx context.Context, txn *dispatchTxn) context.Context {
+	return context.WithValue(ctx, ctxKey("txn"), txn)
+}
+
+func dispatchTxnFrom(ctx context.Context) *dispatchTxn {
+	txn, _ := ctx.Value(ctxKey("txn")).(*dispatchTxn)
+	return txn
+}
+
+// withAtomicDispatch tags ctx as persisting events in its dispatch txn even
+// if the dispatcher has a batch size, see WithNewDBDispatcherBatchSize.
+func withAtomicDispatch(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxKey("atomic"), true)
+}
+
+func atomicDispatch(ctx context.Context) bool {
+	atomic, _ := ctx.Value(ctxKey("atomic")).(bool)
+	return atomic
+}
+
+// txnDatastore is a datastore reading and writing in txn, so codecs can
+// reduce events in it. Transactions it creates are part of txn, so
+// committing or discarding them is a no-op.
+type txnDatastore struct {
+	ds.Txn
+}
+
+var _ ds.TxnDatastore = txnDatastore{}
+
+func (t txnDatastore) NewTransaction(_ bool) (ds.Txn, error) {
+	return nestedTxn(t), nil
+}
+
+func (t txnDatastore) Sync(ds.Key) error {
+	return nil
+}
+
+func (t txnDatastore) Close() error {
+	return nil
+}
+
+type nestedTxn struct {
+	ds.Txn
+}
+
+func (nestedTxn) Commit() error {
+	return nil
+}
+
+func (nestedTxn) Discard() {}
@@ -0,0 +1,30 @@
+package db
+
+// Durability is how durable local writes are when their transaction
+// commit returns, see WithNewDBDurability.
+type Durability int
+
+const (
+	// DurabilitySync makes commits wait for the datastore to sync their
+	// writes to disk, so acknowledged writes survive a crash.
+	DurabilitySync Durability = iota
+	// DurabilityAsync lets commits return once their writes are handed to
+	// the datastore, which syncs them later, trading recent writes lost on
+	// a crash for throughput.
+	DurabilityAsync
+)
+
+// Durability returns the durability mode of local writes.
+func (d *DB) Durability() Durability {
+	return d.durability
+}
+
+// syncWrites syncs the datastore after a commit of local writes, if its
+// durability requires it. The default datastore syncs every write by
+// itself in this mode, which makes it a no-op.
+func (d *DB) syncWrites() error {
+	if d.durability != DurabilitySync {
+		return nil
+	}
+	return d.datastore.Sync(dsDBPrefix)
+}
@@ -0,0 +1,179 @@
+package db
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+var (
+	// ErrInvalidEncryptionKey indicates the provided encryption key isn't a valid AES key.
+	ErrInvalidEncryptionKey = errors.New("encryption key must be 16, 24 or 32 bytes long")
+
+	errCiphertextTooShort = errors.New("ciphertext too short")
+)
+
+// valueCipher encrypts and decrypts datastore values with AES-GCM.
+// The value key is used as additional data, so a ciphertext can't be
+// moved under a different key without failing authentication.
+type valueCipher struct {
+	aead cipher.AEAD
+}
+
+func newValueCipher(key []byte) (valueCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return valueCipher{}, ErrInvalidEncryptionKey
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return valueCipher{}, err
+	}
+	return valueCipher{aead: aead}, nil
+}
+
+func (c valueCipher) seal(key ds.Key, value []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(value)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, value, key.Bytes()), nil
+}
+
+func (c valueCipher) open(key ds.Key, data []byte) ([]byte, error) {
+	ns := c.aead.NonceSize()
+	if len(data) < ns {
+		return nil, errCiphertextTooShort
+	}
+	value, err := c.aead.Open(nil, data[:ns], data[ns:], key.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting value of %s: %v", key, err)
+	}
+	return value, nil
+}
+
+func (c valueCipher) put(w ds.Write, key ds.Key, value []byte) error {
+	data, err := c.seal(key, value)
+	if err != nil {
+		return err
+	}
+	return w.Put(key, data)
+}
+
+func (c valueCipher) get(r ds.Read, key ds.Key) ([]byte, error) {
+	data, err := r.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return c.open(key, data)
+}
+
+func (c valueCipher) getSize(r ds.Read, key ds.Key) (int, error) {
+	size, err := r.GetSize(key)
+	if err != nil {
+		return size, err
+	}
+	return size - c.aead.NonceSize() - c.aead.Overhead(), nil
+}
+
+// query runs q against r, decrypting values on the way back out.
+// Filters and orders on values are applied after decrypting.
+func (c valueCipher) query(r ds.Read, q dsq.Query) (dsq.Results, error) {
+	child := dsq.Query{
+		Prefix:            q.Prefix,
+		KeysOnly:          q.KeysOnly,
+		ReturnExpirations: q.ReturnExpirations,
+	}
+	naive := q
+	if len(q.Filters) == 0 && len(q.Orders) == 0 {
+		child.Limit, child.Offset = q.Limit, q.Offset
+		naive.Limit, naive.Offset = 0, 0
+	}
+	cqr, err := r.Query(child)
+	if err != nil {
+		return nil, err
+	}
+	qr := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			res, ok := cqr.NextSync()
+			if !ok || res.Error != nil || q.KeysOnly {
+				return res, ok
+			}
+			res.Value, res.Error = c.open(ds.RawKey(res.Key), res.Value)
+			res.Size = len(res.Value)
+			return res, true
+		},
+		Close: func() error {
+			return cqr.Close()
+		},
+	})
+	return dsq.NaiveQueryApply(naive, qr), nil
+}
+
+// encryptedDatastore encrypts all values written to the wrapped datastore.
+// Only values are encrypted, keys (including index keys, which embed indexed
+// field values) are stored as-is.
+type encryptedDatastore struct {
+	ds.TxnDatastore
+	cipher valueCipher
+}
+
+var _ ds.TxnDatastore = (*encryptedDatastore)(nil)
+
+func newEncryptedDatastore(child ds.TxnDatastore, key []byte) (*encryptedDatastore, error) {
+	c, err := newValueCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedDatastore{TxnDatastore: child, cipher: c}, nil
+}
+
+func (e *encryptedDatastore) Put(key ds.Key, value []byte) error {
+	return e.cipher.put(e.TxnDatastore, key, value)
+}
+
+func (e *encryptedDatastore) Get(key ds.Key) ([]byte, error) {
+	return e.cipher.get(e.TxnDatastore, key)
+}
+
+func (e *encryptedDatastore) GetSize(key ds.Key) (int, error) {
+	return e.cipher.getSize(e.TxnDatastore, key)
+}
+
+func (e *encryptedDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	return e.cipher.query(e.TxnDatastore, q)
+}
+
+func (e *encryptedDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	t, err := e.TxnDatastore.NewTransaction(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedTxn{Txn: t, cipher: e.cipher}, nil
+}
+
+type encryptedTxn struct {
+	ds.Txn
+	cipher valueCipher
+}
+
+func (t *encryptedTxn) Put(key ds.Key, value []byte) error {
+	return t.cipher.put(t.Txn, key, value)
+}
+
+func (t *encryptedTxn) Get(key ds.Key) ([]byte, error) {
+	return t.cipher.get(t.Txn, key)
+}
+
+func (t *encryptedTxn) GetSize(key ds.Key) (int, error) {
+	return t.cipher.getSize(t.Txn, key)
+}
+
+func (t *encryptedTxn) Query(q dsq.Query) (dsq.Results, error) {
+	return t.cipher.query(t.Txn, q)
+}
@@ -0,0 +1,76 @@
+package db
+
+import (
+	"bytes"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-threads/util"
+)
+
+func TestEncryptionKey(t *testing.T) {
+	t.Parallel()
+
+	t.Run("InvalidKey", func(t *testing.T) {
+		t.Parallel()
+		if err := WithNewDBEncryptionKey([]byte("short"))(&NewDBOptions{}); err != ErrInvalidEncryptionKey {
+			t.Fatalf("expected invalid encryption key error, got %v", err)
+		}
+	})
+	t.Run("EncryptedAtRest", func(t *testing.T) {
+		t.Parallel()
+		key := bytes.Repeat([]byte{1}, 32)
+		store := NewTxMapDatastore()
+		db, clean := createTestDB(t, WithNewDBEncryptionKey(key), func(o *NewDBOptions) error {
+			o.Datastore = store
+			return nil
+		})
+		defer clean()
+		c, err := db.NewCollection(CollectionConfig{
+			Name:   "dummy",
+			Schema: util.SchemaFromInstance(&dummy{}, false),
+		})
+		checkErr(t, err)
+		id, err := c.Create(util.JSONFromInstance(dummy{Name: "TopSecret", Counter: 42}))
+		checkErr(t, err)
+
+		// Values must be decrypted transparently on reads and queries
+		instance, err := c.FindByID(id)
+		checkErr(t, err)
+		if !bytes.Contains(instance, []byte("TopSecret")) {
+			t.Fatalf("instance should be decrypted on read")
+		}
+		res, err := c.Find(Where("Name").Eq("TopSecret"))
+		checkErr(t, err)
+		if len(res) != 1 {
+			t.Fatalf("expected 1 result, got %d", len(res))
+		}
+
+		// Nothing readable must reach the underlying datastore
+		results, err := store.Query(query.Query{})
+		checkErr(t, err)
+		all, err := results.Rest()
+		checkErr(t, err)
+		if len(all) == 0 {
+			t.Fatalf("datastore should contain entries")
+		}
+		for _, e := range all {
+			if bytes.Contains(e.Value, []byte("TopSecret")) {
+				t.Fatalf("value of %s is stored in plaintext", e.Key)
+			}
+		}
+
+		// A different key must fail to decrypt
+		instanceKey := ds.NewKey("/db/collection/dummy").ChildString(id.String())
+		right, err := newEncryptedDatastore(store, key)
+		checkErr(t, err)
+		_, err = right.Get(instanceKey)
+		checkErr(t, err)
+		wrong, err := newEncryptedDatastore(store, bytes.Repeat([]byte{2}, 32))
+		checkErr(t, err)
+		if _, err := wrong.Get(instanceKey); err == nil {
+			t.Fatalf("decrypting with a different key should fail")
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/textileio/go-threads/core/app"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/net"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+var (
+	dsDBOrigins = dsDBPrefix.ChildString("origins")
+)
+
+// threadFeed connects a federated thread to the DB. It's the app of the
+// thread connector, handing records of the thread to the DB, while never
+// sending local events, which are only added to the DB thread.
+type threadFeed struct {
+	d         *DB
+	bus       *app.LocalEventsBus
+	connector *app.Connector
+}
+
+// LocalEventListen returns a listener of the feed bus, which never sends.
+func (f *threadFeed) LocalEventListen() *app.LocalEventListener {
+	return f.bus.Listen()
+}
+
+// HandleNetRecord applies a record of the federated thread. Records of the
+// own log of the peer in the thread are applied too, since they were
+// written by another DB. Errors are logged rather than returned, since the
+// connector stops the process on them.
+func (f *threadFeed) HandleNetRecord(rec net.ThreadRecord, key thread.Key, _ peer.ID, timeout time.Duration) error {
+	if err := f.d.HandleNetRecord(rec, key, "", timeout); err != nil {
+		f.d.log.Errorf("error applying record %s of federated thread %s: %v", rec.Value().Cid(), rec.ThreadID(), err)
+	}
+	return nil
+}
+
+// newFeedThreads returns the set of federated threads, or nil if there's none.
+func newFeedThreads(threads []thread.ID) map[thread.ID]struct{} {
+	if len(threads) == 0 {
+		return nil
+	}
+	res := make(map[thread.ID]struct{}, len(threads))
+	for _, id := range threads {
+		res[id] = struct{}{}
+	}
+	return res
+}
+
+// connectFeeds connects the DB to its federated threads.
+func (d *DB) connectFeeds(n app.Net, threads []thread.ID) error {
+	for _, id := range threads {
+		if id.Equals(d.connector.ThreadID()) {
+			return fmt.Errorf("federated thread %s is the DB thread", id)
+		}
+		f := &threadFeed{d: d, bus: app.NewLocalEventsBus()}
+		connector, err := n.ConnectApp(f, id)
+		if err != nil {
+			f.bus.Discard()
+			return fmt.Errorf("error connecting federated thread %s: %v", id, err)
+		}
+		f.connector = connector
+		d.feeds = append(d.feeds, f)
+	}
+	return nil
+}
+
+// closeFeeds stops handling records of federated threads.
+func (d *DB) closeFeeds() error {
+	for _, f := range d.feeds {
+		if err := f.connector.Close(); err != nil {
+			return err
+		}
+		f.bus.Discard()
+	}
+	return nil
+}
+
+// FederatedThreads returns the threads whose events are reduced into the
+// DB along with those of its own thread, see WithNewDBFederatedThreads.
+func (d *DB) FederatedThreads() []thread.ID {
+	ids := make([]thread.ID, len(d.feeds))
+	for i, f := range d.feeds {
+		ids[i] = f.connector.ThreadID()
+	}
+	return ids
+}
+
+// Origin returns the thread of the last event reduced into an instance,
+// which is the DB thread unless the event came from a federated thread,
+// see WithNewDBFederatedThreads. Instances of collections rebuilt with
+// RebuildCollection from events stored before their origins were kept
+// report the DB thread. If the instance doesn't exist, ErrNotFound is
+// returned.
+func (c *Collection) Origin(id core.InstanceID, opts ...TxnOption) (origin thread.ID, err error) {
+	err = c.ReadTxn(func(txn *Txn) error {
+		exists, err := txn.Has(id)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrNotFound
+		}
+		b, err := c.db.datastore.Get(originKey(c.name, id))
+		if errors.Is(err, ds.ErrNotFound) {
+			origin = c.db.connector.ThreadID()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		origin, err = thread.Cast(b)
+		return err
+	}, opts...)
+	return
+}
+
+func originKey(collection string, id core.InstanceID) ds.Key {
+	return dsDBOrigins.ChildString(collection).ChildString(id.String())
+}
+
+// withOriginThread tags ctx as dispatching events of the thread id.
+func withOriginThread(ctx context.Context, id thread.ID) context.Context {
+	return context.WithValue(ctx, ctxKey("origin"), id)
+}
+
+func originThread(ctx context.Context) thread.ID {
+	id, _ := ctx.Value(ctxKey("origin")).(thread.ID)
+	return id
+}
+
+// originIndexFunc wraps indexFunc to track instances written by events of
+// the federated thread origin. Instances last written by events of the DB
+// thread have no origin key. It's only used by DBs with federated threads.
+func originIndexFunc(
+	d *DB,
+	origin thread.ID,
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+	_, federated := d.feedThreads[origin]
+	return func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+		if err := indexFunc(collection, key, oldData, newData, txn); err != nil {
+			return err
+		}
+		okey := originKey(collection, core.InstanceID(key.BaseNamespace()))
+		if federated && newData != nil {
+			return txn.Put(okey, origin.Bytes())
+		}
+		if oldData != nil {
+			return txn.Delete(okey)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"sync"
+
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/net"
+)
+
+// PreDispatchHook is called with the events of a local commit, or of a
+// remote record, right before they're dispatched to reducers. remote tells
+// which is the case. Returning an error aborts a local commit, which then
+// fails with the error. Remote events were already committed by another
+// peer, so errors are only logged for them. With write batching, batched
+// writes are dispatched, and can be aborted, when the batch is flushed.
+type PreDispatchHook func(events []core.Event, remote bool) error
+
+// PostDispatchHook is called with dispatched events once they are
+// reduced into collection states. remote tells whether they came from
+// a remote record.
+type PostDispatchHook func(events []core.Event, remote bool)
+
+// RecordTap observes every record handed to the DB by the thread,
+// including the ones it ignores, such as records of its own log.
+type RecordTap func(rec net.ThreadRecord)
+
+// dispatchHooks keeps registered hooks in registration order.
+type dispatchHooks struct {
+	lock   sync.RWMutex
+	nextID int
+	pre    []preDispatchHook
+	post   []postDispatchHook
+	taps   []recordTap
+}
+
+type preDispatchHook struct {
+	id int
+	fn PreDispatchHook
+}
+
+type postDispatchHook struct {
+	id int
+	fn PostDispatchHook
+}
+
+type recordTap struct {
+	id int
+	fn RecordTap
+}
+
+// OnPreDispatch registers h to be called before events are dispatched,
+// and returns a function that unregisters it.
+// Hooks run synchronously under the DB lock, or its read lock for flushes
+// of batched writes, so they must not use the DB or its collections (e.g.,
+// transactions, queries, or collection management), which would deadlock.
+// They can register and unregister hooks. Slow hooks delay every write and inbound record.
+func (d *DB) OnPreDispatch(h PreDispatchHook) (remove func()) {
+	d.hooks.lock.Lock()
+	defer d.hooks.lock.Unlock()
+	id := d.hooks.nextID
+	d.hooks.nextID++
+	d.hooks.pre = append(d.hooks.pre, preDispatchHook{id: id, fn: h})
+	return func() {
+		d.hooks.lock.Lock()
+		defer d.hooks.lock.Unlock()
+		for i, ph := range d.hooks.pre {
+			if ph.id == id {
+				d.hooks.pre = append(d.hooks.pre[:i:i], d.hooks.pre[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// OnPostDispatch registers h to be called after events are dispatched,
+// and returns a function that unregisters it. Hooks are called before the
+// changes are notified to the thread of a local commit, and are subject to
+// the same constraints as pre-dispatch hooks, see OnPreDispatch.
+func (d *DB) OnPostDispatch(h PostDispatchHook) (remove func()) {
+	d.hooks.lock.Lock()
+	defer d.hooks.lock.Unlock()
+	id := d.hooks.nextID
+	d.hooks.nextID++
+	d.hooks.post = append(d.hooks.post, postDispatchHook{id: id, fn: h})
+	return func() {
+		d.hooks.lock.Lock()
+		defer d.hooks.lock.Unlock()
+		for i, ph := range d.hooks.post {
+			if ph.id == id {
+				d.hooks.post = append(d.hooks.post[:i:i], d.hooks.post[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// TapRecords registers tap to be called with every record from the
+// thread, before the DB filters or applies it, and returns a function that
+// unregisters it. Taps run synchronously on the path that handles records,
+// so they must be fast, or hand records off to their own goroutine, not to
+// delay handling. Records received while dispatching is paused are seen
+// when they arrive, not when they're applied, see PauseDispatch.
+func (d *DB) TapRecords(tap RecordTap) (remove func()) {
+	d.hooks.lock.Lock()
+	defer d.hooks.lock.Unlock()
+	id := d.hooks.nextID
+	d.hooks.nextID++
+	d.hooks.taps = append(d.hooks.taps, recordTap{id: id, fn: tap})
+	return func() {
+		d.hooks.lock.Lock()
+		defer d.hooks.lock.Unlock()
+		for i, rt := range d.hooks.taps {
+			if rt.id == id {
+				d.hooks.taps = append(d.hooks.taps[:i:i], d.hooks.taps[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// tapRecord calls record taps.
+func (d *DB) tapRecord(rec net.ThreadRecord) {
+	d.hooks.lock.RLock()
+	taps := d.hooks.taps
+	d.hooks.lock.RUnlock()
+	for _, t := range taps {
+		t.fn(rec)
+	}
+}
+
+// preDispatch calls pre-dispatch hooks until one of them fails.
+func (d *DB) preDispatch(events []core.Event, remote bool) error {
+	d.hooks.lock.RLock()
+	hooks := d.hooks.pre
+	d.hooks.lock.RUnlock()
+	for _, h := range hooks {
+		if err := h.fn(events, remote); err != nil {
+			if remote {
+				d.log.Errorf("pre-dispatch hook failed for remote events: %v", err)
+				continue
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// postDispatch calls post-dispatch hooks.
+func (d *DB) postDispatch(events []core.Event, remote bool) {
+	d.hooks.lock.RLock()
+	hooks := d.hooks.post
+	d.hooks.lock.RUnlock()
+	for _, h := range hooks {
+		h.fn(events, remote)
+	}
+}
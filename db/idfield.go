@@ -0,0 +1,40 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+var dsDBIDFields = dsDBPrefix.ChildString("idfields")
+
+// validateIDField checks the ID field name of config. Names are used as
+// index paths, so they can't have path syntax.
+func validateIDField(config CollectionConfig) error {
+	if config.IDField == "" {
+		return nil
+	}
+	if strings.ContainsAny(config.IDField, `.*?|#@\`) {
+		return fmt.Errorf("invalid id field %q", config.IDField)
+	}
+	return nil
+}
+
+// getIDField returns the persisted ID field name of collection, or
+// idFieldName if it has the default one.
+func (d *DB) getIDField(collection string) (string, error) {
+	v, err := d.datastore.Get(dsDBIDFields.ChildString(collection))
+	if errors.Is(err, ds.ErrNotFound) {
+		return idFieldName, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(v), nil
+}
+
+func (d *DB) putIDField(collection, field string) error {
+	return d.datastore.Put(dsDBIDFields.ChildString(collection), []byte(field))
+}
@@ -0,0 +1,33 @@
+package db
+
+// ImportInstances creates instances in the collection in a single
+// transaction, to seed the DB with data from another system. Their events
+// are created with the event codec of the collection and sent through the
+// connector like those of any other write, so they're added to the thread
+// log in a record, and reach other peers as such. Instances are validated
+// and indexed as by Create: they keep their IDs, or get new ones if they
+// have none, and nothing is imported if any of them is invalid or exists.
+// The import is committed on its own, after flushing pending batched
+// writes, and its events are persisted and reduced in one datastore
+// transaction even with a dispatcher batch size, see
+// WithNewDBDispatcherBatchSize.
+func (d *DB) ImportInstances(collection string, instances [][]byte, opts ...TxnOption) error {
+	d.lock.RLock()
+	closed := d.closed
+	c := d.getCollection(collection)
+	d.lock.RUnlock()
+	if closed {
+		return ErrDBClosed
+	}
+	if c == nil {
+		return ErrCollectionNotFound
+	}
+	if len(instances) == 0 {
+		return nil
+	}
+	return c.WriteTxn(func(txn *Txn) error {
+		txn.atomic = true
+		_, err := txn.Create(instances...)
+		return err
+	}, opts...)
+}
@@ -6,10 +6,11 @@ package db
 
 import (
 	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"sort"
+	"strings"
 
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
@@ -22,12 +23,17 @@ const (
 	iteratorKeyMinCacheSize = 100
 )
 
-// ErrUniqueExists is the error thrown when data is being inserted for a unique constraint value that already exists
+// compoundPathSeparator separates the fields of compound index paths.
+const compoundPathSeparator = ","
+
+// ErrUniqueConstraintViolation is returned when data takes the value of a unique index held by another instance.
+// ErrUniqueExists is the same error, kept for compatibility
 var (
-	indexPrefix     = ds.NewKey("_index")
-	ErrUniqueExists = errors.New("unique constraint violation")
-	ErrNotIndexable = errors.New("value not indexable")
-	ErrNoIndexFound = errors.New("no index found")
+	indexPrefix                  = ds.NewKey("_index")
+	ErrUniqueConstraintViolation = errors.New("unique constraint violation")
+	ErrUniqueExists              = ErrUniqueConstraintViolation
+	ErrNotIndexable              = errors.New("value not indexable")
+	ErrNoIndexFound              = errors.New("no index found")
 )
 
 // Indexer is the interface to implement to support Collection indexes
@@ -39,13 +45,48 @@ type Indexer interface {
 // Index is a function that returns the indexable, encoded bytes of the passed in bytes
 type Index struct {
 	IndexFunc func(name string, value []byte) (ds.Key, error)
-	Unique    bool
+	// MultiIndexFunc is used instead of IndexFunc by multikey indexes,
+	// which have an entry per element of an array field.
+	MultiIndexFunc func(name string, value []byte) ([]ds.Key, error)
+	Unique         bool
+	// Sorted tells whether numbers are keyed by sortedIndexFunc, so that
+	// numeric ranges are looked up by a rangeScan.
+	Sorted bool
+}
+
+// keys returns the index keys of value.
+func (i Index) keys(path string, value []byte) ([]ds.Key, error) {
+	if i.MultiIndexFunc != nil {
+		return i.MultiIndexFunc(path, value)
+	}
+	key, err := i.IndexFunc(path, value)
+	if err != nil {
+		return nil, err
+	}
+	return []ds.Key{key}, nil
 }
 
 // IndexConfig stores the configuration for a given Index.
+// Path may be a dotted path into nested objects, e.g. "Address.City".
+// Instances missing any field in the path aren't indexed.
+// Multikey indexes have an entry per element of an array field, and
+// instances where the field isn't an array aren't indexed. Queries using
+// a multikey index see each element as a single-element array, so they
+// should only have array predicates, i.e. Contains, on the field.
+// Compound indexes have a Path listing several fields separated by commas,
+// e.g. "Org,Username", and index the tuple of their values, so instances
+// missing any of them aren't indexed. They enforce uniqueness across the
+// tuple, but can't be multikey nor used by queries.
+// Sorted indexes key numbers in an order-preserving encoding, so numeric
+// ranges on the field, i.e. Between, Gt, Ge, Lt, Le and Eq, seek to their
+// bounds instead of evaluating every entry of the index. They can't be
+// multikey nor compound. Index values other than numbers starting with
+// "~n/" are reserved by sorted indexes.
 type IndexConfig struct {
-	Path   string `json:"path"`
-	Unique bool   `json:"unique,omitempty"`
+	Path     string `json:"path"`
+	Unique   bool   `json:"unique,omitempty"`
+	Multikey bool   `json:"multikey,omitempty"`
+	Sorted   bool   `json:"sorted,omitempty"`
 }
 
 // adds an item to the index
@@ -61,6 +102,88 @@ func indexAdd(indexer Indexer, tx ds.Txn, key ds.Key, data []byte) error {
 	return nil
 }
 
+// indexCheckUnique returns ErrUniqueConstraintViolation if data, stored at
+// key, has the value of a unique index other than the one on idField that's
+// indexed for another key, unless released reports that key as no longer
+// holding the index entry. The index keys of data are returned by path.
+func indexCheckUnique(indexer Indexer, idField string, r ds.Read, key ds.Key, data []byte, released func(owner, indexKey ds.Key) bool) (map[string][]ds.Key, error) {
+	res, err := uniqueIndexKeys(indexer, idField, data)
+	if err != nil {
+		return nil, err
+	}
+	for path, indexKeys := range res {
+		for _, indexKey := range indexKeys {
+			entry, err := r.Get(indexKey)
+			if errors.Is(err, ds.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			indexValue := make(keyList, 0)
+			if err := DefaultDecode(entry, &indexValue); err != nil {
+				return nil, err
+			}
+			for _, owner := range indexValue {
+				if ownerKey := ds.RawKey(string(owner)); ownerKey != key && !released(ownerKey, indexKey) {
+					return nil, fmt.Errorf("%w: index %s", ErrUniqueConstraintViolation, path)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// uniqueIndexKeys returns the keys of the entries of data in the unique
+// indexes other than the one on idField, by path.
+func uniqueIndexKeys(indexer Indexer, idField string, data []byte) (map[string][]ds.Key, error) {
+	res := make(map[string][]ds.Key)
+	for path, index := range indexer.Indexes() {
+		if !index.Unique || path == idField {
+			continue
+		}
+		valueKeys, err := index.keys(path, data)
+		if errors.Is(err, ErrNotIndexable) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, valueKey := range valueKeys {
+			if valueKey.String() == "" {
+				continue
+			}
+			indexKey := indexPrefix.Child(indexer.BaseKey()).ChildString(path).ChildString(valueKey.String()[1:])
+			res[path] = append(res[path], indexKey)
+		}
+	}
+	return res, nil
+}
+
+// compoundPaths returns the fields of a compound index path, or nil if
+// path isn't compound.
+func compoundPaths(path string) []string {
+	if !strings.Contains(path, compoundPathSeparator) {
+		return nil
+	}
+	return strings.Split(path, compoundPathSeparator)
+}
+
+// compoundIndexFunc indexes the tuple of values of the fields of a
+// compound path.
+func compoundIndexFunc(path string, value []byte) (ds.Key, error) {
+	fields := compoundPaths(path)
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		result := gjson.GetBytes(value, field)
+		if !result.Exists() {
+			return ds.Key{}, ErrNotIndexable
+		}
+		parts[i] = url.QueryEscape(result.String())
+	}
+	return ds.NewKey(strings.Join(parts, compoundPathSeparator)), nil
+}
+
 // removes an item from the index
 // be sure to pass the data from the old record, not the new one
 func indexDelete(indexer Indexer, tx ds.Txn, key ds.Key, originalData []byte) error {
@@ -80,10 +203,22 @@ func indexDelete(indexer Indexer, tx ds.Txn, key ds.Key, originalData []byte) er
 func indexUpdate(baseKey ds.Key, path string, index Index, tx ds.Txn, key ds.Key, value []byte,
 	delete bool) error {
 
-	valueKey, err := index.IndexFunc(path, value)
+	valueKeys, err := index.keys(path, value)
 	if err != nil && !errors.Is(err, ErrNotIndexable) {
 		return err
 	}
+	for _, valueKey := range valueKeys {
+		if err := indexUpdateValue(baseKey, path, index, tx, key, valueKey, delete); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// adds or removes an item from the index entry of valueKey
+func indexUpdateValue(baseKey ds.Key, path string, index Index, tx ds.Txn, key ds.Key, valueKey ds.Key,
+	delete bool) error {
+
 	if valueKey.String() == "" {
 		return nil
 	}
@@ -174,18 +309,36 @@ type MarshaledResult struct {
 }
 
 type iterator struct {
-	nextKeys func() ([]ds.Key, error)
-	txn      ds.Txn
-	query    *Query
-	err      error
-	keyCache []ds.Key
-	iter     query.Results
+	nextKeys  func() ([]ds.Key, error)
+	txn       ds.Txn
+	query     *Query
+	useNumber bool
+	err       error
+	keyCache  []ds.Key
+	iter      query.Results
+	// entries holds the index entries looked up, either iter or a
+	// rangeScan.
+	entries indexEntries
+	// deadline aborts the iteration once passed, if set.
+	deadline *queryDeadline
+}
+
+// indexEntries iterates over the entries of an index.
+type indexEntries interface {
+	NextSync() (query.Result, bool)
+	Close() error
 }
 
-func newIterator(txn ds.Txn, baseKey ds.Key, q *Query) *iterator {
+// newIterator returns an iterator over the instances under baseKey matching q.
+// index is the index used by q, if any. Numeric ranges on a sorted index
+// only read the entries between their bounds, see IndexConfig.Sorted.
+// useNumber decodes numbers as json.Number for matching, see decodeInstance.
+func newIterator(txn ds.Txn, baseKey ds.Key, index Index, useNumber bool, q *Query) *iterator {
+	multikey := index.MultiIndexFunc != nil
 	i := &iterator{
-		txn:   txn,
-		query: q,
+		txn:       txn,
+		query:     q,
+		useNumber: useNumber,
 	}
 	// Key field or index not specified, pass thru to base 'iterator'
 	if q.Index == "" {
@@ -201,16 +354,29 @@ func newIterator(txn ds.Txn, baseKey ds.Key, q *Query) *iterator {
 
 	// indexed field, get keys from index
 	indexKey := indexPrefix.Child(baseKey).ChildString(q.Index)
-	dsq := query.Query{
-		Prefix: indexKey.String(),
+	low, high, ranged := q.numberBounds(q.Index)
+	ranged = ranged && index.Sorted
+	if ranged {
+		i.entries = newRangeScan(txn, indexKey, low, high)
+	} else {
+		dsq := query.Query{
+			Prefix: indexKey.String(),
+		}
+		i.iter, i.err = txn.Query(dsq)
+		i.entries = i.iter
 	}
-	i.iter, i.err = txn.Query(dsq)
-	first := true
+	// Ranges may have no entries even if the index has some.
+	first := !ranged
+	// Multikey index entries of an instance can match more than once
+	seen := make(map[string]struct{})
 	i.nextKeys = func() ([]ds.Key, error) {
 		var nKeys []ds.Key
 
+		if i.err != nil {
+			return nil, i.err
+		}
 		for len(nKeys) < iteratorKeyMinCacheSize {
-			result, ok := i.iter.NextSync()
+			result, ok := i.entries.NextSync()
 			if !ok {
 				if first {
 					return nil, ErrNoIndexFound
@@ -218,20 +384,31 @@ func newIterator(txn ds.Txn, baseKey ds.Key, q *Query) *iterator {
 				return nKeys, result.Error
 			}
 			first = false
+			if err := i.deadline.scan(); err != nil {
+				return nil, err
+			}
 			// result.Key contains the indexed value, extract here first
 			key := ds.RawKey(result.Key)
 			base := indexKey.Name()
 			name := key.Name()
-			val := gjson.Parse(name).Value()
+			if index.Sorted {
+				if number, ok := sortedIndexValue(indexKey, key); ok {
+					name = number
+				}
+			}
+			val := decodeIndexValue(name, useNumber)
 			if val == nil {
 				val = name
 			}
+			if multikey {
+				val = []interface{}{val}
+			}
 			doc, err := sjson.Set("", base, val)
 			if err != nil {
 				return nil, err
 			}
-			value := make(map[string]interface{})
-			if err := json.Unmarshal([]byte(doc), &value); err != nil {
+			value, err := decodeInstance([]byte(doc), useNumber)
+			if err != nil {
 				return nil, fmt.Errorf("error when unmarshaling query result: %v", err)
 			}
 			ok, err = q.match(value)
@@ -244,6 +421,12 @@ func newIterator(txn ds.Txn, baseKey ds.Key, q *Query) *iterator {
 					return nil, err
 				}
 				for _, v := range indexValue {
+					if multikey {
+						if _, ok := seen[string(v)]; ok {
+							continue
+						}
+						seen[string(v)] = struct{}{}
+					}
 					nKeys = append(nKeys, ds.RawKey(string(v)))
 				}
 			}
@@ -261,8 +444,11 @@ func (i *iterator) NextSync() (MarshaledResult, bool) {
 		value := MarshaledResult{}
 		var ok bool
 		for res := range i.iter.Next() {
-			val := make(map[string]interface{})
-			if value.Error = json.Unmarshal(res.Value, &val); value.Error != nil {
+			if value.Error = i.deadline.scan(); value.Error != nil {
+				break
+			}
+			var val map[string]interface{}
+			if val, value.Error = decodeInstance(res.Value, i.useNumber); value.Error != nil {
 				break
 			}
 			ok, value.Error = i.query.match(val)
@@ -323,7 +509,13 @@ func (i *iterator) NextSync() (MarshaledResult, bool) {
 }
 
 func (i *iterator) Close() {
-	i.iter.Close()
+	if i.entries != nil {
+		i.entries.Close()
+		return
+	}
+	if i.iter != nil {
+		i.iter.Close()
+	}
 }
 
 // Error returns the last error on the iterator
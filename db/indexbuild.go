@@ -0,0 +1,459 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+var dsDBIndexBuilds = dsDBPrefix.ChildString("indexbuilds")
+
+// indexBuildBatchSize is the number of instances indexed by each
+// transaction of AddIndexContext.
+const indexBuildBatchSize = 1000
+
+// IndexProgress reports the progress of AddIndexContext.
+type IndexProgress struct {
+	// Processed is the number of instances indexed so far, including those
+	// of the interrupted builds it resumes.
+	Processed int
+	// Total is the number of instances to index.
+	Total int
+}
+
+// indexBuild is the persisted state of an unfinished index build.
+type indexBuild struct {
+	Config IndexConfig
+	// Cursor is the key of the last indexed instance, or empty if none is.
+	Cursor    string
+	Processed int
+}
+
+// AddIndexContext is like AddIndex, but indexes existing instances in
+// batches, each committed in its own transaction, and calls progress, if
+// not nil, after each of them. The DB is only locked while a batch is
+// indexed, so it stays available for the duration of the build: writes
+// maintain the entries of the index as usual, but queries don't use it
+// until the build finishes.
+// When ctx is done, the build stops with its error, and the index is kept
+// unfinished. Calling AddIndexContext again with the same config resumes
+// it from the last committed batch, even after the DB is restarted, while
+// another config, AddIndex or DropIndex discards it. Builds failing for
+// other reasons, such as unique constraint violations, are discarded.
+func (c *Collection) AddIndexContext(ctx context.Context, config IndexConfig, progress func(IndexProgress)) error {
+	build, index, done, err := c.startIndexBuild(config)
+	if err != nil || done {
+		return err
+	}
+	defer func() {
+		c.db.lock.Lock()
+		if running, ok := c.building[config.Path]; ok && running {
+			c.building[config.Path] = false
+		}
+		c.db.lock.Unlock()
+	}()
+
+	// Instances written since the build started are indexed by the writes
+	// themselves, so a snapshot of the instance keys is enough. Values
+	// are read in each batch, since they may have changed.
+	res, err := c.db.datastore.Query(query.Query{
+		Prefix:   c.BaseKey().String(),
+		Orders:   []query.Order{query.OrderByKey{}},
+		KeysOnly: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	remaining, err := c.countInstanceKeys(build.Cursor)
+	if err != nil {
+		return err
+	}
+	total := build.Processed + remaining
+
+	keys := make([]ds.Key, 0, indexBuildBatchSize)
+	flush := func() error {
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := c.indexBatch(build, index, keys); err != nil {
+			return err
+		}
+		keys = keys[:0]
+		if progress != nil {
+			progress(IndexProgress{Processed: build.Processed, Total: total})
+		}
+		return nil
+	}
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		key := ds.NewKey(r.Key)
+		if !key.IsDescendantOf(c.BaseKey()) || key.String() <= build.Cursor {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if keys = append(keys, key); len(keys) == indexBuildBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return c.finishIndexBuild(build, index)
+}
+
+// startIndexBuild registers the unfinished index of config, resuming its
+// persisted build if it has the same config. done is true if the index
+// already exists with config, and has nothing to build.
+func (c *Collection) startIndexBuild(config IndexConfig) (build *indexBuild, index Index, done bool, err error) {
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	if c.db.closed {
+		return nil, Index{}, false, ErrDBClosed
+	}
+
+	txn, err := c.db.datastore.NewTransaction(false)
+	if err != nil {
+		return nil, Index{}, false, err
+	}
+	defer txn.Discard()
+	indexes, err := c.getIndexConfigs(txn)
+	if err != nil {
+		return nil, Index{}, false, err
+	}
+	existing, exists := indexes[config.Path]
+	if config.Path == c.idField && exists {
+		// The index on ID can't be redefined
+		config = existing
+	}
+	if index, err = newIndex(config); err != nil {
+		return nil, Index{}, false, err
+	}
+	build, err = c.getIndexBuild(txn, config.Path)
+	if err != nil {
+		return nil, Index{}, false, err
+	}
+	if build == nil && exists && existing == config {
+		return nil, Index{}, true, nil
+	}
+	if running := c.building[config.Path]; running {
+		return nil, Index{}, false, fmt.Errorf("index %s is already being built", config.Path)
+	}
+	if build == nil || build.Config != config {
+		build = &indexBuild{Config: config}
+		if exists {
+			delete(indexes, config.Path)
+			if err := c.putIndexConfigs(txn, indexes); err != nil {
+				return nil, Index{}, false, err
+			}
+		}
+		if err := c.clearIndex(txn, config.Path); err != nil {
+			return nil, Index{}, false, err
+		}
+		if err := c.putIndexBuild(txn, build); err != nil {
+			return nil, Index{}, false, err
+		}
+		if err := txn.Commit(); err != nil {
+			return nil, Index{}, false, err
+		}
+	}
+	c.registerIndexBuild(config.Path, index, true)
+	return build, index, false, nil
+}
+
+// indexBatch indexes the instances of keys, and persists the progress of
+// build along with their entries.
+func (c *Collection) indexBatch(build *indexBuild, index Index, keys []ds.Key) error {
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	if err := c.checkIndexBuild(build.Config.Path); err != nil {
+		return err
+	}
+
+	txn, err := c.db.datastore.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	// Instances with the same value share an index entry, which is only
+	// written once for the batch, or it would be written for each of them.
+	writes := &bufferedTxn{Txn: txn, values: make(map[ds.Key][]byte)}
+	path := build.Config.Path
+	for _, key := range keys {
+		value, err := txn.Get(key)
+		if errors.Is(err, ds.ErrNotFound) {
+			// Deleted since the build started.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// Instances written since the build started already have their
+		// entries, which must not violate their own unique constraint.
+		if err := indexUpdate(c.BaseKey(), path, index, writes, key, value, true); err != nil {
+			return err
+		}
+		if err := indexUpdate(c.BaseKey(), path, index, writes, key, value, false); err != nil {
+			c.discardIndexBuild(path)
+			return err
+		}
+	}
+	if err := writes.flush(); err != nil {
+		return err
+	}
+	next := *build
+	next.Cursor = keys[len(keys)-1].String()
+	next.Processed += len(keys)
+	if err := c.putIndexBuild(txn, &next); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	*build = next
+	return nil
+}
+
+// finishIndexBuild persists the config of the built index, so queries use
+// it from then on.
+func (c *Collection) finishIndexBuild(build *indexBuild, index Index) error {
+	c.db.lock.Lock()
+	defer c.db.lock.Unlock()
+	path := build.Config.Path
+	if err := c.checkIndexBuild(path); err != nil {
+		return err
+	}
+
+	txn, err := c.db.datastore.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	indexes, err := c.getIndexConfigs(txn)
+	if err != nil {
+		return err
+	}
+	indexes[path] = build.Config
+	if err := c.putIndexConfigs(txn, indexes); err != nil {
+		return err
+	}
+	if err := txn.Delete(indexBuildKey(c.name, path)); err != nil {
+		return err
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	delete(c.building, path)
+	c.indexes[path] = index
+	return nil
+}
+
+// checkIndexBuild returns an error if the build of the index on path
+// can't go on, because the index or the DB changed in the meantime.
+// The DB lock must be held by the caller.
+func (c *Collection) checkIndexBuild(path string) error {
+	if c.db.closed {
+		return ErrDBClosed
+	}
+	if c.db.getCollection(c.name) != c {
+		return fmt.Errorf("collection %s was deleted", c.name)
+	}
+	if _, ok := c.building[path]; !ok {
+		return fmt.Errorf("build of index %s was discarded", path)
+	}
+	return nil
+}
+
+// discardIndexBuild deletes the unfinished index on path, along with its
+// entries and persisted build. Errors are logged, since the build is lost
+// anyway, and is discarded again by the next build of the index.
+// The DB lock must be held by the caller.
+func (c *Collection) discardIndexBuild(path string) {
+	delete(c.building, path)
+	delete(c.indexes, path)
+	txn, err := c.db.datastore.NewTransaction(false)
+	if err != nil {
+		c.db.log.Errorf("error discarding build of index %s: %v", path, err)
+		return
+	}
+	defer txn.Discard()
+	if err := c.clearIndex(txn, path); err != nil {
+		c.db.log.Errorf("error discarding build of index %s: %v", path, err)
+		return
+	}
+	if err := txn.Delete(indexBuildKey(c.name, path)); err != nil {
+		c.db.log.Errorf("error discarding build of index %s: %v", path, err)
+		return
+	}
+	if err := txn.Commit(); err != nil {
+		c.db.log.Errorf("error discarding build of index %s: %v", path, err)
+	}
+}
+
+// registerIndexBuild registers the unfinished index on path, so writes
+// maintain its entries. running tells whether its build is running.
+// The DB lock must be held by the caller.
+func (c *Collection) registerIndexBuild(path string, index Index, running bool) {
+	if c.building == nil {
+		c.building = make(map[string]bool)
+	}
+	c.building[path] = running
+	c.indexes[path] = index
+}
+
+// isBuilding returns whether the index on path is unfinished, and can't be
+// used by queries.
+func (c *Collection) isBuilding(path string) bool {
+	_, ok := c.building[path]
+	return ok
+}
+
+// loadIndexBuilds registers the unfinished indexes of persisted builds,
+// e.g., when collections are re-created on start, until they're resumed.
+// The DB lock must be held by the caller.
+func (c *Collection) loadIndexBuilds() error {
+	res, err := c.db.datastore.Query(query.Query{Prefix: dsDBIndexBuilds.ChildString(c.name).String()})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		var build indexBuild
+		if err := json.Unmarshal(r.Value, &build); err != nil {
+			return err
+		}
+		if _, ok := c.indexes[build.Config.Path]; ok {
+			continue
+		}
+		index, err := newIndex(build.Config)
+		if err != nil {
+			return err
+		}
+		c.registerIndexBuild(build.Config.Path, index, false)
+	}
+	return nil
+}
+
+// countInstanceKeys returns the number of instances with keys after
+// cursor.
+func (c *Collection) countInstanceKeys(cursor string) (int, error) {
+	res, err := c.db.datastore.Query(query.Query{Prefix: c.BaseKey().String(), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+	count := 0
+	for r := range res.Next() {
+		if r.Error != nil {
+			return 0, r.Error
+		}
+		if key := ds.NewKey(r.Key); key.IsDescendantOf(c.BaseKey()) && key.String() > cursor {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func indexBuildKey(collection, path string) ds.Key {
+	return dsDBIndexBuilds.ChildString(collection).ChildString(path)
+}
+
+func (c *Collection) getIndexBuild(txn ds.Txn, path string) (*indexBuild, error) {
+	v, err := txn.Get(indexBuildKey(c.name, path))
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	build := &indexBuild{}
+	if err := json.Unmarshal(v, build); err != nil {
+		return nil, err
+	}
+	return build, nil
+}
+
+func (c *Collection) putIndexBuild(txn ds.Txn, build *indexBuild) error {
+	v, err := json.Marshal(build)
+	if err != nil {
+		return err
+	}
+	return txn.Put(indexBuildKey(c.name, build.Config.Path), v)
+}
+
+// clearIndexBuilds deletes the persisted builds of the collection.
+func (c *Collection) clearIndexBuilds(txn ds.Txn) error {
+	prefix := dsDBIndexBuilds.ChildString(c.name)
+	res, err := txn.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if key := ds.NewKey(e.Key); key.IsDescendantOf(prefix) {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// bufferedTxn holds the puts and deletes of keys until flushed to Txn, so
+// each key is written once whatever the number of writes.
+type bufferedTxn struct {
+	ds.Txn
+	// values are the written values of keys, nil for deleted keys.
+	values map[ds.Key][]byte
+}
+
+func (t *bufferedTxn) Get(key ds.Key) ([]byte, error) {
+	if v, ok := t.values[key]; ok {
+		if v == nil {
+			return nil, ds.ErrNotFound
+		}
+		return v, nil
+	}
+	return t.Txn.Get(key)
+}
+
+func (t *bufferedTxn) Put(key ds.Key, value []byte) error {
+	t.values[key] = value
+	return nil
+}
+
+func (t *bufferedTxn) Delete(key ds.Key) error {
+	t.values[key] = nil
+	return nil
+}
+
+func (t *bufferedTxn) flush() error {
+	for key, v := range t.values {
+		var err error
+		if v == nil {
+			err = t.Txn.Delete(key)
+		} else {
+			err = t.Txn.Put(key, v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
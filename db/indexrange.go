@@ -0,0 +1,229 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// sortedNumberDir holds the number entries of sorted indexes, see
+	// IndexConfig.Sorted. Index values of other types starting with it
+	// are reserved.
+	sortedNumberDir = "~n"
+	// sortedNumberWidth is the length of the order-preserving encoding of
+	// numbers.
+	sortedNumberWidth = 16
+	// sortedBucketWidth is the number of leading digits of the encoding,
+	// i.e. the sign and exponent of numbers, nesting their entries one
+	// digit per key segment, so that ranges query the buckets between
+	// their bounds only.
+	sortedBucketWidth = 3
+
+	hexDigits = "0123456789abcdef"
+)
+
+// sortedIndexFunc indexes the value of field like the default index,
+// except for numbers, which are keyed by their order-preserving encoding
+// followed by their value, in the bucket of their encoding.
+func sortedIndexFunc(field string, value []byte) (ds.Key, error) {
+	result := gjson.GetBytes(value, field)
+	if !result.Exists() {
+		return ds.Key{}, ErrNotIndexable
+	}
+	if result.Type != gjson.Number {
+		return ds.NewKey(result.String()), nil
+	}
+	enc := encodeSortedNumber(result.Num)
+	return sortedBucketKey(ds.NewKey(sortedNumberDir), enc[:sortedBucketWidth]).ChildString(enc + result.String()), nil
+}
+
+// sortedBucketKey returns the key of the bucket with the digits prefix
+// under numbers.
+func sortedBucketKey(numbers ds.Key, prefix string) ds.Key {
+	for _, d := range prefix {
+		numbers = numbers.ChildString(string(d))
+	}
+	return numbers
+}
+
+// encodeSortedNumber returns the hex encoding of sortedNumberBits(f).
+func encodeSortedNumber(f float64) string {
+	return fmt.Sprintf("%016x", sortedNumberBits(f))
+}
+
+// sortedNumberBits returns the bits of f flipped so that they sort like the
+// numbers do. Both zeros have the same bits.
+func sortedNumberBits(f float64) uint64 {
+	if f == 0 {
+		f = 0
+	}
+	bits := math.Float64bits(f)
+	if bits>>63 == 1 {
+		return ^bits
+	}
+	return bits | 1<<63
+}
+
+// sortedIndexValue returns the value name of the entry at key of the
+// sorted index at indexKey, and whether it's a number entry.
+func sortedIndexValue(indexKey, key ds.Key) (string, bool) {
+	bucket := key.Parent()
+	for i := 0; i < sortedBucketWidth; i++ {
+		bucket = bucket.Parent()
+	}
+	if !bucket.Equal(indexKey.ChildString(sortedNumberDir)) {
+		return "", false
+	}
+	name := key.Name()
+	if len(name) <= sortedNumberWidth {
+		return "", false
+	}
+	return name[sortedNumberWidth:], true
+}
+
+// numberBounds returns the bounds of the numbers matching the criteria of
+// q on path, which are inclusive, and whether there's any. Exclusive bounds
+// are left to the criteria.
+func (q *Query) numberBounds(path string) (low, high float64, ok bool) {
+	low, high = math.Inf(-1), math.Inf(1)
+	for _, c := range q.Ands {
+		if c.FieldPath != path || c.Negated {
+			continue
+		}
+		v, isNumber := criterionNumber(c.Value)
+		if !isNumber {
+			continue
+		}
+		switch c.Operation {
+		case Eq:
+			low, high = math.Max(low, v), math.Min(high, v)
+		case Gt, Ge:
+			low = math.Max(low, v)
+		case Lt, Le:
+			high = math.Min(high, v)
+		default:
+			continue
+		}
+		ok = true
+	}
+	return low, high, ok
+}
+
+// criterionNumber returns the number of v rounded to a float64, which
+// bounds exact numbers too since rounding is monotonic.
+func criterionNumber(v Value) (float64, bool) {
+	switch {
+	case v.Float != nil && !math.IsNaN(*v.Float):
+		return *v.Float, true
+	case v.Number != nil:
+		r, ok := numberRat(*v.Number)
+		if !ok {
+			return 0, false
+		}
+		f, _ := r.Float64()
+		return f, true
+	default:
+		return 0, false
+	}
+}
+
+// rangeScan iterates over the number entries of a sorted index between two
+// bounds, querying the buckets between them in key order. Queries seek to
+// their prefix, so entries outside of the buckets aren't read.
+type rangeScan struct {
+	txn       ds.Txn
+	prefixes  []ds.Key
+	low, high string
+	current   query.Results
+}
+
+// newRangeScan returns a scan of the number entries of the sorted index at
+// indexKey between low and high, inclusive.
+func newRangeScan(txn ds.Txn, indexKey ds.Key, low, high float64) *rangeScan {
+	s := &rangeScan{txn: txn, low: encodeSortedNumber(low), high: encodeSortedNumber(high)}
+	if low > high {
+		return s
+	}
+	numbers := indexKey.ChildString(sortedNumberDir)
+	for _, prefix := range coverBuckets(s.low[:sortedBucketWidth], s.high[:sortedBucketWidth]) {
+		s.prefixes = append(s.prefixes, sortedBucketKey(numbers, prefix))
+	}
+	return s
+}
+
+// coverBuckets returns the fewest digit prefixes covering the buckets from
+// low to high, in order.
+func coverBuckets(low, high string) []string {
+	if low == high {
+		return []string{low}
+	}
+	if strings.Trim(low, "0") == "" && strings.Trim(high, "f") == "" {
+		return []string{""}
+	}
+	if low[0] == high[0] {
+		return prefixBuckets(low[:1], coverBuckets(low[1:], high[1:]))
+	}
+	rest := len(low) - 1
+	res := prefixBuckets(low[:1], coverBuckets(low[1:], strings.Repeat("f", rest)))
+	for d := strings.IndexByte(hexDigits, low[0]) + 1; hexDigits[d] != high[0]; d++ {
+		res = append(res, hexDigits[d:d+1])
+	}
+	return append(res, prefixBuckets(high[:1], coverBuckets(strings.Repeat("0", rest), high[1:]))...)
+}
+
+func prefixBuckets(digit string, prefixes []string) []string {
+	for i := range prefixes {
+		prefixes[i] = digit + prefixes[i]
+	}
+	return prefixes
+}
+
+func (s *rangeScan) NextSync() (query.Result, bool) {
+	for {
+		if s.current == nil {
+			if len(s.prefixes) == 0 {
+				return query.Result{}, false
+			}
+			res, err := s.txn.Query(query.Query{Prefix: s.prefixes[0].String(), Orders: []query.Order{query.OrderByKey{}}})
+			if err != nil {
+				return query.Result{Error: err}, false
+			}
+			s.prefixes = s.prefixes[1:]
+			s.current = res
+		}
+		r, ok := s.current.NextSync()
+		if !ok && r.Error == nil {
+			s.current.Close()
+			s.current = nil
+			continue
+		}
+		if !ok || r.Error != nil {
+			return r, false
+		}
+		name := ds.RawKey(r.Key).Name()
+		if len(name) <= sortedNumberWidth {
+			continue
+		}
+		enc := name[:sortedNumberWidth]
+		if enc > s.high {
+			s.prefixes = nil
+			return query.Result{}, false
+		}
+		if enc < s.low {
+			continue
+		}
+		return r, true
+	}
+}
+
+func (s *rangeScan) Close() error {
+	if s.current == nil {
+		return nil
+	}
+	return s.current.Close()
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+)
+
+// Datastore key layout
+//
+// The layout of the keys a DB writes to its datastore is stable, so
+// external tools can inspect a raw datastore:
+//
+//   /db/collection/<collection>/<instance-id>   instance JSON
+//   /_index/db/collection/<collection>/<path>/<value>   index entry
+//   /db/schema/<collection>                     collection schema
+//   /db/index/<collection>                      index configuration
+//   /db/dispatcher/<timestamp>/<instance-id>/<collection>   dispatched event
+//
+// Other keys under /db hold per-collection settings and DB state, and are
+// internal. DBs of a Manager share its datastore, with their keys prefixed
+// by /manager/<thread-id>. Sharded instances keep their keys in the shard
+// datastores. Values, but not keys, are encrypted if the DB uses an
+// encryption key.
+
+// KeyForInstance returns the datastore key of an instance.
+func KeyForInstance(collection string, id core.InstanceID) ds.Key {
+	return baseKey.ChildString(collection).ChildString(id.String())
+}
+
+// ParseInstanceKey returns the collection and instance ID of the datastore
+// key of an instance, or false if key isn't an instance key.
+func ParseInstanceKey(key ds.Key) (collection string, id core.InstanceID, ok bool) {
+	if !key.IsDescendantOf(baseKey) {
+		return "", core.EmptyInstanceID, false
+	}
+	parts := key.Namespaces()
+	base := len(baseKey.Namespaces())
+	if len(parts) != base+2 {
+		return "", core.EmptyInstanceID, false
+	}
+	return parts[base], core.InstanceID(parts[base+1]), true
+}
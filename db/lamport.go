@@ -0,0 +1,170 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+)
+
+var (
+	dsDBClock  = dsDBPrefix.ChildString("clock")
+	dsDBStamps = dsDBPrefix.ChildString("stamps")
+)
+
+// lamportClock is the persisted Lamport clock of a DB. It ticks for each
+// record of local events, and witnesses the clocks of remote events, so
+// local events are stamped after every event the DB applied. Its time is
+// saved in the dispatch txn of the events, so it's persisted with them;
+// if the txn is discarded, the time stays ahead, which keeps it monotonic.
+// It must be used with the DB lock held.
+type lamportClock struct {
+	time uint64
+}
+
+func newLamportClock(store ds.Datastore) (*lamportClock, error) {
+	l := &lamportClock{}
+	v, err := store.Get(dsDBClock)
+	if errors.Is(err, ds.ErrNotFound) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(v) != 8 {
+		return nil, fmt.Errorf("invalid lamport clock of %d bytes", len(v))
+	}
+	l.time = binary.BigEndian.Uint64(v)
+	return l, nil
+}
+
+// tick advances the clock and returns the new time.
+func (l *lamportClock) tick() uint64 {
+	l.time++
+	return l.time
+}
+
+// witness advances the clock to t if it's behind.
+func (l *lamportClock) witness(t uint64) {
+	if t > l.time {
+		l.time = t
+	}
+}
+
+// save writes the time of the clock in txn.
+func (l *lamportClock) save(txn ds.Write) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, l.time)
+	return txn.Put(dsDBClock, v)
+}
+
+// stamp orders the events of an instance: by Lamport clock, then by the
+// bytes of the CID of the record body holding the event. The order is
+// total, so every peer orders the same events the same way.
+type stamp struct {
+	clock  uint64
+	record cid.Cid
+}
+
+func eventStamp(e core.Event, record cid.Cid) stamp {
+	var clock uint64
+	if ce, ok := e.(core.ClockedEvent); ok {
+		clock = ce.Clock()
+	}
+	return stamp{clock: clock, record: record}
+}
+
+// after returns whether s is ordered after o.
+func (s stamp) after(o stamp) bool {
+	if s.clock != o.clock {
+		return s.clock > o.clock
+	}
+	return bytes.Compare(recordBytes(s.record), recordBytes(o.record)) > 0
+}
+
+func recordBytes(c cid.Cid) []byte {
+	if !c.Defined() {
+		return nil
+	}
+	return c.Bytes()
+}
+
+func (s stamp) bytes() []byte {
+	v := make([]byte, 8, 8+len(recordBytes(s.record)))
+	binary.BigEndian.PutUint64(v, s.clock)
+	return append(v, recordBytes(s.record)...)
+}
+
+func stampFromBytes(v []byte) (stamp, error) {
+	if len(v) < 8 {
+		return stamp{}, fmt.Errorf("invalid stamp of %d bytes", len(v))
+	}
+	s := stamp{clock: binary.BigEndian.Uint64(v[:8])}
+	if len(v) > 8 {
+		c, err := cid.Cast(v[8:])
+		if err != nil {
+			return stamp{}, err
+		}
+		s.record = c
+	}
+	return s, nil
+}
+
+func stampKey(collection string, id core.InstanceID) ds.Key {
+	return dsDBStamps.ChildString(collection).ChildString(id.String())
+}
+
+// getStamp returns the stamp of the last event applied to an instance,
+// and false if no clocked event was applied to it.
+func getStamp(txn ds.Read, collection string, id core.InstanceID) (stamp, bool, error) {
+	v, err := txn.Get(stampKey(collection, id))
+	if errors.Is(err, ds.ErrNotFound) {
+		return stamp{}, false, nil
+	}
+	if err != nil {
+		return stamp{}, false, err
+	}
+	s, err := stampFromBytes(v)
+	return s, err == nil, err
+}
+
+// putStamps records the stamps of applied events of record in txn, along
+// with the clock. Stamps are kept after deletes, so older events can't
+// bring instances back.
+func (d *DB) putStamps(txn ds.Write, events []core.Event, record cid.Cid) error {
+	for _, e := range events {
+		s := eventStamp(e, record)
+		if err := txn.Put(stampKey(e.Collection(), e.InstanceID()), s.bytes()); err != nil {
+			return err
+		}
+	}
+	return d.clock.save(txn)
+}
+
+// orderEvents witnesses the clocks of remote events of record, and drops
+// those ordered before the last event applied to their instance, see
+// WithNewDBLamportOrdering. Events of a record share its stamp, so they
+// are dropped or kept together for each instance.
+// The DB lock must be held by the caller.
+func (d *DB) orderEvents(txn ds.Read, events []core.Event, record cid.Cid) ([]core.Event, error) {
+	res := events[:0:0]
+	for _, e := range events {
+		s := eventStamp(e, record)
+		d.clock.witness(s.clock)
+		last, ok, err := getStamp(txn, e.Collection(), e.InstanceID())
+		if err != nil {
+			return nil, err
+		}
+		if ok && !s.after(last) {
+			d.log.Debugf("skipping event of instance %s in collection %s: stamp %d is ordered before %d",
+				e.InstanceID(), e.Collection(), s.clock, last.clock)
+			continue
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
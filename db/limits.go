@@ -0,0 +1,70 @@
+package db
+
+import (
+	"errors"
+	"strconv"
+
+	ds "github.com/ipfs/go-datastore"
+)
+
+var (
+	// ErrInstanceTooLarge indicates the instance exceeds the maximum size
+	// of the collection.
+	ErrInstanceTooLarge = errors.New("instance exceeds the collection maximum size")
+
+	dsDBMaxInstanceBytes = dsDBPrefix.ChildString("maxbytes")
+)
+
+// checkInstanceSize returns ErrInstanceTooLarge if instance exceeds the
+// maximum size of the collection.
+func (c *Collection) checkInstanceSize(instance []byte) error {
+	if c.maxInstanceBytes > 0 && len(instance) > c.maxInstanceBytes {
+		return ErrInstanceTooLarge
+	}
+	return nil
+}
+
+// getMaxInstanceBytes returns the persisted maximum instance size of
+// collection, or 0 if it has none.
+func (d *DB) getMaxInstanceBytes(collection string) (int, error) {
+	v, err := d.datastore.Get(dsDBMaxInstanceBytes.ChildString(collection))
+	if errors.Is(err, ds.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(v))
+}
+
+func (d *DB) putMaxInstanceBytes(collection string, n int) error {
+	return d.datastore.Put(dsDBMaxInstanceBytes.ChildString(collection), []byte(strconv.Itoa(n)))
+}
+
+// limitInstanceSizeIndexFunc wraps indexFunc so that remote changes
+// producing instances larger than the collection maximum size aren't
+// applied. The previous state is written back in the reducer's txn,
+// so the local instance is left as it was, and dropped tells whether the
+// last change of each instance key was ignored, so its action can be
+// filtered out. It measures the data it's given, so it must wrap the
+// index funcs that don't transform it.
+func limitInstanceSizeIndexFunc(
+	d *DB,
+	dropped map[ds.Key]bool,
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+	return func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error {
+		c := d.getCollection(collection)
+		if c == nil || newData == nil || c.checkInstanceSize(newData) == nil {
+			delete(dropped, key)
+			return indexFunc(collection, key, oldData, newData, txn)
+		}
+		dropped[key] = true
+		d.log.Warnf("ignoring change of instance %s in collection %s: %d bytes exceed the maximum of %d",
+			key.BaseNamespace(), collection, len(newData), c.maxInstanceBytes)
+		if oldData == nil {
+			return txn.Delete(key)
+		}
+		return txn.Put(key, oldData)
+	}
+}
@@ -1,8 +1,10 @@
 package db
 
 import (
-	"fmt"
+	"context"
+	"errors"
 	"sync"
+	"time"
 
 	format "github.com/ipfs/go-ipld-format"
 	"github.com/textileio/go-threads/core/app"
@@ -17,7 +19,7 @@ func (d *DB) Listen(los ...ListenOption) (Listener, error) {
 	d.lock.Lock()
 	defer d.lock.Unlock()
 	if d.closed {
-		return nil, fmt.Errorf("can't listen on closed DB")
+		return nil, ErrDBClosed
 	}
 
 	sl := &listener{
@@ -29,12 +31,51 @@ func (d *DB) Listen(los ...ListenOption) (Listener, error) {
 	return sl, nil
 }
 
+// WaitFor blocks until pred holds for the instance with id, or ctx is
+// done. pred is called with the current instance first, so a state that
+// already holds resolves right away, and then with the instance after
+// each of its changes. It's called with nil while the instance doesn't
+// exist, so it can wait for creations and deletions too.
+func (c *Collection) WaitFor(ctx context.Context, id core.InstanceID, pred func([]byte) bool) error {
+	l, err := c.db.Listen(ListenOption{Collection: c.name, ID: id})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	for {
+		// Actions received while the instance is being read are dropped
+		// if one is already pending, which makes it read again anyway.
+		instance, err := c.FindByID(id, WithTxnContext(ctx))
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		if pred(instance) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case _, ok := <-l.Channel():
+			if !ok {
+				return ErrDBClosed
+			}
+		}
+	}
+}
+
 func (d *DB) LocalEventListen() *app.LocalEventListener {
 	return d.localEventsBus.Listen()
 }
 
+// LosslessLocalEventListen returns the listener of the connector, which the
+// local events bus policy doesn't apply to, see WithNewDBLocalEventsBus.
+func (d *DB) LosslessLocalEventListen() *app.LocalEventListener {
+	return d.localEventsBus.ListenLossless()
+}
+
 func (d *DB) notifyStateChanged(actions []Action) {
 	d.stateChangedNotifee.notify(actions)
+	d.notifyWebhooks(actions)
 }
 
 func (d *DB) notifyTxnEvents(node format.Node, token thread.Token) error {
@@ -80,6 +121,16 @@ type Listener interface {
 type stateChangedNotifee struct {
 	lock      sync.Mutex
 	listeners []*listener
+	log       Logger
+
+	// window is how long actions are buffered to coalesce saves, or zero
+	// to notify them right away. See WithNewDBCoalesceNotifications.
+	window time.Duration
+	// pendingLock guards pending and timer, so buffering actions doesn't
+	// wait for listeners receiving a flush.
+	pendingLock sync.Mutex
+	pending     []Action
+	timer       *time.Timer
 }
 
 type listener struct {
@@ -91,15 +142,82 @@ type listener struct {
 var _ Listener = (*listener)(nil)
 
 func (scn *stateChangedNotifee) notify(actions []Action) {
+	if scn.window == 0 {
+		scn.lock.Lock()
+		defer scn.lock.Unlock()
+		scn.send(actions, nil)
+		return
+	}
+	scn.pendingLock.Lock()
+	defer scn.pendingLock.Unlock()
+	for _, a := range actions {
+		if a.Type == ActionSave && scn.pendingSave(a) {
+			continue
+		}
+		scn.pending = append(scn.pending, a)
+	}
+	if scn.timer == nil && len(scn.pending) > 0 {
+		scn.timer = time.AfterFunc(scn.window, scn.flush)
+	}
+}
+
+// pendingSave returns whether the latest buffered action of the instance
+// of a is a save, which a coalesces into.
+func (scn *stateChangedNotifee) pendingSave(a Action) bool {
+	for i := len(scn.pending) - 1; i >= 0; i-- {
+		p := scn.pending[i]
+		if p.Collection == a.Collection && p.ID == a.ID {
+			return p.Type == ActionSave
+		}
+	}
+	return false
+}
+
+// flush notifies the buffered actions, waiting up to another window for
+// listeners to receive them, since they're sent at once.
+func (scn *stateChangedNotifee) flush() {
+	scn.lock.Lock()
+	defer scn.lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), scn.window)
+	defer cancel()
+	scn.send(scn.takePending(), ctx.Done())
+}
+
+// takePending returns the buffered actions and clears them.
+func (scn *stateChangedNotifee) takePending() []Action {
+	scn.pendingLock.Lock()
+	defer scn.pendingLock.Unlock()
+	if scn.timer != nil {
+		scn.timer.Stop()
+		scn.timer = nil
+	}
+	actions := scn.pending
+	scn.pending = nil
+	return actions
+}
+
+// send notifies actions to the listeners that match them. Actions are
+// dropped for listeners whose channel is full, right away if wait is nil,
+// or once it's closed otherwise.
+func (scn *stateChangedNotifee) send(actions []Action, wait <-chan struct{}) {
 	for _, a := range actions {
 		for _, l := range scn.listeners {
-			if l.evaluate(a) {
+			if !l.evaluate(a) {
+				continue
+			}
+			select {
+			case l.c <- a:
+				continue
+			default:
+			}
+			if wait != nil {
 				select {
 				case l.c <- a:
-				default:
-					log.Warnf("dropped action %v for reducer with filters %v", a, l.filters)
+					continue
+				case <-wait:
 				}
 			}
+			scn.log.Warnf("dropped action %v for reducer with filters %v", a, l.filters)
 		}
 	}
 }
@@ -127,9 +245,12 @@ func (scn *stateChangedNotifee) remove(sl *listener) bool {
 func (scn *stateChangedNotifee) close() {
 	scn.lock.Lock()
 	defer scn.lock.Unlock()
+	scn.send(scn.takePending(), nil)
 	for i := range scn.listeners {
 		close(scn.listeners[i].c)
 	}
+	// Closed listeners are forgotten, so closing them again is a no-op.
+	scn.listeners = nil
 }
 
 // Channel returns an unbuffered channel to receive
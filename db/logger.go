@@ -0,0 +1,13 @@
+package db
+
+// Logger receives the log statements of a DB. The go-log loggers and
+// *zap.SugaredLogger implement it, so a DB can log to its own sink, e.g.
+// a zap logger with fields correlating the entries to the DB thread.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+var _ Logger = log
@@ -10,6 +10,7 @@ import (
 	kt "github.com/ipfs/go-datastore/keytransform"
 	"github.com/ipfs/go-datastore/query"
 	logging "github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p-core/peer"
 	ma "github.com/multiformats/go-multiaddr"
 	"github.com/textileio/go-threads/core/app"
 	"github.com/textileio/go-threads/core/net"
@@ -28,6 +29,8 @@ type Manager struct {
 
 	network app.Net
 	dbs     map[thread.ID]*DB
+	// shards are shared by all dbs, see WithNewDBShards.
+	shards []ds.TxnDatastore
 }
 
 // NewManager hydrates and starts dbs from prefixes.
@@ -40,7 +43,7 @@ func NewManager(network app.Net, opts ...NewDBOption) (*Manager, error) {
 	}
 
 	if options.Datastore == nil {
-		datastore, err := newDefaultDatastore(options.RepoPath, options.LowMem)
+		datastore, err := newDefaultDatastore(options.RepoPath, options.LowMem, options.Durability)
 		if err != nil {
 			return nil, err
 		}
@@ -54,10 +57,25 @@ func NewManager(network app.Net, opts ...NewDBOption) (*Manager, error) {
 		}
 	}
 
+	var shards []ds.TxnDatastore
+	if options.Shards > 0 {
+		for i := 0; i < options.Shards; i++ {
+			shard, err := options.ShardFactory(i)
+			if err != nil {
+				return nil, fmt.Errorf("error creating shard %d: %v", i, err)
+			}
+			shards = append(shards, shard)
+		}
+		options.ShardFactory = func(i int) (ds.TxnDatastore, error) {
+			return shards[i], nil
+		}
+	}
+
 	m := &Manager{
 		newDBOptions: options,
 		network:      network,
 		dbs:          make(map[thread.ID]*DB),
+		shards:       shards,
 	}
 
 	results, err := m.newDBOptions.Datastore.Query(query.Query{
@@ -134,18 +152,24 @@ func (m *Manager) NewDBFromAddr(ctx context.Context, addr ma.Multiaddr, key thre
 		return nil, err
 	}
 
-	db, err := newDB(m.network, id, getDBOptions(id, m.newDBOptions, args.Collections...))
+	options := getDBOptions(id, m.newDBOptions, args.Collections...)
+	options.SnapshotSigners = appendAddrPeer(options.SnapshotSigners, addr)
+	db, err := newDB(m.network, id, options)
 	if err != nil {
 		return nil, err
 	}
-	m.dbs[id] = db
-
-	go func() {
+	if args.BlockOnPull {
 		if err := m.network.PullThread(ctx, id, net.WithThreadToken(args.Token)); err != nil {
-			log.Errorf("error pulling thread %s", id)
+			if err := db.Close(); err != nil {
+				db.log.Errorf("error closing db %s: %v", id, err)
+			}
+			return nil, fmt.Errorf("error pulling thread %s: %v", id, err)
 		}
-	}()
-
+		m.dbs[id] = db
+		return db, nil
+	}
+	m.dbs[id] = db
+	db.pullThread(args.Token)
 	return db, nil
 }
 
@@ -161,6 +185,22 @@ func (m *Manager) GetDB(ctx context.Context, id thread.ID, opts ...ManagedDBOpti
 	return m.dbs[id], nil
 }
 
+// ListDBs returns all dbs by id.
+func (m *Manager) ListDBs(ctx context.Context, opts ...ManagedDBOption) (map[thread.ID]*DB, error) {
+	args := &ManagedDBOptions{}
+	for _, opt := range opts {
+		opt(args)
+	}
+	dbs := make(map[thread.ID]*DB, len(m.dbs))
+	for id, db := range m.dbs {
+		if _, err := m.network.GetThread(ctx, id, net.WithThreadToken(args.Token)); err != nil {
+			return nil, err
+		}
+		dbs[id] = db
+	}
+	return dbs, nil
+}
+
 // DeleteDB deletes a db by id.
 func (m *Manager) DeleteDB(ctx context.Context, id thread.ID, opts ...ManagedDBOption) error {
 	args := &ManagedDBOptions{}
@@ -212,6 +252,11 @@ func (m *Manager) Close() error {
 			log.Error("error when closing manager datastore: %v", err)
 		}
 	}
+	for _, shard := range m.shards {
+		if err := shard.Close(); err != nil {
+			log.Errorf("error when closing manager shard: %v", err)
+		}
+	}
 	return m.newDBOptions.Datastore.Close()
 }
 
@@ -219,13 +264,58 @@ func (m *Manager) Close() error {
 // wraps the datastore with an id prefix,
 // and merges specified collection configs with those from base
 func getDBOptions(id thread.ID, base *NewDBOptions, collections ...CollectionConfig) *NewDBOptions {
+	prefix := kt.PrefixTransform{
+		Prefix: dsDBManagerBaseKey.ChildString(id.String()),
+	}
+	var shardFactory ShardFactory
+	if base.ShardFactory != nil {
+		shardFactory = func(i int) (ds.TxnDatastore, error) {
+			shard, err := base.ShardFactory(i)
+			if err != nil {
+				return nil, err
+			}
+			return wrapTxnDatastore(shard, prefix), nil
+		}
+	}
 	return &NewDBOptions{
-		RepoPath: base.RepoPath,
-		Datastore: wrapTxnDatastore(base.Datastore, kt.PrefixTransform{
-			Prefix: dsDBManagerBaseKey.ChildString(id.String()),
-		}),
-		EventCodec:  base.EventCodec,
-		Debug:       base.Debug,
-		Collections: append(base.Collections, collections...),
+		RepoPath:            base.RepoPath,
+		Datastore:           wrapTxnDatastore(base.Datastore, prefix),
+		EventCodec:          base.EventCodec,
+		EventCodecs:         base.EventCodecs,
+		Debug:               base.Debug,
+		Collections:         append(base.Collections, collections...),
+		Metrics:             base.Metrics,
+		Logger:              base.Logger,
+		Tracer:              base.Tracer,
+		EncryptionKey:       base.EncryptionKey,
+		BatchSize:           base.BatchSize,
+		BatchInterval:       base.BatchInterval,
+		ConflictResolver:    base.ConflictResolver,
+		DispatcherBatchSize: base.DispatcherBatchSize,
+		DispatcherSync:      base.DispatcherSync,
+		CloseTimeout:        base.CloseTimeout,
+		RecordTimeout:       base.RecordTimeout,
+		CollectionResolver:  base.CollectionResolver,
+		RecordRate:          base.RecordRate,
+		RecordBurst:         base.RecordBurst,
+		ReadOnly:            base.ReadOnly,
+		PausedQueueSize:     base.PausedQueueSize,
+		QueryCacheSize:      base.QueryCacheSize,
+		QueryCacheTTL:       base.QueryCacheTTL,
+		IncompatibleEvents:  base.IncompatibleEvents,
+		MaxReadTxns:         base.MaxReadTxns,
+		MaxWriteTxns:        base.MaxWriteTxns,
+		TxnLimitPolicy:      base.TxnLimitPolicy,
+		CoalesceWindow:      base.CoalesceWindow,
+		LocalEventsBuffer:   base.LocalEventsBuffer,
+		LocalEventsPolicy:   base.LocalEventsPolicy,
+		FederatedThreads:    base.FederatedThreads,
+		LamportOrdering:     base.LamportOrdering,
+		Durability:          base.Durability,
+		QueryTimeout:        base.QueryTimeout,
+		Webhooks:            base.Webhooks,
+		Shards:              base.Shards,
+		ShardFactory:        shardFactory,
+		SnapshotSigners:     append([]peer.ID(nil), base.SnapshotSigners...),
 	}
 }
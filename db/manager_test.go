@@ -155,6 +155,70 @@ func TestManager_GetDB(t *testing.T) {
 	})
 }
 
+func TestManager_ListDBs(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	man, clean := createTestManager(t)
+	defer clean()
+
+	dbs, err := man.ListDBs(ctx)
+	checkErr(t, err)
+	if len(dbs) != 0 {
+		t.Fatalf("expected no dbs, got %d", len(dbs))
+	}
+	id1, id2 := thread.NewIDV1(thread.Raw, 32), thread.NewIDV1(thread.Raw, 32)
+	db1, err := man.NewDB(ctx, id1)
+	checkErr(t, err)
+	db2, err := man.NewDB(ctx, id2)
+	checkErr(t, err)
+
+	dbs, err = man.ListDBs(ctx)
+	checkErr(t, err)
+	if len(dbs) != 2 || dbs[id1] != db1 || dbs[id2] != db2 {
+		t.Fatalf("expected both dbs to be listed, got %v", dbs)
+	}
+	checkErr(t, man.DeleteDB(ctx, id1))
+	dbs, err = man.ListDBs(ctx)
+	checkErr(t, err)
+	if len(dbs) != 1 || dbs[id2] != db2 {
+		t.Fatalf("deleted db shouldn't be listed, got %v", dbs)
+	}
+}
+
+func TestManager_EventNamespacing(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	man, clean := createTestManager(t)
+	defer clean()
+
+	cc := CollectionConfig{
+		Name:   "dummy",
+		Schema: util.SchemaFromInstance(&dummy{}, false),
+	}
+	db1, err := man.NewDB(ctx, thread.NewIDV1(thread.Raw, 32), WithNewManagedDBCollections(cc))
+	checkErr(t, err)
+	db2, err := man.NewDB(ctx, thread.NewIDV1(thread.Raw, 32), WithNewManagedDBCollections(cc))
+	checkErr(t, err)
+
+	_, err = db1.GetCollection("dummy").Create(util.JSONFromInstance(dummy{Name: "db1"}))
+	checkErr(t, err)
+	events, err := db1.DumpEvents("")
+	checkErr(t, err)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 event in db1, got %d", len(events))
+	}
+	events, err = db2.DumpEvents("")
+	checkErr(t, err)
+	if len(events) != 0 {
+		t.Fatalf("events of db1 shouldn't be visible in db2, got %d", len(events))
+	}
+	res, err := db2.GetCollection("dummy").Find(&Query{})
+	checkErr(t, err)
+	if len(res) != 0 {
+		t.Fatalf("instances of db1 shouldn't be visible in db2, got %d", len(res))
+	}
+}
+
 func TestManager_DeleteDB(t *testing.T) {
 	t.Parallel()
 	ctx := context.Background()
@@ -191,10 +255,10 @@ func createTestManager(t *testing.T) (*Manager, func()) {
 	m, err := NewManager(n, WithNewDBRepoPath(dir), WithNewDBDebug(true))
 	checkErr(t, err)
 	return m, func() {
-		if err := n.Close(); err != nil {
+		if err := m.Close(); err != nil {
 			panic(err)
 		}
-		if err := m.Close(); err != nil {
+		if err := n.Close(); err != nil {
 			panic(err)
 		}
 		_ = os.RemoveAll(dir)
@@ -0,0 +1,40 @@
+package db
+
+import (
+	"time"
+)
+
+// Metrics records observations about DB operations. Implementations must be
+// safe for concurrent use, and should return quickly since they're called
+// inline with the instrumented operations.
+type Metrics interface {
+	// HandleNetRecord is called after an inbound record was handled.
+	HandleNetRecord(duration time.Duration, err error)
+	// Reduce is called after a batch of events was reduced into collections.
+	Reduce(events int, duration time.Duration, err error)
+	// Dispatch is called after a batch of events was dispatched.
+	Dispatch(events int, err error)
+	// GetBlockAttempt is called on every attempt to fetch a record block.
+	GetBlockAttempt(attempt int, err error)
+	// TxnCommit is called after a write transaction commit.
+	TxnCommit(duration time.Duration, err error)
+	// LocalEventsDropped is called with the number of local events bus
+	// listeners an event wasn't delivered to, see WithNewDBLocalEventsBus.
+	LocalEventsDropped(listeners int)
+}
+
+type nopMetrics struct{}
+
+var _ Metrics = (*nopMetrics)(nil)
+
+func (nopMetrics) HandleNetRecord(time.Duration, error) {}
+
+func (nopMetrics) Reduce(int, time.Duration, error) {}
+
+func (nopMetrics) Dispatch(int, error) {}
+
+func (nopMetrics) GetBlockAttempt(int, error) {}
+
+func (nopMetrics) TxnCommit(time.Duration, error) {}
+
+func (nopMetrics) LocalEventsDropped(int) {}
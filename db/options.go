@@ -1,12 +1,18 @@
 package db
 
 import (
+	"context"
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/dgraph-io/badger/options"
 	ds "github.com/ipfs/go-datastore"
 	badger "github.com/ipfs/go-ds-badger"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/textileio/go-threads/core/app"
 	core "github.com/textileio/go-threads/core/db"
 	"github.com/textileio/go-threads/core/thread"
 	"github.com/textileio/go-threads/jsonpatcher"
@@ -28,13 +34,86 @@ type NewDBOptions struct {
 	LowMem      bool
 	Collections []CollectionConfig
 	Token       thread.Token
+	Metrics     Metrics
+	Tracer      Tracer
+	Logger      Logger
+	BlockOnPull bool
+	// EncryptionKey is an AES key used to encrypt datastore values at rest.
+	EncryptionKey []byte
+	// BatchSize and BatchInterval enable write batching when BatchSize > 0.
+	BatchSize     int
+	BatchInterval time.Duration
+	// ConflictResolver resolves remote events overwriting a local change.
+	ConflictResolver ConflictResolver
+	// DispatcherBatchSize and DispatcherSync configure how dispatched
+	// events are persisted.
+	DispatcherBatchSize int
+	DispatcherSync      bool
+	// CloseTimeout bounds how long Close waits for in-flight records.
+	CloseTimeout time.Duration
+	// RecordTimeout bounds how long handling a record from other peers
+	// takes, instead of the connector default.
+	RecordTimeout time.Duration
+	// CollectionResolver creates collections referenced by remote events
+	// that aren't registered.
+	CollectionResolver CollectionResolver
+	// RecordRate and RecordBurst rate limit the handling of records from
+	// other peers, in records per second. Zero means no limit.
+	RecordRate  float64
+	RecordBurst int
+	// ReadOnly rejects local instance writes.
+	ReadOnly bool
+	// PausedQueueSize bounds the records queued while dispatching is paused.
+	PausedQueueSize int
+	// Shards and ShardFactory spread instances across datastores.
+	Shards       int
+	ShardFactory ShardFactory
+	// QueryCacheSize and QueryCacheTTL bound the query cache of each
+	// collection. Zero size disables it.
+	QueryCacheSize int
+	QueryCacheTTL  time.Duration
+	// IncompatibleEvents handles events from other peers whose schema
+	// version is incompatible with the local one.
+	IncompatibleEvents IncompatibleEventPolicy
+	// MaxReadTxns and MaxWriteTxns bound concurrent transactions, which
+	// wait or fail past them according to TxnLimitPolicy. Zero means no
+	// limit.
+	MaxReadTxns    int
+	MaxWriteTxns   int
+	TxnLimitPolicy TxnLimitPolicy
+	// CoalesceWindow delays listener notifications to coalesce repeated
+	// saves of instances. Zero notifies right away.
+	CoalesceWindow time.Duration
+	// EventCodecs are named codecs collections can select instead of EventCodec.
+	EventCodecs map[string]core.EventCodec
+	// LocalEventsBuffer and LocalEventsPolicy configure the buffer of each
+	// local events listener, and what sending to a full one does.
+	LocalEventsBuffer int
+	LocalEventsPolicy app.LocalEventsPolicy
+	// FederatedThreads are threads whose events are reduced into the DB
+	// along with those of its own thread.
+	FederatedThreads []thread.ID
+	// LamportOrdering orders concurrent events of instances by Lamport
+	// clock, then by record CID.
+	LamportOrdering bool
+	// Durability is whether commits of local writes wait for the
+	// datastore to sync them.
+	Durability Durability
+	// QueryTimeout bounds the execution time of queries, or 0 if they're
+	// unbounded.
+	QueryTimeout time.Duration
+	// Webhooks are sent the changes of instances, if they have URLs.
+	Webhooks WebhookConfig
+	// SnapshotSigners are the peers whose snapshots LoadSnapshot accepts,
+	// besides the DB host.
+	SnapshotSigners []peer.ID
 }
 
 func newDefaultEventCodec() core.EventCodec {
 	return jsonpatcher.New()
 }
 
-func newDefaultDatastore(repoPath string, lowMem bool) (ds.TxnDatastore, error) {
+func newDefaultDatastore(repoPath string, lowMem bool, durability Durability) (ds.TxnDatastore, error) {
 	path := filepath.Join(repoPath, defaultDatastorePath)
 	if err := os.MkdirAll(path, os.ModePerm); err != nil {
 		return nil, err
@@ -43,6 +122,7 @@ func newDefaultDatastore(repoPath string, lowMem bool) (ds.TxnDatastore, error)
 	if lowMem {
 		opts.TableLoadingMode = options.FileIO
 	}
+	opts.SyncWrites = durability == DurabilitySync
 	return badger.NewDatastore(path, &opts)
 }
 
@@ -54,6 +134,15 @@ func WithNewDBLowMem(low bool) NewDBOption {
 	}
 }
 
+// WithNewDBInMemoryDatastore uses an ephemeral in-memory datastore instead
+// of the on-disk default, which is useful for tests. Data is lost on Close.
+func WithNewDBInMemoryDatastore() NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.Datastore = newInMemoryDatastore()
+		return nil
+	}
+}
+
 // WithNewDBRepoPath sets the repo path.
 func WithNewDBRepoPath(path string) NewDBOption {
 	return func(o *NewDBOptions) error {
@@ -79,7 +168,474 @@ func WithNewDBEventCodec(ec core.EventCodec) NewDBOption {
 	}
 }
 
+// WithNewDBNamedEventCodec registers ec under name, so collections can
+// select it with CollectionConfig.EventCodec instead of the DB default.
+// Collections persist the name of their codec, so it must be registered
+// every time the DB is opened, and by every peer of the thread.
+func WithNewDBNamedEventCodec(name string, ec core.EventCodec) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if name == "" {
+			return fmt.Errorf("event codec name can't be empty")
+		}
+		if ec == nil {
+			return fmt.Errorf("event codec can't be nil")
+		}
+		if o.EventCodecs == nil {
+			o.EventCodecs = make(map[string]core.EventCodec)
+		}
+		o.EventCodecs[name] = ec
+		return nil
+	}
+}
+
+// WithNewDBMetrics sets the recorder of DB operation metrics.
+func WithNewDBMetrics(m Metrics) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.Metrics = m
+		return nil
+	}
+}
+
+// WithNewDBLogger sets the logger of the DB, instead of the "db" go-log
+// logger shared by all DBs.
+func WithNewDBLogger(l Logger) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.Logger = l
+		return nil
+	}
+}
+
+// WithNewDBTracer sets the tracer used to create spans through
+// the path of inbound records.
+func WithNewDBTracer(t Tracer) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.Tracer = t
+		return nil
+	}
+}
+
+// WithNewDBBlockOnPull makes NewDBFromAddr wait for the initial thread
+// pull to finish, returning its error if it fails. By default the pull
+// runs in the background and errors are only logged.
+func WithNewDBBlockOnPull(block bool) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.BlockOnPull = block
+		return nil
+	}
+}
+
+// WithNewDBEncryptionKey sets an AES key (16, 24 or 32 bytes) used to
+// encrypt stored values with AES-GCM. Keys aren't encrypted, so indexed
+// field values remain readable in index keys; avoid indexing sensitive fields.
+func WithNewDBEncryptionKey(key []byte) NewDBOption {
+	return func(o *NewDBOptions) error {
+		switch len(key) {
+		case 16, 24, 32:
+		default:
+			return ErrInvalidEncryptionKey
+		}
+		o.EncryptionKey = key
+		return nil
+	}
+}
+
+// WithNewDBWriteBatching accumulates committed write transactions and
+// applies them together as a single event once size actions are pending,
+// interval elapses since the first pending action (zero disables the timer),
+// DB.Flush is called, or a read needs them. Until then, pending changes are
+// only visible to writes and FindByID/Has; errors such as unique index
+// violations are returned by the flush instead of the transaction.
+func WithNewDBWriteBatching(size int, interval time.Duration) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if size <= 0 {
+			return fmt.Errorf("batch size must be positive")
+		}
+		if interval < 0 {
+			return fmt.Errorf("batch interval can't be negative")
+		}
+		o.BatchSize = size
+		o.BatchInterval = interval
+		return nil
+	}
+}
+
+// WithNewDBConflictResolver sets a resolver invoked when an event from
+// another peer saves an instance whose state comes from a local change,
+// until the change is overwritten by an incoming state. Without it, the
+// incoming state wins. Resolved states are only written locally, see
+// ConflictResolver.
+func WithNewDBConflictResolver(r ConflictResolver) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.ConflictResolver = r
+		return nil
+	}
+}
+
+// WithNewDBDispatcherBatchSize limits the number of events the dispatcher
+// persists per datastore transaction. By default, the events of a
+// transaction or record are persisted atomically along with their
+// reduction. With a limit, dispatches aren't atomic: each batch of events
+// is committed on its own before they're reduced, so a failure may leave
+// some of them persisted but not reduced, e.g., for Compact and
+// RebuildCollection to find. Events of ImportInstances are still persisted
+// atomically.
+func WithNewDBDispatcherBatchSize(size int) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if size < 0 {
+			return fmt.Errorf("dispatcher batch size can't be negative")
+		}
+		o.DispatcherBatchSize = size
+		return nil
+	}
+}
+
+// WithNewDBCloseTimeout sets how long Close waits for records from other
+// peers which are being handled before canceling them. Defaults to 10s.
+func WithNewDBCloseTimeout(timeout time.Duration) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if timeout <= 0 {
+			return fmt.Errorf("close timeout must be positive")
+		}
+		o.CloseTimeout = timeout
+		return nil
+	}
+}
+
+// WithNewDBRecordTimeout sets how long handling a record from other peers
+// can take, including fetching its block and body, instead of the 15s
+// used by the connector. Block fetches are retried with backoff within the
+// same timeout, so it should be increased for large blocks on slow links.
+func WithNewDBRecordTimeout(timeout time.Duration) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if timeout <= 0 {
+			return fmt.Errorf("record timeout must be positive")
+		}
+		o.RecordTimeout = timeout
+		return nil
+	}
+}
+
+// WithNewDBRecordRateLimit limits the handling of records from other peers
+// to rate records per second, allowing bursts of up to burst records.
+// Records exceeding the rate wait for their turn instead of being dropped,
+// which throttles their delivery from the network. The number of waiting
+// records is reported by DB.QueuedRecords.
+func WithNewDBRecordRateLimit(rate float64, burst int) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if rate <= 0 {
+			return fmt.Errorf("record rate must be positive")
+		}
+		if burst <= 0 {
+			return fmt.Errorf("record burst must be positive")
+		}
+		o.RecordRate = rate
+		o.RecordBurst = burst
+		return nil
+	}
+}
+
+// WithNewDBCollectionResolver sets a resolver of collections that are
+// referenced by events from other peers but aren't registered, which are
+// created before the events are applied. Without it, events of unknown
+// collections fail to be reduced.
+func WithNewDBCollectionResolver(r CollectionResolver) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.CollectionResolver = r
+		return nil
+	}
+}
+
+// WithNewDBShards spreads the instances of collections across count
+// datastores returned by factory, picking the shard of an instance by a
+// hash of its ID, while indexes and other DB state stay in the DB
+// datastore. Queries run on every shard and merge their results in
+// key order. Transactions commit one shard at a time, so they aren't
+// atomic across shards when a commit fails; see
+// Collection.VerifyIndexes. The number of shards can't change once
+// instances are stored. Shards are closed with the DB, and a manager
+// calls factory once for all of its DBs.
+func WithNewDBShards(count int, factory ShardFactory) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if count <= 0 {
+			return fmt.Errorf("shard count must be positive")
+		}
+		if factory == nil {
+			return fmt.Errorf("shard factory is required")
+		}
+		o.Shards = count
+		o.ShardFactory = factory
+		return nil
+	}
+}
+
+// WithNewDBPausedQueueSize sets how many records from other peers are
+// queued while dispatching is paused, 1000 by default. See DB.PauseDispatch.
+func WithNewDBPausedQueueSize(size int) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if size <= 0 {
+			return fmt.Errorf("paused queue size must be positive")
+		}
+		o.PausedQueueSize = size
+		return nil
+	}
+}
+
+// WithNewDBQueryCache caches up to size results of Find and GroupBy per
+// collection. Cached results are dropped when instances of the collection
+// change, or after ttl if it's positive. Use WithTxnNoCache for reads that
+// must skip the cache.
+func WithNewDBQueryCache(size int, ttl time.Duration) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if size <= 0 {
+			return fmt.Errorf("query cache size must be positive")
+		}
+		if ttl < 0 {
+			return fmt.Errorf("query cache ttl can't be negative")
+		}
+		o.QueryCacheSize = size
+		o.QueryCacheTTL = ttl
+		return nil
+	}
+}
+
+// WithNewDBIncompatibleEvents sets what the DB does with events from other
+// peers whose schema version is incompatible with the local schema of their
+// collection, see CollectionConfig.SchemaCompatibility. They're logged and
+// applied by default.
+func WithNewDBIncompatibleEvents(policy IncompatibleEventPolicy) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if policy < LogIncompatibleEvents || policy > RejectIncompatibleEvents {
+			return fmt.Errorf("unknown incompatible event policy %d", policy)
+		}
+		o.IncompatibleEvents = policy
+		return nil
+	}
+}
+
+// WithNewDBTxnLimits bounds the number of concurrent write and read
+// transactions, including those of Collection methods like Create or Find,
+// so excess callers don't pile up waiting for the DB lock. Zero leaves a
+// kind unbounded. Past a limit, transactions wait for a running one to
+// finish, or their context (see WithTxnContext), with BlockOnTxnLimit, and
+// fail with ErrTooManyTxns with FailOnTxnLimit. Transactions being run are
+// reported by DB.InFlightTxns. Read transactions must not be nested, since
+// an inner one could wait for a slot its outer one holds.
+func WithNewDBTxnLimits(maxWrites, maxReads int, policy TxnLimitPolicy) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if maxWrites < 0 || maxReads < 0 {
+			return fmt.Errorf("transaction limits can't be negative")
+		}
+		if policy < BlockOnTxnLimit || policy > FailOnTxnLimit {
+			return fmt.Errorf("unknown transaction limit policy %d", policy)
+		}
+		o.MaxWriteTxns = maxWrites
+		o.MaxReadTxns = maxReads
+		o.TxnLimitPolicy = policy
+		return nil
+	}
+}
+
+// WithNewDBCoalesceNotifications delays listener notifications for up to
+// window, so repeated saves of an instance within the window are notified
+// once. Actions are buffered from the first one after a notification, and
+// notified together when the window ends, in the order they happened.
+// A save is dropped if the latest buffered action of the same instance is
+// a save too, so listeners reading the instance on the remaining one see
+// its latest state. Creates and deletes are never dropped, and nothing is
+// reordered: a create, saves and a delete of an instance within the window
+// are notified as the create, a single save and the delete. Since buffered
+// actions are sent at once, listeners are given up to another window to
+// receive them before they're dropped. Buffered actions are also notified
+// on Close, without waiting.
+func WithNewDBCoalesceNotifications(window time.Duration) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if window <= 0 {
+			return fmt.Errorf("coalesce window must be positive")
+		}
+		o.CoalesceWindow = window
+		return nil
+	}
+}
+
+// WithNewDBLocalEventsBus buffers up to buffer local events for each
+// listener of the local events bus, see DB.LocalEventListen, which include
+// the connector adding them to the DB thread. policy tells what writes do
+// when a listener buffer is full: app.LocalEventsBlock waits for it for up
+// to 10 seconds, which is the default, app.LocalEventsDropOldest drops its
+// oldest buffered event, and app.LocalEventsError fails the write with
+// app.ErrLocalEventsBusFull, after it was applied locally. Events that
+// aren't delivered are reported by Metrics.LocalEventsDropped. The policy
+// only applies to listeners of DB.LocalEventListen: sends to the connector
+// wait for it as with app.LocalEventsBlock, so writes aren't dropped from
+// the thread.
+func WithNewDBLocalEventsBus(buffer int, policy app.LocalEventsPolicy) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if buffer < 0 {
+			return fmt.Errorf("local events buffer can't be negative")
+		}
+		if policy < app.LocalEventsBlock || policy > app.LocalEventsError {
+			return fmt.Errorf("unknown local events policy %d", policy)
+		}
+		o.LocalEventsBuffer = buffer
+		o.LocalEventsPolicy = policy
+		return nil
+	}
+}
+
+// WithNewDBFederatedThreads makes the DB state the merge of its own thread
+// and threads, e.g. per-shard threads written by other DBs, which must
+// exist in the network and be readable. Events of every thread are reduced
+// into the same collections, which must be registered in the DB, while
+// local writes are only added to the DB thread. Saves from other threads
+// overwriting a local change go through the conflict resolver, if any, see
+// WithNewDBConflictResolver, and records of federated threads
+// that fail to apply, such as creates of an instance ID already created
+// from another thread, are logged and skipped. See Collection.Origin.
+func WithNewDBFederatedThreads(threads ...thread.ID) NewDBOption {
+	return func(o *NewDBOptions) error {
+		seen := make(map[thread.ID]struct{})
+		for _, id := range threads {
+			if !id.Defined() {
+				return fmt.Errorf("federated thread is undefined")
+			}
+			if _, ok := seen[id]; ok {
+				return fmt.Errorf("federated thread %s is duplicated", id)
+			}
+			seen[id] = struct{}{}
+		}
+		o.FederatedThreads = threads
+		return nil
+	}
+}
+
+// WithNewDBLamportOrdering makes concurrent writes of an instance resolve
+// deterministically, last writer wins. Each record of local events is
+// stamped with the Lamport clock of the DB, which ticks past every clock
+// of the events the DB received, and with the CID of the record body.
+// Stamps are ordered by clock, then by the bytes of the CID, and an event
+// from another peer is only applied if its stamp is ordered after that of
+// the last event applied to its instance. Clocked creates and saves carry
+// the whole instance and replace the stored one, a save of a deleted
+// instance recreates it, and stamps are kept after deletes. So peers that
+// received the same events have byte-identical instances, each written by
+// its last event in stamp order, whatever order the events arrived in.
+// That doesn't hold if a conflict resolver rewrites states, see
+// WithNewDBConflictResolver, and every peer of the thread should enable
+// ordering, since events of other peers are ordered before stamped ones.
+func WithNewDBLamportOrdering(enable bool) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.LamportOrdering = enable
+		return nil
+	}
+}
+
+// WithNewDBDurability sets whether commits of local writes wait for the
+// datastore to sync them to disk, with DurabilitySync, the default, or
+// return before, with DurabilityAsync. The default datastore is opened
+// with synced writes or not accordingly. Other datastores are synced after
+// each commit in DurabilitySync mode, which is a no-op for those that
+// don't support it, like the in-memory one, while DurabilityAsync leaves
+// them as they are, so datastores syncing every write still do. Batched
+// writes are synced when the batch is flushed, see WithNewDBWriteBatching.
+func WithNewDBDurability(mode Durability) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if mode < DurabilitySync || mode > DurabilityAsync {
+			return fmt.Errorf("unknown durability mode %d", mode)
+		}
+		o.Durability = mode
+		return nil
+	}
+}
+
+// WithNewDBQueryTimeout aborts queries of Find, GroupBy, DeleteMatching
+// and the like once they run for longer than d, returning ErrQueryTimeout,
+// so a single runaway query can't hang a shared DB. Transactions override
+// it with WithTxnQueryTimeout. The default of 0 doesn't bound queries.
+func WithNewDBQueryTimeout(d time.Duration) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if d < 0 {
+			return fmt.Errorf("query timeout must be positive, got %v", d)
+		}
+		o.QueryTimeout = d
+		return nil
+	}
+}
+
+// WithNewDBWebhooks POSTs a WebhookPayload to each URL of config for every
+// created, saved and deleted instance of its collections, in the order the
+// changes were applied. Payloads are queued in memory and sent by one
+// sender per URL, which retries failed sends with exponential backoff, so
+// slow or failing URLs never block writes: payloads of changes made while
+// the queue of a URL is full are dropped, and so are those pending on
+// Close.
+func WithNewDBWebhooks(config WebhookConfig) NewDBOption {
+	return func(o *NewDBOptions) error {
+		if len(config.URLs) == 0 {
+			return fmt.Errorf("webhooks need at least one URL")
+		}
+		for _, u := range config.URLs {
+			parsed, err := url.Parse(u)
+			if err != nil {
+				return fmt.Errorf("invalid webhook URL %s: %v", u, err)
+			}
+			if parsed.Scheme != "http" && parsed.Scheme != "https" {
+				return fmt.Errorf("webhook URL %s must be http or https", u)
+			}
+		}
+		if config.QueueSize < 0 {
+			return fmt.Errorf("webhook queue size must be positive, got %d", config.QueueSize)
+		}
+		if config.MaxRetries < 0 {
+			return fmt.Errorf("webhook max retries must be positive, got %d", config.MaxRetries)
+		}
+		if config.Backoff < 0 {
+			return fmt.Errorf("webhook backoff must be positive, got %v", config.Backoff)
+		}
+		o.Webhooks = config
+		return nil
+	}
+}
+
+// WithNewDBSnapshotSigners sets the peers whose snapshots LoadSnapshot
+// accepts, such as the owner and admins of the thread. The DB host is
+// always accepted, and so is the peer of the address a DB is created from
+// with NewDBFromAddr.
+func WithNewDBSnapshotSigners(signers ...peer.ID) NewDBOption {
+	return func(o *NewDBOptions) error {
+		for _, s := range signers {
+			if err := s.Validate(); err != nil {
+				return fmt.Errorf("invalid snapshot signer: %v", err)
+			}
+		}
+		o.SnapshotSigners = signers
+		return nil
+	}
+}
+
+// WithNewDBReadOnly makes a read-only replica of the DB thread: writes of
+// instances fail with ErrReadOnly, while queries and events from other
+// peers are handled as usual. Collections can still be created and
+// deleted, since a replica needs them to apply remote events.
+func WithNewDBReadOnly(readOnly bool) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.ReadOnly = readOnly
+		return nil
+	}
+}
+
+// WithNewDBDispatcherSync makes the dispatcher sync the datastore once
+// events are persisted, so that they're durable even if the datastore
+// doesn't sync writes by itself.
+func WithNewDBDispatcherSync(sync bool) NewDBOption {
+	return func(o *NewDBOptions) error {
+		o.DispatcherSync = sync
+		return nil
+	}
+}
+
 // WithNewDBToken provides authorization for interacting with a db.
+// It's also the default token of transactions and DB info operations,
+// which can be overridden per call.
 func WithNewDBToken(t thread.Token) NewDBOption {
 	return func(o *NewDBOptions) error {
 		o.Token = t
@@ -98,23 +654,69 @@ func WithNewDBCollections(cs ...CollectionConfig) NewDBOption {
 
 // TxnOptions defines options for a transaction.
 type TxnOptions struct {
-	Token thread.Token
+	Token   thread.Token
+	Context context.Context
+	// NoCache bypasses the query cache.
+	NoCache bool
+	// IncludeDeleted makes FindByID and Has return tombstoned instances,
+	// see WithTxnIncludeDeleted.
+	IncludeDeleted bool
+	// QueryTimeout bounds the execution time of each query of the
+	// transaction, or 0 if they're unbounded.
+	QueryTimeout time.Duration
 }
 
 // TxnOption specifies a transaction option.
 type TxnOption func(*TxnOptions)
 
-// WithTxnToken provides authorization for the transaction.
+// WithTxnToken provides authorization for the transaction, overriding
+// the token the DB was created with.
 func WithTxnToken(t thread.Token) TxnOption {
 	return func(args *TxnOptions) {
 		args.Token = t
 	}
 }
 
+// WithTxnContext bounds the transaction by ctx. If ctx is done while
+// waiting for the DB lock or before commit, the transaction is discarded
+// and ctx.Err() is returned.
+func WithTxnContext(ctx context.Context) TxnOption {
+	return func(args *TxnOptions) {
+		args.Context = ctx
+	}
+}
+
+// WithTxnNoCache makes reads of the transaction skip the query cache, for
+// results that must be fresh. See WithNewDBQueryCache.
+func WithTxnNoCache() TxnOption {
+	return func(args *TxnOptions) {
+		args.NoCache = true
+	}
+}
+
+// WithTxnIncludeDeleted makes FindByID, FindByIDs and Has of the
+// transaction return tombstoned instances of collections with soft deletes,
+// like Query.IncludeDeleted does for Find.
+func WithTxnIncludeDeleted() TxnOption {
+	return func(args *TxnOptions) {
+		args.IncludeDeleted = true
+	}
+}
+
+// WithTxnQueryTimeout bounds the execution time of each query of the
+// transaction by d, overriding the timeout of WithNewDBQueryTimeout. A d
+// of 0 doesn't bound them.
+func WithTxnQueryTimeout(d time.Duration) TxnOption {
+	return func(args *TxnOptions) {
+		args.QueryTimeout = d
+	}
+}
+
 // NewManagedDBOptions defines options for creating a new managed db.
 type NewManagedDBOptions struct {
 	Collections []CollectionConfig
 	Token       thread.Token
+	BlockOnPull bool
 }
 
 // NewManagedDBOption specifies a new managed db option.
@@ -135,6 +737,14 @@ func WithNewManagedDBToken(t thread.Token) NewManagedDBOption {
 	}
 }
 
+// WithNewManagedDBBlockOnPull makes NewDBFromAddr wait for the initial
+// thread pull to finish, returning its error if it fails.
+func WithNewManagedDBBlockOnPull(block bool) NewManagedDBOption {
+	return func(args *NewManagedDBOptions) {
+		args.BlockOnPull = block
+	}
+}
+
 // ManagedDBOptions defines options for interacting with a managed db.
 type ManagedDBOptions struct {
 	Token thread.Token
@@ -164,3 +774,18 @@ func WithInviteInfoToken(t thread.Token) InviteInfoOption {
 		args.Token = t
 	}
 }
+
+// ThreadInfoOptions defines options for accessing the DB thread.
+type ThreadInfoOptions struct {
+	Token thread.Token
+}
+
+// ThreadInfoOption specifies a thread info option.
+type ThreadInfoOption func(*ThreadInfoOptions)
+
+// WithThreadInfoToken provides authorization for accessing DB thread info.
+func WithThreadInfoToken(t thread.Token) ThreadInfoOption {
+	return func(args *ThreadInfoOptions) {
+		args.Token = t
+	}
+}
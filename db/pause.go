@@ -0,0 +1,115 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/textileio/go-threads/core/net"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+const (
+	defaultPausedQueueSize = 1000
+)
+
+// dispatchPause queues records from other peers while dispatching is paused.
+type dispatchPause struct {
+	lock    sync.Mutex
+	paused  bool
+	size    int
+	queue   []queuedRecord
+	waiting int
+	resumed chan struct{}
+}
+
+type queuedRecord struct {
+	rec     net.ThreadRecord
+	key     thread.Key
+	lid     peer.ID
+	timeout time.Duration
+}
+
+// enqueue queues r if dispatching is paused, returning whether it did.
+// If the queue is full, it blocks until dispatching is resumed or ctx is done.
+func (p *dispatchPause) enqueue(ctx context.Context, r queuedRecord) (bool, error) {
+	p.lock.Lock()
+	for p.paused {
+		// Records waiting for room go after the queue, so new ones wait too
+		if len(p.queue) < p.size && p.waiting == 0 {
+			p.queue = append(p.queue, r)
+			p.lock.Unlock()
+			return true, nil
+		}
+		resumed := p.resumed
+		p.waiting++
+		p.lock.Unlock()
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			p.lock.Lock()
+			p.waiting--
+			p.lock.Unlock()
+			return false, ctx.Err()
+		}
+		p.lock.Lock()
+		p.waiting--
+	}
+	p.lock.Unlock()
+	return false, nil
+}
+
+// PauseDispatch stops applying records from other peers until
+// ResumeDispatch is called, e.g. to take a consistent snapshot. Local
+// writes are still applied. Records received while paused are queued, up
+// to the size set with WithNewDBPausedQueueSize. Once the queue is full,
+// handling further records blocks until dispatching is resumed, which
+// holds up their delivery from the network, so no record is dropped.
+// Records still queued when the DB is closed aren't applied, and can be
+// applied later with Replay.
+func (d *DB) PauseDispatch() {
+	d.pause.lock.Lock()
+	defer d.pause.lock.Unlock()
+	if d.pause.paused {
+		return
+	}
+	d.pause.paused = true
+	d.pause.resumed = make(chan struct{})
+}
+
+// ResumeDispatch applies the records queued since PauseDispatch in the
+// order they were received, and then resumes applying records from other
+// peers as they arrive. Errors applying queued records are logged.
+func (d *DB) ResumeDispatch() {
+	d.pause.lock.Lock()
+	defer d.pause.lock.Unlock()
+	if !d.pause.paused {
+		return
+	}
+	for len(d.pause.queue) > 0 {
+		r := d.pause.queue[0]
+		d.pause.queue = d.pause.queue[1:]
+		d.pause.lock.Unlock()
+		d.applyQueuedRecord(r)
+		d.pause.lock.Lock()
+	}
+	d.pause.queue = nil
+	d.pause.paused = false
+	close(d.pause.resumed)
+}
+
+func (d *DB) applyQueuedRecord(r queuedRecord) {
+	d.lock.RLock()
+	if d.closed {
+		d.lock.RUnlock()
+		d.log.Debugf("ignoring queued record %s after closing", r.rec.Value().Cid())
+		return
+	}
+	d.handlers.Add(1)
+	d.lock.RUnlock()
+	defer d.handlers.Done()
+	if err := d.processNetRecord(r.rec, r.key, r.timeout); err != nil {
+		d.log.Errorf("error applying queued record %s: %v", r.rec.Value().Cid(), err)
+	}
+}
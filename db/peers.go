@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/textileio/go-threads/core/net"
+)
+
+// PeerStatus describes a log of the DB thread, and whether the DB network
+// is connected to the peers hosting it.
+type PeerStatus struct {
+	// LogID is the log ID.
+	LogID peer.ID
+	// Own is true for the log the DB writes its local events to.
+	Own bool
+	// Hosts are the peers hosting the log, as listed by its addresses.
+	Hosts []peer.ID
+	// Connected is true if the DB network is connected to any of Hosts,
+	// not counting itself.
+	Connected bool
+	// Head is the latest record of the log known by the thread.
+	Head cid.Cid
+	// LastRecord is when a record of the log was last received from the
+	// network, or zero if none was since the DB started.
+	LastRecord time.Time
+}
+
+// Peers returns the status of each log of the DB thread, telling which
+// peers host it, whether the DB network is connected to them, and when
+// their last record was received, e.g. to diagnose a DB that doesn't sync.
+// Unlike SyncStatus, it doesn't walk logs, so it's cheap to poll.
+func (d *DB) Peers(ctx context.Context, opts ...ThreadInfoOption) ([]PeerStatus, error) {
+	options := &ThreadInfoOptions{Token: d.token}
+	for _, opt := range opts {
+		opt(options)
+	}
+	if d.IsClosed() {
+		return nil, ErrDBClosed
+	}
+	tinfo, err := d.connector.Net.GetThread(ctx, d.connector.ThreadID(), net.WithThreadToken(options.Token))
+	if err != nil {
+		return nil, err
+	}
+	own := tinfo.GetOwnLog()
+	h := d.connector.Net.Host()
+
+	res := make([]PeerStatus, 0, len(tinfo.Logs))
+	for _, lg := range tinfo.Logs {
+		s := PeerStatus{
+			LogID:      lg.ID,
+			Own:        own != nil && lg.ID == own.ID,
+			Head:       lg.Head,
+			LastRecord: d.lastRecords.get(lg.ID),
+		}
+		seen := make(map[peer.ID]struct{})
+		for _, addr := range lg.Addrs {
+			v, err := addr.ValueForProtocol(ma.P_P2P)
+			if err != nil {
+				continue
+			}
+			pid, err := peer.Decode(v)
+			if err != nil {
+				continue
+			}
+			if _, ok := seen[pid]; ok {
+				continue
+			}
+			seen[pid] = struct{}{}
+			s.Hosts = append(s.Hosts, pid)
+			if pid != h.ID() && h.Network().Connectedness(pid) == network.Connected {
+				s.Connected = true
+			}
+		}
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+// recordTimes holds when a record of each log was last received. The zero
+// value is ready to use.
+type recordTimes struct {
+	lock  sync.Mutex
+	times map[peer.ID]time.Time
+}
+
+func (r *recordTimes) seen(lid peer.ID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.times == nil {
+		r.times = make(map[peer.ID]time.Time)
+	}
+	r.times[lid] = time.Now()
+}
+
+func (r *recordTimes) get(lid peer.ID) time.Time {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.times[lid]
+}
@@ -0,0 +1,151 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/tidwall/gjson"
+)
+
+var (
+	// ErrPrimaryKeyMismatch indicates the _id of an instance doesn't match
+	// the values of its primary key fields, which can't change once the
+	// instance is created.
+	ErrPrimaryKeyMismatch = errors.New("instance _id doesn't match its primary key")
+
+	dsDBPrimaryKeys = dsDBPrefix.ChildString("primarykeys")
+)
+
+// primaryKeySeparator joins the escaped primary key values of an _id.
+const primaryKeySeparator = ":"
+
+// validatePrimaryKey checks the primary key fields of config.
+func validatePrimaryKey(config CollectionConfig) error {
+	if len(config.PrimaryKey) == 0 {
+		return nil
+	}
+	if config.IDGenerator != nil {
+		return fmt.Errorf("collections with a primary key can't have an id generator")
+	}
+	seen := make(map[string]struct{}, len(config.PrimaryKey))
+	for _, field := range config.PrimaryKey {
+		if field == "" || field == config.IDField {
+			return fmt.Errorf("invalid primary key field %q", field)
+		}
+		if _, ok := seen[field]; ok {
+			return fmt.Errorf("duplicate primary key field %s", field)
+		}
+		seen[field] = struct{}{}
+	}
+	return nil
+}
+
+// KeyID returns the _id of the instance identified by the values of the
+// primary key fields, in the order the collection declares them.
+func (c *Collection) KeyID(key ...interface{}) (core.InstanceID, error) {
+	if len(c.primaryKey) == 0 {
+		return core.EmptyInstanceID, fmt.Errorf("collection %s has no primary key", c.name)
+	}
+	if len(key) != len(c.primaryKey) {
+		return core.EmptyInstanceID, fmt.Errorf("expected %d primary key values, got %d", len(c.primaryKey), len(key))
+	}
+	parts := make([]string, len(key))
+	for i, v := range key {
+		var err error
+		if parts[i], err = primaryKeyPart(c.primaryKey[i], v); err != nil {
+			return core.EmptyInstanceID, err
+		}
+	}
+	return joinPrimaryKey(parts), nil
+}
+
+// FindByKey finds an instance by the values of its primary key fields.
+// If doesn't exists returns ErrNotFound.
+func (c *Collection) FindByKey(key []interface{}, opts ...TxnOption) (instance []byte, err error) {
+	err = c.ReadTxn(func(txn *Txn) error {
+		instance, err = txn.FindByKey(key...)
+		return err
+	}, opts...)
+	return
+}
+
+// FindByKey gets an instance by the values of its primary key fields in
+// the current txn scope.
+func (t *Txn) FindByKey(key ...interface{}) ([]byte, error) {
+	id, err := t.collection.KeyID(key...)
+	if err != nil {
+		return nil, err
+	}
+	return t.FindByID(id)
+}
+
+// instanceKeyID returns the _id synthesized from the primary key fields
+// of instance.
+func (c *Collection) instanceKeyID(instance []byte) (core.InstanceID, error) {
+	parts := make([]string, len(c.primaryKey))
+	for i, field := range c.primaryKey {
+		res := gjson.GetBytes(instance, field)
+		if !res.Exists() {
+			return core.EmptyInstanceID, fmt.Errorf("instance is missing primary key field %s", field)
+		}
+		var err error
+		if parts[i], err = primaryKeyPart(field, res.Value()); err != nil {
+			return core.EmptyInstanceID, err
+		}
+	}
+	return joinPrimaryKey(parts), nil
+}
+
+// primaryKeyPart returns the _id part of the primary key field value v.
+// Numbers are formatted as JSON, so a value decoded from an instance and
+// the same number given to KeyID produce the same part.
+func primaryKeyPart(field string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case nil, map[string]interface{}, []interface{}:
+		return "", fmt.Errorf("primary key field %s must be a string, number or boolean", field)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", fmt.Errorf("invalid primary key field %s: %v", field, err)
+		}
+		return string(b), nil
+	}
+}
+
+func joinPrimaryKey(parts []string) core.InstanceID {
+	for i := range parts {
+		parts[i] = url.QueryEscape(parts[i])
+	}
+	return core.InstanceID(strings.Join(parts, primaryKeySeparator))
+}
+
+// getPrimaryKey returns the persisted primary key fields of collection.
+func (d *DB) getPrimaryKey(collection string) ([]string, error) {
+	v, err := d.datastore.Get(dsDBPrimaryKeys.ChildString(collection))
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	if err := json.Unmarshal(v, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+func (d *DB) putPrimaryKey(collection string, fields []string) error {
+	v, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return d.datastore.Put(dsDBPrimaryKeys.ChildString(collection), v)
+}
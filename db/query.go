@@ -1,19 +1,40 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"regexp"
 	"sort"
 	"strings"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
 )
 
 // Query is a json-seriable query representation
 type Query struct {
-	Ands  []*Criterion
-	Ors   []*Query
+	Ands []*Criterion
+	// AndQueries are nested queries that instances must match too, along
+	// with Ands. See And.
+	AndQueries []*Query
+	// Ors are queries sufficient for an instance to match, even if it
+	// doesn't match Ands and AndQueries. A query with only Ors matches
+	// instances matching any of them. See Or.
+	Ors []*Query
+	// Nots are queries that instances must not match. See Not.
+	Nots  []*Query
 	Sort  Sort
 	Index string
+	// Fields lists the field paths returned by Find, which returns full
+	// instances if it's empty. See Select.
+	Fields []string
+	// IncludeDeleted makes Find and GroupBy return tombstoned instances
+	// of collections with soft deletes.
+	IncludeDeleted bool
 }
 
 // Criterion represents a restriction on a field
@@ -21,7 +42,17 @@ type Criterion struct {
 	FieldPath string
 	Operation Operation
 	Value     Value
-	query     *Query
+	// Negated inverts the criterion, so it matches the instances the
+	// operation doesn't match, including those missing the field.
+	Negated bool
+	query   *Query
+
+	// regexp is the compiled pattern of Regex criteria. It's compiled once,
+	// so criteria of queries shared by goroutines can be validated
+	// concurrently.
+	regexpOnce sync.Once
+	regexp     *regexp.Regexp
+	regexpErr  error
 }
 
 // Value models a single value in JSON
@@ -29,6 +60,10 @@ type Value struct {
 	String *string
 	Bool   *bool
 	Float  *float64
+	// Number holds numbers that don't fit a float64 without losing
+	// precision, such as large integers. It's compared exactly against
+	// fields of collections decoding numbers as json.Number.
+	Number *json.Number
 }
 
 func (q *Query) Validate() error {
@@ -40,11 +75,26 @@ func (q *Query) Validate() error {
 			return err
 		}
 	}
+	for _, qi := range q.AndQueries {
+		if err := qi.Validate(); err != nil {
+			return err
+		}
+	}
 	for _, qi := range q.Ors {
 		if err := qi.Validate(); err != nil {
 			return err
 		}
 	}
+	for _, qi := range q.Nots {
+		if err := qi.Validate(); err != nil {
+			return err
+		}
+	}
+	for _, path := range q.Fields {
+		if path == "" {
+			return fmt.Errorf("selected field path can't be empty")
+		}
+	}
 	return nil
 }
 
@@ -62,12 +112,37 @@ func (c *Criterion) Validate() error {
 	if c.Value.Float != nil {
 		noNil++
 	}
+	if c.Value.Number != nil {
+		noNil++
+	}
 	if noNil != 1 {
 		return fmt.Errorf("value type should describe exactly one type")
 	}
+	switch c.Operation {
+	case EqFold, HasPrefix, Regex:
+		if c.Value.String == nil {
+			return fmt.Errorf("operation on field %s requires a string value", c.FieldPath)
+		}
+	case Present:
+		if c.Value.Bool == nil {
+			return fmt.Errorf("presence operation on field %s requires a bool value", c.FieldPath)
+		}
+	}
+	if c.Operation == Regex {
+		if _, err := c.compileRegexp(); err != nil {
+			return fmt.Errorf("invalid regular expression for field %s: %v", c.FieldPath, err)
+		}
+	}
 	return nil
 }
 
+func (c *Criterion) compileRegexp() (*regexp.Regexp, error) {
+	c.regexpOnce.Do(func() {
+		c.regexp, c.regexpErr = regexp.Compile(*c.Value.String)
+	})
+	return c.regexp, c.regexpErr
+}
+
 // Sort represents a sort order on a field
 type Sort struct {
 	FieldPath string
@@ -90,6 +165,18 @@ const (
 	Ge = Operation(ge)
 	// Le is "less than or equal to"
 	Le = Operation(le)
+	// EqFold is "equals" under Unicode case-folding, for strings
+	EqFold = Operation(eqFold)
+	// HasPrefix is "begins with", for strings
+	HasPrefix = Operation(hasPrefix)
+	// Regex is "matches the regular expression", for strings.
+	// See https://golang.org/pkg/regexp/syntax for the supported syntax.
+	Regex = Operation(regex)
+	// Contains is "has an element equal to", for arrays
+	Contains = Operation(contains)
+	// Present is "has the field" if the value is true, or "doesn't have
+	// the field" if it's false. See Exists and NotExists.
+	Present = Operation(present)
 )
 
 var (
@@ -105,6 +192,31 @@ func Where(field string) *Criterion {
 	}
 }
 
+// Or returns a query matching instances that match any of queries, which
+// can be nested with And to build AND/OR trees, e.g.
+// Or(Where("Status").Eq("active"), Where("Priority").Gt(5.0)).
+// If each query has a criterion on an indexed field, Find looks up the
+// instances of each of them in the index, instead of scanning the
+// collection.
+func Or(queries ...*Query) *Query {
+	return &Query{Ors: queries}
+}
+
+// And returns a query matching instances that match all of queries, e.g.
+// And(Where("Team").Eq("db"), Or(Where("Status").Eq("active"), ...)).
+func And(queries ...*Query) *Query {
+	return &Query{AndQueries: queries}
+}
+
+// Not returns a query matching instances that don't match q, e.g.
+// Not(Where("Meta.Rating").Between(3, 4)). It can be combined with And and
+// Or. Negations can't be answered by an index, since instances missing
+// the field aren't in it, so queries are evaluated on every instance
+// unless another criterion uses an index.
+func Not(q *Query) *Query {
+	return &Query{Nots: []*Query{q}}
+}
+
 // OrderBy specify ascending order for the query results.
 func OrderBy(field string) *Query {
 	q := &Query{}
@@ -135,6 +247,24 @@ func (q *Query) UseIndex(path string) *Query {
 	return q
 }
 
+// Select trims instances returned by Find to the given field paths,
+// plus _id, which may be dotted paths into nested objects. Fields missing
+// in an instance are left out. The projection happens after instances
+// are read and decoded, so it doesn't reduce datastore I/O, but it does
+// reduce serialization and transfer costs for downstream consumers, such
+// as remote clients. On multiple calls, paths are accumulated.
+func (q *Query) Select(paths ...string) *Query {
+	q.Fields = append(q.Fields, paths...)
+	return q
+}
+
+// WithDeleted includes tombstoned instances of collections
+// with soft deletes in the results.
+func (q *Query) WithDeleted() *Query {
+	q.IncludeDeleted = true
+	return q
+}
+
 // Or concatenates a new condition that is sufficient
 // for an instance to satisfy, independant of the current Query.
 // Has left-associativity as: (a And b) Or c
@@ -161,6 +291,14 @@ func (q *Query) OrderByDesc(field string) *Query {
 
 // Criterion helpers
 
+// Not negates the operator that follows, e.g. Where("Author").Not().Eq("A1")
+// matches instances whose Author isn't A1 or that have no Author, unlike
+// Ne. Negated criteria don't use indexes, see the package-level Not.
+func (c *Criterion) Not() *Criterion {
+	c.Negated = !c.Negated
+	return c
+}
+
 // Eq is an equality operator against a field
 func (c *Criterion) Eq(value interface{}) *Query {
 	return c.createcriterion(Eq, value)
@@ -191,6 +329,129 @@ func (c *Criterion) Le(value interface{}) *Query {
 	return c.createcriterion(Le, value)
 }
 
+// BoundOption configures the bounds of a Between range.
+type BoundOption func(*boundOptions)
+
+type boundOptions struct {
+	excludeLow  bool
+	excludeHigh bool
+}
+
+// ExcludeLow makes the low bound of a Between range exclusive.
+func ExcludeLow() BoundOption {
+	return func(o *boundOptions) {
+		o.excludeLow = true
+	}
+}
+
+// ExcludeHigh makes the high bound of a Between range exclusive.
+func ExcludeHigh() BoundOption {
+	return func(o *boundOptions) {
+		o.excludeHigh = true
+	}
+}
+
+// Between starts a query with a numeric range condition on a field.
+// See Criterion.Between.
+func Between(field string, low, high float64, opts ...BoundOption) *Query {
+	return Where(field).Between(low, high, opts...)
+}
+
+// Between is a numeric range operator against a field. Bounds are inclusive
+// unless ExcludeLow or ExcludeHigh are provided, and an infinite bound
+// (math.Inf) leaves that side of the range open.
+// Both bounds are checked against the entries of an index on the field, in
+// disjunctions too, so only instances within the range are read. A sorted
+// index is range-scanned from the low bound to the high one, see
+// IndexConfig.Sorted, while the entries of other indexes are all evaluated.
+func (c *Criterion) Between(low, high float64, opts ...BoundOption) *Query {
+	args := &boundOptions{}
+	for _, opt := range opts {
+		opt(args)
+	}
+	q := c.query
+	if q == nil {
+		q = &Query{}
+	}
+	if c.Negated {
+		// Negating the range negates both bounds at once
+		q.Nots = append(q.Nots, Between(c.FieldPath, low, high, opts...))
+		return q
+	}
+	if !math.IsInf(low, -1) {
+		op := Ge
+		if args.excludeLow {
+			op = Gt
+		}
+		q = (&Criterion{FieldPath: c.FieldPath, query: q}).createcriterion(op, low)
+	}
+	if !math.IsInf(high, 1) {
+		op := Le
+		if args.excludeHigh {
+			op = Lt
+		}
+		q = (&Criterion{FieldPath: c.FieldPath, query: q}).createcriterion(op, high)
+	}
+	return q
+}
+
+// String predicates can't be answered by looking up an index value, so
+// they're evaluated on every instance, or on every entry of the index set
+// with UseIndex, which avoids decoding instances that don't match.
+
+// EqFold is a case-insensitive equality operator against a string field
+func (c *Criterion) EqFold(value string) *Query {
+	return c.createcriterion(EqFold, value)
+}
+
+// HasPrefix is a prefix match operator against a string field
+func (c *Criterion) HasPrefix(prefix string) *Query {
+	return c.createcriterion(HasPrefix, prefix)
+}
+
+// Regex is a regular expression match operator against a string field.
+// Invalid patterns make the query fail before it runs.
+func (c *Criterion) Regex(pattern string) *Query {
+	q := c.createcriterion(Regex, pattern)
+	_, _ = c.compileRegexp()
+	return q
+}
+
+// Exists is shorthand for Where(path).Exists().
+func Exists(path string) *Query {
+	return Where(path).Exists()
+}
+
+// NotExists is shorthand for Where(path).NotExists().
+func NotExists(path string) *Query {
+	return Where(path).NotExists()
+}
+
+// Exists is an operator matching instances that have the field, which may
+// be a dotted path into nested objects, whatever its value, including null.
+// An index on the field holds exactly those instances, so Exists can use it.
+func (c *Criterion) Exists() *Query {
+	return c.createcriterion(Present, true)
+}
+
+// NotExists is an operator matching instances missing the field, or an
+// object on its path. Like negations, it can't use an index.
+func (c *Criterion) NotExists() *Query {
+	return c.createcriterion(Present, false)
+}
+
+// ArrayContains is shorthand for Where(field).Contains(value).
+func ArrayContains(field string, value interface{}) *Query {
+	return Where(field).Contains(value)
+}
+
+// Contains is an operator matching array fields with an element equal to
+// value. Fields that aren't arrays don't match.
+// It can use a multikey index on the field, see IndexConfig.
+func (c *Criterion) Contains(value interface{}) *Query {
+	return c.createcriterion(Contains, value)
+}
+
 func createValue(value interface{}) Value {
 	s, ok := value.(string)
 	if ok {
@@ -216,6 +477,14 @@ func createValue(value interface{}) Value {
 	if ok {
 		return Value{Float: fp}
 	}
+	n, ok := value.(json.Number)
+	if ok {
+		return Value{Number: &n}
+	}
+	np, ok := value.(*json.Number)
+	if ok {
+		return Value{Number: np}
+	}
 	return Value{}
 }
 
@@ -237,20 +506,37 @@ func (t *Txn) Find(q *Query) ([][]byte, error) {
 	if err := q.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid query: %s", err)
 	}
+	if compoundPaths(q.Index) != nil {
+		return nil, fmt.Errorf("invalid query: compound index %s can't be used by queries", q.Index)
+	}
 	txn, err := t.collection.db.datastore.NewTransaction(true)
 	if err != nil {
 		return nil, fmt.Errorf("error building internal query: %v", err)
 	}
 	defer txn.Discard()
-	iter := newIterator(txn, t.collection.BaseKey(), q)
+	iter, err := t.newQueryIterator(txn, q)
+	if err != nil {
+		return nil, err
+	}
 	defer iter.Close()
 
 	var values []MarshaledResult
 	for {
+		if t.ctx != nil {
+			if err := t.ctx.Err(); err != nil {
+				return nil, err
+			}
+		}
 		res, ok := iter.NextSync()
 		if !ok {
+			if res.Error != nil && !errors.Is(res.Error, ErrNoIndexFound) {
+				return nil, res.Error
+			}
 			break
 		}
+		if !q.IncludeDeleted && t.collection.isTombstone(res.Value) {
+			continue
+		}
 		values = append(values, res)
 	}
 
@@ -288,31 +574,83 @@ func (t *Txn) Find(q *Query) ([][]byte, error) {
 	res := make([][]byte, len(values))
 	for i := range values {
 		res[i] = values[i].Value
+		if len(q.Fields) > 0 {
+			if res[i], err = project(values[i].Value, t.collection.idField, q.Fields); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return res, nil
 }
 
+// project returns instance trimmed to its ID field and the fields in paths.
+func project(instance []byte, idField string, paths []string) ([]byte, error) {
+	res := []byte("{}")
+	for _, path := range append([]string{idField}, paths...) {
+		field := gjson.GetBytes(instance, path)
+		if !field.Exists() {
+			continue
+		}
+		var err error
+		if res, err = sjson.SetRawBytes(res, path, []byte(field.Raw)); err != nil {
+			return nil, fmt.Errorf("error selecting field %s: %v", path, err)
+		}
+	}
+	return res, nil
+}
+
 func (q *Query) match(v map[string]interface{}) (bool, error) {
 	if q == nil {
 		panic("query can't be nil")
 	}
 
-	andOk := true
+	// A query with only disjunctions matches through them.
+	andOk := len(q.Ands) > 0 || len(q.AndQueries) > 0 || len(q.Nots) > 0 || len(q.Ors) == 0
 	for _, c := range q.Ands {
 		fieldRes, err := traverseFieldPathMap(v, c.FieldPath)
 		if err != nil {
-			return false, err
+			// Instances missing the field, or an object on its path, don't
+			// match, unless the criterion matches absent fields
+			andOk = c.matchesMissing()
+			if !andOk {
+				break
+			}
+			continue
 		}
 		ok, err := c.match(fieldRes)
 		if err != nil {
 			return false, err
 		}
-		andOk = andOk && ok
+		andOk = andOk && ok != c.Negated
 		if !andOk {
 			break
 		}
 	}
+	if andOk {
+		for _, qi := range q.AndQueries {
+			ok, err := qi.match(v)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				andOk = false
+				break
+			}
+		}
+	}
+	if andOk {
+		for _, qi := range q.Nots {
+			ok, err := qi.match(v)
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				andOk = false
+				break
+			}
+		}
+	}
 	if andOk {
 		return true, nil
 	}
@@ -330,6 +668,45 @@ func (q *Query) match(v map[string]interface{}) (bool, error) {
 	return false, nil
 }
 
+// isTree returns whether q has disjunctions, nested queries or negations,
+// which the index set with UseIndex alone can't answer.
+func (q *Query) isTree() bool {
+	if len(q.Ors) > 0 || len(q.AndQueries) > 0 || len(q.Nots) > 0 {
+		return true
+	}
+	for _, c := range q.Ands {
+		if c.matchesMissing() {
+			return true
+		}
+	}
+	return false
+}
+
+// branches returns the conjunctions of q, any of which is sufficient for
+// an instance to match. Ands of each are necessary for it to match that
+// conjunction.
+func (q *Query) branches() []*Query {
+	var res []*Query
+	if len(q.Ands) > 0 || len(q.AndQueries) > 0 || len(q.Nots) > 0 || len(q.Ors) == 0 {
+		res = append(res, &Query{Ands: q.Ands, AndQueries: q.AndQueries, Nots: q.Nots})
+	}
+	for _, qi := range q.Ors {
+		res = append(res, qi.branches()...)
+	}
+	return res
+}
+
+// criteria returns the criteria of q and its nested queries, in order.
+func (q *Query) criteria() []*Criterion {
+	res := append([]*Criterion{}, q.Ands...)
+	for _, qs := range [][]*Query{q.AndQueries, q.Ors, q.Nots} {
+		for _, qi := range qs {
+			res = append(res, qi.criteria()...)
+		}
+	}
+	return res
+}
+
 func compareValue(value interface{}, critVal Value) (int, error) {
 	if critVal.String != nil {
 		s, ok := value.(string)
@@ -349,24 +726,56 @@ func compareValue(value interface{}, critVal Value) (int, error) {
 		return -1, nil
 	}
 	if critVal.Float != nil {
-		f, ok := value.(float64)
-		if !ok {
-			return 0, &errTypeMismatch{value, critVal}
-		}
-		if f == *critVal.Float {
-			return 0, nil
-		}
-		if f < *critVal.Float {
-			return -1, nil
+		if f, ok := value.(float64); ok {
+			if f == *critVal.Float {
+				return 0, nil
+			}
+			if f < *critVal.Float {
+				return -1, nil
+			}
+			return 1, nil
 		}
-		return 1, nil
+		return compareNumbers(value, *critVal.Float, critVal)
+	}
+	if critVal.Number != nil {
+		return compareNumbers(value, *critVal.Number, critVal)
 	}
 	log.Fatalf("no underlying value for criterion was provided")
 	return 0, nil
 }
 
+// compareNumbers compares value with the number other exactly, where
+// either may be a float64 or a json.Number.
+func compareNumbers(value, other interface{}, critVal Value) (int, error) {
+	v, ok := numberRat(value)
+	if !ok {
+		return 0, &errTypeMismatch{value, critVal}
+	}
+	o, ok := numberRat(other)
+	if !ok {
+		return 0, &errTypeMismatch{value, critVal}
+	}
+	return v.Cmp(o), nil
+}
+
+// matchesMissing returns whether c matches instances missing its field,
+// which aren't in indexes on the field.
+func (c *Criterion) matchesMissing() bool {
+	absent := c.Operation == Present && c.Value.Bool != nil && !*c.Value.Bool
+	return absent != c.Negated
+}
+
 func (c *Criterion) match(value reflect.Value) (bool, error) {
+	if c.Operation == Present {
+		return *c.Value.Bool, nil
+	}
 	valueInterface := value.Interface()
+	switch c.Operation {
+	case EqFold, HasPrefix, Regex:
+		return c.matchString(valueInterface)
+	case Contains:
+		return c.matchArray(valueInterface), nil
+	}
 	result, err := compareValue(valueInterface, c.Value)
 	if err != nil {
 		return false, err
@@ -390,6 +799,43 @@ func (c *Criterion) match(value reflect.Value) (bool, error) {
 
 }
 
+func (c *Criterion) matchArray(value interface{}) bool {
+	elems, ok := value.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, e := range elems {
+		// Elements of another type than the value don't match
+		if result, err := compareValue(e, c.Value); err == nil && result == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Criterion) matchString(value interface{}) (bool, error) {
+	s, ok := value.(string)
+	if !ok {
+		return false, &errTypeMismatch{value, c.Value}
+	}
+	switch c.Operation {
+	case EqFold:
+		return strings.EqualFold(s, *c.Value.String), nil
+	case HasPrefix:
+		return strings.HasPrefix(s, *c.Value.String), nil
+	case Regex:
+		r, err := c.compileRegexp()
+		if err != nil {
+			return false, fmt.Errorf("invalid regular expression for field %s: %v", c.FieldPath, err)
+		}
+		return r.MatchString(s), nil
+	default:
+		panic("invalid string operation")
+	}
+}
+
+// traverseFieldPathMap returns the value at fieldPath, a dotted path that
+// traverses nested objects. It fails if any field in the path is missing.
 func traverseFieldPathMap(value map[string]interface{}, fieldPath string) (reflect.Value, error) {
 	fields := strings.Split(fieldPath, ".")
 
@@ -1,14 +1,19 @@
 package db
 
 import (
+	"encoding/json"
 	"errors"
+	"math"
 	"reflect"
 	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	core "github.com/textileio/go-threads/core/db"
 	"github.com/textileio/go-threads/util"
+	"github.com/tidwall/gjson"
 )
 
 type book struct {
@@ -72,6 +77,35 @@ var (
 		{name: "LeTotalReads", query: Where("Meta.TotalReads").Le(float64(30)), resIdx: []int{0, 1, 2}},
 		{name: "LeRating", query: Where("Meta.Rating").Le(3.6), resIdx: []int{0, 1}},
 
+		{name: "BetweenTotalReads", query: Between("Meta.TotalReads", 20, 114), resIdx: []int{1, 2, 3}},
+		{name: "BetweenTotalReadsExclusive", query: Between("Meta.TotalReads", 20, 114, ExcludeLow(), ExcludeHigh()), resIdx: []int{2}},
+		{name: "BetweenRatingOpenLow", query: Between("Meta.Rating", math.Inf(-1), 3.6), resIdx: []int{0, 1}},
+		{name: "BetweenRatingOpenHigh", query: Between("Meta.Rating", 3.9, math.Inf(1), ExcludeLow()), resIdx: []int{3, 4}},
+		{name: "AndBetweenTotalReads", query: Where("Author").Eq("Author1").And("Meta.TotalReads").Between(15, 100), resIdx: []int{1, 2}},
+		{name: "OrBetweenRating", query: Or(Where("Author").Eq("Author3"), Between("Meta.Rating", 3.5, 3.9)), resIdx: []int{1, 2, 4}},
+
+		{name: "EqFoldAuthor", query: Where("Author").EqFold("aUTHOR1"), resIdx: []int{0, 1, 2}},
+		{name: "HasPrefixTitle", query: Where("Title").HasPrefix("Title"), resIdx: []int{0, 1, 2, 3, 4}},
+		{name: "HasPrefixAuthor", query: Where("Author").HasPrefix("Author1"), resIdx: []int{0, 1, 2}},
+		{name: "RegexTitle", query: Where("Title").Regex("^Title[2-4]$"), resIdx: []int{1, 2, 3}},
+		{name: "RegexAuthorOrTitle", query: Where("Author").Regex("3$").Or(Where("Title").Regex("(?i)^title1")), resIdx: []int{0, 4}},
+
+		{name: "OrQueries", query: Or(Where("Author").Eq("Author2"), Where("Meta.TotalReads").Lt(float64(20))), resIdx: []int{0, 3}},
+		{name: "AndOr", query: And(Where("Author").Eq("Author1"), Or(Where("Title").Eq("Title1"), Where("Meta.Rating").Gt(3.8))), resIdx: []int{0, 2}},
+		{name: "OrAnd", query: Or(And(Where("Author").Eq("Author1"), Where("Meta.TotalReads").Gt(float64(15))), Where("Author").Eq("Author3")), resIdx: []int{1, 2, 4}},
+		{name: "AndOrNested", query: Where("Meta.Rating").Lt(4.5).And("Author").Ne("Author2").Or(And(Where("Author").Eq("Author3"), Or(Where("Title").Eq("Title5"), Where("Title").Eq("Title1")))), resIdx: []int{0, 1, 2, 4}},
+		{name: "AndOrNoMatch", query: And(Where("Author").Eq("Author2"), Or(Where("Title").Eq("Title1"), Where("Title").Eq("Title5"))), resIdx: []int{}},
+
+		{name: "NotEqAuthor", query: Where("Author").Not().Eq("Author1"), resIdx: []int{3, 4}},
+		{name: "NotQuery", query: Not(Where("Author").Eq("Author1")), resIdx: []int{3, 4}},
+		{name: "NotGtTotalReads", query: Where("Meta.TotalReads").Not().Gt(float64(25)), resIdx: []int{0, 1}},
+		{name: "NotBetweenRating", query: Where("Meta.Rating").Not().Between(3.5, 4.0), resIdx: []int{0, 4}},
+		{name: "NotOr", query: Not(Or(Where("Author").Eq("Author2"), Where("Meta.Rating").Lt(3.5))), resIdx: []int{1, 2, 4}},
+		{name: "AndNot", query: Where("Author").Eq("Author1").And("Title").Not().Eq("Title2"), resIdx: []int{0, 2}},
+		{name: "NotNot", query: Not(Not(Where("Author").Eq("Author3"))), resIdx: []int{4}},
+		{name: "NotMissingField", query: Where("Missing").Not().Eq("Author1"), resIdx: []int{0, 1, 2, 3, 4}},
+		{name: "NeMissingField", query: Where("Missing").Ne("Author1"), resIdx: []int{}},
+
 		{name: "SortAscString", query: Where("Meta.TotalReads").Gt(float64(20)).OrderBy("Author"), resIdx: []int{2, 3, 4}, ordered: true},
 		{name: "SortDescString", query: Where("Meta.TotalReads").Gt(float64(20)).OrderByDesc("Author"), resIdx: []int{4, 3, 2}, ordered: true},
 
@@ -104,35 +138,234 @@ func TestCollectionQuery(t *testing.T) {
 			if err != nil {
 				t.Fatalf("error when executing query: %v", err)
 			}
-			if len(q.resIdx) != len(ret) {
-				t.Fatalf("query results length doesn't match, expected: %d, got: %d", len(q.resIdx), len(ret))
-			}
-			res := make([]*book, len(ret))
-			for i, bookJSON := range ret {
-				var book = &book{}
-				util.InstanceFromJSON(bookJSON, book)
-				res[i] = book
+			checkQueryResults(t, q, data, ret)
+		})
+	}
+}
+
+func TestQueryPlan(t *testing.T) {
+	t.Parallel()
+	c, data, clean := createCollectionWithData(t)
+	defer clean()
+	checkErr(t, c.AddIndex(IndexConfig{Path: "Author"}))
+	checkErr(t, c.AddIndex(IndexConfig{Path: "Title"}))
+	checkErr(t, c.AddIndex(IndexConfig{Path: "Meta.Rating"}))
+
+	// Indexes don't change results.
+	for _, q := range queries {
+		q := q
+		t.Run(q.name, func(t *testing.T) {
+			t.Parallel()
+			ret, err := c.Find(q.query)
+			if err != nil {
+				t.Fatalf("error when executing query: %v", err)
 			}
+			checkQueryResults(t, q, data, ret)
+		})
+	}
 
-			expectedIdx := make([]int, len(q.resIdx))
-			for i := range q.resIdx {
-				expectedIdx[i] = q.resIdx[i]
+	t.Run("Plans", func(t *testing.T) {
+		t.Parallel()
+		plans := []struct {
+			query   *Query
+			indexed bool
+		}{
+			{query: Or(Where("Author").Eq("Author2"), Where("Title").Eq("Title1")), indexed: true},
+			{query: Or(Where("Author").Eq("Author2"), Where("Meta.Rating").Gt(4.5).And("Title").HasPrefix("Title")), indexed: true},
+			{query: And(Where("Author").Eq("Author1"), Or(Where("Title").Eq("Title1"), Where("Meta.Rating").Gt(3.8))), indexed: false},
+			{query: Where("Author").Eq("Author1").And("Meta.TotalReads").Gt(float64(5)).Or(Or(Where("Title").Eq("Title5"))), indexed: true},
+			{query: Or(Where("Author").Eq("Author2"), Where("Meta.TotalReads").Lt(float64(20))), indexed: false},
+			{query: Where("Author").Not().Eq("Author1"), indexed: false},
+			{query: Not(Where("Title").Eq("Title1")), indexed: false},
+			{query: Where("Title").Eq("Title1").And("Author").Not().Eq("Author1"), indexed: true},
+		}
+		for _, p := range plans {
+			if indexed := c.planBranches(p.query) != nil; indexed != p.indexed {
+				t.Fatalf("expected query %+v to be indexed: %v", p.query, p.indexed)
+			}
+		}
+	})
+	t.Run("Explain", func(t *testing.T) {
+		t.Parallel()
+		plans := []struct {
+			query     *Query
+			indexes   []string
+			unindexed []string
+		}{
+			{query: Where("Author").Eq("Author1"), unindexed: []string{"Author"}},
+			{query: Where("Author").Eq("Author1").UseIndex("Author").And("Title").Eq("Title1"), indexes: []string{"Author"}, unindexed: []string{"Title"}},
+			{query: Or(Where("Author").Eq("Author2"), Where("Title").Eq("Title1")), indexes: []string{"Author", "Title"}},
+			{query: Or(Where("Author").Eq("Author2"), Where("Author").Eq("Author3").And("Meta.Rating").Gt(4.5)), indexes: []string{"Author"}, unindexed: []string{"Meta.Rating"}},
+			{query: Or(Where("Author").Eq("Author2"), Where("Meta.TotalReads").Lt(float64(20))), unindexed: []string{"Author", "Meta.TotalReads"}},
+			{query: Or(Where("Author").Eq("Author2"), Between("Meta.Rating", 3.5, 3.9)), indexes: []string{"Author", "Meta.Rating"}},
+			{query: Not(Where("Title").Eq("Title1")), unindexed: []string{"Title"}},
+		}
+		for _, p := range plans {
+			plan, err := c.Explain(p.query)
+			checkErr(t, err)
+			if plan.FullScan != (len(p.indexes) == 0) {
+				t.Fatalf("expected query %+v to scan the collection: %v", p.query, len(p.indexes) == 0)
 			}
-			if !q.ordered {
-				sort.Slice(res, func(i, j int) bool {
-					return strings.Compare(res[i].ID.String(), res[j].ID.String()) == -1
-				})
-				sort.Slice(expectedIdx, func(i, j int) bool {
-					return strings.Compare(data[expectedIdx[i]].ID.String(), data[expectedIdx[j]].ID.String()) == -1
-				})
+			if !reflect.DeepEqual(plan.Indexes, p.indexes) {
+				t.Fatalf("expected query %+v to use indexes %v, got %v", p.query, p.indexes, plan.Indexes)
 			}
-			for i, idx := range expectedIdx {
-				if !reflect.DeepEqual(data[idx], *res[i]) {
-					t.Fatalf("wrong query item result, expected: %v, got: %v", data[idx], *res[i])
-				}
+			var unindexed []string
+			for _, crit := range plan.Unindexed {
+				unindexed = append(unindexed, crit.FieldPath)
 			}
+			if !reflect.DeepEqual(unindexed, p.unindexed) {
+				t.Fatalf("expected query %+v to leave %v unindexed, got %v", p.query, p.unindexed, unindexed)
+			}
+		}
+		if _, err := c.Explain(Where("Author").Eq("Author1").UseIndex("Missing")); !errors.Is(err, ErrNoIndexFound) {
+			t.Fatalf("expected missing indexes to be reported, got %v", err)
+		}
+	})
+}
+
+func TestSortedIndex(t *testing.T) {
+	t.Parallel()
+	type measure struct {
+		ID    core.InstanceID `json:"_id"`
+		Value float64
+	}
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:    "Measure",
+		Schema:  util.SchemaFromInstance(&measure{}, false),
+		Indexes: []IndexConfig{{Path: "Value", Sorted: true}},
+	})
+	checkErr(t, err)
+	for _, v := range []float64{-1e10, -5, -0.5, 0, 0.25, 3, 20, 64, 114, 1e5, 1e300} {
+		_, err := c.Create(util.JSONFromInstance(measure{Value: v}))
+		checkErr(t, err)
+	}
+
+	values := func(instances [][]byte) []float64 {
+		res := make([]float64, len(instances))
+		for i, instance := range instances {
+			res[i] = gjson.GetBytes(instance, "Value").Float()
+		}
+		sort.Float64s(res)
+		return res
+	}
+	queries := []*Query{
+		Between("Value", 20, 114),
+		Between("Value", 20, 114, ExcludeLow(), ExcludeHigh()),
+		Between("Value", -5, 5),
+		Between("Value", math.Inf(-1), 3),
+		Between("Value", 64, math.Inf(1), ExcludeLow()),
+		Between("Value", 1e6, math.Inf(1)),
+		Between("Value", 114, 20),
+		Where("Value").Eq(0.25),
+		Where("Value").Gt(0.0).And("Value").Le(1e5),
+	}
+	for _, q := range queries {
+		scanned, err := c.Find(q)
+		checkErr(t, err)
+		indexed, err := c.Find(q.UseIndex("Value"))
+		checkErr(t, err)
+		if !reflect.DeepEqual(values(indexed), values(scanned)) {
+			t.Fatalf("expected range %+v to find %v, got %v", q, values(scanned), values(indexed))
+		}
+	}
+	res, err := c.Find(Or(Between("Value", 20, 114), Where("Value").Lt(-1.0)))
+	checkErr(t, err)
+	if expected := []float64{-1e10, -5, 20, 64, 114}; !reflect.DeepEqual(values(res), expected) {
+		t.Fatalf("expected disjunction to find %v, got %v", expected, values(res))
+	}
+
+	// Ranges only query the buckets of their bounds.
+	txn, err := db.datastore.NewTransaction(true)
+	checkErr(t, err)
+	defer txn.Discard()
+	scan := newRangeScan(txn, indexPrefix.Child(c.BaseKey()).ChildString("Value"), 20, 114)
+	if len(scan.prefixes) != 3 {
+		t.Fatalf("expected range to query 3 buckets, got %v", scan.prefixes)
+	}
+	n := 0
+	for {
+		if _, ok := scan.NextSync(); !ok {
+			break
+		}
+		n++
+	}
+	checkErr(t, scan.Close())
+	if n != 3 {
+		t.Fatalf("expected range to read 3 entries, got %d", n)
+	}
+	if prefixes := coverBuckets("c05", "fff"); len(prefixes) != 29 {
+		t.Fatalf("expected open range to query 29 buckets, got %v", prefixes)
+	}
+
+	if _, err := db.NewCollection(CollectionConfig{
+		Name:    "Tags",
+		Schema:  util.SchemaFromInstance(&measure{}, false),
+		Indexes: []IndexConfig{{Path: "Value", Sorted: true, Multikey: true}},
+	}); err == nil {
+		t.Fatal("sorted multikey indexes should be invalid")
+	}
+}
+
+func TestSortedIndexUseNumber(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:      "Counter",
+		Schema:    util.SchemaFromSchemaString(counterSchema),
+		Indexes:   []IndexConfig{{Path: "Count", Sorted: true}},
+		UseNumber: true,
+	})
+	checkErr(t, err)
+	// 2^53 and 2^53+1 are the same float64, so they have the same encoding
+	_, err = c.Create([]byte(`{"_id": "", "Count": 9007199254740993}`))
+	checkErr(t, err)
+	_, err = c.Create([]byte(`{"_id": "", "Count": 9007199254740992}`))
+	checkErr(t, err)
+	for name, q := range map[string]*Query{
+		"Gt": Where("Count").Gt(float64(9007199254740992)).UseIndex("Count"),
+		"Eq": Where("Count").Eq(json.Number("9007199254740993")).UseIndex("Count"),
+	} {
+		res, err := c.Find(q)
+		checkErr(t, err)
+		if len(res) != 1 || !strings.Contains(string(res[0]), "9007199254740993") {
+			t.Fatalf("%s: expected the larger instance, got %d results", name, len(res))
+		}
+	}
+}
+
+// checkQueryResults checks ret holds the instances of data expected by q.
+func checkQueryResults(t *testing.T, q queryTest, data []book, ret [][]byte) {
+	t.Helper()
+	if len(q.resIdx) != len(ret) {
+		t.Fatalf("query results length doesn't match, expected: %d, got: %d", len(q.resIdx), len(ret))
+	}
+	res := make([]*book, len(ret))
+	for i, bookJSON := range ret {
+		var book = &book{}
+		util.InstanceFromJSON(bookJSON, book)
+		res[i] = book
+	}
+
+	expectedIdx := make([]int, len(q.resIdx))
+	for i := range q.resIdx {
+		expectedIdx[i] = q.resIdx[i]
+	}
+	if !q.ordered {
+		sort.Slice(res, func(i, j int) bool {
+			return strings.Compare(res[i].ID.String(), res[j].ID.String()) == -1
+		})
+		sort.Slice(expectedIdx, func(i, j int) bool {
+			return strings.Compare(data[expectedIdx[i]].ID.String(), data[expectedIdx[j]].ID.String()) == -1
 		})
 	}
+	for i, idx := range expectedIdx {
+		if !reflect.DeepEqual(data[idx], *res[i]) {
+			t.Fatalf("wrong query item result, expected: %v, got: %v", data[idx], *res[i])
+		}
+	}
 }
 
 func TestInvalidSortField(t *testing.T) {
@@ -146,6 +379,455 @@ func TestInvalidSortField(t *testing.T) {
 	}
 }
 
+func TestInvalidStringPredicate(t *testing.T) {
+	t.Parallel()
+
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+	if _, err := c.Find(Where("Title").Regex("Title(")); err == nil || !strings.Contains(err.Error(), "invalid regular expression") {
+		t.Fatalf("query with an invalid regex should fail, got %v", err)
+	}
+	f := float64(1)
+	q := &Query{Ands: []*Criterion{{FieldPath: "Title", Operation: HasPrefix, Value: Value{Float: &f}}}}
+	if _, err := c.Find(q); err == nil {
+		t.Fatal("string predicate with a non-string value should fail")
+	}
+}
+
+func TestConcurrentRegexQuery(t *testing.T) {
+	t.Parallel()
+
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+	s := "^Title[2-4]$"
+	q := &Query{Ands: []*Criterion{{FieldPath: "Title", Operation: Regex, Value: Value{String: &s}}}}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := c.Find(q)
+			if err != nil || len(res) != 3 {
+				t.Errorf("shared regex query should match 3 instances, got %d: %v", len(res), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type person struct {
+	ID      core.InstanceID `json:"_id"`
+	Name    string
+	Address *address `json:",omitempty"`
+}
+
+type address struct {
+	City string
+	Geo  *geo `json:",omitempty"`
+}
+
+type geo struct {
+	Country string
+}
+
+func TestNestedFieldPaths(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:    "Person",
+		Schema:  util.SchemaFromInstance(&person{}, false),
+		Indexes: []IndexConfig{{Path: "Address.City"}, {Path: "Address.Geo.Country"}},
+	})
+	checkErr(t, err)
+	people := []person{
+		{Name: "Alice", Address: &address{City: "Paris", Geo: &geo{Country: "FR"}}},
+		{Name: "Bob", Address: &address{City: "Lyon", Geo: &geo{Country: "FR"}}},
+		{Name: "Carol", Address: &address{City: "Paris"}},
+		{Name: "Dave"},
+	}
+	for i := range people {
+		_, err := c.Create(util.JSONFromInstance(people[i]))
+		checkErr(t, err)
+	}
+
+	tests := []struct {
+		name  string
+		query *Query
+		names []string
+	}{
+		{name: "TwoLevels", query: Where("Address.City").Eq("Paris"), names: []string{"Alice", "Carol"}},
+		{name: "TwoLevelsIndex", query: Where("Address.City").Eq("Paris").UseIndex("Address.City"), names: []string{"Alice", "Carol"}},
+		{name: "ThreeLevels", query: Where("Address.Geo.Country").Eq("FR"), names: []string{"Alice", "Bob"}},
+		{name: "ThreeLevelsIndex", query: Where("Address.Geo.Country").Eq("FR").UseIndex("Address.Geo.Country"), names: []string{"Alice", "Bob"}},
+		{name: "MissingIntermediate", query: Where("Address.Geo.Country").Ne("FR"), names: nil},
+		{name: "MissingIntermediateOr", query: Where("Address.Geo.Country").Eq("FR").Or(Where("Name").Eq("Dave")), names: []string{"Alice", "Bob", "Dave"}},
+		{name: "Exists", query: Exists("Address"), names: []string{"Alice", "Bob", "Carol"}},
+		{name: "ExistsThreeLevels", query: Exists("Address.Geo.Country"), names: []string{"Alice", "Bob"}},
+		{name: "ExistsIndex", query: Exists("Address.Geo.Country").UseIndex("Address.Geo.Country"), names: []string{"Alice", "Bob"}},
+		{name: "NotExists", query: NotExists("Address.Geo"), names: []string{"Carol", "Dave"}},
+		{name: "NotExistsIndex", query: NotExists("Address.Geo.Country").UseIndex("Address.Geo.Country"), names: []string{"Carol", "Dave"}},
+		{name: "NotExistsAnd", query: Where("Address.City").Eq("Paris").And("Address.Geo").NotExists(), names: []string{"Carol"}},
+		{name: "NegatedExists", query: Not(Exists("Address")), names: []string{"Dave"}},
+		{name: "ExistsOr", query: Or(Exists("Address.Geo.Country"), Where("Address.City").Eq("Paris")), names: []string{"Alice", "Bob", "Carol"}},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			ret, err := c.Find(tt.query)
+			if err != nil {
+				t.Fatalf("error when executing query: %v", err)
+			}
+			names := make([]string, len(ret))
+			for i, b := range ret {
+				p := &person{}
+				util.InstanceFromJSON(b, p)
+				names[i] = p.Name
+			}
+			sort.Strings(names)
+			if len(names) != len(tt.names) {
+				t.Fatalf("expected %v, got %v", tt.names, names)
+			}
+			for i := range names {
+				if names[i] != tt.names[i] {
+					t.Fatalf("expected %v, got %v", tt.names, names)
+				}
+			}
+		})
+	}
+
+	t.Run("Plans", func(t *testing.T) {
+		if c.planBranches(Or(Exists("Address.Geo.Country"), Where("Address.City").Eq("Paris"))) == nil {
+			t.Fatalf("expected Exists to use the index")
+		}
+		if c.planBranches(Or(NotExists("Address.Geo.Country"), Where("Address.City").Eq("Paris"))) != nil {
+			t.Fatalf("expected NotExists to not use the index")
+		}
+	})
+}
+
+type post struct {
+	ID     core.InstanceID `json:"_id"`
+	Title  string
+	Tags   []string
+	Scores []float64
+}
+
+func TestArrayContains(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:    "Post",
+		Schema:  util.SchemaFromInstance(&post{}, false),
+		Indexes: []IndexConfig{{Path: "Tags", Multikey: true}},
+	})
+	checkErr(t, err)
+	posts := []post{
+		{Title: "Post1", Tags: []string{"go", "db"}, Scores: []float64{1, 2}},
+		{Title: "Post2", Tags: []string{"go", "go", "threads"}, Scores: []float64{3}},
+		{Title: "Post3", Tags: []string{}, Scores: []float64{2}},
+	}
+	ids := make([]core.InstanceID, len(posts))
+	for i := range posts {
+		ids[i], err = c.Create(util.JSONFromInstance(posts[i]))
+		checkErr(t, err)
+		posts[i].ID = ids[i]
+	}
+
+	tests := []struct {
+		name   string
+		query  *Query
+		titles []string
+	}{
+		{name: "String", query: ArrayContains("Tags", "go"), titles: []string{"Post1", "Post2"}},
+		{name: "StringIndex", query: ArrayContains("Tags", "go").UseIndex("Tags"), titles: []string{"Post1", "Post2"}},
+		{name: "Float", query: ArrayContains("Scores", float64(2)), titles: []string{"Post1", "Post3"}},
+		{name: "NoMatch", query: ArrayContains("Tags", "none"), titles: nil},
+		{name: "NoMatchIndex", query: ArrayContains("Tags", "none").UseIndex("Tags"), titles: nil},
+		{name: "OtherType", query: ArrayContains("Scores", "go"), titles: nil},
+		{name: "NotArray", query: ArrayContains("Title", "Post1"), titles: nil},
+		{name: "OrIndex", query: ArrayContains("Tags", "db").Or(ArrayContains("Tags", "go")).UseIndex("Tags"), titles: []string{"Post1", "Post2"}},
+	}
+	check := func(t *testing.T, q *Query, expected []string) {
+		ret, err := c.Find(q)
+		if err != nil {
+			t.Fatalf("error when executing query: %v", err)
+		}
+		titles := make([]string, len(ret))
+		for i, b := range ret {
+			p := &post{}
+			util.InstanceFromJSON(b, p)
+			titles[i] = p.Title
+		}
+		sort.Strings(titles)
+		if !reflect.DeepEqual(titles, expected) && !(len(titles) == 0 && len(expected) == 0) {
+			t.Fatalf("expected %v, got %v", expected, titles)
+		}
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			check(t, tt.query, tt.titles)
+		})
+	}
+
+	t.Run("UpdatedIndex", func(t *testing.T) {
+		posts[0].Tags = []string{"db"}
+		checkErr(t, c.Save(util.JSONFromInstance(posts[0])))
+		check(t, ArrayContains("Tags", "go").UseIndex("Tags"), []string{"Post2"})
+		check(t, ArrayContains("Tags", "db").UseIndex("Tags"), []string{"Post1"})
+	})
+}
+
+func TestSelect(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:   "Person",
+		Schema: util.SchemaFromInstance(&person{}, false),
+	})
+	checkErr(t, err)
+	alice, err := c.Create(util.JSONFromInstance(person{
+		Name:    "Alice",
+		Address: &address{City: "Lisbon", Geo: &geo{Country: "PT"}},
+	}))
+	checkErr(t, err)
+	bob, err := c.Create(util.JSONFromInstance(person{Name: "Bob"}))
+	checkErr(t, err)
+
+	res, err := c.Find(OrderBy("Name").Select("Name", "Address.Geo.Country"))
+	checkErr(t, err)
+	expected := []string{
+		`{"_id":"` + alice.String() + `","Name":"Alice","Address":{"Geo":{"Country":"PT"}}}`,
+		`{"_id":"` + bob.String() + `","Name":"Bob"}`,
+	}
+	if len(res) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(res))
+	}
+	for i := range res {
+		var got, want map[string]interface{}
+		checkErr(t, json.Unmarshal(res[i], &got))
+		checkErr(t, json.Unmarshal([]byte(expected[i]), &want))
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("expected %s, got %s", expected[i], res[i])
+		}
+	}
+
+	_, err = c.Find(OrderBy("Name").Select(""))
+	if err == nil {
+		t.Fatalf("empty selected field paths should be invalid")
+	}
+}
+
+const counterSchema = `{
+	"$schema": "http://json-schema.org/draft-04/schema#",
+	"type": "object",
+	"properties": {
+		"_id": {"type": "string"},
+		"Count": {"type": "integer"}
+	}
+}`
+
+func TestUseNumber(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:      "Counter",
+		Schema:    util.SchemaFromSchemaString(counterSchema),
+		Indexes:   []IndexConfig{{Path: "Count"}},
+		UseNumber: true,
+	})
+	checkErr(t, err)
+	// 2^53 and 2^53+1 are the same float64
+	_, err = c.Create([]byte(`{"_id": "", "Count": 9007199254740993}`))
+	checkErr(t, err)
+	_, err = c.Create([]byte(`{"_id": "", "Count": 9007199254740992}`))
+	checkErr(t, err)
+
+	tests := map[string]*Query{
+		"Eq":           Where("Count").Eq(json.Number("9007199254740993")),
+		"EqIndex":      Where("Count").Eq(json.Number("9007199254740993")).UseIndex("Count"),
+		"GtFloat":      Where("Count").Gt(float64(9007199254740992)),
+		"GtFloatIndex": Where("Count").Gt(float64(9007199254740992)).UseIndex("Count"),
+	}
+	for name, q := range tests {
+		res, err := c.Find(q)
+		checkErr(t, err)
+		if len(res) != 1 || !strings.Contains(string(res[0]), "9007199254740993") {
+			t.Fatalf("%s: expected the larger instance, got %d results", name, len(res))
+		}
+	}
+
+	res, err := c.Find(OrderBy("Count"))
+	checkErr(t, err)
+	if len(res) != 2 || !strings.Contains(string(res[0]), "9007199254740992") {
+		t.Fatalf("expected instances sorted by exact count")
+	}
+	if !db.ListCollections()[0].UseNumber {
+		t.Fatalf("use number should be reported")
+	}
+}
+
+func TestDisallowUnknownFields(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:                  "Counter",
+		Schema:                util.SchemaFromSchemaString(counterSchema),
+		DisallowUnknownFields: true,
+	})
+	checkErr(t, err)
+
+	id, err := c.Create([]byte(`{"_id": "", "Count": 1}`))
+	checkErr(t, err)
+	if _, err := c.Create([]byte(`{"_id": "", "Count": 1, "Other": true}`)); !errors.Is(err, ErrInvalidSchemaInstance) {
+		t.Fatalf("expected create with unknown fields to fail, got %v", err)
+	}
+	if err := c.Save([]byte(`{"_id": "` + id.String() + `", "Other": true}`)); !errors.Is(err, ErrInvalidSchemaInstance) {
+		t.Fatalf("expected save with unknown fields to fail, got %v", err)
+	}
+}
+
+func TestFindDecodeError(t *testing.T) {
+	t.Parallel()
+	db, clean := createTestDB(t)
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:      "Counter",
+		Schema:    util.SchemaFromSchemaString(counterSchema),
+		Indexes:   []IndexConfig{{Path: "Count"}},
+		UseNumber: true,
+	})
+	checkErr(t, err)
+	_, err = c.Create([]byte(`{"_id": "", "Count": 1}`))
+	checkErr(t, err)
+	// An instance that can't be decoded fails the query, instead of
+	// truncating its results.
+	checkErr(t, db.datastore.Put(c.BaseKey().ChildString("corrupt"), []byte(`{"_id": "corrupt", "Count": 1`)))
+
+	if _, err := c.Find(Where("Count").Eq(json.Number("1"))); err == nil {
+		t.Fatalf("expected the decoding error of the corrupt instance")
+	}
+	if _, err := c.Find(Where("Count").Eq(json.Number("2")).UseIndex("Count")); err != nil {
+		t.Fatalf("expected no instances from an empty index, got %v", err)
+	}
+}
+
+func TestQueryCache(t *testing.T) {
+	t.Parallel()
+	t.Run("Invalidation", func(t *testing.T) {
+		t.Parallel()
+		db, clean := createTestDB(t, WithNewDBQueryCache(10, 0))
+		defer clean()
+		c, err := db.NewCollection(CollectionConfig{
+			Name:   "Book",
+			Schema: util.SchemaFromInstance(&book{}, false),
+		})
+		checkErr(t, err)
+		_, err = c.Create(util.JSONFromInstance(book{Title: "Title1", Author: "Author1"}))
+		checkErr(t, err)
+		q := Where("Author").Eq("Author1")
+		checkQueryCount(t, c, q, 1)
+		buckets, err := c.GroupBy(nil, "Author", "", AggCount)
+		checkErr(t, err)
+		if buckets["Author1"] != 1 {
+			t.Fatalf("expected a single instance in the bucket, got %v", buckets)
+		}
+
+		// Writes that skip the reduce path aren't seen by cached queries.
+		id := core.NewInstanceID()
+		hidden := util.JSONFromInstance(book{ID: id, Title: "Title2", Author: "Author1"})
+		checkErr(t, db.datastore.Put(c.BaseKey().ChildString(id.String()), hidden))
+		checkQueryCount(t, c, q, 1)
+		buckets, err = c.GroupBy(nil, "Author", "", AggCount)
+		checkErr(t, err)
+		if buckets["Author1"] != 1 {
+			t.Fatalf("expected a cached bucket, got %v", buckets)
+		}
+		checkQueryCount(t, c, q, 2, WithTxnNoCache())
+
+		_, err = c.Create(util.JSONFromInstance(book{Title: "Title3", Author: "Author1"}))
+		checkErr(t, err)
+		checkQueryCount(t, c, q, 3)
+		buckets, err = c.GroupBy(nil, "Author", "", AggCount)
+		checkErr(t, err)
+		if buckets["Author1"] != 3 {
+			t.Fatalf("expected an invalidated bucket, got %v", buckets)
+		}
+	})
+	t.Run("TTL", func(t *testing.T) {
+		t.Parallel()
+		db, clean := createTestDB(t, WithNewDBQueryCache(10, 100*time.Millisecond))
+		defer clean()
+		c, err := db.NewCollection(CollectionConfig{
+			Name:   "Book",
+			Schema: util.SchemaFromInstance(&book{}, false),
+		})
+		checkErr(t, err)
+		checkQueryCount(t, c, nil, 0)
+		id := core.NewInstanceID()
+		hidden := util.JSONFromInstance(book{ID: id, Title: "Title1"})
+		checkErr(t, db.datastore.Put(c.BaseKey().ChildString(id.String()), hidden))
+		time.Sleep(200 * time.Millisecond)
+		checkQueryCount(t, c, nil, 1)
+	})
+}
+
+func TestQueryTimeout(t *testing.T) {
+	t.Parallel()
+	c, _, clean := createCollectionWithData(t)
+	defer clean()
+	checkErr(t, c.AddIndex(IndexConfig{Path: "Author"}))
+	timeout := WithTxnQueryTimeout(time.Nanosecond)
+	for name, q := range map[string]*Query{
+		"Scan":     Where("Title").Eq("Title1"),
+		"Index":    Where("Author").Eq("Author1").UseIndex("Author"),
+		"Branches": Where("Author").Eq("Author1").Or(Where("Author").Eq("Author2")),
+	} {
+		if _, err := c.Find(q, timeout); !errors.Is(err, ErrQueryTimeout) {
+			t.Fatalf("%s: expected ErrQueryTimeout, got %v", name, err)
+		}
+	}
+	if _, err := c.GroupBy(nil, "Author", "", AggCount, timeout); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("GroupBy: expected ErrQueryTimeout, got %v", err)
+	}
+	if _, err := c.DeleteMatching(Where("Author").Eq("Author1"), timeout); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("DeleteMatching: expected ErrQueryTimeout, got %v", err)
+	}
+	checkQueryCount(t, c, Where("Author").Eq("Author1"), 3)
+	checkQueryCount(t, c, Where("Author").Eq("Author1"), 3, WithTxnQueryTimeout(time.Minute))
+
+	db, clean := createTestDB(t, WithNewDBQueryTimeout(time.Nanosecond))
+	defer clean()
+	c, err := db.NewCollection(CollectionConfig{
+		Name:   "Book",
+		Schema: util.SchemaFromInstance(&book{}, false),
+	})
+	checkErr(t, err)
+	_, err = c.Create(util.JSONFromInstance(book{Title: "Title1", Author: "Author1"}))
+	checkErr(t, err)
+	if _, err := c.Find(nil); !errors.Is(err, ErrQueryTimeout) {
+		t.Fatalf("expected the DB query timeout to apply, got %v", err)
+	}
+	checkQueryCount(t, c, nil, 1, WithTxnQueryTimeout(0))
+	if err := WithNewDBQueryTimeout(-time.Second)(&NewDBOptions{}); err == nil {
+		t.Fatalf("negative query timeouts should be rejected")
+	}
+}
+
+func checkQueryCount(t *testing.T, c *Collection, q *Query, count int, opts ...TxnOption) {
+	t.Helper()
+	res, err := c.Find(q, opts...)
+	checkErr(t, err)
+	if len(res) != count {
+		t.Fatalf("expected %d results, got %d", count, len(res))
+	}
+}
+
 func createCollectionWithData(t *testing.T) (*Collection, []book, func()) {
 	db, clean := createTestDB(t)
 	c, err := db.NewCollection(CollectionConfig{
@@ -254,6 +254,21 @@ var (
 			resIdx: []int{0, 1, 2, 3},
 			query:  Where("Meta.TotalReads").Ge(&totreadMin).UseIndex("Meta.TotalReads"),
 		},
+		{
+			name:   "IndexBetweenTotalReads",
+			resIdx: []int{0, 2},
+			query:  Between("Meta.TotalReads", 100, 150, ExcludeHigh()).UseIndex("Meta.TotalReads"),
+		},
+		{
+			name:   "IndexHasPrefixTitle",
+			resIdx: []int{0, 1, 2, 3},
+			query:  Where("Title").HasPrefix("Title").UseIndex("Title"),
+		},
+		{
+			name:   "IndexRegexTitle",
+			resIdx: []int{1, 2},
+			query:  Where("Title").Regex("[23]$").UseIndex("Title"),
+		},
 		{
 			name:   "InvalidIndex",
 			resIdx: []int{},
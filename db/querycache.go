@@ -0,0 +1,152 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	core "github.com/textileio/go-threads/core/db"
+)
+
+// queryCache caches results of queries of a collection, keyed by a hash
+// of the query. It's purged whenever instances of the collection change.
+type queryCache struct {
+	entries *lru.Cache
+	ttl     time.Duration
+}
+
+type queryCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// queryCacheKey is the canonical form of a cached call, hashed to key
+// its result.
+type queryCacheKey struct {
+	Op         string
+	Query      *Query
+	GroupField string `json:",omitempty"`
+	ValueField string `json:",omitempty"`
+	AggOp      AggOp  `json:",omitempty"`
+}
+
+func newQueryCache(size int, ttl time.Duration) (*queryCache, error) {
+	entries, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &queryCache{entries: entries, ttl: ttl}, nil
+}
+
+// hash returns the cache key of k, or false if k can't be hashed.
+func (qc *queryCache) hash(k queryCacheKey) (string, bool) {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return "", false
+	}
+	sum := sha256.Sum256(b)
+	return string(sum[:]), true
+}
+
+func (qc *queryCache) get(key string) (interface{}, bool) {
+	v, ok := qc.entries.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(queryCacheEntry)
+	if qc.ttl > 0 && time.Now().After(e.expires) {
+		qc.entries.Remove(key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+func (qc *queryCache) put(key string, value interface{}) {
+	qc.entries.Add(key, queryCacheEntry{value: value, expires: time.Now().Add(qc.ttl)})
+}
+
+// invalidate drops every cached result.
+func (qc *queryCache) invalidate() {
+	qc.entries.Purge()
+}
+
+// cachedFind runs txn.Find(q) through the collection query cache, if
+// any. Results are copied, so callers can't alter cached ones.
+func (c *Collection) cachedFind(txn *Txn, q *Query) ([][]byte, error) {
+	if c.queryCache == nil || txn.noCache {
+		return txn.Find(q)
+	}
+	key, ok := c.queryCache.hash(queryCacheKey{Op: "find", Query: q})
+	if !ok {
+		return txn.Find(q)
+	}
+	if v, ok := c.queryCache.get(key); ok {
+		return copyInstances(v.([][]byte)), nil
+	}
+	instances, err := txn.Find(q)
+	if err != nil {
+		return nil, err
+	}
+	c.queryCache.put(key, copyInstances(instances))
+	return instances, nil
+}
+
+// cachedGroupBy runs txn.GroupBy through the collection query cache, if
+// any.
+func (c *Collection) cachedGroupBy(txn *Txn, q *Query, groupField, valueField string, op AggOp) (map[string]float64, error) {
+	if c.queryCache == nil || txn.noCache {
+		return txn.GroupBy(q, groupField, valueField, op)
+	}
+	key, ok := c.queryCache.hash(queryCacheKey{
+		Op:         "groupby",
+		Query:      q,
+		GroupField: groupField,
+		ValueField: valueField,
+		AggOp:      op,
+	})
+	if !ok {
+		return txn.GroupBy(q, groupField, valueField, op)
+	}
+	if v, ok := c.queryCache.get(key); ok {
+		return copyBuckets(v.(map[string]float64)), nil
+	}
+	buckets, err := txn.GroupBy(q, groupField, valueField, op)
+	if err != nil {
+		return nil, err
+	}
+	c.queryCache.put(key, copyBuckets(buckets))
+	return buckets, nil
+}
+
+// invalidateQueryCaches purges cached results of the collections changed
+// by events.
+func (d *DB) invalidateQueryCaches(events []core.Event) {
+	seen := make(map[string]struct{})
+	for _, e := range events {
+		name := e.Collection()
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		if c := d.getCollection(name); c != nil && c.queryCache != nil {
+			c.queryCache.invalidate()
+		}
+	}
+}
+
+func copyInstances(instances [][]byte) [][]byte {
+	res := make([][]byte, len(instances))
+	for i, instance := range instances {
+		res[i] = append([]byte(nil), instance...)
+	}
+	return res
+}
+
+func copyBuckets(buckets map[string]float64) map[string]float64 {
+	res := make(map[string]float64, len(buckets))
+	for k, v := range buckets {
+		res[k] = v
+	}
+	return res
+}
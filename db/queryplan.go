@@ -0,0 +1,263 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// resultIterator iterates over the instances matching a query.
+type resultIterator interface {
+	NextSync() (MarshaledResult, bool)
+	Close()
+}
+
+// queryBranch is the index lookup of a branch of a query, which finds the
+// instances matching every criterion of cs in the index of path. Criteria of
+// a branch on the same field are looked up together, so both bounds of a
+// range, such as Between, narrow down the instances read.
+type queryBranch struct {
+	cs   []*Criterion
+	path string
+}
+
+// newQueryIterator returns an iterator over the instances matching q.
+// Queries with disjunctions, nested queries or negations are planned: if every
+// branch of the disjunction has a criterion on an indexed field, the
+// instances of each branch are looked up in its index, and their union is
+// matched against q. Otherwise, the collection is scanned, since a branch
+// without an index may match any instance.
+// Queries are aborted with ErrQueryTimeout once they run past the query
+// timeout of the transaction.
+func (t *Txn) newQueryIterator(txn ds.Txn, q *Query) (resultIterator, error) {
+	c := t.collection
+	deadline := newQueryDeadline(t.queryTimeout)
+	if !q.isTree() {
+		if c.isBuilding(q.Index) {
+			// Entries of unfinished indexes are incomplete.
+			scan := *q
+			scan.Index = ""
+			q = &scan
+		}
+		iter := newIterator(txn, c.BaseKey(), c.indexes[q.Index], c.useNumber, q)
+		iter.deadline = deadline
+		return iter, nil
+	}
+	branches := c.planBranches(q)
+	if branches == nil {
+		scan := *q
+		scan.Index = ""
+		iter := newIterator(txn, c.BaseKey(), Index{}, c.useNumber, &scan)
+		iter.deadline = deadline
+		return iter, nil
+	}
+	res, err := c.findBranches(txn, q, branches, deadline)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceIterator{results: res}, nil
+}
+
+// planBranches returns the index lookups of the branches of q, or nil if
+// a branch can't use an index.
+func (c *Collection) planBranches(q *Query) []queryBranch {
+	var branches []queryBranch
+	for _, b := range q.branches() {
+		lookup, ok := c.branchIndex(b, q.Index)
+		if !ok {
+			return nil
+		}
+		branches = append(branches, lookup)
+	}
+	return branches
+}
+
+// branchIndex returns the criteria of the conjunction b on an indexed
+// field, preferring the preferred index path.
+func (c *Collection) branchIndex(b *Query, preferred string) (queryBranch, bool) {
+	var res queryBranch
+	found := false
+	for _, crit := range b.Ands {
+		if !c.indexAnswers(crit) {
+			continue
+		}
+		if !found || (crit.FieldPath == preferred && res.path != preferred) {
+			res = queryBranch{path: crit.FieldPath}
+			found = true
+		}
+	}
+	if !found {
+		return res, false
+	}
+	for _, crit := range b.Ands {
+		if crit.FieldPath != res.path || !c.indexAnswers(crit) {
+			continue
+		}
+		res.cs = append(res.cs, crit)
+		// Each multikey index entry holds a single element, which can't
+		// answer several Contains at once.
+		if c.isMultikey(res.path) {
+			break
+		}
+	}
+	return res, true
+}
+
+// indexAnswers returns whether the index on the field of crit, if any, can
+// answer it.
+func (c *Collection) indexAnswers(crit *Criterion) bool {
+	index, ok := c.indexes[crit.FieldPath]
+	if !ok || c.isBuilding(crit.FieldPath) || crit.matchesMissing() || compoundPaths(crit.FieldPath) != nil {
+		return false
+	}
+	// Multikey index entries hold single elements, so they only answer
+	// Contains.
+	return (index.MultiIndexFunc != nil) == (crit.Operation == Contains)
+}
+
+// findBranches returns the instances found by the index lookups of
+// branches that match q, in key order, sharing deadline.
+func (c *Collection) findBranches(txn ds.Txn, q *Query, branches []queryBranch, deadline *queryDeadline) ([]MarshaledResult, error) {
+	keys := make(map[string]struct{})
+	for _, b := range branches {
+		lookup := &Query{Ands: b.cs, Index: b.path}
+		iter := newIterator(txn, c.BaseKey(), c.indexes[b.path], c.useNumber, lookup)
+		iter.deadline = deadline
+		for {
+			res, ok := iter.NextSync()
+			if !ok {
+				if res.Error != nil && !errors.Is(res.Error, ErrNoIndexFound) {
+					iter.Close()
+					return nil, res.Error
+				}
+				break
+			}
+			keys[res.Key] = struct{}{}
+		}
+		iter.Close()
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	var results []MarshaledResult
+	for _, k := range sorted {
+		value, err := txn.Get(ds.NewKey(k))
+		if err != nil {
+			return nil, err
+		}
+		v, err := decodeInstance(value, c.useNumber)
+		if err != nil {
+			return nil, fmt.Errorf("error when unmarshaling query result: %v", err)
+		}
+		ok, err := q.match(v)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results = append(results, MarshaledResult{
+				Result:         query.Result{Entry: query.Entry{Key: k, Value: value}},
+				MarshaledValue: v,
+			})
+		}
+	}
+	return results, nil
+}
+
+// sliceIterator iterates over results found in advance.
+type sliceIterator struct {
+	results []MarshaledResult
+}
+
+func (i *sliceIterator) NextSync() (MarshaledResult, bool) {
+	if len(i.results) == 0 {
+		return MarshaledResult{}, false
+	}
+	res := i.results[0]
+	i.results = i.results[1:]
+	return res, true
+}
+
+func (i *sliceIterator) Close() {}
+
+// QueryPlan describes how Find runs a query, see Collection.Explain.
+type QueryPlan struct {
+	// Indexes are the paths of the indexes the instances matching the
+	// query are looked up in, a single one unless the query has
+	// disjunctions, or none if the collection is scanned.
+	Indexes []string
+	// FullScan is true if every instance of the collection is read and
+	// matched against the query.
+	FullScan bool
+	// Unindexed are the criteria that aren't answered by the index lookups,
+	// which are matched against the instances read. They're all of the
+	// criteria of the query if FullScan is true.
+	Unindexed []*Criterion
+}
+
+// Explain returns the plan Find would follow to run q, telling whether it
+// uses indexes or scans the collection. Queries without disjunctions,
+// nested queries or negations only use the index set with UseIndex, if
+// any, while other queries use indexes if each of their branches has a
+// criterion on an indexed field, see Or. If q uses an index missing from
+// the collection, ErrNoIndexFound is returned: Find returns no instances.
+func (c *Collection) Explain(q *Query) (QueryPlan, error) {
+	if q == nil {
+		q = &Query{}
+	}
+	if err := q.Validate(); err != nil {
+		return QueryPlan{}, fmt.Errorf("invalid query: %s", err)
+	}
+	if compoundPaths(q.Index) != nil {
+		return QueryPlan{}, fmt.Errorf("invalid query: compound index %s can't be used by queries", q.Index)
+	}
+	c.db.lock.RLock()
+	defer c.db.lock.RUnlock()
+	if c.db.closed {
+		return QueryPlan{}, ErrDBClosed
+	}
+
+	// Plans mirror newQueryIterator.
+	var plan QueryPlan
+	indexed := make(map[*Criterion]struct{})
+	switch {
+	case !q.isTree() && (q.Index == "" || c.isBuilding(q.Index)):
+		plan.FullScan = true
+	case !q.isTree():
+		if _, ok := c.indexes[q.Index]; !ok {
+			return QueryPlan{}, fmt.Errorf("query uses index %s: %w", q.Index, ErrNoIndexFound)
+		}
+		plan.Indexes = []string{q.Index}
+		for _, crit := range q.Ands {
+			if crit.FieldPath == q.Index {
+				indexed[crit] = struct{}{}
+			}
+		}
+	default:
+		branches := c.planBranches(q)
+		if branches == nil {
+			plan.FullScan = true
+			break
+		}
+		seen := make(map[string]struct{})
+		for _, b := range branches {
+			for _, crit := range b.cs {
+				indexed[crit] = struct{}{}
+			}
+			if _, ok := seen[b.path]; !ok {
+				seen[b.path] = struct{}{}
+				plan.Indexes = append(plan.Indexes, b.path)
+			}
+		}
+	}
+	for _, crit := range q.criteria() {
+		if _, ok := indexed[crit]; !ok {
+			plan.Unindexed = append(plan.Unindexed, crit)
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,41 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrQueryTimeout indicates a query ran for longer than its timeout, see
+// WithNewDBQueryTimeout and WithTxnQueryTimeout.
+var ErrQueryTimeout = errors.New("query timed out")
+
+// queryDeadline aborts a query once it runs past its deadline, counting the
+// datastore rows it scans. A nil queryDeadline doesn't abort queries.
+type queryDeadline struct {
+	timeout time.Duration
+	at      time.Time
+	scanned int
+}
+
+// newQueryDeadline returns the deadline of a query starting now, or nil if
+// timeout is 0.
+func newQueryDeadline(timeout time.Duration) *queryDeadline {
+	if timeout == 0 {
+		return nil
+	}
+	return &queryDeadline{timeout: timeout, at: time.Now().Add(timeout)}
+}
+
+// scan counts a scanned row, returning ErrQueryTimeout if the deadline
+// passed.
+func (q *queryDeadline) scan() error {
+	if q == nil {
+		return nil
+	}
+	q.scanned++
+	if time.Now().After(q.at) {
+		return fmt.Errorf("%w after %v, scanning %d rows", ErrQueryTimeout, q.timeout, q.scanned)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket that makes callers wait for a token,
+// so records exceeding the rate are delayed instead of dropped.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	waiting int64
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token and returns how long to wait until it's available.
+// Tokens may go negative, so waiters are served in reservation order.
+func (l *rateLimiter) reserve() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens--
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// cancel gives back a reserved token that won't be used.
+func (l *rateLimiter) cancel() {
+	l.Lock()
+	l.tokens++
+	l.Unlock()
+}
+
+// wait blocks until a token is available or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	delay := l.reserve()
+	if delay == 0 {
+		return nil
+	}
+	atomic.AddInt64(&l.waiting, 1)
+	defer atomic.AddInt64(&l.waiting, -1)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
+
+// QueuedRecords returns the number of records from other peers waiting
+// for the record rate limit, see WithNewDBRecordRateLimit.
+func (d *DB) QueuedRecords() int {
+	if d.recordLimiter == nil {
+		return 0
+	}
+	return int(atomic.LoadInt64(&d.recordLimiter.waiting))
+}
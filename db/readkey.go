@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	format "github.com/ipfs/go-ipld-format"
+	"github.com/textileio/go-threads/core/net"
+	"github.com/textileio/go-threads/core/thread"
+	sym "github.com/textileio/go-threads/crypto/symmetric"
+)
+
+var (
+	// ErrReadKeyNotSupported indicates the network of the DB can't replace
+	// the read key of its thread, see net.ReadKeySetter.
+	ErrReadKeyNotSupported = errors.New("network doesn't support setting read keys")
+
+	dsDBReadKeys = dsDBPrefix.ChildString("readkeys")
+)
+
+// RotateReadKey replaces the read key of the DB thread with the read key
+// of newKey, which is used to encrypt new records from now on. Previous
+// read keys are kept by the DB, so records created before the rotation,
+// or by peers that haven't rotated yet, can still be decrypted.
+// The new key isn't sent to other peers. A peer that doesn't know it
+// can't decrypt new records, and its thread connection will fail on the
+// first one, so the key must be shared out of band and rotated on every
+// peer, ideally before new records are created. It returns
+// ErrReadKeyNotSupported if the network doesn't implement
+// net.ReadKeySetter.
+func (d *DB) RotateReadKey(ctx context.Context, newKey thread.Key, opts ...ThreadInfoOption) error {
+	args := &ThreadInfoOptions{Token: d.token}
+	for _, opt := range opts {
+		opt(args)
+	}
+	if !newKey.CanRead() {
+		return fmt.Errorf("new key must include a read key")
+	}
+	setter, ok := d.connector.Net.(net.ReadKeySetter)
+	if !ok {
+		return ErrReadKeyNotSupported
+	}
+
+	// The network is called without the DB lock, so reads and writes don't
+	// wait on it.
+	id := d.connector.ThreadID()
+	info, err := d.connector.Net.GetThread(ctx, id, net.WithThreadToken(args.Token))
+	if err != nil {
+		return err
+	}
+	// Both keys are persisted before the thread key is replaced, so the
+	// previous key can't be lost if the rotation fails halfway.
+	if err := d.addReadKeys(info.Key.Read(), newKey.Read()); err != nil {
+		return err
+	}
+	return setter.SetReadKey(ctx, id, newKey.Read(), net.WithThreadToken(args.Token))
+}
+
+// addReadKeys persists keys along with the known read keys.
+func (d *DB) addReadKeys(keys ...*sym.Key) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	all := append([]*sym.Key{}, d.readKeys...)
+	for _, k := range keys {
+		if k != nil && !containsKey(all, k) {
+			all = append(all, k)
+		}
+	}
+	if len(all) == len(d.readKeys) {
+		return nil
+	}
+	if err := d.putReadKeys(all); err != nil {
+		return err
+	}
+	d.readKeys = all
+	return nil
+}
+
+// getEventBody decrypts the body of event with key, falling back to the
+// read keys known from rotations.
+func (d *DB) getEventBody(ctx context.Context, event net.Event, key *sym.Key) (format.Node, error) {
+	node, err := event.GetBody(ctx, d.connector.Net, key)
+	if err == nil {
+		return node, nil
+	}
+	d.lock.RLock()
+	keys := d.readKeys
+	d.lock.RUnlock()
+	for _, k := range keys {
+		if k.String() == key.String() {
+			continue
+		}
+		if n, err := event.GetBody(ctx, d.connector.Net, k); err == nil {
+			return n, nil
+		}
+	}
+	return nil, err
+}
+
+// getReadKeys returns the persisted read keys.
+func (d *DB) getReadKeys() ([]*sym.Key, error) {
+	keysBytes, err := d.datastore.Get(dsDBReadKeys)
+	if errors.Is(err, ds.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var raw [][]byte
+	if err := json.Unmarshal(keysBytes, &raw); err != nil {
+		return nil, err
+	}
+	keys := make([]*sym.Key, len(raw))
+	for i, b := range raw {
+		if keys[i], err = sym.FromBytes(b); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+func (d *DB) putReadKeys(keys []*sym.Key) error {
+	raw := make([][]byte, len(keys))
+	for i, k := range keys {
+		raw[i] = k.Bytes()
+	}
+	keysBytes, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	return d.datastore.Put(dsDBReadKeys, keysBytes)
+}
+
+func containsKey(keys []*sym.Key, key *sym.Key) bool {
+	for _, k := range keys {
+		if k.String() == key.String() {
+			return true
+		}
+	}
+	return false
+}
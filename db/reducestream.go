@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+
+	core "github.com/textileio/go-threads/core/db"
+)
+
+// reduceStreamBatchSize is the max number of events ReduceStream dispatches
+// at once.
+const reduceStreamBatchSize = 1000
+
+// ReduceStream is like Reduce, but reads events from the channel until it's
+// closed, dispatching them in batches of up to 1000 events, so memory stays
+// bounded whatever the number of events, e.g. when catching up on a large
+// backlog. Events are dispatched as events from other peers: they're added
+// to the event store of the dispatcher, and checked and reduced as those of
+// records from other peers are. Each batch is dispatched as soon as the
+// channel has no more events ready, in a single transaction, and its
+// changes notified to listeners before the next one is read. The DB is
+// locked while dispatching each batch, so it can be fed by another
+// goroutine while local writes and remote records run between batches.
+// Replay streams the records it replays the same way.
+// If ctx is done, or dispatching a batch fails, the error is returned and
+// the events read but not dispatched yet are dropped: batches dispatched
+// before are kept, and the caller should stop sending events.
+func (d *DB) ReduceStream(ctx context.Context, events <-chan core.Event) error {
+	batch := make([]core.Event, 0, reduceStreamBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			batch = append(batch[:0], e)
+		}
+		more := true
+		for more && len(batch) < reduceStreamBatchSize {
+			select {
+			case e, ok := <-events:
+				if !ok {
+					more = false
+				} else {
+					batch = append(batch, e)
+				}
+			default:
+				more = false
+			}
+		}
+		if err := d.dispatchRecords(ctx, []streamedRecord{{events: batch}}); err != nil {
+			return err
+		}
+	}
+}
+
+// dispatchStream is like ReduceStream, but for the events of records read
+// from the channel, which are dispatched along with their record.
+func (d *DB) dispatchStream(ctx context.Context, records <-chan streamedRecord) error {
+	batch := make([]streamedRecord, 0, reduceStreamBatchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-records:
+			if !ok {
+				return nil
+			}
+			batch = append(batch[:0], r)
+		}
+		n := len(batch[0].events)
+		more := true
+		for more && n < reduceStreamBatchSize {
+			select {
+			case r, ok := <-records:
+				if !ok {
+					more = false
+				} else {
+					batch = append(batch, r)
+					n += len(r.events)
+				}
+			default:
+				more = false
+			}
+		}
+		if err := d.dispatchRecords(ctx, batch); err != nil {
+			return err
+		}
+	}
+}
+
+var _ StreamReducer = (*DB)(nil)
@@ -0,0 +1,449 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/net"
+	"github.com/textileio/go-threads/core/thread"
+	"golang.org/x/sync/errgroup"
+)
+
+var (
+	dsDBAppliedRecords = dsDBPrefix.ChildString("applied")
+	// dsDBAppliedCursors holds, for each log, the record up to which
+	// applied markers were pruned by Compact.
+	dsDBAppliedCursors = dsDBPrefix.ChildString("appliedcursors")
+)
+
+// replayBufferSize is the max number of records Replay reads ahead of
+// dispatching them.
+const replayBufferSize = 100
+
+// Replay rebuilds collection states and indexes from the thread records,
+// e.g., after losing the datastore while keeping the thread logs. If from
+// is nil, the records of every log are replayed from the first one.
+// Otherwise, the records of the log containing from are replayed, starting
+// at from. Records are replayed in log order, and those already applied to
+// the DB are skipped, so replaying them is a no-op. Collections must be
+// registered before replaying their records.
+// Records are fetched one at a time, so only the IDs of the records of a
+// log not applied yet are kept in memory, and they're dispatched in
+// batches like the events of ReduceStream. A failure leaves the batches
+// dispatched before applied, and replaying again resumes after them.
+func (d *DB) Replay(ctx context.Context, from net.Record) error {
+	if d.IsClosed() {
+		return ErrDBClosed
+	}
+	records := make(chan streamedRecord, replayBufferSize)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		return d.dispatchStream(gctx, records)
+	})
+	g.Go(func() error {
+		defer close(records)
+		return d.replayRecords(gctx, from, records)
+	})
+	return g.Wait()
+}
+
+// replayRecords sends the records Replay replays to the channel.
+func (d *DB) replayRecords(ctx context.Context, from net.Record, records chan<- streamedRecord) error {
+	tid := d.connector.ThreadID()
+	info, err := d.connector.Net.GetThread(ctx, tid, net.WithThreadToken(d.token))
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, lg := range info.Logs {
+		cursor, err := d.getAppliedCursor(lg.ID)
+		if err != nil {
+			return err
+		}
+		// Records up to the cursor were applied, so they're only walked
+		// to look for from.
+		var pending []cid.Cid
+		pruned := false
+		for c := lg.Head; c.Defined(); {
+			if c.Equals(cursor) {
+				pruned = true
+			}
+			if !pruned {
+				pending = append(pending, c)
+			}
+			if from != nil && c.Equals(from.Cid()) {
+				found = true
+				break
+			}
+			if pruned && from == nil {
+				break
+			}
+			rec, err := d.connector.Net.GetRecord(ctx, tid, c, net.WithThreadToken(d.token))
+			if err != nil {
+				return fmt.Errorf("error getting record %s: %v", c, err)
+			}
+			c = rec.PrevID()
+		}
+		if from != nil && !found {
+			continue
+		}
+		for i := len(pending) - 1; i >= 0; i-- {
+			rec, err := d.connector.Net.GetRecord(ctx, tid, pending[i], net.WithThreadToken(d.token))
+			if err != nil {
+				return fmt.Errorf("error getting record %s: %v", pending[i], err)
+			}
+			node, events, err := d.recordEvents(ctx, lg.ID, rec, info.Key)
+			if err != nil {
+				return fmt.Errorf("error replaying record %s: %v", pending[i], err)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case records <- streamedRecord{lid: lg.ID, rec: rec.Cid(), body: node.Cid(), events: events}:
+			}
+		}
+		if found {
+			return nil
+		}
+	}
+	if from != nil {
+		return fmt.Errorf("record %s not found in thread %s", from.Cid(), tid)
+	}
+	return nil
+}
+
+// RebuildCollection rebuilds the state and indexes of a single collection,
+// e.g., after its instances got corrupted, by clearing its instances and
+// index entries and reducing again the dispatched events of the collection,
+// in time order. Other collections aren't touched.
+// Events received from other peers are reduced as when they were
+// dispatched: instance size limits, the conflict resolver and schema
+// version checks apply to them, and their origin is tracked. Events stored
+// before origins were kept are reduced as local events.
+// Events removed by Compact can't be reduced again, so the collection may
+// fail to be rebuilt after compacting, e.g., if the create event of an
+// instance with later saves was removed. The collection is cleared and
+// rebuilt in a single transaction, so it's left untouched if reducing
+// fails, and rebuilding very large collections may exceed the transaction
+// limits of the datastore.
+// Collections loaded from a snapshot can't be rebuilt, see LoadSnapshot.
+// The collection codec must implement core.StoredEventDecoder, as the
+// built-in ones do. Listeners are notified of the reduced events.
+func (d *DB) RebuildCollection(ctx context.Context, name string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+	c, ok := d.collectionNames[name]
+	if !ok {
+		return ErrCollectionNotFound
+	}
+	if err := d.checkEventsStored(name); err != nil {
+		return err
+	}
+	_, codec := d.eventCodec(name)
+	decoder, ok := codec.(core.StoredEventDecoder)
+	if !ok {
+		return fmt.Errorf("event codec of collection %s can't decode stored events", name)
+	}
+	if err := d.flushBatch(); err != nil {
+		return err
+	}
+	records, err := d.dispatcher.Events(name)
+	if err != nil {
+		return err
+	}
+
+	txn, err := d.newDispatchTxn()
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	if err := c.clearData(txn); err != nil {
+		return err
+	}
+	if c.queryCache != nil {
+		txn.onCommit(c.queryCache.invalidate)
+	}
+	// Consecutive events of the same origin are reduced together.
+	var (
+		events []core.Event
+		remote bool
+		origin thread.ID
+	)
+	reduce := func() error {
+		if len(events) == 0 {
+			return nil
+		}
+		rctx := withDispatchTxn(ctx, txn)
+		if remote {
+			rctx = withOriginThread(withRemoteEvents(rctx), origin)
+			events = d.checkSchemaVersions(events)
+		}
+		err := d.reduceContext(rctx, events)
+		events = nil
+		return err
+	}
+	for _, r := range records {
+		e, err := decoder.EventFromStore(r.Data)
+		if err != nil {
+			return fmt.Errorf("error decoding event of instance %s: %v", r.InstanceID, err)
+		}
+		rremote, rorigin, err := d.dispatcher.eventOrigin(r)
+		if err != nil {
+			return err
+		}
+		if rremote != remote || rorigin != origin {
+			if err := reduce(); err != nil {
+				return err
+			}
+			remote, origin = rremote, rorigin
+		}
+		events = append(events, e)
+	}
+	if err := reduce(); err != nil {
+		return err
+	}
+	return txn.Commit()
+}
+
+// FindAsOf queries the collection as it was right after record, a record
+// of the DB thread. The state is rebuilt in a temporary view by reducing
+// the events of the records causally preceding record, i.e. the records of
+// its log walked back from it, oldest first, and record itself. Records of
+// other logs aren't linked to record, so their events aren't part of the
+// view. Events are reduced as when they're dispatched: instances are
+// canonicalized, soft deletes and Lamport ordering apply, and events of
+// other peers are size limited. It's expensive: every call reads and
+// reduces the records of the log up to record, and rebuilds the indexes of
+// the collection in memory. Since events are read from the records rather
+// than from the event store, compacted events are included.
+func (c *Collection) FindAsOf(ctx context.Context, record net.Record, q *Query) ([][]byte, error) {
+	d := c.db
+	if d.IsClosed() {
+		return nil, ErrDBClosed
+	}
+	if err := d.authorize(c, d.token, thread.ScopeRead); err != nil {
+		return nil, err
+	}
+	info, err := d.connector.Net.GetThread(ctx, d.connector.ThreadID(), net.WithThreadToken(d.token))
+	if err != nil {
+		return nil, err
+	}
+	lid, chain, err := d.recordChain(ctx, info, record.Cid())
+	if err != nil {
+		return nil, err
+	}
+	view, err := c.viewAsOf(ctx, info, lid, chain)
+	if err != nil {
+		return nil, err
+	}
+	txn := &Txn{collection: view, token: d.token, ctx: ctx, readonly: true, queryTimeout: d.queryTimeout}
+	defer txn.Discard()
+	return txn.Find(q)
+}
+
+// recordChain returns the log of the record rec, and the IDs of its
+// records up to rec, oldest first.
+func (d *DB) recordChain(ctx context.Context, info thread.Info, rec cid.Cid) (peer.ID, []cid.Cid, error) {
+	for _, lg := range info.Logs {
+		var chain []cid.Cid
+		for c := lg.Head; c.Defined(); {
+			if len(chain) > 0 || c.Equals(rec) {
+				chain = append(chain, c)
+			}
+			r, err := d.connector.Net.GetRecord(ctx, info.ID, c, net.WithThreadToken(d.token))
+			if err != nil {
+				return "", nil, fmt.Errorf("error getting record %s: %v", c, err)
+			}
+			c = r.PrevID()
+		}
+		if len(chain) == 0 {
+			continue
+		}
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+		return lg.ID, chain, nil
+	}
+	return "", nil, fmt.Errorf("record %s not found in thread %s", rec, info.ID)
+}
+
+// viewAsOf returns a copy of the collection backed by an in-memory
+// datastore, where the events of the records of chain, records of the log
+// lid, are reduced in order.
+func (c *Collection) viewAsOf(ctx context.Context, info thread.Info, lid peer.ID, chain []cid.Cid) (*Collection, error) {
+	d := c.db
+	d.lock.RLock()
+	view := *c
+	view.indexes = make(map[string]Index, len(c.indexes))
+	for path, index := range c.indexes {
+		view.indexes[path] = index
+	}
+	d.lock.RUnlock()
+
+	view.queryCache = nil
+	view.db = &DB{
+		datastore:           newInMemoryDatastore(),
+		eventcodec:          d.eventcodec,
+		eventCodecs:         d.eventCodecs,
+		metrics:             nopMetrics{},
+		tracer:              nopTracer{},
+		feedThreads:         d.feedThreads,
+		conflictResolver:    d.conflictResolver,
+		collectionNames:     map[string]*Collection{c.name: &view},
+		stateChangedNotifee: &stateChangedNotifee{log: d.log},
+		log:                 d.log,
+	}
+	if d.clock != nil {
+		clock, err := newLamportClock(view.db.datastore)
+		if err != nil {
+			return nil, err
+		}
+		view.db.clock = clock
+	}
+	rctx := ctx
+	if own := info.GetOwnLog(); own == nil || own.ID != lid {
+		rctx = withRemoteEvents(ctx)
+	}
+	for _, rc := range chain {
+		rec, err := d.connector.Net.GetRecord(ctx, info.ID, rc, net.WithThreadToken(d.token))
+		if err != nil {
+			return nil, fmt.Errorf("error getting record %s: %v", rc, err)
+		}
+		body, events, err := d.recordEvents(ctx, lid, rec, info.Key)
+		if err != nil {
+			return nil, err
+		}
+		if err := view.db.reduceRecord(rctx, body.Cid(), events); err != nil {
+			return nil, fmt.Errorf("error reducing record %s: %v", rc, err)
+		}
+	}
+	return &view, nil
+}
+
+// reduceRecord reduces the events of the view collection from the record
+// body into the view datastore, ordering them first if it has a clock.
+func (d *DB) reduceRecord(ctx context.Context, body cid.Cid, events []core.Event) (err error) {
+	var res []core.Event
+	for _, e := range events {
+		if d.getCollection(e.Collection()) != nil {
+			res = append(res, e)
+		}
+	}
+	if d.clock != nil {
+		if res, err = d.orderEvents(d.datastore, res, body); err != nil {
+			return err
+		}
+		if err = d.putStamps(d.datastore, res, body); err != nil {
+			return err
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return d.reduceContext(ctx, res)
+}
+
+// isApplied returns whether the events of a record body were applied.
+func (d *DB) isApplied(body cid.Cid) (bool, error) {
+	return d.datastore.Has(dsDBAppliedRecords.ChildString(body.String()))
+}
+
+// pruneApplied replaces the applied markers of the records of each log up
+// to its applied head with the applied cursor of the log, which Replay
+// skips records up to. Own records are applied before being added to the
+// own log, so its head is used instead. The cursor is moved before
+// markers are deleted, so interrupted prunes don't make records look
+// unapplied.
+func (d *DB) pruneApplied(ctx context.Context) error {
+	tid := d.connector.ThreadID()
+	info, err := d.connector.Net.GetThread(ctx, tid, net.WithThreadToken(d.token))
+	if err != nil {
+		return err
+	}
+	own := info.GetOwnLog()
+	for _, lg := range info.Logs {
+		head := lg.Head
+		if own == nil || lg.ID != own.ID {
+			if head, err = d.getAppliedHead(lg.ID); err != nil {
+				return err
+			}
+		}
+		cursor, err := d.getAppliedCursor(lg.ID)
+		if err != nil {
+			return err
+		}
+		var markers []ds.Key
+		for c := head; c.Defined() && !c.Equals(cursor); {
+			rec, err := d.connector.Net.GetRecord(ctx, tid, c, net.WithThreadToken(d.token))
+			if err != nil {
+				return fmt.Errorf("error getting record %s: %v", c, err)
+			}
+			body, err := d.recordBody(ctx, lg.ID, rec, info.Key)
+			if err != nil {
+				return err
+			}
+			markers = append(markers, dsDBAppliedRecords.ChildString(body.Cid().String()))
+			c = rec.PrevID()
+		}
+		if len(markers) == 0 {
+			continue
+		}
+		if err := d.datastore.Put(dsDBAppliedCursors.ChildString(lg.ID.String()), head.Bytes()); err != nil {
+			return err
+		}
+		for len(markers) > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			n := compactBatchSize
+			if n > len(markers) {
+				n = len(markers)
+			}
+			if err := deleteKeys(d.datastore, markers[:n]); err != nil {
+				return err
+			}
+			markers = markers[n:]
+		}
+	}
+	return nil
+}
+
+// getAppliedCursor returns the record of the log up to which applied
+// markers were pruned, or cid.Undef if none were.
+func (d *DB) getAppliedCursor(lid peer.ID) (cid.Cid, error) {
+	b, err := d.datastore.Get(dsDBAppliedCursors.ChildString(lid.String()))
+	if errors.Is(err, ds.ErrNotFound) {
+		return cid.Undef, nil
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.Cast(b)
+}
+
+func deleteKeys(store ds.TxnDatastore, keys []ds.Key) error {
+	txn, err := store.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	for _, k := range keys {
+		if err := txn.Delete(k); err != nil {
+			return err
+		}
+	}
+	return txn.Commit()
+}
+
+// markApplied marks the events of a record body as applied in txn.
+func markApplied(txn ds.Write, body cid.Cid) error {
+	return txn.Put(dsDBAppliedRecords.ChildString(body.String()), []byte{})
+}
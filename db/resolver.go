@@ -0,0 +1,39 @@
+package db
+
+import (
+	core "github.com/textileio/go-threads/core/db"
+)
+
+// CollectionResolver returns the config of a collection that is referenced
+// by events from other peers but isn't registered, so it can be created
+// before the events are applied, e.g. from a schema fetched out of band.
+// It runs while the DB lock is held, so it must not use the DB.
+type CollectionResolver func(name string) (CollectionConfig, error)
+
+// resolveCollections creates the unknown collections referenced by events
+// with the collection resolver, if any. Collections that can't be resolved
+// are left unknown, so their events fail to be reduced as usual.
+// The DB lock must be held by the caller.
+func (d *DB) resolveCollections(events []core.Event) {
+	if d.collectionResolver == nil {
+		return
+	}
+	for _, e := range events {
+		name := e.Collection()
+		if d.getCollection(name) != nil {
+			continue
+		}
+		config, err := d.collectionResolver(name)
+		if err != nil {
+			d.log.Errorf("error resolving collection %s: %v", name, err)
+			continue
+		}
+		if config.Name != name {
+			d.log.Errorf("resolved collection %s has name %s", name, config.Name)
+			continue
+		}
+		if _, err := d.addCollection(config); err != nil {
+			d.log.Errorf("error creating resolved collection %s: %v", name, err)
+		}
+	}
+}
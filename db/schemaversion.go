@@ -0,0 +1,136 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+)
+
+var (
+	dsDBSchemaVersions = dsDBPrefix.ChildString("schemaversions")
+)
+
+// SchemaCompatibility tells which schema versions of events from other
+// peers are compatible with the local schema of a collection.
+type SchemaCompatibility int
+
+const (
+	// SchemaCompatAny accepts events of any schema version.
+	SchemaCompatAny SchemaCompatibility = iota
+	// SchemaCompatBackward accepts events of the local schema version or
+	// older ones, since the local schema is expected to still accept
+	// their instances, but not events of newer versions.
+	SchemaCompatBackward
+	// SchemaCompatExact only accepts events of the local schema version.
+	SchemaCompatExact
+)
+
+// IncompatibleEventPolicy tells what the DB does with events from other
+// peers whose schema version is incompatible with the local one.
+type IncompatibleEventPolicy int
+
+const (
+	// LogIncompatibleEvents logs incompatible events, which are applied
+	// anyway.
+	LogIncompatibleEvents IncompatibleEventPolicy = iota
+	// RejectIncompatibleEvents logs and skips incompatible events.
+	RejectIncompatibleEvents
+)
+
+// schemaVersionConfig is the persisted schema version of a collection.
+type schemaVersionConfig struct {
+	Version       int
+	Compatibility SchemaCompatibility
+}
+
+// validateSchemaVersion checks the schema version settings of config.
+func validateSchemaVersion(config CollectionConfig) error {
+	if config.SchemaVersion < 0 {
+		return fmt.Errorf("schema version can't be negative")
+	}
+	if config.SchemaCompatibility < SchemaCompatAny || config.SchemaCompatibility > SchemaCompatExact {
+		return fmt.Errorf("unknown schema compatibility %d", config.SchemaCompatibility)
+	}
+	return nil
+}
+
+// SchemaVersion returns the schema version of a collection, or 0 if it's
+// unversioned.
+func (d *DB) SchemaVersion(collection string) (int, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	c := d.getCollection(collection)
+	if c == nil {
+		return 0, ErrCollectionNotFound
+	}
+	return c.schemaVersion, nil
+}
+
+// compatibleVersion returns whether events of version are compatible with
+// the local schema of c.
+func (c *Collection) compatibleVersion(version int) bool {
+	switch c.schemaCompatibility {
+	case SchemaCompatBackward:
+		return version <= c.schemaVersion
+	case SchemaCompatExact:
+		return version == c.schemaVersion
+	default:
+		return true
+	}
+}
+
+// checkSchemaVersions logs events from other peers with incompatible
+// schema versions, and drops them if the DB rejects them.
+// The DB lock must be held by the caller.
+func (d *DB) checkSchemaVersions(events []core.Event) []core.Event {
+	res := events[:0:0]
+	for _, e := range events {
+		c := d.getCollection(e.Collection())
+		if c == nil {
+			res = append(res, e)
+			continue
+		}
+		var version int
+		if ve, ok := e.(core.VersionedEvent); ok {
+			version = ve.SchemaVersion()
+		}
+		if c.compatibleVersion(version) {
+			res = append(res, e)
+			continue
+		}
+		if d.incompatibleEvents == RejectIncompatibleEvents {
+			d.log.Warnf("skipping event of instance %s in collection %s: schema version %d is incompatible with %d",
+				e.InstanceID(), c.name, version, c.schemaVersion)
+			continue
+		}
+		d.log.Warnf("applying event of instance %s in collection %s with incompatible schema version %d, local is %d",
+			e.InstanceID(), c.name, version, c.schemaVersion)
+		res = append(res, e)
+	}
+	return res
+}
+
+// getSchemaVersion returns the persisted schema version of collection.
+func (d *DB) getSchemaVersion(collection string) (schemaVersionConfig, error) {
+	var config schemaVersionConfig
+	v, err := d.datastore.Get(dsDBSchemaVersions.ChildString(collection))
+	if errors.Is(err, ds.ErrNotFound) {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(v, &config)
+	return config, err
+}
+
+func (d *DB) putSchemaVersion(collection string, config schemaVersionConfig) error {
+	v, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return d.datastore.Put(dsDBSchemaVersions.ChildString(collection), v)
+}
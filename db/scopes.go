@@ -0,0 +1,50 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+// NewScopedToken issues a token for key, only granting scopes over the
+// collections of the DB, see thread.NewScopedToken. It's signed by the
+// host of the DB network, like the tokens of its GetToken.
+func (d *DB) NewScopedToken(key thread.PubKey, scopes thread.Scopes) (thread.Token, error) {
+	return thread.NewScopedToken(d.hostKey(), key, scopes)
+}
+
+// hostKey returns the private key of the DB network host, which signs
+// its tokens.
+func (d *DB) hostKey() crypto.PrivKey {
+	h := d.connector.Net.Host()
+	return h.Peerstore().PrivKey(h.ID())
+}
+
+// authorize returns ErrUnauthorized if token is limited to scopes that
+// don't grant scope over the collection c. Tokens that aren't limited to
+// scopes, including the empty token, are left to the network to check.
+func (d *DB) authorize(c *Collection, token thread.Token, scope thread.Scope) error {
+	if !token.Defined() {
+		return nil
+	}
+	scopes, err := token.Scopes(d.hostKey())
+	if err != nil {
+		return err
+	}
+	if scopes != nil && !scopes.Allows(c.name, scope) {
+		return fmt.Errorf("%w to %s collection %s", ErrUnauthorized, scopeName(scope), c.name)
+	}
+	return nil
+}
+
+func scopeName(scope thread.Scope) string {
+	switch scope {
+	case thread.ScopeRead:
+		return "read"
+	case thread.ScopeWrite:
+		return "write"
+	default:
+		return "read and write"
+	}
+}
@@ -0,0 +1,334 @@
+package db
+
+import (
+	"fmt"
+	"hash/fnv"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+)
+
+// ShardFactory returns the datastore of the given shard, from 0 to the
+// shard count.
+type ShardFactory func(shard int) (ds.TxnDatastore, error)
+
+// shardedDatastore stores instances across shards, picked by a hash of
+// their ID. Everything else, including indexes, schemas and events, is
+// stored in the wrapped primary datastore.
+// Transactions span all the shards they touch, but they're committed one
+// shard at a time, so a failed commit may leave some shards committed.
+type shardedDatastore struct {
+	ds.TxnDatastore
+	shards []ds.TxnDatastore
+}
+
+var _ ds.TxnDatastore = (*shardedDatastore)(nil)
+
+func newShardedDatastore(primary ds.TxnDatastore, count int, factory ShardFactory) (*shardedDatastore, error) {
+	s := &shardedDatastore{TxnDatastore: primary}
+	for i := 0; i < count; i++ {
+		shard, err := factory(i)
+		if err != nil {
+			_ = s.closeShards()
+			return nil, fmt.Errorf("error creating shard %d: %v", i, err)
+		}
+		s.shards = append(s.shards, shard)
+	}
+	return s, nil
+}
+
+// shardIndex returns the shard storing key, or -1 if it isn't an
+// instance key and lives in the primary datastore.
+func (s *shardedDatastore) shardIndex(key ds.Key) int {
+	if !key.IsDescendantOf(baseKey) || len(key.Namespaces()) != len(baseKey.Namespaces())+2 {
+		return -1
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key.BaseNamespace()))
+	return int(h.Sum32() % uint32(len(s.shards)))
+}
+
+func (s *shardedDatastore) store(key ds.Key) ds.TxnDatastore {
+	if i := s.shardIndex(key); i >= 0 {
+		return s.shards[i]
+	}
+	return s.TxnDatastore
+}
+
+func (s *shardedDatastore) Get(key ds.Key) ([]byte, error) {
+	return s.store(key).Get(key)
+}
+
+func (s *shardedDatastore) Has(key ds.Key) (bool, error) {
+	return s.store(key).Has(key)
+}
+
+func (s *shardedDatastore) GetSize(key ds.Key) (int, error) {
+	return s.store(key).GetSize(key)
+}
+
+func (s *shardedDatastore) Put(key ds.Key, value []byte) error {
+	return s.store(key).Put(key, value)
+}
+
+func (s *shardedDatastore) Delete(key ds.Key) error {
+	return s.store(key).Delete(key)
+}
+
+func (s *shardedDatastore) Query(q dsq.Query) (dsq.Results, error) {
+	if !spansShards(q.Prefix) {
+		return s.TxnDatastore.Query(q)
+	}
+	reads := make([]ds.Read, 0, len(s.shards)+1)
+	reads = append(reads, s.TxnDatastore)
+	for _, shard := range s.shards {
+		reads = append(reads, shard)
+	}
+	return mergeQuery(reads, q)
+}
+
+func (s *shardedDatastore) Sync(prefix ds.Key) error {
+	if err := s.TxnDatastore.Sync(prefix); err != nil {
+		return err
+	}
+	for _, shard := range s.shards {
+		if err := shard.Sync(prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedDatastore) Close() error {
+	err := s.closeShards()
+	if cerr := s.TxnDatastore.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (s *shardedDatastore) closeShards() error {
+	var err error
+	for _, shard := range s.shards {
+		if cerr := shard.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (s *shardedDatastore) NewTransaction(readOnly bool) (ds.Txn, error) {
+	primary, err := s.TxnDatastore.NewTransaction(readOnly)
+	if err != nil {
+		return nil, err
+	}
+	return &shardedTxn{
+		Txn:      primary,
+		store:    s,
+		readOnly: readOnly,
+		shards:   make([]ds.Txn, len(s.shards)),
+	}, nil
+}
+
+// shardedTxn opens shard transactions as they're used.
+type shardedTxn struct {
+	ds.Txn
+	store    *shardedDatastore
+	readOnly bool
+	shards   []ds.Txn
+}
+
+func (t *shardedTxn) shard(i int) (ds.Txn, error) {
+	if t.shards[i] == nil {
+		txn, err := t.store.shards[i].NewTransaction(t.readOnly)
+		if err != nil {
+			return nil, err
+		}
+		t.shards[i] = txn
+	}
+	return t.shards[i], nil
+}
+
+func (t *shardedTxn) txn(key ds.Key) (ds.Txn, error) {
+	if i := t.store.shardIndex(key); i >= 0 {
+		return t.shard(i)
+	}
+	return t.Txn, nil
+}
+
+func (t *shardedTxn) Get(key ds.Key) ([]byte, error) {
+	txn, err := t.txn(key)
+	if err != nil {
+		return nil, err
+	}
+	return txn.Get(key)
+}
+
+func (t *shardedTxn) Has(key ds.Key) (bool, error) {
+	txn, err := t.txn(key)
+	if err != nil {
+		return false, err
+	}
+	return txn.Has(key)
+}
+
+func (t *shardedTxn) GetSize(key ds.Key) (int, error) {
+	txn, err := t.txn(key)
+	if err != nil {
+		return -1, err
+	}
+	return txn.GetSize(key)
+}
+
+func (t *shardedTxn) Put(key ds.Key, value []byte) error {
+	txn, err := t.txn(key)
+	if err != nil {
+		return err
+	}
+	return txn.Put(key, value)
+}
+
+func (t *shardedTxn) Delete(key ds.Key) error {
+	txn, err := t.txn(key)
+	if err != nil {
+		return err
+	}
+	return txn.Delete(key)
+}
+
+func (t *shardedTxn) Query(q dsq.Query) (dsq.Results, error) {
+	if !spansShards(q.Prefix) {
+		return t.Txn.Query(q)
+	}
+	reads := make([]ds.Read, 0, len(t.shards)+1)
+	reads = append(reads, t.Txn)
+	for i := range t.shards {
+		txn, err := t.shard(i)
+		if err != nil {
+			return nil, err
+		}
+		reads = append(reads, txn)
+	}
+	return mergeQuery(reads, q)
+}
+
+// Commit commits the shard transactions and then the primary one, which
+// holds the indexes of the instances. If a commit fails, the remaining
+// transactions are discarded, and the indexes of instances committed to
+// other shards can be fixed with Collection.RebuildIndexes.
+func (t *shardedTxn) Commit() error {
+	for i, txn := range t.shards {
+		if txn == nil {
+			continue
+		}
+		if err := txn.Commit(); err != nil {
+			t.discardFrom(i + 1)
+			t.Txn.Discard()
+			return fmt.Errorf("error committing shard %d: %v", i, err)
+		}
+	}
+	return t.Txn.Commit()
+}
+
+func (t *shardedTxn) Discard() {
+	t.discardFrom(0)
+	t.Txn.Discard()
+}
+
+func (t *shardedTxn) discardFrom(i int) {
+	for ; i < len(t.shards); i++ {
+		if t.shards[i] != nil {
+			t.shards[i].Discard()
+		}
+	}
+}
+
+// spansShards returns whether a query with prefix may return instance keys.
+func spansShards(prefix string) bool {
+	p := ds.NewKey(prefix)
+	if baseKey.Equal(p) || baseKey.IsDescendantOf(p) {
+		return true
+	}
+	return p.IsDescendantOf(baseKey) && len(p.Namespaces()) <= len(baseKey.Namespaces())+2
+}
+
+// mergeQuery runs q against reads, merging their results in key order.
+// Orders other than by key, offsets and limits are applied after merging.
+func mergeQuery(reads []ds.Read, q dsq.Query) (dsq.Results, error) {
+	child := dsq.Query{
+		Prefix:            q.Prefix,
+		Filters:           q.Filters,
+		KeysOnly:          q.KeysOnly,
+		ReturnExpirations: q.ReturnExpirations,
+		ReturnsSizes:      q.ReturnsSizes,
+		Orders:            []dsq.Order{dsq.OrderByKey{}},
+	}
+	results := make([]dsq.Results, 0, len(reads))
+	closeAll := func() error {
+		var err error
+		for _, r := range results {
+			if cerr := r.Close(); cerr != nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	for _, r := range reads {
+		res, err := r.Query(child)
+		if err != nil {
+			_ = closeAll()
+			return nil, err
+		}
+		results = append(results, res)
+	}
+
+	heads := make([]*dsq.Result, len(results))
+	next := func(i int) {
+		if res, ok := results[i].NextSync(); ok {
+			heads[i] = &res
+		} else {
+			heads[i] = nil
+		}
+	}
+	for i := range results {
+		next(i)
+	}
+	merged := dsq.ResultsFromIterator(q, dsq.Iterator{
+		Next: func() (dsq.Result, bool) {
+			min := -1
+			for i, h := range heads {
+				if h == nil {
+					continue
+				}
+				if h.Error != nil {
+					res := *h
+					heads[i] = nil
+					return res, true
+				}
+				if min < 0 || h.Key < heads[min].Key {
+					min = i
+				}
+			}
+			if min < 0 {
+				return dsq.Result{}, false
+			}
+			res := *heads[min]
+			next(min)
+			return res, true
+		},
+		Close: closeAll,
+	})
+	naive := dsq.Query{Limit: q.Limit, Offset: q.Offset}
+	if len(q.Orders) > 0 && !isKeyOrder(q.Orders) {
+		naive.Orders = q.Orders
+	}
+	return dsq.NaiveQueryApply(naive, merged), nil
+}
+
+func isKeyOrder(orders []dsq.Order) bool {
+	if len(orders) != 1 {
+		return false
+	}
+	_, ok := orders[0].(dsq.OrderByKey)
+	return ok
+}
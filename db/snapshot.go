@@ -0,0 +1,480 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/net"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+const (
+	// snapshotVersion is the version of written snapshots. Snapshots of
+	// version 1 have no head frames.
+	snapshotVersion = 2
+
+	// maxSnapshotFieldBytes bounds the fields of snapshot frames, so
+	// corrupted lengths don't exhaust memory.
+	maxSnapshotFieldBytes = 1 << 26
+)
+
+var (
+	// ErrInvalidSnapshot indicates a snapshot is malformed, wasn't signed
+	// by an accepted signer, or doesn't match its signature.
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+	// ErrLoadedFromSnapshot indicates an operation needs the stored events
+	// of a collection loaded from a snapshot, which doesn't include them.
+	ErrLoadedFromSnapshot = errors.New("collection was loaded from a snapshot")
+
+	// dsDBSnapshotCollections marks collections loaded from a snapshot.
+	dsDBSnapshotCollections = dsDBPrefix.ChildString("snapshotcollections")
+)
+
+// Snapshot frames are a kind byte followed by three fields, the collection,
+// the name and the value, each prefixed by its uvarint length.
+const (
+	frameHeader byte = iota + 1
+	frameApplied
+	frameInstance
+	frameOrigin
+	frameStamp
+	frameSignature
+	frameHead
+)
+
+type snapshotHeader struct {
+	Version int
+	Thread  string
+	// Signer is the public key of the host signing the snapshot.
+	Signer      []byte
+	Collections []string
+	// Clock is the Lamport clock of the DB, or 0 if it doesn't order
+	// events by Lamport clock.
+	Clock uint64
+}
+
+type snapshotFrame struct {
+	kind       byte
+	collection string
+	name       string
+	value      []byte
+}
+
+// Snapshot writes the current state of every collection to w: the stored
+// instances, along with their origins and Lamport stamps if any, the
+// record bodies their events were reduced from, and the applied heads of
+// logs. It's signed by the host of the DB network, and carries a digest of
+// its content, so LoadSnapshot can check it's intact and comes from an
+// accepted signer.
+// The DB is read locked while writing, so the snapshot is consistent with
+// the records it lists, but remote events and local writes wait until it's
+// written: w should be fast, e.g. buffered, rather than a slow connection.
+// Listeners, schemas and the stored events of collections aren't part of
+// the snapshot, see LoadSnapshot.
+func (d *DB) Snapshot(ctx context.Context, w io.Writer) error {
+	// Records of the own log are applied before being added to it, so its
+	// head is applied.
+	info, err := d.connector.Net.GetThread(ctx, d.connector.ThreadID(), net.WithThreadToken(d.token))
+	if err != nil {
+		return err
+	}
+	var own *thread.LogInfo
+	if lg := info.GetOwnLog(); lg != nil && lg.Head.Defined() {
+		own = lg
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+	if err := d.flushBatch(); err != nil {
+		return err
+	}
+
+	sk := d.hostKey()
+	signer, err := crypto.MarshalPublicKey(sk.GetPublic())
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(d.collectionNames))
+	for name := range d.collectionNames {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	header := snapshotHeader{
+		Version:     snapshotVersion,
+		Thread:      d.connector.ThreadID().String(),
+		Signer:      signer,
+		Collections: names,
+	}
+	if d.clock != nil {
+		header.Clock = d.clock.time
+	}
+	hv, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	sw := &snapshotWriter{w: bw, digest: sha256.New()}
+	if err := sw.write(snapshotFrame{kind: frameHeader, value: hv}); err != nil {
+		return err
+	}
+	err = d.forEachChild(dsDBAppliedRecords, func(name string, _ []byte) error {
+		return sw.write(snapshotFrame{kind: frameApplied, name: name})
+	})
+	if err != nil {
+		return err
+	}
+	err = d.forEachChild(dsDBHeads, func(name string, value []byte) error {
+		return sw.write(snapshotFrame{kind: frameHead, name: name, value: value})
+	})
+	if err != nil {
+		return err
+	}
+	if own != nil {
+		if err := sw.write(snapshotFrame{kind: frameHead, name: own.ID.String(), value: own.Head.Bytes()}); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		prefixes := map[byte]ds.Key{
+			frameInstance: d.collectionNames[name].BaseKey(),
+			frameOrigin:   dsDBOrigins.ChildString(name),
+			frameStamp:    dsDBStamps.ChildString(name),
+		}
+		for _, kind := range []byte{frameInstance, frameOrigin, frameStamp} {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := d.forEachChild(prefixes[kind], func(id string, value []byte) error {
+				return sw.write(snapshotFrame{kind: kind, collection: name, name: id, value: value})
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	sig, err := sk.Sign(sw.digest.Sum(nil))
+	if err != nil {
+		return err
+	}
+	sw.digest = nil
+	if err := sw.write(snapshotFrame{kind: frameSignature, value: sig}); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// forEachChild calls f with the name and value of every direct child of
+// prefix in the datastore.
+func (d *DB) forEachChild(prefix ds.Key, f func(name string, value []byte) error) error {
+	res, err := d.datastore.Query(query.Query{Prefix: prefix.String()})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+	for r := range res.Next() {
+		if r.Error != nil {
+			return r.Error
+		}
+		key := ds.NewKey(r.Key)
+		if !key.Parent().Equal(prefix) {
+			continue // Collection names sharing a prefix, e.g. "dog" and "dogs"
+		}
+		if err := f(key.BaseNamespace(), r.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadSnapshot verifies a snapshot written by Snapshot from the DB host,
+// the peer the DB was created from by NewDBFromAddr, or a signer set with
+// WithNewDBSnapshotSigners, and replaces the state of its collections with
+// it. Records listed by the snapshot are marked as applied, and the heads
+// of logs tracked, so when they're received from the thread their events
+// are skipped, and only the records missing from the snapshot are reduced:
+// the DB switches to incremental sync.
+// The snapshot is read and verified before anything is written. Then the
+// DB is locked while the snapshot is ingested, so remote events arriving
+// meanwhile are applied after it, or skipped if it includes them.
+// The collections of the snapshot must be registered, and the snapshot
+// must include every record the DB applied, e.g. by loading it right after
+// joining the thread, or it's rejected rather than losing their events.
+// Collections of the DB missing from the snapshot aren't touched. Index
+// entries are rebuilt from the instances, and listeners aren't notified.
+// The stored events of the collections aren't loaded, so RebuildCollection
+// fails with ErrLoadedFromSnapshot for them, and Compact only compacts the
+// events dispatched after loading.
+func (d *DB) LoadSnapshot(ctx context.Context, r io.Reader) error {
+	if d.IsClosed() {
+		return ErrDBClosed
+	}
+	header, frames, err := readSnapshot(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	if header.Thread != d.connector.ThreadID().String() {
+		return fmt.Errorf("%w: snapshot of thread %s", ErrInvalidSnapshot, header.Thread)
+	}
+	if err := d.checkSnapshotSigner(header.Signer); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return ErrDBClosed
+	}
+	if err := d.flushBatch(); err != nil {
+		return err
+	}
+	collections := make(map[string]*Collection, len(header.Collections))
+	for _, name := range header.Collections {
+		c, ok := d.collectionNames[name]
+		if !ok {
+			return fmt.Errorf("collection %s of snapshot: %w", name, ErrCollectionNotFound)
+		}
+		collections[name] = c
+	}
+	applied := make(map[string]struct{})
+	for _, f := range frames {
+		if f.kind == frameApplied {
+			applied[f.name] = struct{}{}
+		}
+	}
+	err = d.forEachChild(dsDBAppliedRecords, func(name string, _ []byte) error {
+		if _, ok := applied[name]; !ok {
+			return fmt.Errorf("snapshot is missing record %s applied by the DB", name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	txn, err := d.datastore.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer txn.Discard()
+	for name, c := range collections {
+		if err := c.clearData(txn); err != nil {
+			return err
+		}
+		if err := txn.Put(dsDBSnapshotCollections.ChildString(name), []byte{}); err != nil {
+			return err
+		}
+	}
+	for _, f := range frames {
+		if f.name == "" || strings.Contains(f.name, "/") {
+			return fmt.Errorf("%w: bad key name %q", ErrInvalidSnapshot, f.name)
+		}
+		var c *Collection
+		if f.kind != frameApplied && f.kind != frameHead {
+			if c = collections[f.collection]; c == nil {
+				return fmt.Errorf("%w: collection %s isn't in the header", ErrInvalidSnapshot, f.collection)
+			}
+		}
+		var err error
+		switch f.kind {
+		case frameApplied:
+			err = txn.Put(dsDBAppliedRecords.ChildString(f.name), []byte{})
+		case frameHead:
+			err = txn.Put(dsDBHeads.ChildString(f.name), f.value)
+		case frameInstance:
+			key := c.BaseKey().ChildString(f.name)
+			if err = txn.Put(key, f.value); err == nil {
+				err = indexAdd(c, txn, key, f.value)
+			}
+		case frameOrigin:
+			err = txn.Put(originKey(f.collection, core.InstanceID(f.name)), f.value)
+		case frameStamp:
+			err = txn.Put(stampKey(f.collection, core.InstanceID(f.name)), f.value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.clock != nil {
+		d.clock.witness(header.Clock)
+		if err := d.clock.save(txn); err != nil {
+			return err
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return err
+	}
+	for _, c := range collections {
+		if c.queryCache != nil {
+			c.queryCache.invalidate()
+		}
+	}
+	return nil
+}
+
+// checkSnapshotSigner returns ErrInvalidSnapshot if signer isn't the key
+// of the DB host or of an accepted signer, see WithNewDBSnapshotSigners.
+// Being a peer of the thread isn't enough, since any peer could then
+// replace the state of the DB.
+func (d *DB) checkSnapshotSigner(signer []byte) error {
+	pk, err := crypto.UnmarshalPublicKey(signer)
+	if err != nil {
+		return fmt.Errorf("%w: bad signer key: %v", ErrInvalidSnapshot, err)
+	}
+	pid, err := peer.IDFromPublicKey(pk)
+	if err != nil {
+		return fmt.Errorf("%w: bad signer key: %v", ErrInvalidSnapshot, err)
+	}
+	if pid == d.connector.Net.Host().ID() {
+		return nil
+	}
+	if _, ok := d.snapshotSigners[pid]; ok {
+		return nil
+	}
+	return fmt.Errorf("%w: signer %s isn't accepted", ErrInvalidSnapshot, pid)
+}
+
+// appendAddrPeer appends the peer of addr, if it has one, to signers.
+func appendAddrPeer(signers []peer.ID, addr ma.Multiaddr) []peer.ID {
+	v, err := addr.ValueForProtocol(ma.P_P2P)
+	if err != nil {
+		return signers
+	}
+	pid, err := peer.Decode(v)
+	if err != nil {
+		return signers
+	}
+	return append(signers, pid)
+}
+
+// checkEventsStored returns ErrLoadedFromSnapshot if collection was loaded
+// from a snapshot, so its events before loading aren't stored.
+func (d *DB) checkEventsStored(collection string) error {
+	loaded, err := d.datastore.Has(dsDBSnapshotCollections.ChildString(collection))
+	if err != nil {
+		return err
+	}
+	if loaded {
+		return fmt.Errorf("%w: %s doesn't have its events", ErrLoadedFromSnapshot, collection)
+	}
+	return nil
+}
+
+// snapshotWriter writes snapshot frames, adding them to digest if set.
+type snapshotWriter struct {
+	w      io.Writer
+	digest hash.Hash
+}
+
+func (s *snapshotWriter) write(f snapshotFrame) error {
+	buf := make([]byte, 0, 1+3*binary.MaxVarintLen64+len(f.collection)+len(f.name)+len(f.value))
+	buf = append(buf, f.kind)
+	for _, field := range [][]byte{[]byte(f.collection), []byte(f.name), f.value} {
+		var l [binary.MaxVarintLen64]byte
+		buf = append(buf, l[:binary.PutUvarint(l[:], uint64(len(field)))]...)
+		buf = append(buf, field...)
+	}
+	if s.digest != nil {
+		s.digest.Write(buf)
+	}
+	_, err := s.w.Write(buf)
+	return err
+}
+
+// readSnapshot reads the frames of a snapshot, checking they match the
+// signature of the header signer. The header and signature frames aren't
+// returned.
+func readSnapshot(r *bufio.Reader) (snapshotHeader, []snapshotFrame, error) {
+	var header snapshotHeader
+	var frames []snapshotFrame
+	digest := sha256.New()
+	for i := 0; ; i++ {
+		f, raw, err := readFrame(r)
+		if err != nil {
+			return header, nil, err
+		}
+		switch {
+		case i == 0 && f.kind != frameHeader, i > 0 && f.kind == frameHeader:
+			return header, nil, fmt.Errorf("%w: misplaced header", ErrInvalidSnapshot)
+		case f.kind == frameHeader:
+			if err := json.Unmarshal(f.value, &header); err != nil {
+				return header, nil, fmt.Errorf("%w: bad header: %v", ErrInvalidSnapshot, err)
+			}
+			if header.Version != 1 && header.Version != snapshotVersion {
+				return header, nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, header.Version)
+			}
+		case f.kind == frameSignature:
+			pk, err := crypto.UnmarshalPublicKey(header.Signer)
+			if err != nil {
+				return header, nil, fmt.Errorf("%w: bad signer key: %v", ErrInvalidSnapshot, err)
+			}
+			if ok, err := pk.Verify(digest.Sum(nil), f.value); err != nil || !ok {
+				return header, nil, fmt.Errorf("%w: signature doesn't match", ErrInvalidSnapshot)
+			}
+			if _, err := r.Peek(1); err != io.EOF {
+				return header, nil, fmt.Errorf("%w: data after signature", ErrInvalidSnapshot)
+			}
+			return header, frames, nil
+		case f.kind < frameApplied || f.kind > frameHead:
+			return header, nil, fmt.Errorf("%w: unknown frame kind %d", ErrInvalidSnapshot, f.kind)
+		default:
+			frames = append(frames, f)
+		}
+		// The signature frame isn't part of the digest.
+		digest.Write(raw)
+	}
+}
+
+// readFrame reads a snapshot frame, returning it along with its bytes.
+func readFrame(r *bufio.Reader) (snapshotFrame, []byte, error) {
+	var f snapshotFrame
+	kind, err := r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return f, nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	f.kind = kind
+	raw := []byte{kind}
+	var fields [3][]byte
+	for i := range fields {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return f, nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		if l > maxSnapshotFieldBytes {
+			return f, nil, fmt.Errorf("%w: field of %d bytes", ErrInvalidSnapshot, l)
+		}
+		fields[i] = make([]byte, l)
+		if _, err := io.ReadFull(r, fields[i]); err != nil {
+			return f, nil, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		var lb [binary.MaxVarintLen64]byte
+		raw = append(raw, lb[:binary.PutUvarint(lb[:], l)]...)
+		raw = append(raw, fields[i]...)
+	}
+	f.collection, f.name, f.value = string(fields[0]), string(fields[1]), fields[2]
+	return f, raw, nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// deletedFieldName holds the deletion time of tombstoned instances
+	// of collections with soft deletes.
+	deletedFieldName = "_deleted"
+)
+
+var (
+	dsDBSoftDeletes = dsDBPrefix.ChildString("softdelete")
+)
+
+// isTombstone returns whether instance was soft deleted.
+func isTombstone(instance []byte) bool {
+	return instance != nil && gjson.GetBytes(instance, deletedFieldName).Exists()
+}
+
+// isTombstone returns whether instance was soft deleted, which only
+// instances of collections with soft deletes can be.
+func (c *Collection) isTombstone(instance []byte) bool {
+	return c.softDelete && isTombstone(instance)
+}
+
+// tombstone returns instance marked as deleted at t.
+func tombstone(instance []byte, t time.Time) ([]byte, error) {
+	return sjson.SetBytes(instance, deletedFieldName, t.UTC().Format(time.RFC3339Nano))
+}
+
+// deletedAt returns the deletion time of a tombstoned instance.
+func deletedAt(instance []byte) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, gjson.GetBytes(instance, deletedFieldName).String())
+}
+
+// softDelete adds an action tombstoning the instance with key.
+func (t *Txn) softDelete(id core.InstanceID, key ds.Key) error {
+	current, err := t.get(key)
+	if err == ds.ErrNotFound {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if t.collection.isTombstone(current) {
+		return ErrNotFound
+	}
+	now := time.Now()
+	deleted, err := tombstone(current, now)
+	if err != nil {
+		return err
+	}
+	if t.collection.timestamps {
+		if deleted, err = stampInstance(deleted, current, now); err != nil {
+			return err
+		}
+	}
+	if deleted, err = CanonicalJSON(deleted); err != nil {
+		return err
+	}
+	t.actions = append(t.actions, core.Action{
+		Type:           core.Save,
+		InstanceID:     id,
+		CollectionName: t.collection.name,
+		Previous:       current,
+		Current:        deleted,
+	})
+	return nil
+}
+
+// Purge hard-deletes tombstoned instances of the collection deleted
+// before the given time, returning how many were purged.
+func (c *Collection) Purge(before time.Time, opts ...TxnOption) (count int, err error) {
+	err = c.WriteTxn(func(txn *Txn) error {
+		count, err = txn.Purge(before)
+		return err
+	}, opts...)
+	return
+}
+
+// Purge hard-deletes tombstoned instances deleted before the given time
+// when the current transaction commits, returning how many are purged.
+// Purged instances are deleted by peers too.
+func (t *Txn) Purge(before time.Time) (int, error) {
+	if t.readonly {
+		return 0, ErrReadonlyTx
+	}
+	instances, err := t.Find(&Query{IncludeDeleted: true})
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, instance := range instances {
+		if !t.collection.isTombstone(instance) {
+			continue
+		}
+		at, err := deletedAt(instance)
+		if err != nil || !at.Before(before) {
+			continue
+		}
+		id, err := t.collection.getInstanceID(instance)
+		if err != nil {
+			return 0, err
+		}
+		t.actions = append(t.actions, core.Action{
+			Type:           core.Delete,
+			InstanceID:     id,
+			CollectionName: t.collection.name,
+		})
+		t.release(t.collection.BaseKey().ChildString(id.String()))
+		count++
+	}
+	return count, nil
+}
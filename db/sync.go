@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/textileio/go-threads/core/net"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+const (
+	waitForSyncInterval = time.Millisecond * 100
+)
+
+var (
+	dsDBHeads = dsDBPrefix.ChildString("heads")
+	// dsDBHeadsInitialized marks DBs whose applied heads were initialized,
+	// see initAppliedHeads.
+	dsDBHeadsInitialized = dsDBPrefix.ChildString("headsinitialized")
+)
+
+// SyncStatus describes how far the DB state is from the thread's known records.
+type SyncStatus struct {
+	// Logs holds the status of every log in the thread.
+	Logs []LogSyncStatus
+	// Pending is the total number of records not yet applied to the DB.
+	Pending int
+}
+
+// LogSyncStatus describes the sync status of a single thread log.
+type LogSyncStatus struct {
+	// ID is the log ID.
+	ID peer.ID
+	// LocalHead is the last record of the log applied to the DB.
+	LocalHead cid.Cid
+	// RemoteHead is the latest record of the log known by the thread.
+	RemoteHead cid.Cid
+	// Pending is the number of records between LocalHead and RemoteHead.
+	Pending int
+}
+
+// Synced returns true if all known thread records were applied to the DB.
+func (s SyncStatus) Synced() bool {
+	return s.Pending == 0
+}
+
+// SyncStatus returns the sync status of each log by comparing the last
+// records applied to the DB against the heads known by the thread. Pending
+// records are counted by walking the logs whose heads differ.
+func (d *DB) SyncStatus(ctx context.Context, opts ...ThreadInfoOption) (SyncStatus, error) {
+	options := &ThreadInfoOptions{Token: d.token}
+	for _, opt := range opts {
+		opt(options)
+	}
+	tid := d.connector.ThreadID()
+	tinfo, err := d.connector.Net.GetThread(ctx, tid, net.WithThreadToken(options.Token))
+	if err != nil {
+		return SyncStatus{}, err
+	}
+	own := tinfo.GetOwnLog()
+
+	var status SyncStatus
+	for _, lg := range tinfo.Logs {
+		ls := LogSyncStatus{ID: lg.ID, RemoteHead: lg.Head, LocalHead: lg.Head}
+		if own == nil || lg.ID != own.ID {
+			// Own records are applied before being added to the log
+			if ls.LocalHead, err = d.getAppliedHead(lg.ID); err != nil {
+				return SyncStatus{}, err
+			}
+			for c := ls.RemoteHead; c.Defined() && !c.Equals(ls.LocalHead); ls.Pending++ {
+				rec, err := d.connector.Net.GetRecord(ctx, tid, c, net.WithThreadToken(options.Token))
+				if err != nil {
+					return SyncStatus{}, err
+				}
+				c = rec.PrevID()
+			}
+		}
+		status.Logs = append(status.Logs, ls)
+		status.Pending += ls.Pending
+	}
+	return status, nil
+}
+
+// WaitForSync blocks until all thread records known when polling were
+// applied to the DB, or ctx is done. Polls only compare the heads of logs,
+// so they don't walk them.
+func (d *DB) WaitForSync(ctx context.Context, opts ...ThreadInfoOption) error {
+	options := &ThreadInfoOptions{Token: d.token}
+	for _, opt := range opts {
+		opt(options)
+	}
+	for {
+		synced, err := d.synced(ctx, options.Token)
+		if err != nil {
+			return err
+		}
+		if synced {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitForSyncInterval):
+		}
+	}
+}
+
+// synced returns whether the applied head of every log of other peers is
+// its head known by the thread.
+func (d *DB) synced(ctx context.Context, token thread.Token) (bool, error) {
+	tinfo, err := d.connector.Net.GetThread(ctx, d.connector.ThreadID(), net.WithThreadToken(token))
+	if err != nil {
+		return false, err
+	}
+	own := tinfo.GetOwnLog()
+	for _, lg := range tinfo.Logs {
+		if (own != nil && lg.ID == own.ID) || !lg.Head.Defined() {
+			continue
+		}
+		head, err := d.getAppliedHead(lg.ID)
+		if err != nil {
+			return false, err
+		}
+		if !head.Equals(lg.Head) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// setAppliedHead records rec as the last applied record of the log in txn.
+func setAppliedHead(txn ds.Write, lid peer.ID, rec cid.Cid) error {
+	return txn.Put(dsDBHeads.ChildString(lid.String()), rec.Bytes())
+}
+
+// getAppliedHead returns the last applied record of the log, or
+// cid.Undef if none was recorded.
+func (d *DB) getAppliedHead(lid peer.ID) (cid.Cid, error) {
+	b, err := d.datastore.Get(dsDBHeads.ChildString(lid.String()))
+	if err == ds.ErrNotFound {
+		return cid.Undef, nil
+	}
+	if err != nil {
+		return cid.Undef, err
+	}
+	return cid.Cast(b)
+}
+
+// initAppliedHeads sets the applied heads of DBs which applied records
+// before heads were tracked: the head of each log of other peers is its
+// last record marked as applied, since records of a log are applied in
+// order. It only runs once, and logs whose head is set meanwhile by
+// incoming records are left alone.
+func (d *DB) initAppliedHeads(ctx context.Context) error {
+	initialized, err := d.datastore.Has(dsDBHeadsInitialized)
+	if err != nil || initialized {
+		return err
+	}
+	tid := d.connector.ThreadID()
+	tinfo, err := d.connector.Net.GetThread(ctx, tid, net.WithThreadToken(d.token))
+	if err != nil {
+		return err
+	}
+	own := tinfo.GetOwnLog()
+	for _, lg := range tinfo.Logs {
+		if own != nil && lg.ID == own.ID {
+			continue
+		}
+		head, err := d.lastAppliedRecord(ctx, tinfo, lg.ID, lg.Head)
+		if err != nil {
+			return err
+		}
+		if !head.Defined() {
+			continue
+		}
+		d.lock.Lock()
+		current, err := d.getAppliedHead(lg.ID)
+		if err == nil && !current.Defined() {
+			err = setAppliedHead(d.datastore, lg.ID, head)
+		}
+		d.lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return d.datastore.Put(dsDBHeadsInitialized, []byte{})
+}
+
+// lastAppliedRecord walks the log lid back from head, returning the first
+// record whose body is marked as applied, or cid.Undef if there's none.
+func (d *DB) lastAppliedRecord(ctx context.Context, tinfo thread.Info, lid peer.ID, head cid.Cid) (cid.Cid, error) {
+	cursor, err := d.getAppliedCursor(lid)
+	if err != nil {
+		return cid.Undef, err
+	}
+	for c := head; c.Defined(); {
+		if c.Equals(cursor) {
+			return c, nil
+		}
+		rec, err := d.connector.Net.GetRecord(ctx, tinfo.ID, c, net.WithThreadToken(d.token))
+		if err != nil {
+			return cid.Undef, err
+		}
+		body, err := d.recordBody(ctx, lid, rec, tinfo.Key)
+		if err != nil {
+			return cid.Undef, err
+		}
+		applied, err := d.isApplied(body.Cid())
+		if err != nil {
+			return cid.Undef, err
+		}
+		if applied {
+			return c, nil
+		}
+		c = rec.PrevID()
+	}
+	return cid.Undef, nil
+}
@@ -0,0 +1,51 @@
+package db
+
+import (
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const (
+	// createdFieldName and modifiedFieldName hold the creation and last
+	// modification times of instances of collections with timestamps,
+	// in Unix nanoseconds.
+	createdFieldName  = "_created"
+	modifiedFieldName = "_mod"
+)
+
+var (
+	dsDBTimestamps = dsDBPrefix.ChildString("timestamps")
+)
+
+// isTimestampField returns whether name is a field maintained by
+// collections with timestamps.
+func isTimestampField(name string) bool {
+	return name == createdFieldName || name == modifiedFieldName
+}
+
+// withoutTimestamps returns instance without its timestamp fields.
+func withoutTimestamps(instance []byte) ([]byte, error) {
+	res, err := sjson.DeleteBytes(instance, createdFieldName)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.DeleteBytes(res, modifiedFieldName)
+}
+
+// stampInstance returns instance modified at t. Its creation time is kept
+// from previous, or set to t if previous is nil.
+func stampInstance(instance, previous []byte, t time.Time) ([]byte, error) {
+	created := t.UnixNano()
+	if previous != nil {
+		if c := gjson.GetBytes(previous, createdFieldName); c.Exists() {
+			created = c.Int()
+		}
+	}
+	res, err := sjson.SetBytes(instance, createdFieldName, created)
+	if err != nil {
+		return nil, err
+	}
+	return sjson.SetBytes(res, modifiedFieldName, t.UnixNano())
+}
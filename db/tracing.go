@@ -0,0 +1,38 @@
+package db
+
+import (
+	"context"
+)
+
+// Tracer starts spans around DB operations. It's shaped after OpenTelemetry's
+// trace.Tracer, so an OpenTelemetry (or any other) tracer can be plugged in
+// with a thin adapter.
+type Tracer interface {
+	// Start creates a span named name as a child of any span in ctx, and
+	// returns a context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetAttribute annotates the span with a key-value pair.
+	SetAttribute(key string, value interface{})
+	// End finishes the span, recording err if it isn't nil.
+	End(err error)
+}
+
+type nopTracer struct{}
+
+var _ Tracer = (*nopTracer)(nil)
+
+func (nopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+var _ Span = (*nopSpan)(nil)
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+
+func (nopSpan) End(error) {}
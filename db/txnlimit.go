@@ -0,0 +1,77 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ErrTooManyTxns indicates a transaction was rejected because the DB
+// already runs the max number of concurrent transactions of its kind,
+// see WithNewDBTxnLimits.
+var ErrTooManyTxns = errors.New("too many concurrent transactions")
+
+// TxnLimitPolicy tells what transactions exceeding a concurrency limit do.
+type TxnLimitPolicy int
+
+const (
+	// BlockOnTxnLimit makes transactions wait for a running one to finish,
+	// or for their context to be done.
+	BlockOnTxnLimit TxnLimitPolicy = iota
+	// FailOnTxnLimit makes transactions fail with ErrTooManyTxns.
+	FailOnTxnLimit
+)
+
+// txnLimiter counts the transactions of a kind being run, and bounds them
+// if it has slots.
+type txnLimiter struct {
+	slots    chan struct{}
+	policy   TxnLimitPolicy
+	inFlight int64
+}
+
+// newTxnLimiter returns a limiter of max transactions, or one that only
+// counts them if max is zero.
+func newTxnLimiter(max int, policy TxnLimitPolicy) *txnLimiter {
+	l := &txnLimiter{policy: policy}
+	if max > 0 {
+		l.slots = make(chan struct{}, max)
+	}
+	return l
+}
+
+// acquire takes a slot for a transaction, which must be given back with
+// release.
+func (l *txnLimiter) acquire(ctx context.Context) error {
+	if l.slots != nil {
+		if l.policy == FailOnTxnLimit {
+			select {
+			case l.slots <- struct{}{}:
+			default:
+				return ErrTooManyTxns
+			}
+		} else {
+			select {
+			case l.slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	atomic.AddInt64(&l.inFlight, 1)
+	return nil
+}
+
+func (l *txnLimiter) release() {
+	atomic.AddInt64(&l.inFlight, -1)
+	if l.slots != nil {
+		<-l.slots
+	}
+}
+
+// InFlightTxns returns the number of read and write transactions being
+// run, including those waiting for the DB lock but not those waiting for
+// a slot under the limits set with WithNewDBTxnLimits.
+func (d *DB) InFlightTxns() (reads, writes int) {
+	return int(atomic.LoadInt64(&d.readTxns.inFlight)), int(atomic.LoadInt64(&d.writeTxns.inFlight))
+}
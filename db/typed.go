@@ -0,0 +1,226 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/alecthomas/jsonschema"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/util"
+)
+
+// TypedCollection is a collection of instances of a Go struct type, which
+// are encoded to and decoded from JSON with encoding/json. The struct must
+// have an _id string field, e.g. ID core.InstanceID `json:"_id"`, or one
+// named by CollectionConfig.IDField.
+type TypedCollection struct {
+	collection *Collection
+	typ        reflect.Type
+}
+
+// NewTypedCollection creates a collection of instances of the struct type
+// of v, which can be a struct or a pointer to one. If config has no schema,
+// it's reflected from the struct as by NewCollectionFromType.
+func (d *DB) NewTypedCollection(config CollectionConfig, v interface{}) (*TypedCollection, error) {
+	typ, err := structType(v)
+	if err != nil {
+		return nil, err
+	}
+	if config.Schema == nil {
+		idField := config.IDField
+		if idField == "" {
+			idField = idFieldName
+		}
+		if config.Schema, err = schemaFromType(typ, idField); err != nil {
+			return nil, err
+		}
+	}
+	c, err := d.NewCollection(config)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCollection{collection: c, typ: typ}, nil
+}
+
+// NewCollectionFromType creates a collection whose schema is reflected
+// from the struct type of v, which can be a struct or a pointer to one,
+// with its JSON tags naming the properties. The struct must have a string
+// field mapped to _id, or ErrInvalidCollectionSchema is returned.
+func (d *DB) NewCollectionFromType(name string, v interface{}, indexes []IndexConfig) (*Collection, error) {
+	typ, err := structType(v)
+	if err != nil {
+		return nil, err
+	}
+	schema, err := schemaFromType(typ, idFieldName)
+	if err != nil {
+		return nil, err
+	}
+	return d.NewCollection(CollectionConfig{
+		Name:    name,
+		Schema:  schema,
+		Indexes: indexes,
+	})
+}
+
+// Typed returns a typed view of the collection, with instances of the
+// struct type of v, e.g. to use a collection created in a previous run.
+func (c *Collection) Typed(v interface{}) (*TypedCollection, error) {
+	typ, err := structType(v)
+	if err != nil {
+		return nil, err
+	}
+	return &TypedCollection{collection: c, typ: typ}, nil
+}
+
+// Collection returns the underlying collection.
+func (tc *TypedCollection) Collection() *Collection {
+	return tc.collection
+}
+
+// Create creates an instance from v, which must be a pointer to a value
+// of the collection type. If v has no _id, the generated one is set in v.
+func (tc *TypedCollection) Create(v interface{}, opts ...TxnOption) (core.InstanceID, error) {
+	data, err := tc.encode(v)
+	if err != nil {
+		return core.EmptyInstanceID, err
+	}
+	id, err := tc.collection.Create(data, opts...)
+	if err != nil {
+		return core.EmptyInstanceID, err
+	}
+	if err := json.Unmarshal(tc.collection.setInstanceID([]byte("{}"), id), v); err != nil {
+		return core.EmptyInstanceID, err
+	}
+	return id, nil
+}
+
+// Save saves the instance v, which must be a pointer to a value of the
+// collection type.
+func (tc *TypedCollection) Save(v interface{}, opts ...TxnOption) error {
+	data, err := tc.encode(v)
+	if err != nil {
+		return err
+	}
+	return tc.collection.Save(data, opts...)
+}
+
+// Delete deletes an instance by its ID.
+func (tc *TypedCollection) Delete(id core.InstanceID, opts ...TxnOption) error {
+	return tc.collection.Delete(id, opts...)
+}
+
+// Has returns true if an instance with id exists in the collection.
+func (tc *TypedCollection) Has(id core.InstanceID, opts ...TxnOption) (bool, error) {
+	return tc.collection.Has(id, opts...)
+}
+
+// FindByID decodes the instance with id into dst, which must be a pointer
+// to a value of the collection type. If doesn't exists returns ErrNotFound.
+func (tc *TypedCollection) FindByID(id core.InstanceID, dst interface{}, opts ...TxnOption) error {
+	if err := tc.checkPtr(dst); err != nil {
+		return err
+	}
+	instance, err := tc.collection.FindByID(id, opts...)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(instance, dst)
+}
+
+// Find decodes the instances matching q into dst, which must be a pointer
+// to a slice of values of the collection type, or of pointers to them.
+func (tc *TypedCollection) Find(q *Query, dst interface{}, opts ...TxnOption) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("expected a pointer to a slice of %s, got %T", tc.typ, dst)
+	}
+	elem := rv.Elem().Type().Elem()
+	if elem != tc.typ && elem != reflect.PtrTo(tc.typ) {
+		return fmt.Errorf("expected a pointer to a slice of %s, got %T", tc.typ, dst)
+	}
+	instances, err := tc.collection.Find(q, opts...)
+	if err != nil {
+		return err
+	}
+	res := reflect.MakeSlice(rv.Elem().Type(), len(instances), len(instances))
+	for i, instance := range instances {
+		v := reflect.New(tc.typ)
+		if err := json.Unmarshal(instance, v.Interface()); err != nil {
+			return err
+		}
+		if elem == tc.typ {
+			res.Index(i).Set(v.Elem())
+		} else {
+			res.Index(i).Set(v)
+		}
+	}
+	rv.Elem().Set(res)
+	return nil
+}
+
+// encode returns the JSON of v, which must be a pointer to a value of the
+// collection type.
+func (tc *TypedCollection) encode(v interface{}) ([]byte, error) {
+	if err := tc.checkPtr(v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (tc *TypedCollection) checkPtr(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Type() != tc.typ {
+		return fmt.Errorf("expected *%s, got %T", tc.typ, v)
+	}
+	return nil
+}
+
+// schemaFromType reflects the schema of the struct type typ, which must
+// have a string field with the json name idField.
+func schemaFromType(typ reflect.Type, idField string) (*jsonschema.Schema, error) {
+	if !hasIDField(typ, idField) {
+		return nil, fmt.Errorf("%w: %s has no string field with the json name %s", ErrInvalidCollectionSchema, typ, idField)
+	}
+	return util.SchemaFromInstance(reflect.New(typ).Interface(), false), nil
+}
+
+// hasIDField returns whether the struct type typ, or a struct it embeds,
+// has a string field encoded as idField.
+func hasIDField(typ reflect.Type, idField string) bool {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && hasIDField(ft, idField) {
+				return true
+			}
+			continue
+		}
+		if name == idField && f.PkgPath == "" && f.Type.Kind() == reflect.String {
+			return true
+		}
+	}
+	return false
+}
+
+// structType returns the struct type of v, which is a struct or a pointer
+// to one.
+func structType(v interface{}) (reflect.Type, error) {
+	typ := reflect.TypeOf(v)
+	if typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if typ == nil || typ.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected a struct or a pointer to one, got %T", v)
+	}
+	return typ, nil
+}
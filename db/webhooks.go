@@ -0,0 +1,251 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/thread"
+)
+
+const (
+	// WebhookSignatureHeader holds the hex encoded HMAC-SHA256 of webhook
+	// payloads, keyed by WebhookConfig.Secret and prefixed by "sha256=".
+	WebhookSignatureHeader = "X-Threads-Signature"
+
+	defaultWebhookQueueSize  = 1000
+	defaultWebhookMaxRetries = 5
+	defaultWebhookBackoff    = time.Second
+	maxWebhookBackoff        = time.Minute
+	webhookRequestTimeout    = 10 * time.Second
+)
+
+// WebhookConfig configures the webhooks of a DB, see WithNewDBWebhooks.
+type WebhookConfig struct {
+	// URLs are the endpoints every payload is POSTed to.
+	URLs []string
+	// Secret signs payloads in the WebhookSignatureHeader header. Payloads
+	// aren't signed if it's empty.
+	Secret []byte
+	// Collections are the collections whose changes are sent, or all of
+	// them if empty.
+	Collections []string
+	// IncludeValue adds the instance to the payloads of creates and saves.
+	IncludeValue bool
+	// QueueSize bounds the payloads waiting to be sent to each URL, 1000
+	// by default. Payloads of changes made while it's full are dropped.
+	QueueSize int
+	// MaxRetries is the number of retries of failed sends, 5 by default.
+	MaxRetries int
+	// Backoff is the delay before the first retry, 1s by default. It
+	// doubles for each retry, up to a minute.
+	Backoff time.Duration
+	// Client sends the payloads, one with a 10s timeout by default.
+	Client *http.Client
+}
+
+// WebhookPayload is the JSON body POSTed to webhooks for each change of an
+// instance.
+type WebhookPayload struct {
+	Thread     string          `json:"thread"`
+	Collection string          `json:"collection"`
+	Action     string          `json:"action"`
+	ID         core.InstanceID `json:"id"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+
+var webhookActions = map[ActionType]string{
+	ActionCreate: "create",
+	ActionSave:   "save",
+	ActionDelete: "delete",
+}
+
+// webhooks sends the payloads of a DB to its webhooks. Each URL has its own
+// queue and sender, so a failing URL doesn't hold back the others.
+type webhooks struct {
+	config      WebhookConfig
+	thread      thread.ID
+	collections map[string]struct{}
+	queues      []chan []byte
+	log         Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWebhooks(config WebhookConfig, id thread.ID, log Logger) *webhooks {
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultWebhookQueueSize
+	}
+	if config.MaxRetries == 0 {
+		config.MaxRetries = defaultWebhookMaxRetries
+	}
+	if config.Backoff == 0 {
+		config.Backoff = defaultWebhookBackoff
+	}
+	if config.Client == nil {
+		config.Client = &http.Client{Timeout: webhookRequestTimeout}
+	}
+	w := &webhooks{config: config, thread: id, log: log}
+	if len(config.Collections) > 0 {
+		w.collections = make(map[string]struct{}, len(config.Collections))
+		for _, c := range config.Collections {
+			w.collections[c] = struct{}{}
+		}
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	for _, url := range config.URLs {
+		q := make(chan []byte, config.QueueSize)
+		w.queues = append(w.queues, q)
+		w.wg.Add(1)
+		go w.run(url, q)
+	}
+	return w
+}
+
+// watches returns whether changes of collection are sent.
+func (w *webhooks) watches(collection string) bool {
+	if w.collections == nil {
+		return true
+	}
+	_, ok := w.collections[collection]
+	return ok
+}
+
+// enqueue queues body for every URL without blocking, dropping it from
+// full queues.
+func (w *webhooks) enqueue(body []byte) {
+	for i, q := range w.queues {
+		select {
+		case q <- body:
+		default:
+			w.log.Warnf("webhook queue of %s is full, dropping payload", w.config.URLs[i])
+		}
+	}
+}
+
+func (w *webhooks) run(url string, q chan []byte) {
+	defer w.wg.Done()
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case body := <-q:
+			w.send(url, body)
+		}
+	}
+}
+
+// send POSTs body to url, retrying with exponential backoff until it's
+// accepted, retries run out, or the webhooks are closed.
+func (w *webhooks) send(url string, body []byte) {
+	backoff := w.config.Backoff
+	for attempt := 0; ; attempt++ {
+		err := w.post(url, body)
+		if err == nil {
+			return
+		}
+		if attempt == w.config.MaxRetries {
+			w.log.Errorf("dropping webhook payload for %s after %d attempts: %v", url, attempt+1, err)
+			return
+		}
+		w.log.Debugf("retrying webhook payload for %s in %v: %v", url, backoff, err)
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxWebhookBackoff {
+			backoff = maxWebhookBackoff
+		}
+	}
+}
+
+func (w *webhooks) post(url string, body []byte) error {
+	req, err := http.NewRequestWithContext(w.ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(w.config.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+SignWebhookPayload(w.config.Secret, body))
+	}
+	res, err := w.config.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return nil
+}
+
+// close stops the senders, dropping the payloads they didn't send.
+func (w *webhooks) close() {
+	w.cancel()
+	w.wg.Wait()
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 of body keyed by
+// secret, which receivers compare to the WebhookSignatureHeader header.
+func SignWebhookPayload(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyWebhooks queues the payloads of actions for the webhooks, if any.
+// It never blocks, so webhooks can't hold back writes.
+// The DB lock must be held by the caller.
+func (d *DB) notifyWebhooks(actions []Action) {
+	if d.webhooks == nil {
+		return
+	}
+	for _, a := range actions {
+		if !d.webhooks.watches(a.Collection) {
+			continue
+		}
+		p := WebhookPayload{
+			Thread:     d.webhooks.thread.String(),
+			Collection: a.Collection,
+			Action:     webhookActions[a.Type],
+			ID:         a.ID,
+		}
+		if d.webhooks.config.IncludeValue && a.Type != ActionDelete {
+			v, err := d.getInstance(KeyForInstance(a.Collection, a.ID))
+			if err != nil {
+				d.log.Errorf("error getting instance %s of webhook payload: %v", a.ID, err)
+			} else {
+				p.Value = v
+			}
+		}
+		body, err := json.Marshal(p)
+		if err != nil {
+			d.log.Errorf("error encoding webhook payload: %v", err)
+			continue
+		}
+		d.webhooks.enqueue(body)
+	}
+}
+
+// getInstance returns the value at key, including pending batched writes.
+func (d *DB) getInstance(key ds.Key) ([]byte, error) {
+	if v, ok := d.batch.get(key); ok {
+		if v == nil {
+			return nil, ds.ErrNotFound
+		}
+		return v, nil
+	}
+	return d.datastore.Get(key)
+}
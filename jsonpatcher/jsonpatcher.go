@@ -3,6 +3,7 @@ package jsonpatcher
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/gob"
 	"errors"
 	"fmt"
 	"time"
@@ -41,6 +42,7 @@ type jsonPatcher struct {
 }
 
 var _ core.EventCodec = (*jsonPatcher)(nil)
+var _ core.StoredEventDecoder = (*jsonPatcher)(nil)
 
 func init() {
 	cbornode.RegisterCborType(patchEvent{})
@@ -49,7 +51,10 @@ func init() {
 	cbornode.RegisterCborType(time.Time{})
 }
 
-// New returns a JSON-Patcher EventCodec
+// New returns a JSON-Patcher EventCodec.
+// Create events carry the full instance, while save events only carry a
+// JSON merge patch (RFC 7386) against the previous instance, which Reduce
+// applies to the stored value.
 func New() core.EventCodec {
 	return &jsonPatcher{}
 }
@@ -67,7 +72,11 @@ func (jp *jsonPatcher) Create(actions []core.Action) ([]core.Event, format.Node,
 		case core.Create:
 			op, err = createEvent(actions[i].InstanceID, actions[i].Current)
 		case core.Save:
-			op, err = saveEvent(actions[i].InstanceID, actions[i].Previous, actions[i].Current)
+			if actions[i].Clock > 0 {
+				op, err = replaceEvent(actions[i].InstanceID, actions[i].Current)
+			} else {
+				op, err = saveEvent(actions[i].InstanceID, actions[i].Previous, actions[i].Current)
+			}
 		case core.Delete:
 			op, err = deleteEvent(actions[i].InstanceID)
 		default:
@@ -76,11 +85,15 @@ func (jp *jsonPatcher) Create(actions []core.Action) ([]core.Event, format.Node,
 		if err != nil {
 			return nil, nil, err
 		}
+		now := time.Now()
 		revents.Patches[i] = patchEvent{
-			Timestamp:      time.Now(),
+			Timestamp:      now,
+			UnixNano:       now.UnixNano(),
 			ID:             actions[i].InstanceID,
 			CollectionName: actions[i].CollectionName,
 			Patch:          *op,
+			Version:        actions[i].SchemaVersion,
+			LamportClock:   actions[i].Clock,
 		}
 		events[i] = revents.Patches[i]
 	}
@@ -111,6 +124,13 @@ func (jp *jsonPatcher) Reduce(
 			return nil, fmt.Errorf("event unrecognized for jsonpatcher eventcodec")
 		}
 		key := baseKey.ChildString(e.Collection()).ChildString(e.InstanceID().String())
+		if je.LamportClock > 0 && je.Patch.Type != delete {
+			if actions[i], err = replaceInstance(txn, key, e, je.Patch.JSONPatch, indexFunc); err != nil {
+				return nil, err
+			}
+			log.Debug("\treplace operation applied")
+			continue
+		}
 		switch je.Patch.Type {
 		case create:
 			exist, err := txn.Has(key)
@@ -150,6 +170,11 @@ func (jp *jsonPatcher) Reduce(
 			log.Debug("\tsave operation applied")
 		case delete:
 			value, err := txn.Get(key)
+			if errors.Is(err, ds.ErrNotFound) && je.LamportClock > 0 {
+				// The instance was deleted, or its create wasn't received yet.
+				actions[i] = core.ReduceAction{Type: core.Delete, Collection: e.Collection(), InstanceID: e.InstanceID()}
+				continue
+			}
 			if err != nil {
 				return nil, err
 			}
@@ -191,6 +216,15 @@ func (jp *jsonPatcher) EventsFromBytes(data []byte) ([]core.Event, error) {
 	return res, nil
 }
 
+// EventFromStore returns an event persisted by the dispatcher.
+func (jp *jsonPatcher) EventFromStore(data []byte) (core.Event, error) {
+	var e patchEvent
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
 func createEvent(id core.InstanceID, v []byte) (*operation, error) {
 	return &operation{
 		Type:       create,
@@ -211,6 +245,42 @@ func saveEvent(id core.InstanceID, prev []byte, curr []byte) (*operation, error)
 	}, nil
 }
 
+// replaceEvent returns a save carrying the whole instance, for clocked
+// events, which replace the stored instance regardless of its state.
+func replaceEvent(id core.InstanceID, curr []byte) (*operation, error) {
+	return &operation{
+		Type:       save,
+		InstanceID: id,
+		JSONPatch:  curr,
+	}, nil
+}
+
+// replaceInstance reduces a clocked create or save, writing the instance
+// whether or not it exists.
+func replaceInstance(
+	txn ds.Txn,
+	key ds.Key,
+	e core.Event,
+	instance []byte,
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) (core.ReduceAction, error) {
+	value, err := txn.Get(key)
+	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+		return core.ReduceAction{}, err
+	}
+	if err := txn.Put(key, instance); err != nil {
+		return core.ReduceAction{}, fmt.Errorf("error when reducing replace event: %w", err)
+	}
+	if err := indexFunc(e.Collection(), key, value, instance, txn); err != nil {
+		return core.ReduceAction{}, fmt.Errorf("error when indexing replaced data: %w", err)
+	}
+	action := core.ReduceAction{Type: core.Save, Collection: e.Collection(), InstanceID: e.InstanceID()}
+	if value == nil {
+		action.Type = core.Create
+	}
+	return action, nil
+}
+
 func deleteEvent(id core.InstanceID) (*operation, error) {
 	return &operation{
 		Type:       delete,
@@ -224,10 +294,25 @@ type patchEvent struct {
 	ID             core.InstanceID
 	CollectionName string
 	Patch          operation
+	// Version is the collection schema version. It's omitted when zero,
+	// so events of unversioned collections can still be decoded by peers
+	// that don't know it.
+	Version int `refmt:",omitempty"`
+	// LamportClock is the Lamport clock of the event, omitted when zero
+	// like Version.
+	LamportClock uint64 `refmt:",omitempty"`
+	// UnixNano is the event time. Unlike Timestamp, which is only kept by
+	// stored events, it survives the CBOR encoding of records. It's omitted
+	// when zero, so peers running versions without it ignore the field
+	// when decoding, and their records decode to events with a zero time.
+	UnixNano int64 `refmt:",omitempty"`
 }
 
 func (je patchEvent) Time() []byte {
-	t := je.Timestamp.UnixNano()
+	t := je.UnixNano
+	if t == 0 {
+		t = je.Timestamp.UnixNano()
+	}
 	buf := new(bytes.Buffer)
 	// Use big endian to preserve lexicographic sorting
 	_ = binary.Write(buf, binary.BigEndian, t)
@@ -242,4 +327,26 @@ func (je patchEvent) Collection() string {
 	return je.CollectionName
 }
 
+func (je patchEvent) SchemaVersion() int {
+	return je.Version
+}
+
+func (je patchEvent) Clock() uint64 {
+	return je.LamportClock
+}
+
+func (je patchEvent) ActionType() core.ActionType {
+	switch je.Patch.Type {
+	case create:
+		return core.Create
+	case save:
+		return core.Save
+	default:
+		return core.Delete
+	}
+}
+
 var _ core.Event = (*patchEvent)(nil)
+var _ core.VersionedEvent = (*patchEvent)(nil)
+var _ core.ClockedEvent = (*patchEvent)(nil)
+var _ core.TypedEvent = (*patchEvent)(nil)
@@ -0,0 +1,71 @@
+package jsonpatcher
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	core "github.com/textileio/go-threads/core/db"
+)
+
+// BenchmarkSaveLargeInstance measures the record size of save events when a
+// single field of a large instance changes. Saves are encoded as merge patches,
+// so payload-bytes/op should stay far below instance-bytes/op.
+func BenchmarkSaveLargeInstance(b *testing.B) {
+	id := core.NewInstanceID()
+	doc := map[string]interface{}{"_id": id.String()}
+	for i := 0; i < 500; i++ {
+		doc[fmt.Sprintf("field%d", i)] = fmt.Sprintf("value of field number %d", i)
+	}
+	prev, err := json.Marshal(doc)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	jp := New()
+	var payload int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		doc["field0"] = i
+		curr, err := json.Marshal(doc)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, n, err := jp.Create([]core.Action{{
+			Type:           core.Save,
+			InstanceID:     id,
+			CollectionName: "large",
+			Previous:       prev,
+			Current:        curr,
+		}})
+		if err != nil {
+			b.Fatal(err)
+		}
+		payload += len(n.RawData())
+		prev = curr
+	}
+	b.ReportMetric(float64(payload)/float64(b.N), "payload-bytes/op")
+	b.ReportMetric(float64(len(prev)), "instance-bytes/op")
+}
+
+func TestEventTimeRoundTrip(t *testing.T) {
+	jp := New()
+	id := core.NewInstanceID()
+	events, n, err := jp.Create([]core.Action{{
+		Type:           core.Create,
+		InstanceID:     id,
+		CollectionName: "dummy",
+		Current:        []byte(`{"_id":"` + id.String() + `"}`),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := jp.EventsFromBytes(n.RawData())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded[0].Time(), events[0].Time()) {
+		t.Fatalf("decoded event time %x doesn't match %x", decoded[0].Time(), events[0].Time())
+	}
+}
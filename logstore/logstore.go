@@ -260,3 +260,28 @@ func (ls *logstore) DeleteLog(id thread.ID, lid peer.ID) (err error) {
 	}
 	return nil
 }
+
+// RemoveLog deletes a compromised log, and the read and service keys of its
+// thread. The thread metadata is deleted once no logs are left.
+func (ls *logstore) RemoveLog(id thread.ID, lid peer.ID) error {
+	ls.Lock()
+	defer ls.Unlock()
+
+	if err := ls.KeyBook.RemoveLog(id, lid); err != nil {
+		return err
+	}
+	if err := ls.ClearAddrs(id, lid); err != nil {
+		return err
+	}
+	if err := ls.ClearHeads(id, lid); err != nil {
+		return err
+	}
+	set, err := ls.getLogIDs(id)
+	if err != nil {
+		return err
+	}
+	if len(set) == 0 {
+		return ls.ClearMetadata(id)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package lstoreds
 
 import (
 	"context"
+	"errors"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -9,7 +10,11 @@ import (
 
 	ds "github.com/ipfs/go-datastore"
 	badger "github.com/ipfs/go-ds-badger"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ptest "github.com/libp2p/go-libp2p-core/test"
 	core "github.com/textileio/go-threads/core/logstore"
+	"github.com/textileio/go-threads/core/thread"
 	pt "github.com/textileio/go-threads/test"
 )
 
@@ -69,6 +74,61 @@ func TestDatastoreMetadataBook(t *testing.T) {
 	}
 }
 
+func TestKeyBookCounts(t *testing.T) {
+	store, closeFunc := badgerStore(t)
+	defer closeFunc()
+	kb, err := NewKeyBook(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tid := thread.NewIDV1(thread.Raw, 24)
+	for i := 0; i < 3; i++ {
+		_, pub, _ := ptest.RandTestKeyPair(crypto.Ed25519, 0)
+		p, _ := peer.IDFromPublicKey(pub)
+		if err := kb.AddPubKey(tid, p, pub); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Build", func(t *testing.T) {
+		// A store written before the counts were kept has none of them.
+		if err := store.Delete(kbCountThreads); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.Delete(dsThreadKey(tid, kbCountLogsBase)); err != nil {
+			t.Fatal(err)
+		}
+		kb, err := NewKeyBook(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := kb.NumLogsWithKeys(tid); err != nil || n != 3 {
+			t.Fatalf("expected 3 logs, got %d (%v)", n, err)
+		}
+		if n, err := kb.NumThreadsFromKeys(); err != nil || n != 1 {
+			t.Fatalf("expected 1 thread, got %d (%v)", n, err)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		kb := &dsKeyBook{ds: failingGetDatastore{store}}
+		if _, err := kb.NumLogsWithKeys(tid); err == nil {
+			t.Fatal("expected an error counting logs")
+		}
+		if _, err := kb.NumThreadsFromKeys(); err == nil {
+			t.Fatal("expected an error counting threads")
+		}
+	})
+}
+
+type failingGetDatastore struct {
+	ds.Datastore
+}
+
+func (f failingGetDatastore) Get(ds.Key) ([]byte, error) {
+	return nil, errors.New("get failed")
+}
+
 func addressBookFactory(tb testing.TB, storeFactory datastoreFactory, opts Options) pt.AddrBookFactory {
 	return func() (core.AddrBook, func()) {
 		store, closeFunc := storeFactory(tb)
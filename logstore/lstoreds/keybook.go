@@ -1,7 +1,9 @@
 package lstoreds
 
 import (
+	"encoding/binary"
 	"fmt"
+	"sync"
 
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
@@ -15,6 +17,10 @@ import (
 
 type dsKeyBook struct {
 	ds ds.Datastore
+
+	// lock serializes the updates of the counts of logs and threads with
+	// the keys they count.
+	lock sync.Mutex
 }
 
 // Public and private keys are stored under the following db key pattern:
@@ -29,12 +35,33 @@ var (
 	serviceSuffix = ds.NewKey("/service")
 )
 
+// The number of logs with keys under a thread, and the number of threads
+// with logs with keys, are stored under the following db keys:
+// /thread/keycounts/logs/<b32 thread id no padding>
+// /thread/keycounts/threads
+var (
+	kbCountLogsBase = ds.NewKey("/thread/keycounts/logs")
+	kbCountThreads  = ds.NewKey("/thread/keycounts/threads")
+)
+
 var _ core.KeyBook = (*dsKeyBook)(nil)
 
 // NewKeyBook returns a new key book for storing public and private keys
 // of (thread.ID, peer.ID) pairs with durable guarantees by store.
+// The counts of logs and threads are built from the keys of store the
+// first time it's opened with them.
 func NewKeyBook(store ds.Datastore) (core.KeyBook, error) {
-	return &dsKeyBook{ds: store}, nil
+	kb := &dsKeyBook{ds: store}
+	has, err := store.Has(kbCountThreads)
+	if err != nil {
+		return nil, fmt.Errorf("error when getting thread count from store: %w", err)
+	}
+	if !has {
+		if err := kb.buildCounts(); err != nil {
+			return nil, err
+		}
+	}
+	return kb, nil
 }
 
 // PubKey returns the public key of (thread.ID, peer.ID). The implementation
@@ -71,11 +98,7 @@ func (kb *dsKeyBook) AddPubKey(t thread.ID, p peer.ID, pk crypto.PubKey) error {
 	if err != nil {
 		return fmt.Errorf("error when getting bytes from public key: %w", err)
 	}
-	key := dsLogKey(t, p, kbBase).Child(pubSuffix)
-	if kb.ds.Put(key, val) != nil {
-		return fmt.Errorf("error when putting public key in store: %w", err)
-	}
-	return nil
+	return kb.putLogKey(t, p, pubSuffix, val)
 }
 
 // PrivKey returns the private key of (thread.ID, peer.ID). If not private key
@@ -108,11 +131,41 @@ func (kb *dsKeyBook) AddPrivKey(t thread.ID, p peer.ID, sk crypto.PrivKey) error
 	if err != nil {
 		return fmt.Errorf("error when getting private key bytes: %w", err)
 	}
-	key := dsLogKey(t, p, kbBase).Child(privSuffix)
-	if err = kb.ds.Put(key, skb); err != nil {
+	return kb.putLogKey(t, p, privSuffix, skb)
+}
+
+// putLogKey puts the key with suffix of (thread.ID, peer.ID), counting the
+// log if it had no keys yet.
+func (kb *dsKeyBook) putLogKey(t thread.ID, p peer.ID, suffix ds.Key, val []byte) error {
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+
+	had, err := kb.hasLogKeys(t, p)
+	if err != nil {
+		return err
+	}
+	key := dsLogKey(t, p, kbBase).Child(suffix)
+	if err := kb.ds.Put(key, val); err != nil {
 		return fmt.Errorf("error when putting key %v in datastore: %w", key, err)
 	}
-	return nil
+	if had {
+		return nil
+	}
+	return kb.addLogCount(t, 1)
+}
+
+// hasLogKeys returns whether (thread.ID, peer.ID) has a public or private key.
+func (kb *dsKeyBook) hasLogKeys(t thread.ID, p peer.ID) (bool, error) {
+	for _, suffix := range []ds.Key{pubSuffix, privSuffix} {
+		has, err := kb.ds.Has(dsLogKey(t, p, kbBase).Child(suffix))
+		if err != nil {
+			return false, fmt.Errorf("error when getting key from datastore: %w", err)
+		}
+		if has {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 // ReadKey returns the read-key associated with thread.ID.
@@ -170,17 +223,52 @@ func (kb *dsKeyBook) AddServiceKey(t thread.ID, fk *sym.Key) error {
 
 // ClearKeys deletes all keys under a thread.
 func (kb *dsKeyBook) ClearKeys(t thread.ID) error {
-	return kb.clearKeys(dsThreadKey(t, kbBase))
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+
+	if err := kb.clearKeys(dsThreadKey(t, kbBase)); err != nil {
+		return err
+	}
+	n, err := kb.getCount(dsThreadKey(t, kbCountLogsBase))
+	if err != nil {
+		return err
+	}
+	return kb.addLogCount(t, -n)
 }
 
 // ClearLogKeys deletes all keys under a log.
 func (kb *dsKeyBook) ClearLogKeys(t thread.ID, p peer.ID) error {
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+
+	had, err := kb.hasLogKeys(t, p)
+	if err != nil {
+		return err
+	}
 	if err := kb.ds.Delete(dsLogKey(t, p, kbBase).Child(privSuffix)); err != nil {
 		return fmt.Errorf("error when clearing key: %w", err)
 	}
 	if err := kb.ds.Delete(dsLogKey(t, p, kbBase).Child(pubSuffix)); err != nil {
 		return fmt.Errorf("error when clearing key: %w", err)
 	}
+	if !had {
+		return nil
+	}
+	return kb.addLogCount(t, -1)
+}
+
+// RemoveLog deletes the keys of a log, and the read and service keys of
+// its thread.
+func (kb *dsKeyBook) RemoveLog(t thread.ID, p peer.ID) error {
+	if err := kb.ClearLogKeys(t, p); err != nil {
+		return err
+	}
+	if err := kb.ds.Delete(dsThreadKey(t, kbBase).Child(readSuffix)); err != nil {
+		return fmt.Errorf("error when clearing key: %w", err)
+	}
+	if err := kb.ds.Delete(dsThreadKey(t, kbBase).Child(serviceSuffix)); err != nil {
+		return fmt.Errorf("error when clearing key: %w", err)
+	}
 	return nil
 }
 
@@ -212,6 +300,41 @@ func (kb *dsKeyBook) LogsWithKeys(t thread.ID) (peer.IDSlice, error) {
 	return ids, nil
 }
 
+// ForEachLog calls fn with each log ID with keys under a thread, until fn
+// returns false.
+func (kb *dsKeyBook) ForEachLog(t thread.ID, fn func(peer.ID) bool) error {
+	q := query.Query{Prefix: dsThreadKey(t, kbBase).String(), KeysOnly: true}
+	results, err := kb.ds.Query(q)
+	if err != nil {
+		return fmt.Errorf("error while iterating logs with keys: %v", err)
+	}
+	defer results.Close()
+
+	seen := make(map[string]struct{})
+	for result := range results.Next() {
+		if result.Error != nil {
+			return fmt.Errorf("error while iterating logs with keys: %v", result.Error)
+		}
+		name := ds.RawKey(result.Key).Parent().Name()
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		b, err := base32.RawStdEncoding.DecodeString(name)
+		if err != nil {
+			continue
+		}
+		id, err := peer.IDFromBytes(b)
+		if err != nil {
+			continue
+		}
+		if !fn(id) {
+			return nil
+		}
+	}
+	return nil
+}
+
 // ThreadsFromKeys returns a list of threads referenced in the book.
 func (kb *dsKeyBook) ThreadsFromKeys() (thread.IDSlice, error) {
 	ids, err := uniqueThreadIds(kb.ds, kbBase, func(result query.Result) string {
@@ -222,3 +345,120 @@ func (kb *dsKeyBook) ThreadsFromKeys() (thread.IDSlice, error) {
 	}
 	return ids, nil
 }
+
+// NumLogsWithKeys returns the number of logs with keys under a thread.
+func (kb *dsKeyBook) NumLogsWithKeys(t thread.ID) (int, error) {
+	n, err := kb.getCount(dsThreadKey(t, kbCountLogsBase))
+	if err != nil {
+		return 0, fmt.Errorf("error while counting logs with keys: %v", err)
+	}
+	return n, nil
+}
+
+// NumThreadsFromKeys returns the number of threads referenced in the book.
+func (kb *dsKeyBook) NumThreadsFromKeys() (int, error) {
+	n, err := kb.getCount(kbCountThreads)
+	if err != nil {
+		return 0, fmt.Errorf("error while counting threads from keys: %v", err)
+	}
+	return n, nil
+}
+
+// addLogCount adds delta to the number of logs with keys under a thread,
+// and counts the thread in or out if it gains its first log or loses its
+// last one. The lock must be held by the caller.
+func (kb *dsKeyBook) addLogCount(t thread.ID, delta int) error {
+	if delta == 0 {
+		return nil
+	}
+	key := dsThreadKey(t, kbCountLogsBase)
+	n, err := kb.getCount(key)
+	if err != nil {
+		return err
+	}
+	if err := kb.putCount(key, n+delta); err != nil {
+		return err
+	}
+	switch {
+	case n == 0 && n+delta > 0:
+		return kb.addThreadCount(1)
+	case n > 0 && n+delta == 0:
+		return kb.addThreadCount(-1)
+	default:
+		return nil
+	}
+}
+
+func (kb *dsKeyBook) addThreadCount(delta int) error {
+	n, err := kb.getCount(kbCountThreads)
+	if err != nil {
+		return err
+	}
+	return kb.putCount(kbCountThreads, n+delta)
+}
+
+// getCount returns the count at key, which is 0 if it's missing.
+func (kb *dsKeyBook) getCount(key ds.Key) (int, error) {
+	v, err := kb.ds.Get(key)
+	if err == ds.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error when getting count from datastore: %w", err)
+	}
+	n, read := binary.Uvarint(v)
+	if read <= 0 {
+		return 0, fmt.Errorf("count %s can't be decoded", key)
+	}
+	return int(n), nil
+}
+
+// putCount puts n at key, deleting it if n is 0. The thread count is
+// always stored, since it marks the counts as built.
+func (kb *dsKeyBook) putCount(key ds.Key, n int) error {
+	if n < 0 {
+		return fmt.Errorf("count %s can't be negative", key)
+	}
+	if n == 0 && !key.Equal(kbCountThreads) {
+		if err := kb.ds.Delete(key); err != nil {
+			return fmt.Errorf("error when clearing count: %w", err)
+		}
+		return nil
+	}
+	buf := make([]byte, binary.MaxVarintLen64)
+	if err := kb.ds.Put(key, buf[:binary.PutUvarint(buf, uint64(n))]); err != nil {
+		return fmt.Errorf("error when putting count in datastore: %w", err)
+	}
+	return nil
+}
+
+// buildCounts counts the logs of the threads with keys in the book.
+func (kb *dsKeyBook) buildCounts() error {
+	kb.lock.Lock()
+	defer kb.lock.Unlock()
+
+	threads, err := kb.ThreadsFromKeys()
+	if err != nil {
+		return err
+	}
+	for _, t := range threads {
+		logs, err := kb.LogsWithKeys(t)
+		if err != nil {
+			return err
+		}
+		if err := kb.putCount(dsThreadKey(t, kbCountLogsBase), len(logs)); err != nil {
+			return err
+		}
+	}
+	return kb.putCount(kbCountThreads, len(threads))
+}
+
+// ExportKeys returns all keys under a thread, serialized.
+func (kb *dsKeyBook) ExportKeys(t thread.ID) ([]byte, error) {
+	return core.ExportThreadKeys(kb, t)
+}
+
+// ImportKeys adds keys serialized by ExportKeys under a thread.
+func (kb *dsKeyBook) ImportKeys(t thread.ID, data []byte) error {
+	return core.ImportThreadKeys(kb, t, data)
+}
@@ -132,6 +132,32 @@ func uniqueLogIds(ds ds.Datastore, prefix ds.Key, extractor func(result query.Re
 	return ids, nil
 }
 
+// countUniqueIds returns the number of unique valid IDs extracted from
+// database keys, without decoding them into a slice.
+func countUniqueIds(ds ds.Datastore, prefix ds.Key, extractor func(result query.Result) string, valid func([]byte) bool) (int, error) {
+	results, err := ds.Query(query.Query{Prefix: prefix.String(), KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer results.Close()
+
+	idset := make(map[string]struct{})
+	for result := range results.Next() {
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		idset[extractor(result)] = struct{}{}
+	}
+
+	var n int
+	for id := range idset {
+		if pid, err := base32.RawStdEncoding.DecodeString(id); err == nil && valid(pid) {
+			n++
+		}
+	}
+	return n, nil
+}
+
 func dsThreadKey(t thread.ID, baseKey ds.Key) ds.Key {
 	key := baseKey.ChildString(base32.RawStdEncoding.EncodeToString(t.Bytes()))
 	return key
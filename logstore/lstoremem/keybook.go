@@ -151,8 +151,29 @@ func (mkb *memoryKeyBook) ClearKeys(t thread.ID) error {
 
 func (mkb *memoryKeyBook) ClearLogKeys(t thread.ID, p peer.ID) error {
 	mkb.Lock()
-	delete(mkb.pks, t)
-	delete(mkb.sks, t)
+	if lmap := mkb.pks[t]; lmap != nil {
+		delete(lmap, p)
+		if len(lmap) == 0 {
+			delete(mkb.pks, t)
+		}
+	}
+	if lmap := mkb.sks[t]; lmap != nil {
+		delete(lmap, p)
+		if len(lmap) == 0 {
+			delete(mkb.sks, t)
+		}
+	}
+	mkb.Unlock()
+	return nil
+}
+
+func (mkb *memoryKeyBook) RemoveLog(t thread.ID, p peer.ID) error {
+	if err := mkb.ClearLogKeys(t, p); err != nil {
+		return err
+	}
+	mkb.Lock()
+	delete(mkb.rks, t)
+	delete(mkb.fks, t)
 	mkb.Unlock()
 	return nil
 }
@@ -178,6 +199,25 @@ func (mkb *memoryKeyBook) LogsWithKeys(t thread.ID) (peer.IDSlice, error) {
 	return pids, nil
 }
 
+func (mkb *memoryKeyBook) ForEachLog(t thread.ID, fn func(peer.ID) bool) error {
+	mkb.RLock()
+	defer mkb.RUnlock()
+	for p := range mkb.pks[t] {
+		if !fn(p) {
+			return nil
+		}
+	}
+	for p := range mkb.sks[t] {
+		if _, ok := mkb.pks[t][p]; ok {
+			continue
+		}
+		if !fn(p) {
+			return nil
+		}
+	}
+	return nil
+}
+
 func (mkb *memoryKeyBook) ThreadsFromKeys() (thread.IDSlice, error) {
 	mkb.RLock()
 	ts := make(map[thread.ID]struct{})
@@ -194,3 +234,37 @@ func (mkb *memoryKeyBook) ThreadsFromKeys() (thread.IDSlice, error) {
 	}
 	return tids, nil
 }
+
+func (mkb *memoryKeyBook) NumLogsWithKeys(t thread.ID) (int, error) {
+	mkb.RLock()
+	defer mkb.RUnlock()
+	n := len(mkb.pks[t])
+	for p := range mkb.sks[t] {
+		if _, ok := mkb.pks[t][p]; !ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (mkb *memoryKeyBook) NumThreadsFromKeys() (int, error) {
+	mkb.RLock()
+	defer mkb.RUnlock()
+	n := len(mkb.pks)
+	for t := range mkb.sks {
+		if _, ok := mkb.pks[t]; !ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ExportKeys returns all keys under a thread, serialized.
+func (mkb *memoryKeyBook) ExportKeys(t thread.ID) ([]byte, error) {
+	return core.ExportThreadKeys(mkb, t)
+}
+
+// ImportKeys adds keys serialized by ExportKeys under a thread.
+func (mkb *memoryKeyBook) ImportKeys(t thread.ID, data []byte) error {
+	return core.ImportThreadKeys(mkb, t, data)
+}
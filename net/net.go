@@ -430,6 +430,26 @@ func (n *net) pullThreadUnsafe(ctx context.Context, id thread.ID) error {
 	return nil
 }
 
+var _ core.ReadKeySetter = (*net)(nil)
+
+// SetReadKey replaces the read key of a thread, see core.ReadKeySetter.
+func (n *net) SetReadKey(_ context.Context, id thread.ID, key *sym.Key, opts ...core.ThreadOption) error {
+	args := &core.ThreadOptions{}
+	for _, opt := range opts {
+		opt(args)
+	}
+	if _, err := args.Token.Validate(n.getPrivKey()); err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("read-key is nil")
+	}
+	if _, err := n.store.GetThread(id); err != nil {
+		return err
+	}
+	return n.store.AddReadKey(id, key)
+}
+
 func (n *net) DeleteThread(ctx context.Context, id thread.ID, opts ...core.ThreadOption) error {
 	args := &core.ThreadOptions{}
 	for _, opt := range opts {
@@ -0,0 +1,307 @@
+// Package protocodec is an EventCodec that serializes events with Protobuf.
+// Its wire format is described in codec.proto. Instance changes are encoded
+// with the same semantics as jsonpatcher: creates carry the full instance and
+// saves carry a JSON merge patch against the previous instance.
+package protocodec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"github.com/gogo/protobuf/proto"
+	ds "github.com/ipfs/go-datastore"
+	cbornode "github.com/ipfs/go-ipld-cbor"
+	format "github.com/ipfs/go-ipld-format"
+	logging "github.com/ipfs/go-log"
+	"github.com/multiformats/go-multihash"
+	core "github.com/textileio/go-threads/core/db"
+)
+
+const (
+	typeCreate int32 = iota
+	typeSave
+	typeDelete
+)
+
+var (
+	log                           = logging.Logger("protocodec")
+	errSavingNonExistentInstance  = errors.New("can't save nonexistent instance")
+	errCantCreateExistingInstance = errors.New("cant't create already existent instance")
+	errUnknownOperation           = errors.New("unknown operation type")
+)
+
+type protoCodec struct{}
+
+var _ core.EventCodec = (*protoCodec)(nil)
+var _ core.StoredEventDecoder = (*protoCodec)(nil)
+
+// New returns a Protobuf EventCodec.
+func New() core.EventCodec {
+	return &protoCodec{}
+}
+
+func (pc *protoCodec) Create(actions []core.Action) ([]core.Event, format.Node, error) {
+	if len(actions) == 0 {
+		return nil, nil, nil
+	}
+	revents := &pbEvents{Events: make([]*pbEvent, len(actions))}
+	events := make([]core.Event, len(actions))
+	now := time.Now().UnixNano()
+	for i, a := range actions {
+		e := &pbEvent{
+			Timestamp:      now,
+			ID:             a.InstanceID.String(),
+			CollectionName: a.CollectionName,
+			Version:        int64(a.SchemaVersion),
+			LamportClock:   a.Clock,
+		}
+		switch a.Type {
+		case core.Create:
+			e.Type = typeCreate
+			e.Patch = a.Current
+		case core.Save:
+			e.Type = typeSave
+			if a.Clock > 0 {
+				// Clocked saves carry the whole instance.
+				e.Patch = a.Current
+				break
+			}
+			patch, err := jsonpatch.CreateMergePatch(a.Previous, a.Current)
+			if err != nil {
+				return nil, nil, err
+			}
+			e.Patch = patch
+		case core.Delete:
+			e.Type = typeDelete
+		default:
+			return nil, nil, errUnknownOperation
+		}
+		revents.Events[i] = e
+		events[i] = e
+	}
+
+	data, err := proto.Marshal(revents)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Thread event bodies are CBOR blocks, so the protobuf payload is
+	// wrapped as a CBOR byte string.
+	n, err := cbornode.WrapObject(data, multihash.SHA2_256, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return events, n, nil
+}
+
+func (pc *protoCodec) Reduce(
+	events []core.Event,
+	datastore ds.TxnDatastore,
+	baseKey ds.Key,
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) ([]core.ReduceAction, error) {
+	txn, err := datastore.NewTransaction(false)
+	if err != nil {
+		return nil, err
+	}
+	defer txn.Discard()
+
+	actions := make([]core.ReduceAction, len(events))
+	for i, ev := range events {
+		e, ok := ev.(*pbEvent)
+		if !ok {
+			return nil, fmt.Errorf("event unrecognized for protocodec eventcodec")
+		}
+		key := baseKey.ChildString(e.Collection()).ChildString(e.InstanceID().String())
+		if e.LamportClock > 0 && e.Type != typeDelete {
+			if actions[i], err = replaceInstance(txn, key, e, indexFunc); err != nil {
+				return nil, err
+			}
+			log.Debug("\treplace operation applied")
+			continue
+		}
+		switch e.Type {
+		case typeCreate:
+			exist, err := txn.Has(key)
+			if err != nil {
+				return nil, err
+			}
+			if exist {
+				return nil, errCantCreateExistingInstance
+			}
+			if err := txn.Put(key, e.Patch); err != nil {
+				return nil, fmt.Errorf("error when reducing create event: %w", err)
+			}
+			if err := indexFunc(e.Collection(), key, nil, e.Patch, txn); err != nil {
+				return nil, fmt.Errorf("error when indexing created data: %w", err)
+			}
+			actions[i] = core.ReduceAction{Type: core.Create, Collection: e.Collection(), InstanceID: e.InstanceID()}
+			log.Debug("\tcreate operation applied")
+		case typeSave:
+			value, err := txn.Get(key)
+			if errors.Is(err, ds.ErrNotFound) {
+				return nil, errSavingNonExistentInstance
+			}
+			if err != nil {
+				return nil, err
+			}
+			patchedValue, err := jsonpatch.MergePatch(value, e.Patch)
+			if err != nil {
+				return nil, fmt.Errorf("error when reducing save event: %w", err)
+			}
+			if err = txn.Put(key, patchedValue); err != nil {
+				return nil, err
+			}
+			if err := indexFunc(e.Collection(), key, value, patchedValue, txn); err != nil {
+				return nil, fmt.Errorf("error when indexing created data: %w", err)
+			}
+			actions[i] = core.ReduceAction{Type: core.Save, Collection: e.Collection(), InstanceID: e.InstanceID()}
+			log.Debug("\tsave operation applied")
+		case typeDelete:
+			value, err := txn.Get(key)
+			if errors.Is(err, ds.ErrNotFound) && e.LamportClock > 0 {
+				// The instance was deleted, or its create wasn't received yet.
+				actions[i] = core.ReduceAction{Type: core.Delete, Collection: e.Collection(), InstanceID: e.InstanceID()}
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := txn.Delete(key); err != nil {
+				return nil, err
+			}
+			if err := indexFunc(e.Collection(), key, value, nil, txn); err != nil {
+				return nil, fmt.Errorf("error when removing index: %w", err)
+			}
+			actions[i] = core.ReduceAction{Type: core.Delete, Collection: e.Collection(), InstanceID: e.InstanceID()}
+			log.Debug("\tdelete operation applied")
+		default:
+			return nil, errUnknownOperation
+		}
+	}
+	if err := txn.Commit(); err != nil {
+		return nil, err
+	}
+
+	return actions, nil
+}
+
+// replaceInstance reduces a clocked create or save, writing the instance
+// whether or not it exists.
+func replaceInstance(
+	txn ds.Txn,
+	key ds.Key,
+	e *pbEvent,
+	indexFunc func(collection string, key ds.Key, oldData, newData []byte, txn ds.Txn) error,
+) (core.ReduceAction, error) {
+	value, err := txn.Get(key)
+	if err != nil && !errors.Is(err, ds.ErrNotFound) {
+		return core.ReduceAction{}, err
+	}
+	if err := txn.Put(key, e.Patch); err != nil {
+		return core.ReduceAction{}, fmt.Errorf("error when reducing replace event: %w", err)
+	}
+	if err := indexFunc(e.Collection(), key, value, e.Patch, txn); err != nil {
+		return core.ReduceAction{}, fmt.Errorf("error when indexing replaced data: %w", err)
+	}
+	action := core.ReduceAction{Type: core.Save, Collection: e.Collection(), InstanceID: e.InstanceID()}
+	if value == nil {
+		action.Type = core.Create
+	}
+	return action, nil
+}
+
+// EventsFromBytes returns unmarshaled events from the CBOR-wrapped
+// protobuf payload.
+func (pc *protoCodec) EventsFromBytes(data []byte) ([]core.Event, error) {
+	var payload []byte
+	if err := cbornode.DecodeInto(data, &payload); err != nil {
+		return nil, err
+	}
+	revents := &pbEvents{}
+	if err := proto.Unmarshal(payload, revents); err != nil {
+		return nil, err
+	}
+
+	res := make([]core.Event, len(revents.Events))
+	for i := range revents.Events {
+		res[i] = revents.Events[i]
+	}
+	return res, nil
+}
+
+// EventFromStore returns an event persisted by the dispatcher.
+func (pc *protoCodec) EventFromStore(data []byte) (core.Event, error) {
+	e := &pbEvent{}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// pbEvents mirrors the Events message in codec.proto.
+type pbEvents struct {
+	Events []*pbEvent `protobuf:"bytes,1,rep,name=events,proto3" json:"events,omitempty"`
+}
+
+func (m *pbEvents) Reset()         { *m = pbEvents{} }
+func (m *pbEvents) String() string { return proto.CompactTextString(m) }
+func (*pbEvents) ProtoMessage()    {}
+
+// pbEvent mirrors the Event message in codec.proto.
+type pbEvent struct {
+	Timestamp      int64  `protobuf:"varint,1,opt,name=timestamp,proto3" json:"timestamp,omitempty"`
+	ID             string `protobuf:"bytes,2,opt,name=instanceID,proto3" json:"instanceID,omitempty"`
+	CollectionName string `protobuf:"bytes,3,opt,name=collection,proto3" json:"collection,omitempty"`
+	Type           int32  `protobuf:"varint,4,opt,name=type,proto3" json:"type,omitempty"`
+	Patch          []byte `protobuf:"bytes,5,opt,name=patch,proto3" json:"patch,omitempty"`
+	Version        int64  `protobuf:"varint,6,opt,name=schemaVersion,proto3" json:"schemaVersion,omitempty"`
+	LamportClock   uint64 `protobuf:"varint,7,opt,name=clock,proto3" json:"clock,omitempty"`
+}
+
+var _ core.Event = (*pbEvent)(nil)
+var _ core.VersionedEvent = (*pbEvent)(nil)
+var _ core.ClockedEvent = (*pbEvent)(nil)
+var _ core.TypedEvent = (*pbEvent)(nil)
+
+func (m *pbEvent) Reset()         { *m = pbEvent{} }
+func (m *pbEvent) String() string { return proto.CompactTextString(m) }
+func (*pbEvent) ProtoMessage()    {}
+
+func (m *pbEvent) Time() []byte {
+	buf := new(bytes.Buffer)
+	// Use big endian to preserve lexicographic sorting
+	_ = binary.Write(buf, binary.BigEndian, m.Timestamp)
+	return buf.Bytes()
+}
+
+func (m *pbEvent) InstanceID() core.InstanceID {
+	return core.InstanceID(m.ID)
+}
+
+func (m *pbEvent) Collection() string {
+	return m.CollectionName
+}
+
+func (m *pbEvent) SchemaVersion() int {
+	return int(m.Version)
+}
+
+func (m *pbEvent) Clock() uint64 {
+	return m.LamportClock
+}
+
+func (m *pbEvent) ActionType() core.ActionType {
+	switch m.Type {
+	case typeCreate:
+		return core.Create
+	case typeSave:
+		return core.Save
+	default:
+		return core.Delete
+	}
+}
@@ -0,0 +1,183 @@
+package protocodec
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/textileio/go-threads/common"
+	core "github.com/textileio/go-threads/core/db"
+	"github.com/textileio/go-threads/core/thread"
+	"github.com/textileio/go-threads/db"
+	"github.com/textileio/go-threads/jsonpatcher"
+	"github.com/textileio/go-threads/util"
+)
+
+var baseKey = ds.NewKey("/db/collection")
+
+func noopIndex(string, ds.Key, []byte, []byte, ds.Txn) error {
+	return nil
+}
+
+// roundTrip creates events for each batch of actions, decodes them from
+// the node bytes, and reduces them into store.
+func roundTrip(t *testing.T, ec core.EventCodec, store ds.TxnDatastore, batches [][]core.Action) {
+	for _, actions := range batches {
+		_, node, err := ec.Create(actions)
+		checkErr(t, err)
+		events, err := ec.EventsFromBytes(node.RawData())
+		checkErr(t, err)
+		if len(events) != len(actions) {
+			t.Fatalf("expected %d events, got %d", len(actions), len(events))
+		}
+		for i, e := range events {
+			if e.InstanceID() != actions[i].InstanceID || e.Collection() != actions[i].CollectionName {
+				t.Fatalf("decoded event doesn't match its action")
+			}
+			if ve, ok := e.(core.VersionedEvent); !ok || ve.SchemaVersion() != actions[i].SchemaVersion {
+				t.Fatalf("decoded event doesn't have the schema version of its action")
+			}
+			if ce, ok := e.(core.ClockedEvent); !ok || ce.Clock() != actions[i].Clock {
+				t.Fatalf("decoded event doesn't have the clock of its action")
+			}
+		}
+		_, err = ec.Reduce(events, store, baseKey, noopIndex)
+		checkErr(t, err)
+	}
+}
+
+func TestRoundTripMatchesJSONPatcher(t *testing.T) {
+	t.Parallel()
+	id1, id2 := core.NewInstanceID(), core.NewInstanceID()
+	v1 := []byte(`{"_id":"` + id1.String() + `","Name":"Alice","Age":30,"Tags":["a"]}`)
+	v1b := []byte(`{"_id":"` + id1.String() + `","Name":"Alice","Age":31}`)
+	v2 := []byte(`{"_id":"` + id2.String() + `","Name":"Bob"}`)
+	batches := [][]core.Action{
+		{
+			{Type: core.Create, InstanceID: id1, CollectionName: "person", Current: v1, SchemaVersion: 2},
+			{Type: core.Create, InstanceID: id2, CollectionName: "person", Current: v2},
+		},
+		{{Type: core.Save, InstanceID: id1, CollectionName: "person", Previous: v1, Current: v1b, SchemaVersion: 3}},
+		{{Type: core.Delete, InstanceID: id2, CollectionName: "person", Previous: v2}},
+	}
+
+	pstore := db.NewTxMapDatastore()
+	roundTrip(t, New(), pstore, batches)
+	jstore := db.NewTxMapDatastore()
+	roundTrip(t, jsonpatcher.New(), jstore, batches)
+
+	pres := queryAll(t, pstore)
+	jres := queryAll(t, jstore)
+	if len(pres) != len(jres) || len(pres) != 1 {
+		t.Fatalf("expected 1 instance from both codecs, got %d and %d", len(pres), len(jres))
+	}
+	for k, v := range jres {
+		if !bytes.Equal(pres[k], v) {
+			t.Fatalf("instance %s differs between codecs: %s vs %s", k, pres[k], v)
+		}
+	}
+}
+
+func TestClockedEventsMatchJSONPatcher(t *testing.T) {
+	t.Parallel()
+	id1, id2, id3 := core.NewInstanceID(), core.NewInstanceID(), core.NewInstanceID()
+	v1 := []byte(`{"_id":"` + id1.String() + `","Name":"Alice","Age":30}`)
+	v1b := []byte(`{"_id":"` + id1.String() + `","Name":"Alice"}`)
+	v2 := []byte(`{"_id":"` + id2.String() + `","Name":"Bob"}`)
+	batches := [][]core.Action{
+		{{Type: core.Create, InstanceID: id1, CollectionName: "person", Current: v1, Clock: 1}},
+		// Clocked saves replace the instance, whatever the previous state.
+		{{Type: core.Save, InstanceID: id1, CollectionName: "person", Previous: v2, Current: v1b, Clock: 2}},
+		// Saves of missing instances recreate them, and deleting missing
+		// instances is a no-op.
+		{{Type: core.Save, InstanceID: id2, CollectionName: "person", Previous: v2, Current: v2, Clock: 3}},
+		{{Type: core.Delete, InstanceID: id3, CollectionName: "person", Clock: 4}},
+	}
+
+	pstore := db.NewTxMapDatastore()
+	roundTrip(t, New(), pstore, batches)
+	jstore := db.NewTxMapDatastore()
+	roundTrip(t, jsonpatcher.New(), jstore, batches)
+
+	expected := map[string][]byte{
+		baseKey.ChildString("person").ChildString(id1.String()).String(): v1b,
+		baseKey.ChildString("person").ChildString(id2.String()).String(): v2,
+	}
+	for name, res := range map[string]map[string][]byte{"protocodec": queryAll(t, pstore), "jsonpatcher": queryAll(t, jstore)} {
+		if len(res) != len(expected) {
+			t.Fatalf("expected %d instances from %s, got %d", len(expected), name, len(res))
+		}
+		for k, v := range expected {
+			if !bytes.Equal(res[k], v) {
+				t.Fatalf("expected instance %s from %s to be %s, got %s", k, name, v, res[k])
+			}
+		}
+	}
+}
+
+func TestWithDB(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "")
+	checkErr(t, err)
+	defer os.RemoveAll(dir)
+	n, err := common.DefaultNetwork(dir, common.WithNetDebug(true), common.WithNetHostAddr(util.FreeLocalAddr()))
+	checkErr(t, err)
+	defer n.Close()
+	d, err := db.NewDB(context.Background(), n, thread.NewIDV1(thread.Raw, 32), db.WithNewDBRepoPath(dir), db.WithNewDBEventCodec(New()))
+	checkErr(t, err)
+	defer d.Close()
+
+	type person struct {
+		ID   core.InstanceID `json:"_id"`
+		Name string
+		Age  int
+	}
+	c, err := d.NewCollection(db.CollectionConfig{
+		Name:   "person",
+		Schema: util.SchemaFromInstance(&person{}, false),
+	})
+	checkErr(t, err)
+	p := util.JSONFromInstance(person{Name: "Alice", Age: 30})
+	id, err := c.Create(p)
+	checkErr(t, err)
+	p = util.SetJSONID(id, p)
+	p = util.SetJSONProperty("Age", 31, p)
+	checkErr(t, c.Save(p))
+
+	res, err := c.FindByID(id)
+	checkErr(t, err)
+	got := &person{}
+	util.InstanceFromJSON(res, got)
+	if got.Name != "Alice" || got.Age != 31 {
+		t.Fatalf("unexpected instance %+v", got)
+	}
+
+	events, err := d.DumpEvents("person")
+	checkErr(t, err)
+	if len(events) != 2 || events[0].Type != db.ActionCreate || events[1].Type != db.ActionSave {
+		t.Fatalf("unexpected dumped events %+v", events)
+	}
+}
+
+func queryAll(t *testing.T, store ds.TxnDatastore) map[string][]byte {
+	res, err := store.Query(query.Query{Prefix: baseKey.String()})
+	checkErr(t, err)
+	all, err := res.Rest()
+	checkErr(t, err)
+	m := make(map[string][]byte, len(all))
+	for _, e := range all {
+		m[e.Key] = e.Value
+	}
+	return m
+}
+
+func checkErr(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
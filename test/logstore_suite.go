@@ -7,6 +7,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/ipfs/go-cid"
 	"github.com/libp2p/go-libp2p-core/crypto"
 	"github.com/libp2p/go-libp2p-core/peer"
 	pstore "github.com/libp2p/go-libp2p-core/peerstore"
@@ -22,6 +23,7 @@ var threadstoreSuite = map[string]func(core.Logstore) func(*testing.T){
 	"AddStreamDuplicates":     testAddrStreamDuplicates,
 	"BasicLogstore":           testBasicLogstore,
 	"Metadata":                testMetadata,
+	"RemoveLog":               testRemoveLog,
 }
 
 type LogstoreFactory func() (core.Logstore, func())
@@ -349,6 +351,52 @@ func testMetadata(ls core.Logstore) func(t *testing.T) {
 	}
 }
 
+func testRemoveLog(ls core.Logstore) func(t *testing.T) {
+	return func(t *testing.T) {
+		tid := thread.NewIDV1(thread.Raw, 24)
+		check(t, ls.AddServiceKey(tid, sym.New()))
+		check(t, ls.AddReadKey(tid, sym.New()))
+		check(t, ls.PutString(tid, "Name", "thread"))
+		lids := make([]peer.ID, 2)
+		for i := range lids {
+			priv, pub, _ := crypto.GenerateKeyPair(crypto.Ed25519, 0)
+			lids[i], _ = peer.IDFromPrivateKey(priv)
+			check(t, ls.AddLog(tid, thread.LogInfo{
+				ID:      lids[i],
+				PubKey:  pub,
+				PrivKey: priv,
+				Addrs:   getAddrs(t, 1),
+				Head:    cid.NewCidV1(cid.Raw, []byte("head")),
+			}))
+		}
+
+		check(t, ls.RemoveLog(tid, lids[0]))
+		if _, err := ls.GetLog(tid, lids[0]); err != core.ErrLogNotFound {
+			t.Fatal("log was not deleted")
+		}
+		if addrs, err := ls.Addrs(tid, lids[0]); err != nil || len(addrs) != 0 {
+			t.Error("addresses should have been deleted")
+		}
+		if heads, err := ls.Heads(tid, lids[0]); err != nil || len(heads) != 0 {
+			t.Error("heads should have been deleted")
+		}
+		if key, err := ls.ReadKey(tid); err != nil || key != nil {
+			t.Error("read key should have been deleted")
+		}
+		if key, err := ls.ServiceKey(tid); err != nil || key != nil {
+			t.Error("service key should have been deleted")
+		}
+		if name, err := ls.GetString(tid, "Name"); err != nil || name == nil {
+			t.Error("metadata should be kept while the thread has logs")
+		}
+
+		check(t, ls.RemoveLog(tid, lids[1]))
+		if name, err := ls.GetString(tid, "Name"); err != nil || name != nil {
+			t.Error("metadata should have been deleted with the last log")
+		}
+	}
+}
+
 func getAddrs(t *testing.T, n int) []ma.Multiaddr {
 	var addrs []ma.Multiaddr
 	for i := 0; i < n; i++ {